@@ -0,0 +1,1049 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azanul/peer-pressure/pkg/dirwalk"
+	"github.com/Azanul/peer-pressure/pkg/folder"
+	"github.com/Azanul/peer-pressure/pkg/mailbox"
+	"github.com/Azanul/peer-pressure/pkg/outbox"
+	"github.com/Azanul/peer-pressure/pkg/peer"
+	"github.com/Azanul/peer-pressure/pkg/ratelimit"
+	"github.com/Azanul/peer-pressure/pkg/schedule"
+	"github.com/Azanul/peer-pressure/pkg/streamio"
+	"github.com/Azanul/peer-pressure/pkg/transfer"
+	"github.com/Azanul/peer-pressure/pkg/util"
+	"github.com/Azanul/peer-pressure/tui/style"
+	libp2ppeer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+const usage = `Usage: peer-pressure [command]
+
+Without a command the interactive UI is started.
+
+Commands:
+  send -node NAME [-links follow|preserve|skip] [-hardlinks follow|preserve|skip]
+       [-exclude PATTERN]... [-include PATTERN]... [-cdc] [-seal] [-group GROUP] PATH
+        send a file or directory to the peers on the node's rendezvous,
+        leaving out what .ppignore files and -exclude patterns match
+        unless an -include pattern matches, -cdc splits files by content
+        so receivers skip the chunks they already have, -seal encrypts
+        the file data to each receiver's key on top of the connection,
+        -group sends to the members of GROUP only and reports on each
+        of them
+  id -node NAME
+        print the peer ID of a node, for other nodes to trust it
+  trust -node NAME PEER ID
+        trust the node with the peer ID ID under the name PEER
+  group set -node NAME GROUP PEER...
+        save the trusted nodes PEER as GROUP
+  group list -node NAME
+        list the groups of a node
+  group remove -node NAME GROUP
+        remove a group
+  sync -node NAME DIR -with PEER
+        keep DIR synchronized with the trusted node PEER until interrupted,
+        PEER sharing a directory of the same name
+  outbox -node NAME DIR -to PEER [-to PEER]... [-stable DURATION]
+        send every file dropped into DIR to the trusted nodes PEER once it
+        hasn't changed for DURATION (5s), moving it to DIR/sent afterwards
+  provide -node NAME FILE...
+        announce files on the DHT and serve them by their digest, printed
+        for each file, until interrupted
+  fetch -node NAME DIGEST
+        download the file with the SHA-256 DIGEST from every node providing
+        it at once, checking each chunk as it arrives
+  share -node NAME [-seal] PATH...
+        share files and directories until interrupted, peers browse and
+        pull them whenever they like, -seal encrypts the file data to
+        each puller's key
+  browse -node NAME [-dir DIR] PEER
+        list the files shared by PEER, a trusted node or a peer ID, or with
+        -dir only the entries of DIR of the share with their digests, the
+        shared paths themselves if DIR is empty
+  pull -node NAME PEER FILE
+        fetch FILE, as listed by browse, from the share of PEER
+  mailbox -node NAME [-ttl DURATION] [-quota BYTES] [-total BYTES]
+        hold files left for other nodes until they collect them, for at
+        most DURATION (168h), up to -quota BYTES (1 GiB) per recipient
+        and -total BYTES (10 GiB) for all of them, until interrupted
+  post -node NAME -mailbox MAILBOX -to PEER FILE
+        leave FILE with the mailbox node MAILBOX for PEER to collect later,
+        sealed so that only PEER can read it; PEER has to have collected
+        from MAILBOX once before
+  collect -node NAME MAILBOX
+        pick up the files left for the node with the mailbox node MAILBOX
+  swarm-key new -node NAME [-o FILE] [-bootstrap ADDR]... [-listen ADDR]...
+        put the node on a new private network, where nodes only ever
+        connect to nodes holding the same swarm key; the key is printed,
+        or written to FILE, for copying to the other nodes
+  swarm-key set -node NAME [-bootstrap ADDR]... [-listen ADDR]... FILE
+        put the node on the private network of the swarm key in FILE, - for
+        standard input; nodes on a private network find each other through
+        the bootstrap nodes ADDR, as printed by swarm-key show, which
+        should -listen on a fixed port
+  swarm-key show -node NAME
+        print the swarm key of the node and its bootstrap addresses
+  swarm-key remove -node NAME
+        put the node back on the public network
+  schedule add -node NAME [-at TIME] [-window HH:MM-HH:MM] FILE
+        queue a send to start at TIME and/or only inside a daily window
+  schedule list -node NAME
+        list the queued sends of a node
+  schedule cancel -node NAME ID
+        remove a queued send
+  schedule run -node NAME
+        wait for the queued sends of a node and run them, retrying failed
+        ones and picking up sends queued meanwhile, until none are left
+`
+
+// runCommand runs peer-pressure non-interactively, args being the command
+// line without the program name.
+func runCommand(args []string) error {
+	switch args[0] {
+	case "send":
+		return sendCommand(args[1:])
+	case "id", "trust":
+		return trustCommand(args[0], args[1:])
+	case "group":
+		return groupCommand(args[1:])
+	case "sync":
+		return syncCommand(args[1:])
+	case "outbox":
+		return outboxCommand(args[1:])
+	case "provide":
+		return provideCommand(args[1:])
+	case "fetch":
+		return fetchCommand(args[1:])
+	case "share":
+		return shareCommand(args[1:])
+	case "browse", "pull":
+		return pullCommand(args[0], args[1:])
+	case "mailbox":
+		return mailboxCommand(args[1:])
+	case "post":
+		return postCommand(args[1:])
+	case "collect":
+		return collectCommand(args[1:])
+	case "swarm-key":
+		return swarmKeyCommand(args[1:])
+	case "schedule":
+		return scheduleCommand(args[1:])
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+		return nil
+	default:
+		fmt.Print(usage)
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+func sendCommand(args []string) error {
+	fs := flag.NewFlagSet("send", flag.ContinueOnError)
+	node := fs.String("node", "", "name of the node")
+	links := fs.String("links", "", "what to do with symlinks in directories: follow, preserve (default) or skip")
+	hardlinks := fs.String("hardlinks", "", "what to do with hard links in directories: follow, preserve (default) or skip")
+	var exclude, include patternList
+	fs.Var(&exclude, "exclude", "leave out what matches the .ppignore style `pattern`, repeatable")
+	fs.Var(&include, "include", "send what matches the .ppignore style `pattern` even if excluded, repeatable")
+	cdc := fs.Bool("cdc", false, "split files into content defined chunks, receivers reuse the chunks they already have")
+	sealed := fs.Bool("seal", false, "encrypt the file data to the key of each receiver")
+	group := fs.String("group", "", "send to the members of `group` only")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *node == "" {
+		return fmt.Errorf("-node is required")
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("send needs exactly one file or directory")
+	}
+	if _, err := os.Stat(peer.NodeDir(*node)); err != nil {
+		return fmt.Errorf("unknown node %q: %w", *node, err)
+	}
+
+	opts := transfer.Options{
+		Limit:     ratelimit.New(0),
+		EventCh:   make(chan peer.Event),
+		CommandCh: make(chan peer.Command),
+	}
+	opts.Walk.Symlinks, err = dirwalk.ParseLinkPolicy(*links)
+	if err != nil {
+		return fmt.Errorf("-links: %w", err)
+	}
+	opts.Walk.Hardlinks, err = dirwalk.ParseLinkPolicy(*hardlinks)
+	if err != nil {
+		return fmt.Errorf("-hardlinks: %w", err)
+	}
+	opts.Walk.Exclude, opts.Walk.Include = exclude, include
+	if *cdc {
+		opts.Chunking = streamio.ContentDefined
+	}
+	opts.Seal = *sealed
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	done := make(chan struct{})
+	defer close(done)
+	go printEvents(filepath.Base(fs.Arg(0)), opts.EventCh, done)
+	if *group != "" {
+		return sendToGroup(ctx, *node, *group, fs.Arg(0), opts)
+	}
+	return sendFile(ctx, *node, fs.Arg(0), opts)
+}
+
+// sendToGroup sends path to the members of group and prints who got it.
+func sendToGroup(ctx context.Context, nodeName, group, path string, opts transfer.Options) error {
+	p, err := peer.Load(nodeName)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+	deliveries, err := transfer.SendToGroup(ctx, p, group, path, opts)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, d := range deliveries {
+		if d.Err != nil {
+			failed++
+		}
+	}
+	fmt.Printf("%s sent to %d of %d members of %s\n", filepath.Base(path), len(deliveries)-failed, len(deliveries), group)
+	for _, d := range deliveries {
+		if d.Err != nil {
+			fmt.Println(style.ErrorTextStyle(fmt.Sprintf("  %s: %v", d.Name, d.Err)))
+		} else {
+			fmt.Printf("  %s: done\n", d.Name)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d members of %s didn't get %s", failed, len(deliveries), group, filepath.Base(path))
+	}
+	return nil
+}
+
+func trustCommand(cmd string, args []string) error {
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	node := fs.String("node", "", "name of the node")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *node == "" {
+		return fmt.Errorf("-node is required")
+	}
+
+	if cmd == "id" {
+		id, err := peer.ReadID(*node)
+		if err != nil {
+			return err
+		}
+		fmt.Println(id)
+		return nil
+	}
+
+	if fs.NArg() != 2 {
+		return fmt.Errorf("trust needs a name and a peer ID")
+	}
+	id, err := libp2ppeer.Decode(fs.Arg(1))
+	if err != nil {
+		return fmt.Errorf("invalid peer ID %q: %w", fs.Arg(1), err)
+	}
+	p, err := peer.Load(*node)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+	return p.Trust(fs.Arg(0), id)
+}
+
+func groupCommand(args []string) error {
+	if len(args) == 0 {
+		fmt.Print(usage)
+		return fmt.Errorf("group needs one of set, list or remove")
+	}
+
+	fs := flag.NewFlagSet("group "+args[0], flag.ContinueOnError)
+	node := fs.String("node", "", "name of the node")
+	err := fs.Parse(args[1:])
+	if err != nil {
+		return err
+	}
+	if *node == "" {
+		return fmt.Errorf("-node is required")
+	}
+	p, err := peer.Load(*node)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+
+	switch args[0] {
+	case "set":
+		if fs.NArg() < 2 {
+			return fmt.Errorf("group set needs a group name and at least one trusted node")
+		}
+		return p.SetGroup(fs.Arg(0), fs.Args()[1:])
+
+	case "list":
+		if len(p.Config.Groups) == 0 {
+			fmt.Println("No groups")
+		}
+		names := make([]string, 0, len(p.Config.Groups))
+		for name := range p.Config.Groups {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("%s: %s\n", name, strings.Join(p.Config.Groups[name], ", "))
+		}
+
+	case "remove":
+		if fs.NArg() != 1 {
+			return fmt.Errorf("group remove needs exactly one group name")
+		}
+		if _, err := p.Group(fs.Arg(0)); err != nil {
+			return err
+		}
+		return p.SetGroup(fs.Arg(0), nil)
+
+	default:
+		return fmt.Errorf("unknown group command %q", args[0])
+	}
+	return nil
+}
+
+func syncCommand(args []string) error {
+	fs := flag.NewFlagSet("sync", flag.ContinueOnError)
+	node := fs.String("node", "", "name of the node")
+	with := fs.String("with", "", "trusted node to synchronize with")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	// Flags may come after the directory as well
+	var dir string
+	if fs.NArg() > 0 {
+		dir = fs.Arg(0)
+		err = fs.Parse(fs.Args()[1:])
+		if err != nil {
+			return err
+		}
+	}
+	if *node == "" || *with == "" {
+		return fmt.Errorf("-node and -with are required")
+	}
+	if dir == "" || fs.NArg() != 0 {
+		return fmt.Errorf("sync needs exactly one directory")
+	}
+
+	p, err := peer.Load(*node)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+	id, err := p.TrustedID(*with)
+	if err != nil {
+		return err
+	}
+
+	eventCh := make(chan peer.Event)
+	done := make(chan struct{})
+	defer close(done)
+	go printEvents(filepath.Base(dir), eventCh, done)
+	f, err := folder.New(p, dir, id, folder.Options{EventCh: eventCh})
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	fmt.Printf("Synchronizing %s with %s, interrupt to stop\n", dir, *with)
+	return f.Run(ctx)
+}
+
+func outboxCommand(args []string) error {
+	fs := flag.NewFlagSet("outbox", flag.ContinueOnError)
+	node := fs.String("node", "", "name of the node")
+	var to patternList
+	fs.Var(&to, "to", "trusted `node` to send to, repeatable")
+	stable := fs.Duration("stable", outbox.DefaultStable, "how long a file has to stay unchanged before it's sent")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	// Flags may come after the directory as well
+	var dir string
+	if fs.NArg() > 0 {
+		dir = fs.Arg(0)
+		err = fs.Parse(fs.Args()[1:])
+		if err != nil {
+			return err
+		}
+	}
+	if *node == "" || len(to) == 0 {
+		return fmt.Errorf("-node and -to are required")
+	}
+	if dir == "" || fs.NArg() != 0 {
+		return fmt.Errorf("outbox needs exactly one directory")
+	}
+
+	p, err := peer.Load(*node)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+	opts := transfer.Options{
+		Limit:     ratelimit.New(0),
+		EventCh:   make(chan peer.Event),
+		CommandCh: make(chan peer.Command),
+	}
+	for _, name := range to {
+		id, err := p.TrustedID(name)
+		if err != nil {
+			return err
+		}
+		opts.To = append(opts.To, id)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go printEvents(filepath.Base(dir), opts.EventCh, done)
+	o := &outbox.Outbox{
+		Dir:    dir,
+		Stable: *stable,
+		Send: func(ctx context.Context, path string) error {
+			return transfer.Send(ctx, p, path, opts)
+		},
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	fmt.Printf("Sending what is dropped into %s to %s, interrupt to stop\n", dir, to.String())
+	return o.Run(ctx)
+}
+
+func provideCommand(args []string) error {
+	fs := flag.NewFlagSet("provide", flag.ContinueOnError)
+	node := fs.String("node", "", "name of the node")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *node == "" {
+		return fmt.Errorf("-node is required")
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("provide needs at least one file")
+	}
+
+	p, err := peer.Load(*node)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+	opts := transfer.Options{
+		Limit:   ratelimit.New(0),
+		EventCh: make(chan peer.Event),
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		// Downloaders fetch bits and pieces, the progress of each says little
+		for {
+			select {
+			case <-opts.EventCh:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	pr := transfer.NewProvider(p, opts)
+	defer pr.Close()
+	for _, path := range fs.Args() {
+		digest, err := pr.Add(ctx, path)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%x  %s\n", digest, path)
+	}
+	fmt.Println("Providing, interrupt to stop")
+	pr.Run(ctx)
+	return nil
+}
+
+func fetchCommand(args []string) error {
+	fs := flag.NewFlagSet("fetch", flag.ContinueOnError)
+	node := fs.String("node", "", "name of the node")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *node == "" {
+		return fmt.Errorf("-node is required")
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("fetch needs exactly one digest")
+	}
+	digest, err := hex.DecodeString(fs.Arg(0))
+	if err != nil || len(digest) != sha256.Size {
+		return fmt.Errorf("%q is not a SHA-256 in hex", fs.Arg(0))
+	}
+
+	p, err := peer.Load(*node)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+	opts := transfer.Options{
+		Limit:   ratelimit.New(0),
+		EventCh: make(chan peer.Event),
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	done := make(chan struct{})
+	defer close(done)
+	go printEvents(fs.Arg(0)[:12], opts.EventCh, done)
+	path, err := transfer.Fetch(ctx, p, digest, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Println(path)
+	return nil
+}
+
+func shareCommand(args []string) error {
+	fs := flag.NewFlagSet("share", flag.ContinueOnError)
+	node := fs.String("node", "", "name of the node")
+	sealed := fs.Bool("seal", false, "encrypt the file data to the key of each puller")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *node == "" {
+		return fmt.Errorf("-node is required")
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("share needs at least one file or directory")
+	}
+	for _, path := range fs.Args() {
+		if _, err := os.Stat(path); err != nil {
+			return err
+		}
+	}
+
+	p, err := peer.Load(*node)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+	opts := transfer.Options{
+		Limit:   ratelimit.New(0),
+		EventCh: make(chan peer.Event),
+		Seal:    *sealed,
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		// Several peers may pull at once, the progress of each says little
+		for {
+			select {
+			case <-opts.EventCh:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	s := transfer.NewShare(p, fs.Args(), opts)
+	defer s.Close()
+	catalog, err := s.Catalog()
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	fmt.Printf("Sharing %d files as %s, interrupt to stop\n", len(catalog.GetFiles()), p.Node.ID())
+	return s.Run(ctx)
+}
+
+func pullCommand(cmd string, args []string) error {
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	node := fs.String("node", "", "name of the node")
+	dir := fs.String("dir", "", "directory of the share to list")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *node == "" {
+		return fmt.Errorf("-node is required")
+	}
+	listDir := false
+	fs.Visit(func(f *flag.Flag) {
+		listDir = listDir || f.Name == "dir"
+	})
+	if cmd == "browse" && fs.NArg() != 1 {
+		return fmt.Errorf("browse needs exactly one peer")
+	}
+	if cmd == "pull" && fs.NArg() != 2 {
+		return fmt.Errorf("pull needs a peer and a file")
+	}
+
+	p, err := peer.Load(*node)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+	id, err := resolvePeer(p, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if cmd == "browse" && listDir {
+		return printListing(ctx, p, id, *dir)
+	}
+	if cmd == "browse" {
+		catalog, err := transfer.Browse(ctx, p, id)
+		if err != nil {
+			return err
+		}
+		for _, f := range catalog.GetFiles() {
+			mtime := time.Unix(0, f.GetMtime()).Format("2006-01-02 15:04")
+			fmt.Printf("%10s  %s  %s\n", util.HumanBytes(float64(f.GetSize())), mtime, f.GetName())
+		}
+		return nil
+	}
+
+	opts := transfer.Options{
+		Limit:     ratelimit.New(0),
+		EventCh:   make(chan peer.Event),
+		CommandCh: make(chan peer.Command),
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go printEvents(path.Base(fs.Arg(1)), opts.EventCh, done)
+	dest, err := transfer.Pull(ctx, p, id, fs.Arg(1), opts)
+	if err != nil {
+		return err
+	}
+	fmt.Println(dest)
+	return nil
+}
+
+// resolvePeer returns the peer ID of name, a node trusted by p or a peer ID.
+func resolvePeer(p *peer.Peer, name string) (libp2ppeer.ID, error) {
+	id, err := p.TrustedID(name)
+	if err != nil {
+		id, err = libp2ppeer.Decode(name)
+		if err != nil {
+			return "", fmt.Errorf("%q is neither a trusted node nor a peer ID", name)
+		}
+	}
+	return id, nil
+}
+
+func mailboxCommand(args []string) error {
+	fs := flag.NewFlagSet("mailbox", flag.ContinueOnError)
+	node := fs.String("node", "", "name of the node")
+	ttl := fs.Duration("ttl", mailbox.DefaultTTL, "how long files are held")
+	quota := fs.Int64("quota", mailbox.DefaultQuota, "most `bytes` held for one recipient, 0 for no limit")
+	total := fs.Int64("total", mailbox.DefaultTotal, "most `bytes` held for all recipients together, 0 for no limit")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *node == "" {
+		return fmt.Errorf("-node is required")
+	}
+
+	p, err := peer.Load(*node)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+	opts := transfer.Options{Limit: ratelimit.New(0)}
+	box := mailbox.New(filepath.Join(p.GetPeerDir(), peer.MailboxDir), *ttl, *quota, *total)
+	m := transfer.NewMailbox(p, box, opts)
+	defer m.Close()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	fmt.Printf("Holding files for other nodes as %s, interrupt to stop\n", p.Node.ID())
+	return m.Run(ctx)
+}
+
+func postCommand(args []string) error {
+	fs := flag.NewFlagSet("post", flag.ContinueOnError)
+	node := fs.String("node", "", "name of the node")
+	box := fs.String("mailbox", "", "mailbox node, trusted or a peer ID")
+	to := fs.String("to", "", "recipient, trusted or a peer ID")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *node == "" || *box == "" || *to == "" {
+		return fmt.Errorf("-node, -mailbox and -to are required")
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("post needs exactly one file")
+	}
+
+	p, err := peer.Load(*node)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+	boxID, err := resolvePeer(p, *box)
+	if err != nil {
+		return err
+	}
+	toID, err := resolvePeer(p, *to)
+	if err != nil {
+		return err
+	}
+	opts := transfer.Options{
+		Limit:   ratelimit.New(0),
+		EventCh: make(chan peer.Event),
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go printEvents(filepath.Base(fs.Arg(0)), opts.EventCh, done)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	receipt, err := transfer.Post(ctx, p, boxID, toID, fs.Arg(0), opts)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Left for %s until %s\n", *to, time.Unix(0, receipt.GetExpires()).Format("2006-01-02 15:04"))
+	return nil
+}
+
+func collectCommand(args []string) error {
+	fs := flag.NewFlagSet("collect", flag.ContinueOnError)
+	node := fs.String("node", "", "name of the node")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *node == "" {
+		return fmt.Errorf("-node is required")
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("collect needs exactly one mailbox")
+	}
+
+	p, err := peer.Load(*node)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+	boxID, err := resolvePeer(p, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	opts := transfer.Options{
+		Limit:   ratelimit.New(0),
+		EventCh: make(chan peer.Event),
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go printEvents("collect", opts.EventCh, done)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	paths, err := transfer.Collect(ctx, p, boxID, opts)
+	for _, path := range paths {
+		fmt.Println(path)
+	}
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		fmt.Println("Nothing left for this node")
+	}
+	return nil
+}
+
+func swarmKeyCommand(args []string) error {
+	if len(args) == 0 {
+		fmt.Print(usage)
+		return fmt.Errorf("swarm-key needs one of new, set, show or remove")
+	}
+
+	fs := flag.NewFlagSet("swarm-key "+args[0], flag.ContinueOnError)
+	node := fs.String("node", "", "name of the node")
+	out := fs.String("o", "", "write the new swarm key to `file` instead of printing it")
+	var bootstrap, listen patternList
+	fs.Var(&bootstrap, "bootstrap", "multiaddr ending in /p2p/ID of a node on the private network to join the DHT through, repeatable")
+	fs.Var(&listen, "listen", "multiaddr to listen on, e.g. /ip4/0.0.0.0/tcp/4001, repeatable")
+	err := fs.Parse(args[1:])
+	if err != nil {
+		return err
+	}
+	if *node == "" {
+		return fmt.Errorf("-node is required")
+	}
+	p, err := peer.Load(*node)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+
+	var key []byte
+	switch args[0] {
+	case "new":
+		if fs.NArg() != 0 {
+			return fmt.Errorf("swarm-key new takes no arguments")
+		}
+		key, err = peer.NewSwarmKey()
+		if err == nil && *out != "" {
+			err = os.WriteFile(*out, key, 0600)
+		} else if err == nil {
+			fmt.Print(string(key))
+		}
+
+	case "set":
+		if fs.NArg() != 1 {
+			return fmt.Errorf("swarm-key set needs exactly one swarm key file")
+		}
+		if fs.Arg(0) == "-" {
+			key, err = io.ReadAll(os.Stdin)
+		} else {
+			key, err = os.ReadFile(fs.Arg(0))
+		}
+
+	case "show":
+		if !p.Private() {
+			fmt.Println("Not on a private network")
+			return nil
+		}
+		key, err = os.ReadFile(filepath.Join(p.GetPeerDir(), peer.SwarmKeyFile))
+		if err != nil {
+			return err
+		}
+		fmt.Print(string(key))
+		fmt.Println("Bootstrap addresses of this node:")
+		for _, addr := range p.Node.Addrs() {
+			fmt.Printf("  %s/p2p/%s\n", addr, p.Node.ID())
+		}
+		return nil
+
+	case "remove":
+		return p.SetSwarmKey(nil)
+
+	default:
+		return fmt.Errorf("unknown swarm-key command %q", args[0])
+	}
+	if err != nil {
+		return err
+	}
+	err = p.SetSwarmKey(key)
+	if err != nil {
+		return err
+	}
+	if len(bootstrap) > 0 || len(listen) > 0 {
+		if len(bootstrap) > 0 {
+			p.Config.Bootstrap = bootstrap
+		}
+		if len(listen) > 0 {
+			p.Config.Listen = listen
+		}
+		return p.SaveConfig()
+	}
+	return nil
+}
+
+// printListing prints the entries of dir of the share of the node id, asking
+// for them a page at a time.
+func printListing(ctx context.Context, p *peer.Peer, id libp2ppeer.ID, dir string) error {
+	for offset := 0; ; {
+		listing, err := transfer.BrowseDir(ctx, p, id, dir, offset, transfer.DefaultPage)
+		if err != nil {
+			return err
+		}
+		for _, e := range listing.GetEntries() {
+			mtime := time.Unix(0, e.GetMtime()).Format("2006-01-02 15:04")
+			name, sum := e.GetName(), fmt.Sprintf("%x", e.GetSha256())
+			if e.GetDir() {
+				name, sum = name+"/", "-"
+			}
+			fmt.Printf("%10s  %s  %-64s  %s\n", util.HumanBytes(float64(e.GetSize())), mtime, sum, name)
+		}
+		offset += len(listing.GetEntries())
+		if len(listing.GetEntries()) == 0 || offset >= int(listing.GetTotal()) {
+			return nil
+		}
+	}
+}
+
+// patternList collects the values of a flag given several times.
+type patternList []string
+
+func (l *patternList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *patternList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+func scheduleCommand(args []string) error {
+	if len(args) == 0 {
+		fmt.Print(usage)
+		return fmt.Errorf("schedule needs one of add, list, cancel or run")
+	}
+
+	fs := flag.NewFlagSet("schedule "+args[0], flag.ContinueOnError)
+	node := fs.String("node", "", "name of the node")
+	at := fs.String("at", "", "start time, as RFC 3339, \"2006-01-02 15:04\" or \"15:04\"")
+	window := fs.String("window", "", "daily window to send in, e.g. 01:00-06:00")
+	err := fs.Parse(args[1:])
+	if err != nil {
+		return err
+	}
+	if *node == "" {
+		return fmt.Errorf("-node is required")
+	}
+	if _, err := os.Stat(peer.NodeDir(*node)); err != nil {
+		return fmt.Errorf("unknown node %q: %w", *node, err)
+	}
+
+	queue, err := schedule.Load(filepath.Join(peer.NodeDir(*node), peer.ScheduleFile))
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "add":
+		if fs.NArg() != 1 {
+			return fmt.Errorf("schedule add needs exactly one file")
+		}
+		path, err := filepath.Abs(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(path); err != nil {
+			return err
+		}
+
+		job := schedule.Job{Path: path}
+		if *at != "" {
+			job.StartAt, err = parseStartTime(*at, time.Now())
+			if err != nil {
+				return err
+			}
+		}
+		if *window != "" {
+			w, err := schedule.ParseWindow(*window)
+			if err != nil {
+				return err
+			}
+			job.Window = &w
+		}
+
+		job, err = queue.Add(job)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Scheduled", job)
+
+	case "list":
+		if len(queue.Jobs) == 0 {
+			fmt.Println("Nothing scheduled")
+		}
+		for _, job := range queue.Jobs {
+			fmt.Println(job)
+		}
+
+	case "cancel":
+		if fs.NArg() != 1 {
+			return fmt.Errorf("schedule cancel needs exactly one job ID")
+		}
+		return queue.Remove(fs.Arg(0))
+
+	case "run":
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		queue.Run(ctx, func(ctx context.Context, job schedule.Job, cmdCh chan peer.Command) error {
+			eventCh := make(chan peer.Event)
+			done := make(chan struct{})
+			defer close(done)
+			go printEvents(filepath.Base(job.Path), eventCh, done)
+			return sendFile(ctx, *node, job.Path, transfer.Options{Limit: ratelimit.New(0), EventCh: eventCh, CommandCh: cmdCh})
+		})
+
+	default:
+		return fmt.Errorf("unknown schedule command %q", args[0])
+	}
+	return nil
+}
+
+// parseStartTime accepts a full timestamp or a time of day, the latter
+// meaning its next occurrence after now.
+func parseStartTime(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02 15:04", s, time.Local); err == nil {
+		return t, nil
+	}
+	clock, err := time.ParseInLocation("15:04", s, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid start time %q", s)
+	}
+	t := time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0, time.Local)
+	if t.Before(now) {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// printEvents reports the progress of a transfer run from the command line
+// in steps of 10%, for each recipient of a group on its own, until done is
+// closed.
+func printEvents(name string, eventCh chan peer.Event, done chan struct{}) {
+	last := map[string]int{}
+	for {
+		select {
+		case e := <-eventCh:
+			label, data := name, e.Data
+			if r, ok := data.(transfer.RecipientEvent); ok {
+				label, data = name+" to "+r.Name, r.Data
+			}
+			switch data := data.(type) {
+			case peer.Stats:
+				step := int(data.Fraction * 10)
+				if prev, ok := last[label]; data.Fraction >= 0 && (!ok || step != prev) {
+					last[label] = step
+					fmt.Printf("%s: %d%% (%s/s)\n", label, step*10, util.HumanBytes(data.Rate))
+				}
+			case peer.RetryInfo:
+				fmt.Printf("%s: %s, retry %d/%d in %s\n", label, data.Err, data.Attempt, data.MaxAttempts, data.Delay.Round(time.Second))
+			case string:
+				fmt.Println(style.ErrorTextStyle(label + ": " + data))
+			}
+		case <-done:
+			return
+		}
+	}
+}
@@ -4,10 +4,16 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/Azanul/peer-pressure/pkg/gateway"
 	"github.com/Azanul/peer-pressure/pkg/peer"
+	"github.com/Azanul/peer-pressure/pkg/ratelimit"
+	"github.com/Azanul/peer-pressure/pkg/streamio"
+	"github.com/Azanul/peer-pressure/pkg/transfer"
+	"github.com/Azanul/peer-pressure/pkg/util"
 	"github.com/Azanul/peer-pressure/tui/style"
 	"github.com/charmbracelet/bubbles/filepicker"
 	"github.com/charmbracelet/bubbles/progress"
@@ -24,7 +30,7 @@ var (
 
 	TabChoices = [][]string{
 		{},
-		{"Send", "Receive"},
+		{"Send", "Receive", "Stream", "Browse"},
 	}
 
 	nodeCreate = createFormModel{
@@ -36,15 +42,21 @@ var (
 
 	crrNode = oldNodeMenuModel{
 		name:       "test",
-		choices:    []string{"Send", "Receive"},
+		choices:    []string{"Send", "Receive", "Stream", "Browse"},
 		filepicker: filepicker.New(),
 		transfer: peer.Transfer{
 			Progress:  progress.New(progress.WithDefaultGradient()),
 			EventCh:   make(chan peer.Event),
 			CommandCh: make(chan peer.Command),
+			Limit:     ratelimit.New(0),
 			TempPerc:  0,
 		},
 	}
+
+	crrRemote = remoteBrowserModel{
+		input:  textinput.New(),
+		styles: filepicker.DefaultStyles(),
+	}
 )
 
 type sessionState uint
@@ -56,6 +68,8 @@ const (
 	sendFileExplorer
 	sendLoader
 	receiveLoader
+	remotePeerForm
+	remoteExplorer
 )
 
 type model struct {
@@ -91,23 +105,27 @@ func (m *model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	case oldNodeMenu:
 		return crrNode.Update(m, msg)
 
+	case remotePeerForm, remoteExplorer:
+		return crrRemote.Update(m, msg)
+
 	case sendFileExplorer:
 		crrNode.filepicker, cmd = crrNode.filepicker.Update(msg)
 
 		// Did the user select a file?
 		if didSelect, path := crrNode.filepicker.DidSelectFile(msg); didSelect {
+			p, err := peer.Load(crrNode.name)
+			if err != nil {
+				fmt.Println(style.ErrorTextStyle(err.Error()))
+				return m, tea.Quit
+			}
+			crrNode.p = p
 			go func() {
-				go func() {
-					for c := range crrNode.transfer.EventCh {
-						data := c.Data.(float64)
-						if data < 0 {
-							return
-						} else {
-							crrNode.transfer.TempPerc = min(data, 1)
-						}
-					}
-				}()
-				err := sendFile(context.TODO(), crrNode.name, path, crrNode.transfer.EventCh, crrNode.transfer.CommandCh)
+				go crrNode.transfer.Track()
+				err := transfer.Send(context.TODO(), p, path, transfer.Options{
+					Limit:     crrNode.transfer.Limit,
+					EventCh:   crrNode.transfer.EventCh,
+					CommandCh: crrNode.transfer.CommandCh,
+				})
 				if err != nil {
 					fmt.Println(style.ErrorTextStyle(err.Error()))
 					cmd = tea.Quit
@@ -134,6 +152,17 @@ func (m *model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			// These keys should pause/continue the transfer.
 			case "space":
 				crrNode.transfer.Toggle()
+
+			// These keys adjust the bandwidth limit of the transfer, the
+			// node or all nodes, switching between them with l.
+			case "l":
+				crrNode.limits = (crrNode.limits + 1) % limitScopes
+			case "+", "=":
+				stepLimit(crrNode.limiter(crrNode.limits, true), crrNode.transfer.TempRate, true)
+			case "-":
+				stepLimit(crrNode.limiter(crrNode.limits, true), crrNode.transfer.TempRate, false)
+			case "0":
+				crrNode.limiter(crrNode.limits, true).SetRate(0)
 			}
 		}
 
@@ -163,6 +192,31 @@ func (m *model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			// These keys should pause/continue the transfer.
 			case "space":
 				crrNode.transfer.Toggle()
+
+			// These keys adjust the bandwidth limit of the transfer, the
+			// node or all nodes, switching between them with l.
+			case "l":
+				crrNode.limits = (crrNode.limits + 1) % limitScopes
+			case "+", "=":
+				stepLimit(crrNode.limiter(crrNode.limits, false), crrNode.transfer.TempRate, true)
+			case "-":
+				stepLimit(crrNode.limiter(crrNode.limits, false), crrNode.transfer.TempRate, false)
+			case "0":
+				crrNode.limiter(crrNode.limits, false).SetRate(0)
+
+			// These keys steer the order a streamed file is fetched in.
+			case "b":
+				if crrNode.gw != nil {
+					toggleSchedule(crrNode.gw)
+				}
+			case "]":
+				if crrNode.gw != nil {
+					stepReadAhead(crrNode.gw, true)
+				}
+			case "[":
+				if crrNode.gw != nil {
+					stepReadAhead(crrNode.gw, false)
+				}
 			}
 		}
 
@@ -268,11 +322,15 @@ func (m model) View() string {
 	case oldNodeMenu:
 		s += crrNode.View()
 
+	case remotePeerForm, remoteExplorer:
+		s += crrRemote.View(m.state)
+
 	case sendFileExplorer:
 		s += "\n\n" + crrNode.filepicker.View()
 
 	case sendLoader:
 		s += "\n\n" + crrNode.transfer.Progress.View()
+		s += "\n\n" + rateView(&crrNode, true) + retryView(&crrNode.transfer)
 		footer := ""
 		if crrNode.transfer.Paused() {
 			footer = "\n\t\tPAUSED\n\n"
@@ -280,10 +338,16 @@ func (m model) View() string {
 		} else {
 			footer += "Press space to pause"
 		}
+		footer += "\nPress + / - to raise or lower the bandwidth limit, 0 to remove it, l to pick the limit of the transfer, the node or all nodes"
 		s += style.FooterStyle(footer)
 
 	case receiveLoader:
+		if crrNode.streamURL != "" {
+			s += "\n\n" + style.HeaderStyle("Open "+crrNode.streamURL+" in a media player to start playback")
+			s += "\n" + scheduleView(crrNode.gw)
+		}
 		s += "\n\n" + crrNode.transfer.Progress.View()
+		s += "\n\n" + rateView(&crrNode, false) + retryView(&crrNode.transfer)
 		footer := ""
 		if crrNode.transfer.Paused() {
 			footer = "\n\t\tPAUSED\n\n"
@@ -291,6 +355,10 @@ func (m model) View() string {
 		} else {
 			footer += "Press space to pause"
 		}
+		footer += "\nPress + / - to raise or lower the bandwidth limit, 0 to remove it, l to pick the limit of the transfer, the node or all nodes"
+		if crrNode.gw != nil {
+			footer += "\nPress b to fetch in playback order or in bulk, [ / ] to shrink or grow the read-ahead"
+		}
 		s += style.FooterStyle(footer)
 	}
 
@@ -341,6 +409,20 @@ func main() {
 	log.SetOutput(f)
 	log.SetLevel(log.DebugLevel)
 
+	err = ratelimit.LoadGlobal("bandwidthCfg.json")
+	if err != nil {
+		log.Fatalf("error loading bandwidth config: %v", err)
+	}
+
+	if len(os.Args) > 1 {
+		err := runCommand(os.Args[1:])
+		if err != nil {
+			fmt.Println(style.ErrorTextStyle(err.Error()))
+			os.Exit(1)
+		}
+		return
+	}
+
 	// starting our program
 	m := initialModel()
 	if _, err := tea.NewProgram(&m).Run(); err != nil {
@@ -349,9 +431,122 @@ func main() {
 	}
 }
 
-func min[T float64 | float32 | int | int64 | int32 | int16 | int8](a, b T) T {
-	if a < b {
-		return a
+// minLimit is the lowest limit stepLimit goes down to, in bytes per second.
+const minLimit = 16 * 1024
+
+// limitScope is which bandwidth limit the keys of a transfer adjust.
+type limitScope int
+
+const (
+	transferLimit limitScope = iota // The transfer alone
+	nodeLimit                       // Every transfer of the node, see peer.Peer.Upload
+	globalLimit                     // Every transfer of every node, see ratelimit.GlobalUpload
+	limitScopes
+)
+
+var limitScopeNames = [limitScopes]string{"transfer", "node", "all nodes"}
+
+// limiter returns the limit of scope for the transfer of m, the upload limit
+// if it's sending.
+func (m *oldNodeMenuModel) limiter(scope limitScope, upload bool) *ratelimit.Limiter {
+	switch scope {
+	case nodeLimit:
+		if m.p == nil {
+			return nil
+		}
+		if upload {
+			return m.p.Upload
+		}
+		return m.p.Download
+	case globalLimit:
+		if upload {
+			return ratelimit.GlobalUpload
+		}
+		return ratelimit.GlobalDownload
+	}
+	return m.transfer.Limit
+}
+
+// stepLimit halves or doubles a bandwidth limit. Lowering it from unlimited
+// starts from rate, the current one of the transfer.
+func stepLimit(l *ratelimit.Limiter, rate float64, faster bool) {
+	limit := l.Rate()
+	if limit == 0 {
+		if faster {
+			return
+		}
+		limit = int64(rate)
+	}
+
+	if faster {
+		limit *= 2
+	} else {
+		limit /= 2
+	}
+	if limit < minLimit {
+		limit = minLimit
+	}
+	l.SetRate(limit)
+}
+
+// minReadAhead is the smallest read-ahead stepReadAhead goes down to, in
+// chunks.
+const minReadAhead = 16
+
+// toggleSchedule switches a streamed file between fetching in playback order
+// and in bulk.
+func toggleSchedule(gw *gateway.Server) {
+	if gw.Schedule() == streamio.Stream {
+		gw.SetSchedule(streamio.Bulk)
+	} else {
+		gw.SetSchedule(streamio.Stream)
+	}
+}
+
+// stepReadAhead halves or doubles the read-ahead of a streamed file.
+func stepReadAhead(gw *gateway.Server, more bool) {
+	chunks := gw.ReadAhead()
+	if more {
+		chunks *= 2
+	} else {
+		chunks /= 2
+	}
+	if chunks < minReadAhead {
+		chunks = minReadAhead
+	}
+	gw.SetReadAhead(chunks)
+}
+
+func scheduleView(gw *gateway.Server) string {
+	if gw.Schedule() == streamio.Bulk {
+		return "Fetching in bulk"
+	}
+	return fmt.Sprintf("Fetching in playback order, %d chunks ahead", gw.ReadAhead())
+}
+
+func retryView(t *peer.Transfer) string {
+	r := t.LastRetry
+	switch {
+	case r.Attempt == 0:
+		return ""
+	case r.MaxAttempts == 0:
+		return fmt.Sprintf("\nInterrupted %d time(s), waiting for the sender to resume", r.Attempt)
+	default:
+		return fmt.Sprintf("\nReconnecting, retry %d/%d: %s", r.Attempt, r.MaxAttempts, r.Err)
+	}
+}
+
+func rateView(m *oldNodeMenuModel, upload bool) string {
+	limits := make([]string, limitScopes)
+	for scope := transferLimit; scope < limitScopes; scope++ {
+		limit := "unlimited"
+		if rate := m.limiter(scope, upload).Rate(); rate > 0 {
+			limit = util.HumanBytes(float64(rate)) + "/s"
+		}
+		limits[scope] = limitScopeNames[scope] + " " + limit
+		if scope == m.limits {
+			limits[scope] = "[" + limits[scope] + "]"
+		}
 	}
-	return b
+	return fmt.Sprintf("%s/s (limits: %s)", util.HumanBytes(m.transfer.TempRate), strings.Join(limits, ", "))
 }
@@ -122,7 +122,7 @@ func createNewNode(name string, rendezvous string) {
 			if peer.ID == p.Node.ID() {
 				continue // No self connection
 			}
-			err := p.Node.Connect(context.Background(), peer)
+			err := p.Connect(context.Background(), peer)
 			if err != nil {
 				log.Println("Failed connecting to ", peer.ID.Pretty(), ", error:", err)
 			} else {
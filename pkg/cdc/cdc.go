@@ -0,0 +1,100 @@
+// Package cdc splits data into content defined chunks, FastCDC style. Cut
+// points depend on the bytes just before them only, so an insertion or
+// removal changes the chunks around it and leaves the others as they were.
+package cdc
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+)
+
+// Chunk sizes, chunks are only shorter than MinSize at the end of the data.
+const (
+	MinSize = 32 << 10
+	AvgSize = 128 << 10
+	MaxSize = 512 << 10
+)
+
+// Cut point masks, harder to match before AvgSize and easier after it, which
+// keeps chunk sizes close to the average. The high bits of the gear hash
+// depend on the most bytes.
+const (
+	maskHard = (1<<19 - 1) << (64 - 19)
+	maskEasy = (1<<15 - 1) << (64 - 15)
+)
+
+// gear maps bytes to random values, derived from a fixed seed so that every
+// node cuts the same data the same way.
+var gear [256]uint64
+
+func init() {
+	for i := range gear {
+		sum := sha256.Sum256([]byte{'g', 'e', 'a', 'r', byte(i)})
+		gear[i] = binary.BigEndian.Uint64(sum[:8])
+	}
+}
+
+// Split reads r to the end and hands fn its chunks in order. The data of a
+// chunk is only valid during the call.
+func Split(r io.Reader, fn func(chunk []byte) error) error {
+	buf := make([]byte, 2*MaxSize)
+	n, start := 0, 0
+	eof := false
+	for {
+		if n-start < MaxSize && !eof {
+			copy(buf, buf[start:n])
+			n -= start
+			start = 0
+			for n < len(buf) && !eof {
+				k, err := r.Read(buf[n:])
+				n += k
+				if err == io.EOF {
+					eof = true
+				} else if err != nil {
+					return err
+				}
+			}
+		}
+		if start == n {
+			return nil
+		}
+		size := cut(buf[start:n])
+		err := fn(buf[start : start+size])
+		if err != nil {
+			return err
+		}
+		start += size
+	}
+}
+
+// cut returns the length of the chunk data starts with.
+func cut(data []byte) int {
+	n := len(data)
+	if n <= MinSize {
+		return n
+	}
+	if n > MaxSize {
+		n = MaxSize
+	}
+	normal := AvgSize
+	if n < normal {
+		normal = n
+	}
+
+	var fp uint64
+	i := MinSize
+	for ; i < normal; i++ {
+		fp = fp<<1 + gear[data[i]]
+		if fp&maskHard == 0 {
+			return i
+		}
+	}
+	for ; i < n; i++ {
+		fp = fp<<1 + gear[data[i]]
+		if fp&maskEasy == 0 {
+			return i
+		}
+	}
+	return n
+}
@@ -0,0 +1,95 @@
+package cdc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"math/rand"
+	"testing"
+)
+
+func random(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// chunks splits data and returns the digests of its chunks, checking that
+// they make up data and stay within the size bounds.
+func chunks(t testing.TB, data []byte) [][sha256.Size]byte {
+	var sums [][sha256.Size]byte
+	var joined []byte
+	err := Split(bytes.NewReader(data), func(chunk []byte) error {
+		if len(chunk) > MaxSize || len(chunk) == 0 {
+			t.Errorf("chunk of %d bytes", len(chunk))
+		}
+		if len(chunk) < MinSize && len(joined)+len(chunk) != len(data) {
+			t.Errorf("chunk of %d bytes before the end", len(chunk))
+		}
+		joined = append(joined, chunk...)
+		sums = append(sums, sha256.Sum256(chunk))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(joined, data) {
+		t.Fatal("chunks don't make up the data")
+	}
+	return sums
+}
+
+func TestSplit(t *testing.T) {
+	old := random(1, 16<<20)
+	var tests = []struct {
+		name   string
+		data   []byte
+		shared int // Chunks of old at least kept, in percent
+	}{
+		{"Same", old, 100},
+		{"Prepended", append([]byte("header"), old...), 95},
+		{"Inserted", append(append(append([]byte{}, old[:5<<20]...), random(2, 1000)...), old[5<<20:]...), 95},
+		{"Removed", append(append([]byte{}, old[:5<<20]...), old[5<<20+1000:]...), 95},
+		{"Empty", nil, 0},
+		{"Short", old[:100], 0},
+		{"Zeros", make([]byte, 4<<20), 0},
+	}
+
+	before := map[[sha256.Size]byte]bool{}
+	oldChunks := chunks(t, old)
+	for _, sum := range oldChunks {
+		before[sum] = true
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shared := 0
+			for _, sum := range chunks(t, tt.data) {
+				if before[sum] {
+					shared++
+				}
+			}
+			if shared*100 < tt.shared*len(oldChunks) {
+				t.Errorf("%d of %d chunks kept, want %d%%", shared, len(oldChunks), tt.shared)
+			}
+		})
+	}
+}
+
+func TestAverage(t *testing.T) {
+	data := random(3, 64<<20)
+	n := len(chunks(t, data))
+	if avg := len(data) / n; avg < AvgSize/2 || avg > 2*AvgSize {
+		t.Errorf("average chunk of %d bytes, want about %d", avg, AvgSize)
+	}
+}
+
+func BenchmarkSplit(b *testing.B) {
+	data := random(4, 32<<20)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := Split(bytes.NewReader(data), func([]byte) error { return nil })
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+// Package chunkstore keeps the chunks of received files by their SHA-256,
+// so that later files sharing them needn't fetch them again.
+package chunkstore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultLimit is how many bytes of chunks a store keeps unless told
+// otherwise.
+const DefaultLimit = 4 << 30
+
+var (
+	ErrNotFound = errors.New("chunk not in the store")
+	ErrCorrupt  = errors.New("stored chunk doesn't match its digest")
+)
+
+// Store is a directory of chunks, each in a file named after its digest.
+// The least recently used chunks are dropped once the store grows past its
+// limit.
+type Store struct {
+	dir   string
+	limit int64
+}
+
+// New returns the store kept in dir, which is created on the first Put.
+// A limit of 0 means DefaultLimit, a negative one keeps nothing.
+func New(dir string, limit int64) *Store {
+	if limit == 0 {
+		limit = DefaultLimit
+	}
+	return &Store{dir: dir, limit: limit}
+}
+
+// path shards the chunks by the first byte of their digest.
+func (s *Store) path(sum []byte) string {
+	name := hex.EncodeToString(sum)
+	return filepath.Join(s.dir, name[:2], name)
+}
+
+// Get returns the chunk with the given digest.
+func (s *Store) Get(sum []byte) ([]byte, error) {
+	if len(sum) != sha256.Size {
+		return nil, ErrNotFound
+	}
+	path := s.path(sum)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if actual := sha256.Sum256(data); !bytes.Equal(actual[:], sum) {
+		os.Remove(path)
+		return nil, fmt.Errorf("%w: %s", ErrCorrupt, path)
+	}
+	now := time.Now()
+	os.Chtimes(path, now, now) // Marks it used, failing only makes it go sooner
+	return data, nil
+}
+
+// Put stores data under its digest sum, unless it's there already.
+func (s *Store) Put(sum, data []byte) error {
+	if s.limit < 0 {
+		return nil
+	}
+	if actual := sha256.Sum256(data); !bytes.Equal(actual[:], sum) {
+		return fmt.Errorf("%w: %x", ErrCorrupt, sum)
+	}
+	path := s.path(sum)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".put-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Trim drops the least recently used chunks until the store fits its limit.
+func (s *Store) Trim() error {
+	type chunk struct {
+		path  string
+		size  int64
+		mtime time.Time
+	}
+	var chunks []chunk
+	var total int64
+	err := filepath.WalkDir(s.dir, func(path string, de fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == s.dir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if !de.Type().IsRegular() {
+			return nil
+		}
+		info, err := de.Info()
+		if err != nil {
+			return nil // Dropped by someone else
+		}
+		chunks = append(chunks, chunk{path, info.Size(), info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	limit := s.limit
+	if limit < 0 {
+		limit = 0
+	}
+	if total <= limit {
+		return nil
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].mtime.Before(chunks[j].mtime) })
+	for _, c := range chunks {
+		if total <= limit {
+			break
+		}
+		err := os.Remove(c.path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		total -= c.size
+	}
+	log.Debugf("Chunk store %s trimmed to %d bytes", s.dir, total)
+	return nil
+}
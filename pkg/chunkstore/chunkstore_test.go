@@ -0,0 +1,103 @@
+package chunkstore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func sum(data []byte) []byte {
+	s := sha256.Sum256(data)
+	return s[:]
+}
+
+func TestGetPut(t *testing.T) {
+	s := New(t.TempDir(), 0)
+	data := []byte("chunk")
+
+	if _, err := s.Get(sum(data)); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v for a missing chunk, want ErrNotFound", err)
+	}
+	if err := s.Put(sum([]byte("other")), data); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("got %v storing under the wrong digest, want ErrCorrupt", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.Put(sum(data), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := s.Get(sum(data))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("got %q, %v, want %q", got, err, data)
+	}
+
+	// Chunks damaged on disk are dropped
+	if err := os.WriteFile(s.path(sum(data)), []byte("damaged"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(sum(data)); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("got %v for a damaged chunk, want ErrCorrupt", err)
+	}
+	if _, err := s.Get(sum(data)); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v after the damaged chunk, want ErrNotFound", err)
+	}
+}
+
+func TestTrim(t *testing.T) {
+	var tests = []struct {
+		name  string
+		limit int64
+		kept  []string
+	}{
+		{"UnderLimit", 100, []string{"aaaa", "bbbb", "cccc"}},
+		{"LeastRecentlyUsed", 8, []string{"aaaa", "cccc"}},
+		{"KeepNothing", -1, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "chunks")
+			s := New(dir, 100)
+			old := time.Now().Add(-time.Hour)
+			for i, chunk := range []string{"aaaa", "bbbb", "cccc"} {
+				if err := s.Put(sum([]byte(chunk)), []byte(chunk)); err != nil {
+					t.Fatal(err)
+				}
+				mtime := old.Add(time.Duration(i) * time.Minute)
+				if err := os.Chtimes(s.path(sum([]byte(chunk))), mtime, mtime); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := s.Get(sum([]byte("aaaa"))); err != nil {
+				t.Fatal(err)
+			}
+
+			s.limit = tt.limit
+			if err := s.Trim(); err != nil {
+				t.Fatal(err)
+			}
+			kept := 0
+			for _, chunk := range []string{"aaaa", "bbbb", "cccc"} {
+				if _, err := os.Stat(s.path(sum([]byte(chunk)))); err == nil {
+					kept++
+				}
+			}
+			if kept != len(tt.kept) {
+				t.Errorf("%d chunks kept, want %v", kept, tt.kept)
+			}
+			for _, chunk := range tt.kept {
+				if _, err := os.Stat(s.path(sum([]byte(chunk)))); err != nil {
+					t.Errorf("%s dropped", chunk)
+				}
+			}
+		})
+	}
+
+	if err := New(filepath.Join(t.TempDir(), "missing"), 0).Trim(); err != nil {
+		t.Errorf("trimming a store never written to: %v", err)
+	}
+}
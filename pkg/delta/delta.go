@@ -0,0 +1,347 @@
+// Package delta computes rsync style differences between a file and an
+// older copy of it held by someone else. The holder of the copy describes it
+// with Sign, the holder of the new version answers with Diff, which only
+// spells out the data the copy lacks, and a Patcher rebuilds the new version
+// from the copy and the instructions.
+package delta
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/Azanul/peer-pressure/pkg/pressure/pb"
+)
+
+const (
+	MinBlockSize = 2 << 10
+	MaxBlockSize = 16 << 20
+
+	maxBlocks  = 1 << 18  // Keeps Signatures well below pb.MaxMessageSize
+	maxLiteral = 64 << 10 // Literal data per instruction
+	strongSize = 16       // Bytes of the SHA-256 kept per block
+)
+
+// ErrInvalid is returned for signatures or instructions that can't be
+// right.
+var ErrInvalid = errors.New("invalid delta")
+
+// BlockSize picks the block size for signing a copy of size bytes, about
+// the square root of the size like rsync does, but large enough to keep the
+// number of blocks bounded.
+func BlockSize(size int64) int32 {
+	bs := int64(math.Sqrt(float64(size)))
+	if least := (size + maxBlocks - 1) / maxBlocks; bs < least {
+		bs = least
+	}
+	if bs < MinBlockSize {
+		bs = MinBlockSize
+	}
+	if bs > MaxBlockSize {
+		bs = MaxBlockSize
+	}
+	return int32(bs)
+}
+
+// Sign reads the copy from r and returns the signatures of its blocks.
+func Sign(r io.Reader, blockSize int32) (*pb.Signatures, error) {
+	if blockSize <= 0 || blockSize > MaxBlockSize {
+		return nil, fmt.Errorf("%w: block size %d", ErrInvalid, blockSize)
+	}
+	sig := &pb.Signatures{BlockSize: blockSize}
+	block := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(r, block)
+		if n > 0 {
+			var sum rolling
+			sum.init(block[:n])
+			sig.Blocks = append(sig.Blocks, &pb.BlockSignature{Weak: sum.sum(), Strong: strong(block[:n])})
+			sig.Size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sig, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Diff reads the new version from r and hands emit the instructions that
+// turn the copy described by sig into it. The literal data of an
+// instruction is only valid during the call.
+func Diff(r io.Reader, sig *pb.Signatures, emit func(*pb.Delta) error) error {
+	bs := int(sig.GetBlockSize())
+	if bs <= 0 || bs > MaxBlockSize {
+		return fmt.Errorf("%w: block size %d", ErrInvalid, bs)
+	}
+	d := &differ{
+		r:     r,
+		sig:   sig,
+		bs:    bs,
+		emit:  emit,
+		buf:   make([]byte, 2*bs+maxLiteral),
+		table: map[uint32][]int{},
+	}
+	for i, b := range sig.GetBlocks() {
+		d.table[b.GetWeak()] = append(d.table[b.GetWeak()], i)
+	}
+	return d.run()
+}
+
+// differ slides a window of a block over the new version, looking it up
+// among the blocks of the copy. Bytes the window moves past without a match
+// become literal data.
+type differ struct {
+	r     io.Reader
+	sig   *pb.Signatures
+	bs    int
+	emit  func(*pb.Delta) error
+	table map[uint32][]int // Blocks of the copy by weak checksum
+
+	buf []byte
+	n   int // Bytes in buf
+	pos int // Start of the window
+	lit int // Start of the literal data not emitted yet
+	eof bool
+
+	copyBlock int64 // Run of blocks not emitted yet
+	copyCount int32
+}
+
+func (d *differ) run() error {
+	var sum rolling
+	fresh := true
+	for {
+		// The window and the byte after it have to be buffered
+		if d.n-d.pos <= d.bs && !d.eof {
+			err := d.fill()
+			if err != nil {
+				return err
+			}
+		}
+		end := d.pos + d.bs
+		if end > d.n {
+			end = d.n
+		}
+		if d.pos == end {
+			break
+		}
+		if fresh {
+			sum.init(d.buf[d.pos:end])
+			fresh = false
+		}
+
+		if block, ok := d.match(sum.sum(), d.buf[d.pos:end]); ok {
+			err := d.flushLiteral()
+			if err == nil {
+				err = d.copy(block)
+			}
+			if err != nil {
+				return err
+			}
+			d.pos, d.lit = end, end
+			fresh = true
+			continue
+		}
+
+		if end < d.n {
+			sum.roll(d.buf[d.pos], d.buf[end])
+		} else {
+			sum.shrink(d.buf[d.pos]) // The tail, shorter than a block
+		}
+		d.pos++
+		if d.pos-d.lit >= maxLiteral {
+			err := d.flushLiteral()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err := d.flushLiteral()
+	if err != nil {
+		return err
+	}
+	return d.flushCopy()
+}
+
+// fill moves the window to the front of the buffer and reads behind it.
+// Pending literal data is emitted first, as it's overwritten.
+func (d *differ) fill() error {
+	err := d.flushLiteral()
+	if err != nil {
+		return err
+	}
+	copy(d.buf, d.buf[d.pos:d.n])
+	d.n -= d.pos
+	d.pos, d.lit = 0, 0
+	for d.n < len(d.buf) && !d.eof {
+		k, err := d.r.Read(d.buf[d.n:])
+		d.n += k
+		if err == io.EOF {
+			d.eof = true
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// match looks data up among the blocks of the copy, preferring the block
+// that continues the pending run.
+func (d *differ) match(weak uint32, data []byte) (int64, bool) {
+	candidates := d.table[weak]
+	if len(candidates) == 0 {
+		return 0, false
+	}
+	next := d.copyBlock + int64(d.copyCount)
+	var sum []byte
+	found, ok := int64(0), false
+	for _, i := range candidates {
+		if d.blockLen(i) != len(data) {
+			continue
+		}
+		if sum == nil {
+			sum = strong(data)
+		}
+		if !bytes.Equal(sum, d.sig.Blocks[i].GetStrong()) {
+			continue
+		}
+		if d.copyCount > 0 && int64(i) == next {
+			return next, true
+		}
+		if !ok {
+			found, ok = int64(i), true
+		}
+	}
+	return found, ok
+}
+
+func (d *differ) blockLen(i int) int {
+	rest := d.sig.GetSize() - int64(i)*int64(d.bs)
+	if rest < int64(d.bs) {
+		return int(rest)
+	}
+	return d.bs
+}
+
+func (d *differ) copy(block int64) error {
+	if d.copyCount > 0 && block == d.copyBlock+int64(d.copyCount) {
+		d.copyCount++
+		return nil
+	}
+	err := d.flushCopy()
+	d.copyBlock, d.copyCount = block, 1
+	return err
+}
+
+func (d *differ) flushCopy() error {
+	if d.copyCount == 0 {
+		return nil
+	}
+	err := d.emit(&pb.Delta{Block: d.copyBlock, Count: d.copyCount})
+	d.copyCount = 0
+	return err
+}
+
+func (d *differ) flushLiteral() error {
+	if d.pos == d.lit {
+		return nil
+	}
+	err := d.flushCopy()
+	if err != nil {
+		return err
+	}
+	err = d.emit(&pb.Delta{Literal: d.buf[d.lit:d.pos]})
+	d.lit = d.pos
+	return err
+}
+
+// Patcher rebuilds the new version of a file, writing it out in order.
+type Patcher struct {
+	w       io.Writer
+	basis   io.ReaderAt
+	sig     *pb.Signatures
+	limit   int64
+	Written int64
+}
+
+// NewPatcher returns a Patcher writing to w at most limit bytes, copying
+// blocks from basis, the copy that sig was made of.
+func NewPatcher(w io.Writer, basis io.ReaderAt, sig *pb.Signatures, limit int64) *Patcher {
+	return &Patcher{w: w, basis: basis, sig: sig, limit: limit}
+}
+
+// Apply carries out one instruction. Instructions copying blocks the copy
+// doesn't have or writing past the limit fail with ErrInvalid.
+func (p *Patcher) Apply(op *pb.Delta) error {
+	var r io.Reader
+	var n int64
+	switch {
+	case op.GetCount() > 0 && len(op.GetLiteral()) > 0:
+		return fmt.Errorf("%w: literal data and blocks in one instruction", ErrInvalid)
+	case op.GetCount() > 0:
+		first, count := op.GetBlock(), int64(op.GetCount())
+		if first < 0 || first+count > int64(len(p.sig.GetBlocks())) {
+			return fmt.Errorf("%w: blocks [%d, %d) of %d", ErrInvalid, first, first+count, len(p.sig.GetBlocks()))
+		}
+		bs := int64(p.sig.GetBlockSize())
+		n = count * bs
+		if first*bs+n > p.sig.GetSize() {
+			n = p.sig.GetSize() - first*bs
+		}
+		r = io.NewSectionReader(p.basis, first*bs, n)
+	default:
+		n = int64(len(op.GetLiteral()))
+		r = bytes.NewReader(op.GetLiteral())
+	}
+	if p.Written+n > p.limit {
+		return fmt.Errorf("%w: more than the %d bytes expected", ErrInvalid, p.limit)
+	}
+
+	k, err := io.Copy(p.w, r)
+	p.Written += k
+	if err == nil && k < n {
+		err = io.ErrUnexpectedEOF // The copy shrank since it was signed
+	}
+	return err
+}
+
+// rolling is the rsync checksum of a window, which can be moved on by a
+// byte without going over the whole window again.
+type rolling struct {
+	a, b uint32
+	n    uint32 // Length of the window
+}
+
+func (r *rolling) init(data []byte) {
+	r.a, r.b, r.n = 0, 0, uint32(len(data))
+	for i, c := range data {
+		r.a += uint32(c)
+		r.b += uint32(len(data)-i) * uint32(c)
+	}
+}
+
+func (r *rolling) sum() uint32 {
+	return r.a&0xffff | r.b<<16
+}
+
+// roll moves the window on by a byte, out leaving and in entering it.
+func (r *rolling) roll(out, in byte) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - r.n*uint32(out)
+}
+
+// shrink drops the first byte of the window.
+func (r *rolling) shrink(out byte) {
+	r.a -= uint32(out)
+	r.b -= r.n * uint32(out)
+	r.n--
+}
+
+func strong(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:strongSize]
+}
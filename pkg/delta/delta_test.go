@@ -0,0 +1,151 @@
+package delta
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/Azanul/peer-pressure/pkg/pressure/pb"
+)
+
+const testBlock = 64
+
+func random(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// roundTrip signs basis, diffs target against it and patches basis back into
+// target, returning the literal bytes that went over.
+func roundTrip(t testing.TB, basis, target []byte, blockSize int32) int {
+	sig, err := Sign(bytes.NewReader(basis), blockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	p := NewPatcher(&out, bytes.NewReader(basis), sig, int64(len(target)))
+	literal := 0
+	err = Diff(bytes.NewReader(target), sig, func(op *pb.Delta) error {
+		literal += len(op.GetLiteral())
+		return p.Apply(op)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), target) {
+		t.Fatalf("patched %d bytes differing from the %d of the target", out.Len(), len(target))
+	}
+	return literal
+}
+
+func TestRoundTrip(t *testing.T) {
+	old := random(1, 100*testBlock+17)
+	var tests = []struct {
+		name        string
+		basis, file []byte
+		maxLiteral  int
+	}{
+		{"Same", old, old, 0},
+		{"Appended", old, join(old, []byte("tail")), testBlock + 17 + 4},
+		{"Prepended", old, join([]byte("head"), old), 4},
+		{"Inserted", old, join(old[:5000], []byte("new"), old[5000:]), testBlock + 3},
+		{"Removed", old, join(old[:5000], old[5100:]), testBlock},
+		{"Changed", old, join(old[:5000], []byte("XYZ"), old[5003:]), testBlock},
+		{"Truncated", old, old[:3000], testBlock},
+		{"Moved", old, join(old[3200:], old[:3200]), 2 * testBlock},
+		{"Repeated", old, join(old, old), 2 * 17},
+		{"Unrelated", old, random(2, 5000), 5000},
+		{"EmptyBasis", nil, old, len(old)},
+		{"EmptyFile", old, nil, 0},
+		{"ShorterThanBlock", old[:10], old[:10], 0},
+		{"Zeros", make([]byte, 50*testBlock), make([]byte, 60*testBlock), 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if literal := roundTrip(t, tt.basis, tt.file, testBlock); literal > tt.maxLiteral {
+				t.Errorf("sent %d literal bytes, want at most %d", literal, tt.maxLiteral)
+			}
+		})
+	}
+}
+
+func TestLargeLiteral(t *testing.T) {
+	// Literal data spans several buffer refills and instructions
+	file := random(3, 5*maxLiteral+123)
+	if literal := roundTrip(t, random(4, 1000), file, MinBlockSize); literal != len(file) {
+		t.Errorf("sent %d literal bytes, want %d", literal, len(file))
+	}
+}
+
+func TestPatcherInvalid(t *testing.T) {
+	basis := random(5, 3*testBlock+10)
+	sig, err := Sign(bytes.NewReader(basis), testBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		name string
+		op   *pb.Delta
+	}{
+		{"PastLastBlock", &pb.Delta{Block: 3, Count: 2}},
+		{"NegativeBlock", &pb.Delta{Block: -1, Count: 1}},
+		{"Both", &pb.Delta{Literal: []byte("x"), Count: 1}},
+		{"OverLimit", &pb.Delta{Literal: make([]byte, 101)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewPatcher(&bytes.Buffer{}, bytes.NewReader(basis), sig, 100)
+			if err := p.Apply(tt.op); !errors.Is(err, ErrInvalid) {
+				t.Errorf("got %v, want ErrInvalid", err)
+			}
+		})
+	}
+}
+
+func TestBlockSize(t *testing.T) {
+	for _, size := range []int64{0, 1 << 20, 1 << 30, 1 << 40, 1 << 50} {
+		bs := BlockSize(size)
+		if bs < MinBlockSize || bs > MaxBlockSize {
+			t.Errorf("block size %d for %d bytes out of bounds", bs, size)
+		}
+		if blocks := size / int64(bs); blocks > maxBlocks && bs < MaxBlockSize {
+			t.Errorf("%d blocks for %d bytes", blocks, size)
+		}
+	}
+}
+
+func FuzzDelta(f *testing.F) {
+	f.Add([]byte("the quick brown fox"), []byte("the quick red fox"), uint8(4))
+	f.Add([]byte{}, []byte("new"), uint8(1))
+	f.Fuzz(func(t *testing.T, basis, file []byte, blockSize uint8) {
+		if blockSize == 0 {
+			return
+		}
+		roundTrip(t, basis, file, int32(blockSize))
+	})
+}
+
+func BenchmarkDiff(b *testing.B) {
+	old := random(6, 8<<20)
+	file := join(old[:1<<20], []byte("edit"), old[1<<20:])
+	sig, err := Sign(bytes.NewReader(old), BlockSize(int64(len(old))))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(file)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := Diff(bytes.NewReader(file), sig, func(*pb.Delta) error { return nil })
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,383 @@
+package dest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/Azanul/peer-pressure/pkg/pressure/pb"
+)
+
+// Policy decides what happens when an incoming file would land on a file
+// that's already there.
+type Policy string
+
+const (
+	Rename    Policy = "rename"    // Pick a free name like "file (1).bin", the default
+	Overwrite Policy = "overwrite" // Replace the existing file
+	Refuse    Policy = "refuse"    // Fail the transfer
+)
+
+// maxRenames bounds the search for a free name.
+const maxRenames = 1000
+
+var (
+	ErrUnsafeName = errors.New("unsafe file name")
+	ErrExists     = errors.New("file already exists")
+)
+
+// Resolver maps the file names peers send to paths inside a download root.
+type Resolver struct {
+	Root   string
+	Policy Policy
+
+	// Reserved, if set, reports whether the first component of a cleaned
+	// name is off limits, for names that would reach files of the program
+	// itself kept under Root.
+	Reserved func(first string) bool
+}
+
+// Dest is where an incoming file goes. It's written to Part and only moved
+// to Path once complete, Index tracks the chunks received so far.
+type Dest struct {
+	Path   string
+	Part   string
+	Index  string
+	Resume bool   // A partial download of the same file is there to resume
+	Basis  string // A file already there under the name, likely an older version, empty if none
+}
+
+func newDest(path string, resume bool) Dest {
+	return Dest{
+		Path:   path,
+		Part:   path + ".part",
+		Index:  pb.IndexPath(path),
+		Resume: resume,
+	}
+}
+
+// Clean checks a name sent by a peer and returns it as a relative path in
+// Unicode NFC, using the separator of this OS. Absolute paths, volume names,
+// ".." and control characters are rejected, backslashes count as separators
+// whatever the OS.
+func Clean(name string) (string, error) {
+	name = norm.NFC.String(name)
+	if name == "" {
+		return "", fmt.Errorf("%w: empty", ErrUnsafeName)
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return "", fmt.Errorf("%w: %q has control characters", ErrUnsafeName, name)
+		}
+	}
+
+	slashed := strings.ReplaceAll(name, `\`, "/")
+	if absolute(name, slashed) {
+		return "", fmt.Errorf("%w: %q is absolute", ErrUnsafeName, name)
+	}
+	for _, part := range strings.Split(slashed, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("%w: %q leaves the download directory", ErrUnsafeName, name)
+		}
+	}
+
+	cleaned := path.Clean(slashed)
+	if cleaned == "." {
+		return "", fmt.Errorf("%w: %q names no file", ErrUnsafeName, name)
+	}
+	return filepath.FromSlash(cleaned), nil
+}
+
+// absolute reports whether name is absolute or has a volume on any OS,
+// slashed being name with backslashes turned into slashes.
+func absolute(name, slashed string) bool {
+	return strings.HasPrefix(slashed, "/") || filepath.IsAbs(name) || filepath.VolumeName(name) != "" ||
+		(len(slashed) >= 2 && slashed[1] == ':')
+}
+
+// Resolve picks the path for the file described by index. A partial download
+// of the same file, told apart by its saved index, is resumed rather than
+// treated as a collision. A regular file already under the name is kept as
+// the Basis for a delta, whatever the policy. Missing directories under the
+// root are created.
+func (r Resolver) Resolve(index *pb.Index) (Dest, error) {
+	name, err := Clean(index.GetFilename())
+	if err != nil {
+		return Dest{}, err
+	}
+	err = r.checkReserved(name)
+	if err != nil {
+		return Dest{}, err
+	}
+
+	root, err := filepath.Abs(r.Root)
+	if err != nil {
+		return Dest{}, err
+	}
+	candidate := filepath.Join(root, name)
+	err = MkdirInside(root, filepath.Dir(candidate))
+	if err != nil {
+		return Dest{}, err
+	}
+
+	basis := ""
+	if info, err := os.Lstat(candidate); err == nil && info.Mode().IsRegular() {
+		basis = candidate
+	}
+
+	ext := filepath.Ext(candidate)
+	base := strings.TrimSuffix(candidate, ext)
+	for i := 1; i <= maxRenames; i++ {
+		d := newDest(candidate, false)
+		d.Basis = basis
+		if partialOf(d, index) {
+			d.Resume = true
+			return d, nil
+		}
+		info, err := os.Lstat(candidate)
+		if err != nil && !os.IsNotExist(err) {
+			return Dest{}, err
+		}
+		// A different download on its way to the same name takes it as well
+		_, indexErr := os.Lstat(d.Index)
+		if info == nil && os.IsNotExist(indexErr) {
+			return d, nil
+		}
+
+		switch r.Policy {
+		case Overwrite:
+			if info != nil && !info.Mode().IsRegular() {
+				return Dest{}, fmt.Errorf("%w: %s is not a regular file", ErrExists, candidate)
+			}
+			os.Remove(d.Index)
+			return d, nil
+		case Refuse:
+			return Dest{}, fmt.Errorf("%w: %s", ErrExists, candidate)
+		}
+		candidate = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+	return Dest{}, fmt.Errorf("%w: no free name for %s", ErrExists, name)
+}
+
+// checkReserved fails with ErrUnsafeName if the cleaned name starts with a
+// reserved component.
+func (r Resolver) checkReserved(name string) error {
+	if r.Reserved == nil {
+		return nil
+	}
+	first := strings.SplitN(name, string(filepath.Separator), 2)[0]
+	if r.Reserved(first) {
+		return fmt.Errorf("%w: %q is reserved", ErrUnsafeName, first)
+	}
+	return nil
+}
+
+// partialOf reports whether d holds a download of the file described by
+// index, going by the index saved next to it.
+func partialOf(d Dest, index *pb.Index) bool {
+	data, err := os.ReadFile(d.Index)
+	if err != nil {
+		return false
+	}
+	saved := pb.Index{}
+	if proto.Unmarshal(data, &saved) != nil {
+		return false
+	}
+	info, err := os.Lstat(d.Part)
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	return saved.GetFilename() == index.GetFilename() &&
+		saved.GetSize() == index.GetSize() &&
+		saved.GetNChunks() == index.GetNChunks() &&
+		bytes.Equal(saved.GetSha256(), index.GetSha256())
+}
+
+// MkdirInside creates dir and its parents below root, after making sure the
+// part that already exists doesn't lead out of root.
+func MkdirInside(root, dir string) error {
+	err := os.MkdirAll(root, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	existing := dir
+	for existing != root {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		existing = filepath.Dir(existing)
+	}
+	err = checkInside(root, existing)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(dir, os.ModePerm)
+}
+
+// checkInside makes sure dir doesn't lead out of root through a symlink.
+func checkInside(root, dir string) error {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(realRoot, realDir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%w: %s leads out of the download directory", ErrUnsafeName, dir)
+	}
+	return nil
+}
+
+// Symlink creates a symbolic link to target at d.Path. The target has to be
+// relative and stay inside the root once resolved from where the link is,
+// following the symlinks already on the way there, see resolveInside.
+func (r Resolver) Symlink(d Dest, target string) error {
+	slashed := strings.ReplaceAll(target, `\`, "/")
+	if target == "" || absolute(target, slashed) {
+		return fmt.Errorf("%w: link to %q is absolute", ErrUnsafeName, target)
+	}
+	for _, c := range target {
+		if unicode.IsControl(c) {
+			return fmt.Errorf("%w: link to %q has control characters", ErrUnsafeName, target)
+		}
+	}
+
+	root, err := filepath.Abs(r.Root)
+	if err != nil {
+		return err
+	}
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(d.Path))
+	if err != nil {
+		return err
+	}
+	resolved, err := resolveInside(root, dir, slashed)
+	if err != nil {
+		return fmt.Errorf("link to %q: %w", target, err)
+	}
+	err = r.checkReserved(filepath.FromSlash(resolved))
+	if err != nil {
+		return err
+	}
+
+	err = r.clear(d)
+	if err != nil {
+		return err
+	}
+	return os.Symlink(filepath.FromSlash(slashed), d.Path)
+}
+
+// maxLinkHops bounds the symlinks resolveInside follows, like the OS does
+// to stop at loops.
+const maxLinkHops = 40
+
+// resolveInside follows the slash separated target from dir the way the OS
+// would, through the symlinks already on disk, and returns where it leads
+// relative to root, slash separated. root and dir are real paths, dir inside
+// root. Components that don't exist yet are taken as they are. It fails with
+// ErrUnsafeName as soon as the path leaves root.
+func resolveInside(root, dir, target string) (string, error) {
+	rel, err := filepath.Rel(root, dir)
+	if err != nil {
+		return "", err
+	}
+	var current []string // Real path so far, below root
+	if rel != "." {
+		current = strings.Split(filepath.ToSlash(rel), "/")
+	}
+	pending := strings.Split(target, "/")
+	hops := 0
+	for len(pending) > 0 {
+		c := pending[0]
+		pending = pending[1:]
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			if len(current) == 0 {
+				return "", fmt.Errorf("%w: leads out of the download directory", ErrUnsafeName)
+			}
+			current = current[:len(current)-1]
+			continue
+		}
+
+		p := filepath.Join(root, filepath.FromSlash(path.Join(append(current, c)...)))
+		info, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			current = append(current, c)
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			current = append(current, c)
+			continue
+		}
+
+		hops++
+		if hops > maxLinkHops {
+			return "", fmt.Errorf("%w: too many levels of symbolic links", ErrUnsafeName)
+		}
+		link, err := os.Readlink(p)
+		if err != nil {
+			return "", err
+		}
+		slashed := strings.ReplaceAll(link, `\`, "/")
+		if absolute(link, slashed) {
+			// Not made by a sender, but followed all the same
+			rel, err := filepath.Rel(root, link)
+			if err != nil {
+				return "", fmt.Errorf("%w: leads out of the download directory", ErrUnsafeName)
+			}
+			current, slashed = nil, filepath.ToSlash(rel)
+		}
+		pending = append(strings.Split(slashed, "/"), pending...)
+	}
+	if len(current) == 0 {
+		return ".", nil
+	}
+	return path.Join(current...), nil
+}
+
+// Hardlink makes d.Path another name of existing, a file received before.
+func (r Resolver) Hardlink(d Dest, existing string) error {
+	info, err := os.Lstat(existing)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%w: link to %s, which is not a regular file", ErrUnsafeName, existing)
+	}
+	err = r.clear(d)
+	if err != nil {
+		return err
+	}
+	return os.Link(existing, d.Path)
+}
+
+// clear removes the file a link is going to replace, Resolve only hands out
+// taken names when overwriting.
+func (r Resolver) clear(d Dest) error {
+	if r.Policy != Overwrite {
+		return nil
+	}
+	err := os.Remove(d.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
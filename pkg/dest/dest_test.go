@@ -0,0 +1,275 @@
+package dest
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azanul/peer-pressure/pkg/pressure/pb"
+)
+
+func TestClean(t *testing.T) {
+	var tests = []struct {
+		name string
+		want string // Empty if the name has to be rejected
+	}{
+		{"file.bin", "file.bin"},
+		{"sub/dir/file.bin", filepath.Join("sub", "dir", "file.bin")},
+		{`sub\file.bin`, filepath.Join("sub", "file.bin")},
+		{"./a//b/", filepath.Join("a", "b")},
+		{"cafe\u0301.txt", "caf\u00e9.txt"},
+		{"", ""},
+		{".", ""},
+		{"..", ""},
+		{"../../.bashrc", ""},
+		{"a/../../b", ""},
+		{"a/../b", ""},
+		{`..\..\win.ini`, ""},
+		{"/etc/passwd", ""},
+		{`\\server\share\x`, ""},
+		{`C:\Windows\x`, ""},
+		{"C:x", ""},
+		{"a\x00b", ""},
+		{"line\nbreak", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Clean(tt.name)
+			if tt.want == "" {
+				if !errors.Is(err, ErrUnsafeName) {
+					t.Errorf("got %q, %v, want ErrUnsafeName", got, err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("got %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolve(t *testing.T) {
+	manifest := &pb.Index{Filename: "file.bin", NChunks: 3, Size: 9000}
+	other := &pb.Index{Filename: "file.bin", NChunks: 1, Size: 10}
+
+	var tests = []struct {
+		name   string
+		policy Policy
+		setup  func(t *testing.T, root string)
+		index  *pb.Index
+		want   string // Relative to the root, empty if Resolve has to fail
+		resume bool
+	}{
+		{"New", Rename, nil, manifest, "file.bin", false},
+		{"Subdir", Rename, nil, &pb.Index{Filename: "a/b/file.bin"}, filepath.Join("a", "b", "file.bin"), false},
+		{"Traversal", Rename, nil, &pb.Index{Filename: "../../.bashrc"}, "", false},
+		{"Absolute", Rename, nil, &pb.Index{Filename: "/etc/passwd"}, "", false},
+		{"Rename", Rename, existing("file.bin"), manifest, "file (1).bin", false},
+		{"RenameTwice", Rename, existing("file.bin", "file (1).bin"), manifest, "file (2).bin", false},
+		{"DefaultIsRename", "", existing("file.bin"), manifest, "file (1).bin", false},
+		{"Overwrite", Overwrite, existing("file.bin"), manifest, "file.bin", false},
+		{"Refuse", Refuse, existing("file.bin"), manifest, "", false},
+		{"Resume", Refuse, partial("file.bin", manifest), manifest, "file.bin", true},
+		{"ResumeRenamed", Rename, func(t *testing.T, root string) {
+			existing("file.bin")(t, root)
+			partial("file (1).bin", manifest)(t, root)
+		}, manifest, "file (1).bin", true},
+		{"DifferentPartial", Rename, partial("file.bin", other), manifest, "file (1).bin", false},
+		{"OverwriteDifferentPartial", Overwrite, partial("file.bin", other), manifest, "file.bin", false},
+		{"SymlinkedDir", Rename, func(t *testing.T, root string) {
+			symlink(t, t.TempDir(), filepath.Join(root, "out"))
+		}, &pb.Index{Filename: "out/file.bin"}, "", false},
+		{"SymlinkedFile", Overwrite, func(t *testing.T, root string) {
+			symlink(t, filepath.Join(t.TempDir(), "target"), filepath.Join(root, "file.bin"))
+		}, manifest, "", false},
+		{"RenameSymlinkedFile", Rename, func(t *testing.T, root string) {
+			symlink(t, filepath.Join(t.TempDir(), "target"), filepath.Join(root, "file.bin"))
+		}, manifest, "file (1).bin", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			if tt.setup != nil {
+				tt.setup(t, root)
+			}
+			got, err := Resolver{Root: root, Policy: tt.policy}.Resolve(tt.index)
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("got %s, want an error", got.Path)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := filepath.Join(root, tt.want)
+			if got.Path != want || got.Resume != tt.resume {
+				t.Errorf("got %+v, want {Path:%s Resume:%t}", got, want, tt.resume)
+			}
+			if tt.policy == Overwrite && !got.Resume {
+				if _, err := os.Stat(pb.IndexPath(got.Path)); !os.IsNotExist(err) {
+					t.Errorf("stale index of the overwritten file is still there")
+				}
+			}
+		})
+	}
+}
+
+func TestBasis(t *testing.T) {
+	manifest := &pb.Index{Filename: "file.bin", NChunks: 3, Size: 9000}
+	var tests = []struct {
+		name   string
+		policy Policy
+		setup  func(t *testing.T, root string)
+		want   bool
+	}{
+		{"New", Rename, nil, false},
+		{"Rename", Rename, existing("file.bin", "file (1).bin"), true},
+		{"Overwrite", Overwrite, existing("file.bin"), true},
+		{"Symlink", Rename, func(t *testing.T, root string) {
+			symlink(t, filepath.Join(t.TempDir(), "target"), filepath.Join(root, "file.bin"))
+		}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			if tt.setup != nil {
+				tt.setup(t, root)
+			}
+			got, err := Resolver{Root: root, Policy: tt.policy}.Resolve(manifest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := ""
+			if tt.want {
+				want = filepath.Join(root, "file.bin")
+			}
+			if got.Basis != want {
+				t.Errorf("got basis %q, want %q", got.Basis, want)
+			}
+		})
+	}
+}
+
+func existing(names ...string) func(*testing.T, string) {
+	return func(t *testing.T, root string) {
+		for _, name := range names {
+			if err := os.WriteFile(filepath.Join(root, name), []byte("old"), 0666); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func partial(name string, index *pb.Index) func(*testing.T, string) {
+	return func(t *testing.T, root string) {
+		existing(name+".part")(t, root)
+		index.Save(pb.IndexPath(filepath.Join(root, name)))
+	}
+}
+
+func symlink(t *testing.T, target, link string) {
+	if err := os.Symlink(target, link); err != nil {
+		t.Skip("symlinks not supported:", err)
+	}
+}
+
+func TestSymlink(t *testing.T) {
+	var tests = []struct {
+		name   string
+		setup  func(t *testing.T, root string)
+		link   string
+		target string
+		ok     bool
+	}{
+		{"Sibling", nil, "a/link", "file.bin", true},
+		{"Up", nil, "a/link", "../file.bin", true},
+		{"Dir", nil, "link", "a/b/", true},
+		{"Out", nil, "a/link", "../../file.bin", false},
+		{"OutAndBack", nil, "link", "../root/file.bin", false},
+		{"Absolute", nil, "link", "/etc/passwd", false},
+		{"Volume", nil, "link", `C:\Windows`, false},
+		{"Backslashes", nil, "a/link", `..\..\file.bin`, false},
+		{"Empty", nil, "link", "", false},
+		{"Reserved", nil, "link", "node/config.json", false},
+		{"ReservedUp", nil, "a/link", "../node", false},
+		{"ThroughSymlinkedDir", func(t *testing.T, root string) {
+			if err := os.Mkdir(filepath.Join(root, "a"), 0777); err != nil {
+				t.Fatal(err)
+			}
+			symlink(t, "..", filepath.Join(root, "a", "b"))
+		}, "a/b/link", "../file.bin", false},
+		{"ThroughLinkToRoot", func(t *testing.T, root string) {
+			symlink(t, ".", filepath.Join(root, "s"))
+		}, "t", "s/..", false},
+		{"ThroughLinkInside", func(t *testing.T, root string) {
+			if err := os.MkdirAll(filepath.Join(root, "a", "b"), 0777); err != nil {
+				t.Fatal(err)
+			}
+			symlink(t, "a/b", filepath.Join(root, "s"))
+		}, "t", "s/../../file.bin", true},
+		{"ThroughLinkOut", func(t *testing.T, root string) {
+			if err := os.Mkdir(filepath.Join(root, "a"), 0777); err != nil {
+				t.Fatal(err)
+			}
+			symlink(t, "a", filepath.Join(root, "s"))
+		}, "t", "s/../../file.bin", false},
+		{"LinkLoop", func(t *testing.T, root string) {
+			symlink(t, "loop", filepath.Join(root, "loop"))
+		}, "t", "loop/file.bin", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := filepath.Join(t.TempDir(), "root")
+			if err := os.Mkdir(root, 0777); err != nil {
+				t.Fatal(err)
+			}
+			if tt.setup != nil {
+				tt.setup(t, root)
+			}
+			r := Resolver{Root: root, Reserved: func(first string) bool { return first == "node" }}
+			d, err := r.Resolve(&pb.Index{Filename: tt.link})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = r.Symlink(d, tt.target)
+			if errors.Is(err, ErrUnsafeName) == tt.ok {
+				t.Fatalf("got %v, want ok %t", err, tt.ok)
+			}
+			if tt.ok && err != nil {
+				t.Skip("symlinks not supported:", err)
+			}
+			if _, err := os.Lstat(d.Path); (err == nil) != tt.ok {
+				t.Errorf("link created: %t, want %t", err == nil, tt.ok)
+			}
+		})
+	}
+}
+
+func TestReserved(t *testing.T) {
+	r := Resolver{Root: t.TempDir(), Reserved: func(first string) bool { return first == "node" }}
+	var tests = []struct {
+		name string
+		ok   bool
+	}{
+		{"node/config.json", false},
+		{"node", false},
+		{`node\swarm.key`, false},
+		{"./node/config.json", false},
+		{"nodes/config.json", true},
+		{"a/node/config.json", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := r.Resolve(&pb.Index{Filename: tt.name})
+			if (err == nil) != tt.ok || (err != nil && !errors.Is(err, ErrUnsafeName)) {
+				t.Errorf("got %v, want ok %t", err, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,225 @@
+// Package dirwalk lists the files a directory send transfers.
+package dirwalk
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Azanul/peer-pressure/pkg/ignore"
+)
+
+// LinkPolicy decides how links met while walking are sent.
+type LinkPolicy string
+
+const (
+	Preserve LinkPolicy = "preserve" // Send the link itself, the default
+	Follow   LinkPolicy = "follow"   // Send what the link points to as a file of its own
+	Skip     LinkPolicy = "skip"     // Leave the link out
+)
+
+// ParseLinkPolicy accepts the names of the policies, "" meaning Preserve.
+func ParseLinkPolicy(s string) (LinkPolicy, error) {
+	switch policy := LinkPolicy(s); policy {
+	case "", Preserve:
+		return Preserve, nil
+	case Follow, Skip:
+		return policy, nil
+	}
+	return "", errors.New("link policy has to be follow, preserve or skip")
+}
+
+// IgnoreFile is the name of the files listing what to leave out of the
+// directory they're in, see ignore.Matcher for the syntax.
+const IgnoreFile = ".ppignore"
+
+// Options pick how symbolic and hard links are sent and what is left out.
+// The zero value preserves links and only honours ignore files.
+type Options struct {
+	Symlinks  LinkPolicy `json:"symlinks,omitempty"`
+	Hardlinks LinkPolicy `json:"hardlinks,omitempty"` // Skip sends only the first name of a file
+
+	// Exclude and Include are patterns relative to the walked directory, in
+	// the syntax of ignore files. They take precedence over ignore files,
+	// Include over Exclude.
+	Exclude []string `json:"exclude,omitempty"`
+	Include []string `json:"include,omitempty"`
+}
+
+// Kind tells what an Entry is sent as.
+type Kind int8
+
+const (
+	File     Kind = iota
+	Symlink       // Target is the link as read, slash separated
+	Hardlink      // Target is the Name of an earlier entry for the same file
+)
+
+// Entry is one file to send.
+type Entry struct {
+	Path   string // Where it is on this host
+	Name   string // Slash separated, starting with the base name of the walked path
+	Kind   Kind
+	Target string
+}
+
+var ErrLoop = errors.New("symlink loop")
+
+// Walk lists what sending path transfers, in lexical order. A regular file
+// is a single entry, a directory is walked recursively, leaving out what the
+// ignore files in it and opts exclude. Sockets, devices and named pipes are
+// skipped, as are followed links that dangle or lead back into a directory
+// being walked. Skipped files are logged.
+func Walk(root string, opts Options) ([]Entry, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	w := walker{opts: opts}
+	name := filepath.Base(root)
+	switch {
+	case info.IsDir():
+		w.name = name
+		for _, pattern := range opts.Exclude {
+			err = w.flags.Add(pattern, "")
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, pattern := range opts.Include {
+			err = w.flags.Add("!"+pattern, "")
+			if err != nil {
+				return nil, err
+			}
+		}
+		err = w.dir(root, "", []os.FileInfo{info})
+	case info.Mode().IsRegular():
+		w.file(root, name, info)
+	default:
+		err = &os.PathError{Op: "send", Path: root, Err: errors.New("not a regular file or directory")}
+	}
+	return w.entries, err
+}
+
+type walker struct {
+	opts    Options
+	name    string // Of the walked directory, in front of every entry
+	files   ignore.Matcher
+	flags   ignore.Matcher
+	entries []Entry
+	linked  []linkedFile
+}
+
+// linkedFile is a file with more than one name, first seen as name.
+type linkedFile struct {
+	info os.FileInfo
+	name string
+}
+
+// dir adds the entries below dir, rel being its path inside the walked
+// directory and ancestors the directories walked into to get there.
+func (w *walker) dir(dir, rel string, ancestors []os.FileInfo) error {
+	err := w.files.ReadFile(filepath.Join(dir, IgnoreFile), rel)
+	if err != nil {
+		return err
+	}
+	dirents, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, de := range dirents {
+		p := filepath.Join(dir, de.Name())
+		r := path.Join(rel, de.Name())
+		n := path.Join(w.name, r)
+		info, err := os.Lstat(p)
+		if err != nil {
+			return err
+		}
+		if w.ignored(r, de.IsDir()) {
+			log.Debugf("Ignoring %s", p)
+			continue
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			switch w.opts.Symlinks {
+			case Skip:
+				continue
+			case Follow:
+				info, err = os.Stat(p)
+				if err != nil {
+					log.Warnf("Skipping %s: %v", p, err)
+					continue
+				}
+			default:
+				target, err := os.Readlink(p)
+				if err != nil {
+					return err
+				}
+				w.entries = append(w.entries, Entry{Path: p, Name: n, Kind: Symlink, Target: filepath.ToSlash(target)})
+				continue
+			}
+		}
+
+		switch {
+		case info.IsDir():
+			if within(ancestors, info) {
+				log.Warnf("Skipping %s: %v", p, ErrLoop)
+				continue
+			}
+			err = w.dir(p, r, append(ancestors[:len(ancestors):len(ancestors)], info))
+			if err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			w.file(p, n, info)
+		default:
+			log.Warnf("Skipping %s: %v files can't be sent", p, info.Mode().Type())
+		}
+	}
+	return nil
+}
+
+// file adds a regular file, as a hard link if it is another name of one
+// added before.
+func (w *walker) file(p, name string, info os.FileInfo) {
+	if w.opts.Hardlinks == Follow || linkCount(info) < 2 {
+		w.entries = append(w.entries, Entry{Path: p, Name: name, Kind: File})
+		return
+	}
+	for _, l := range w.linked {
+		if os.SameFile(l.info, info) {
+			if w.opts.Hardlinks != Skip {
+				w.entries = append(w.entries, Entry{Path: p, Name: name, Kind: Hardlink, Target: l.name})
+			}
+			return
+		}
+	}
+	w.linked = append(w.linked, linkedFile{info, name})
+	w.entries = append(w.entries, Entry{Path: p, Name: name, Kind: File})
+}
+
+// ignored reports whether rel is left out by the options or an ignore file.
+// Links are matched by their own name, not by what they point to.
+func (w *walker) ignored(rel string, isDir bool) bool {
+	if ignored, ok := w.flags.Match(rel, isDir); ok {
+		return ignored
+	}
+	ignored, _ := w.files.Match(rel, isDir)
+	return ignored
+}
+
+func within(ancestors []os.FileInfo, info os.FileInfo) bool {
+	for _, a := range ancestors {
+		if os.SameFile(a, info) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,137 @@
+package dirwalk
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// tree builds a directory with every kind of file Walk has to deal with.
+func tree(t *testing.T) string {
+	root := filepath.Join(t.TempDir(), "tree")
+	write := func(name string) {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(name), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(root, "sub"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	write("a.txt")
+	write("sub/b.txt")
+	if err := os.Link(filepath.Join(root, "a.txt"), filepath.Join(root, "sub", "hard")); err != nil {
+		t.Skip("hard links not supported:", err)
+	}
+	for link, target := range map[string]string{"link": "sub/b.txt", "loop": ".", "dangling": "missing"} {
+		if err := os.Symlink(filepath.FromSlash(target), filepath.Join(root, link)); err != nil {
+			t.Skip("symlinks not supported:", err)
+		}
+	}
+	if l, err := net.Listen("unix", filepath.Join(root, "sock")); err == nil {
+		t.Cleanup(func() { l.Close() })
+	}
+	return root
+}
+
+func TestWalk(t *testing.T) {
+	var tests = []struct {
+		name string
+		opts Options
+		want []string
+	}{
+		{"Default", Options{}, []string{
+			"tree/a.txt", "tree/dangling -> missing", "tree/link -> sub/b.txt", "tree/loop -> .",
+			"tree/sub/b.txt", "tree/sub/hard => tree/a.txt",
+		}},
+		{"FollowSymlinks", Options{Symlinks: Follow}, []string{
+			"tree/a.txt", "tree/link", "tree/sub/b.txt", "tree/sub/hard => tree/a.txt",
+		}},
+		{"SkipSymlinks", Options{Symlinks: Skip}, []string{
+			"tree/a.txt", "tree/sub/b.txt", "tree/sub/hard => tree/a.txt",
+		}},
+		{"FollowHardlinks", Options{Hardlinks: Follow}, []string{
+			"tree/a.txt", "tree/dangling -> missing", "tree/link -> sub/b.txt", "tree/loop -> .",
+			"tree/sub/b.txt", "tree/sub/hard",
+		}},
+		{"SkipHardlinks", Options{Symlinks: Skip, Hardlinks: Skip}, []string{
+			"tree/a.txt", "tree/sub/b.txt",
+		}},
+	}
+
+	root := tree(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := Walk(root, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, e := range entries {
+				switch e.Kind {
+				case Symlink:
+					got = append(got, fmt.Sprintf("%s -> %s", e.Name, e.Target))
+				case Hardlink:
+					got = append(got, fmt.Sprintf("%s => %s", e.Name, e.Target))
+				default:
+					got = append(got, e.Name)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWalkFile(t *testing.T) {
+	root := tree(t)
+	entries, err := Walk(filepath.Join(root, "link"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Entry{{Path: filepath.Join(root, "link"), Name: "link", Kind: File}}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("got %+v, want %+v", entries, want)
+	}
+}
+
+func TestWalkIgnore(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "tree")
+	files := map[string]string{
+		".ppignore":          "node_modules/\n*.log\n!keep.log\n",
+		"a.log":              "",
+		"keep.log":           "",
+		"local":              "",
+		"node_modules/x.js":  "",
+		"build/out":          "",
+		"src/.ppignore":      "/local\n",
+		"src/local":          "",
+		"src/main.go":        "",
+		"src/vendor/dep.log": "",
+	}
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := Walk(root, Options{Exclude: []string{"build/"}, Include: []string{"a.log"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, e := range entries {
+		got = append(got, e.Name)
+	}
+	want := []string{"tree/.ppignore", "tree/a.log", "tree/keep.log", "tree/local", "tree/src/.ppignore", "tree/src/main.go"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package disk
+
+import (
+	"errors"
+	"os"
+)
+
+var errNoAllocate = errors.New("preallocation not supported")
+
+func allocate(f *os.File, size int64) error {
+	return errNoAllocate
+}
@@ -0,0 +1,24 @@
+// Package disk checks and reserves room for incoming files.
+package disk
+
+import (
+	"errors"
+	"os"
+)
+
+// ErrUnsupported is returned by Free on systems it can't query.
+var ErrUnsupported = errors.New("free space can't be determined on this system")
+
+// Preallocate reserves size bytes for f, so that running out of space shows
+// up before the transfer instead of halfway through it. Where the filesystem
+// can't reserve space the file is only extended to size.
+func Preallocate(f *os.File, size int64) error {
+	err := allocate(f, size)
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, errNoAllocate) {
+		return f.Truncate(size)
+	}
+	return err
+}
@@ -0,0 +1,37 @@
+package disk
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPreallocate(t *testing.T) {
+	dir := t.TempDir()
+	free, err := Free(dir)
+	if err == ErrUnsupported {
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	if free == 0 {
+		t.Fatal("no free space reported")
+	}
+
+	f, err := os.Create(filepath.Join(dir, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	err = Preallocate(f, 1<<20+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 1<<20+1 {
+		t.Errorf("got %d bytes, want %d", info.Size(), 1<<20+1)
+	}
+}
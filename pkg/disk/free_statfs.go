@@ -0,0 +1,15 @@
+//go:build linux || darwin || freebsd
+
+package disk
+
+import "golang.org/x/sys/unix"
+
+// Free returns the bytes available to us on the filesystem holding dir.
+func Free(dir string) (uint64, error) {
+	var st unix.Statfs_t
+	err := unix.Statfs(dir, &st)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
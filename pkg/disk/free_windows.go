@@ -0,0 +1,16 @@
+//go:build windows
+
+package disk
+
+import "golang.org/x/sys/windows"
+
+// Free returns the bytes available to us on the volume holding dir.
+func Free(dir string) (uint64, error) {
+	path, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var free, total, totalFree uint64
+	err = windows.GetDiskFreeSpaceEx(path, &free, &total, &totalFree)
+	return free, err
+}
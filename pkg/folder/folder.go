@@ -0,0 +1,581 @@
+// Package folder keeps a directory synchronized with a trusted node. Both
+// sides index their copy, with a version vector per file, and pull whatever
+// the other has newer. When both changed a file the newer edit keeps the name
+// and the other is kept as a conflict copy next to it.
+package folder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/Azanul/peer-pressure/pkg/dest"
+	"github.com/Azanul/peer-pressure/pkg/meta"
+	"github.com/Azanul/peer-pressure/pkg/peer"
+	"github.com/Azanul/peer-pressure/pkg/pressure/pb"
+	"github.com/Azanul/peer-pressure/pkg/ratelimit"
+	"github.com/Azanul/peer-pressure/pkg/streamio"
+	"github.com/Azanul/peer-pressure/pkg/watch"
+	"github.com/libp2p/go-libp2p/core/network"
+	libp2ppeer "github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// Protocols of the index exchange and of fetching files.
+const (
+	IndexProtocolID = protocol.ID("/peer-pressure/sync/index/1.0.0")
+	FileProtocolID  = protocol.ID("/peer-pressure/sync/file/1.0.0")
+)
+
+const (
+	// DefaultInterval is how often the folder is rescanned and compared with
+	// the peer without any change noticed.
+	DefaultInterval = time.Minute
+
+	// settle is how long changes are collected before a round starts, files
+	// are often written in several steps.
+	settle = 500 * time.Millisecond
+)
+
+var (
+	ErrUntrusted = errors.New("peer is not trusted with this folder")
+	ErrAway      = errors.New("peer not found on the rendezvous")
+	ErrChanged   = errors.New("file changed while synchronizing")
+)
+
+// Options configure a Folder.
+type Options struct {
+	Label    string // Name both sides share the folder under, its base name by default
+	Interval time.Duration
+	EventCh  chan peer.Event // Progress of fetched and served files, has to be read
+}
+
+// Folder is a directory kept in sync with one trusted node.
+type Folder struct {
+	p     *peer.Peer
+	root  string
+	with  libp2ppeer.ID
+	id    string // Our own peer ID, for the version vectors
+	opts  Options
+	mu    sync.Mutex
+	files map[string]*pb.FileVersion
+
+	trigger chan struct{}
+}
+
+// New prepares root to be synchronized with the node with, and starts
+// answering it. Only one folder can be shared per node at a time.
+func New(p *peer.Peer, root string, with libp2ppeer.ID, opts Options) (*Folder, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+	if opts.Label == "" {
+		opts.Label = filepath.Base(root)
+	}
+	if opts.Interval == 0 {
+		opts.Interval = DefaultInterval
+	}
+
+	f := &Folder{
+		p:       p,
+		root:    root,
+		with:    with,
+		id:      p.Node.ID().String(),
+		opts:    opts,
+		files:   map[string]*pb.FileVersion{},
+		trigger: make(chan struct{}, 1),
+	}
+	err = f.loadIndex()
+	if err != nil {
+		return nil, err
+	}
+	p.Node.SetStreamHandler(IndexProtocolID, f.handleIndex)
+	p.Node.SetStreamHandler(FileProtocolID, f.handleFile)
+	return f, nil
+}
+
+// Close stops answering the peer.
+func (f *Folder) Close() {
+	f.p.Node.RemoveStreamHandler(IndexProtocolID)
+	f.p.Node.RemoveStreamHandler(FileProtocolID)
+}
+
+// Run synchronizes whenever the folder changes, the peer has news or the
+// interval passes, until ctx is done. Failed rounds are reported on the
+// event channel and retried the next time.
+func (f *Folder) Run(ctx context.Context) error {
+	changes, err := watch.Changes(ctx, f.root, func(dir string) bool {
+		return dir == filepath.Join(f.root, StateDir)
+	})
+	if err != nil {
+		log.Warnf("Not watching %s, rescanning every %s: %v", f.root, f.opts.Interval, err)
+	}
+	ticker := time.NewTicker(f.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		err := f.Sync(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Errorf("Synchronizing %s: %v", f.root, err)
+			f.opts.EventCh <- peer.Event{Type: peer.Error, Data: err.Error()}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-changes:
+			time.Sleep(settle)
+		case <-f.trigger:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sync runs one round: the folder is scanned, the indexes exchanged and
+// whatever the peer has newer is pulled.
+func (f *Folder) Sync(ctx context.Context) error {
+	f.mu.Lock()
+	changed, err := f.scan()
+	if err == nil && changed {
+		err = f.saveIndex()
+	}
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = f.connect(ctx)
+	if err != nil {
+		return err
+	}
+	remote, err := f.exchange(ctx)
+	if err != nil {
+		return err
+	}
+	err = f.pull(ctx, remote)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if saveErr := f.saveIndex(); err == nil {
+		err = saveErr
+	}
+	return err
+}
+
+// connect makes sure there is a connection to the peer, looking for it on
+// the rendezvous if needed.
+func (f *Folder) connect(ctx context.Context) error {
+	if f.p.Node.Network().Connectedness(f.with) == network.Connected {
+		return nil
+	}
+	peerChan, err := f.p.DiscoverPeers(ctx)
+	if err != nil {
+		return err
+	}
+	for info := range peerChan {
+		if info.ID == f.with {
+			return f.p.Connect(ctx, info)
+		}
+	}
+	return ErrAway
+}
+
+// exchange sends our index to the peer and returns its own.
+func (f *Folder) exchange(ctx context.Context) ([]*pb.FileVersion, error) {
+	stream, err := f.p.Node.NewStream(ctx, f.with, IndexProtocolID)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	f.mu.Lock()
+	req := &pb.SyncRequest{Folder: f.opts.Label, Index: f.snapshot()}
+	f.mu.Unlock()
+	if proto.Size(req) > pb.MaxMessageSize {
+		return nil, fmt.Errorf("index of %d files too large to send", len(req.Index.Files))
+	}
+	_, err = stream.Write(pb.Marshal(req))
+	if err != nil {
+		return nil, err
+	}
+	remote := pb.FolderIndex{}
+	err = pb.Read(bufio.NewReader(stream), &remote)
+	if err != nil {
+		return nil, err
+	}
+	return remote.GetFiles(), nil
+}
+
+// accept checks that a stream comes from the peer the folder is shared with.
+func (f *Folder) accept(stream network.Stream, label string) bool {
+	from := stream.Conn().RemotePeer()
+	if from != f.with || label != f.opts.Label {
+		log.Warnf("Refusing to synchronize %q with %s: %v", label, from.Pretty(), ErrUntrusted)
+		stream.Reset()
+		return false
+	}
+	return true
+}
+
+// handleIndex answers an index exchange, and starts a round if the peer has
+// anything to pull.
+func (f *Folder) handleIndex(stream network.Stream) {
+	defer stream.Close()
+	req := pb.SyncRequest{}
+	err := pb.Read(bufio.NewReader(stream), &req)
+	if err != nil || !f.accept(stream, req.GetFolder()) {
+		return
+	}
+
+	f.mu.Lock()
+	index := f.snapshot()
+	news := false
+	for _, r := range req.GetIndex().GetFiles() {
+		l := f.files[r.GetName()]
+		if order := Compare(r.GetVersion(), l.GetVersion()); order == Newer || order == Concurrent {
+			news = true
+		}
+	}
+	f.mu.Unlock()
+
+	if proto.Size(index) > pb.MaxMessageSize {
+		log.Errorf("Index of %d files too large to send", len(index.Files))
+		stream.Reset()
+		return
+	}
+	_, err = stream.Write(pb.Marshal(index))
+	if err != nil {
+		log.Errorf("Sending index to %s: %v", f.with.Pretty(), err)
+		return
+	}
+	if news {
+		select {
+		case f.trigger <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// handleFile serves a file of the folder, like a transfer would. Only files
+// in the index are served, see openInside.
+func (f *Folder) handleFile(stream network.Stream) {
+	defer stream.Close()
+	out := ratelimit.NewWriter(stream, nil, f.p.Upload, ratelimit.GlobalUpload)
+	rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(out))
+	req := pb.FileRequest{}
+	err := pb.Read(rw.Reader, &req)
+	if err != nil || !f.accept(stream, req.GetFolder()) {
+		return
+	}
+	name, err := checkName(req.GetName())
+	if err != nil {
+		log.Warnf("Refusing %q to %s: %v", req.GetName(), f.with.Pretty(), err)
+		stream.Reset()
+		return
+	}
+	f.mu.Lock()
+	v := f.files[filepath.ToSlash(name)]
+	f.mu.Unlock()
+	if v == nil || v.GetDeleted() {
+		streamio.Refuse(rw, fmt.Sprintf("%q isn't in the folder", req.GetName()))
+		return
+	}
+	file, err := openInside(f.root, name)
+	if err != nil {
+		log.Warnf("Refusing %q to %s: %v", req.GetName(), f.with.Pretty(), err)
+		streamio.Refuse(rw, err.Error())
+		return
+	}
+	defer file.Close()
+	err = streamio.FileToStream(rw, file, req.GetName(), streamio.Fixed, f.opts.EventCh, nil)
+	if err != nil {
+		log.Errorf("Serving %s: %v", name, err)
+	}
+}
+
+// openInside opens the regular file name of the folder at root, refusing
+// one reached through a symlink, which the folder doesn't synchronize.
+func openInside(root, name string) (*os.File, error) {
+	path := filepath.Join(root, name)
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, err
+	}
+	if real != filepath.Join(realRoot, name) {
+		return nil, fmt.Errorf("%w: %s is reached through a symlink", dest.ErrUnsafeName, path)
+	}
+	file, err := os.Open(real)
+	if err != nil {
+		return nil, err
+	}
+	// Whatever was opened has to be what's there now, not something a
+	// link swapped in meanwhile led to
+	opened, err := file.Stat()
+	var info os.FileInfo
+	if err == nil {
+		info, err = os.Lstat(path)
+	}
+	if err == nil && (!opened.Mode().IsRegular() || !os.SameFile(opened, info)) {
+		err = fmt.Errorf("%w: %s isn't a regular file", dest.ErrUnsafeName, path)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// checkName turns the name of a file in the folder into a relative path,
+// refusing names outside of it or inside the StateDir.
+func checkName(name string) (string, error) {
+	cleaned, err := dest.Clean(name)
+	if err != nil {
+		return "", err
+	}
+	if top, _, _ := strings.Cut(filepath.ToSlash(cleaned), "/"); top == StateDir {
+		return "", fmt.Errorf("%w: %q is internal", dest.ErrUnsafeName, name)
+	}
+	return cleaned, nil
+}
+
+// pull brings over what the peer has newer than we do. Files failing to
+// come over are left for the next round, the first error is returned.
+func (f *Folder) pull(ctx context.Context, remote []*pb.FileVersion) error {
+	var firstErr error
+	for _, r := range remote {
+		err := f.pullFile(ctx, r)
+		if err != nil {
+			log.Warnf("Not synchronizing %s yet: %v", r.GetName(), err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return firstErr
+}
+
+func (f *Folder) pullFile(ctx context.Context, r *pb.FileVersion) error {
+	name, err := checkName(r.GetName())
+	if err != nil {
+		return err
+	}
+	local := filepath.Join(f.root, name)
+
+	f.mu.Lock()
+	l := f.files[r.GetName()]
+	order := Compare(r.GetVersion(), l.GetVersion())
+	if l == nil {
+		order = Newer
+	}
+	merged := Merge(r.GetVersion(), l.GetVersion())
+	same := l != nil && l.GetDeleted() == r.GetDeleted() && bytes.Equal(l.GetSha256(), r.GetSha256())
+
+	switch {
+	case order == Equal || order == Older:
+		f.mu.Unlock()
+		return nil
+	case same:
+		// Both ended up with the same content, only the versions differ
+		v := proto.Clone(l).(*pb.FileVersion)
+		v.Version = merged
+		f.files[r.GetName()] = v
+		f.mu.Unlock()
+		return nil
+	case order == Concurrent && !remoteWins(l, r):
+		// Ours stays, the peer moves its edit aside and takes ours
+		f.mu.Unlock()
+		return nil
+	}
+
+	if !unchanged(local, l) {
+		f.mu.Unlock()
+		return ErrChanged // Picked up by the next scan, possibly as a conflict
+	}
+	expect := l
+	if order == Concurrent && !l.GetDeleted() {
+		err = f.conflictCopy(local, name)
+		if err != nil {
+			f.mu.Unlock()
+			return err
+		}
+		// Without the file our version counts as removed, which loses
+		// against the peer's until it's here
+		expect = &pb.FileVersion{Name: r.GetName(), Deleted: true, Mtime: l.GetMtime(), Version: l.GetVersion()}
+		f.files[r.GetName()] = expect
+	}
+	f.mu.Unlock()
+
+	v := &pb.FileVersion{
+		Name:    r.GetName(),
+		Mtime:   r.GetMtime(),
+		Deleted: true,
+		Version: merged,
+	}
+	if r.GetDeleted() {
+		log.Printf("Removing %s, removed by %s", local, f.with.Pretty())
+		err = os.Remove(local)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		v, err = f.fetch(ctx, name, r, expect)
+		if err != nil {
+			return err
+		}
+		v.Version = merged
+	}
+
+	f.mu.Lock()
+	f.files[r.GetName()] = v
+	f.mu.Unlock()
+	return nil
+}
+
+// remoteWins decides a conflict between the local version l and the peer's
+// r the same way on both sides. Edits win over removals, then the later edit
+// wins, the digest breaking ties.
+func remoteWins(l, r *pb.FileVersion) bool {
+	switch {
+	case l.GetDeleted() || r.GetDeleted():
+		return !r.GetDeleted()
+	case r.GetMtime() != l.GetMtime():
+		return r.GetMtime() > l.GetMtime()
+	}
+	return bytes.Compare(r.GetSha256(), l.GetSha256()) > 0
+}
+
+// conflictCopy moves the file at local, whose edit lost a conflict, aside
+// under a name like "notes.sync-conflict-20060102-150405-abcdef.txt".
+func (f *Folder) conflictCopy(local, name string) error {
+	ext := path.Ext(name)
+	id := f.id[len(f.id)-6:]
+	conflict := fmt.Sprintf("%s.sync-conflict-%s-%s%s", strings.TrimSuffix(local, ext), time.Now().Format("20060102-150405"), id, ext)
+	log.Printf("Conflicting edits of %s, keeping ours as %s", local, conflict)
+	return os.Rename(local, conflict)
+}
+
+// fetch gets the version r of the file name from the peer and moves it into
+// place, as long as the local file is still as expected. It returns what the
+// file is now in the index.
+func (f *Folder) fetch(ctx context.Context, name string, r, expect *pb.FileVersion) (*pb.FileVersion, error) {
+	stream, err := f.p.Node.NewStream(ctx, f.with, FileProtocolID)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	in := ratelimit.NewReader(stream, nil, f.p.Download, ratelimit.GlobalDownload)
+	rw := bufio.NewReadWriter(bufio.NewReader(in), bufio.NewWriter(stream))
+
+	_, err = rw.Write(pb.Marshal(&pb.FileRequest{Folder: f.opts.Label, Name: r.GetName()}))
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		return nil, err
+	}
+	index := pb.Index{}
+	err = pb.Read(rw.Reader, &index)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(index.GetSha256(), r.GetSha256()) {
+		return nil, ErrChanged // The peer has a newer one to tell us about
+	}
+
+	// Fetched into the StateDir, then moved into place
+	tmp := filepath.Join(f.root, StateDir, "tmp")
+	err = os.MkdirAll(tmp, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	part := filepath.Join(tmp, fmt.Sprintf("%x", r.GetSha256()))
+	indexPath := pb.IndexPath(part)
+	defer os.Remove(indexPath)
+	file, err := os.OpenFile(part, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, err
+	}
+	index.ResetProgress()
+	index.Save(indexPath)
+	_, err = rw.Write(pb.Marshal(&pb.ChunkRequest{}))
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err == nil {
+		err = streamio.StreamToFile(rw, file, indexPath, nil, f.opts.EventCh, nil)
+	} else {
+		file.Close()
+	}
+	if err == nil {
+		err = verify(part, r.GetSha256())
+	}
+	if err == nil {
+		err = meta.Apply(part, &index, f.p.Config.Metadata)
+	}
+	if err != nil {
+		os.Remove(part)
+		return nil, err
+	}
+
+	local := filepath.Join(f.root, name)
+	err = dest.MkdirInside(f.root, filepath.Dir(local))
+	if err == nil && !unchanged(local, expect) {
+		err = ErrChanged
+	}
+	if err == nil {
+		err = os.Rename(part, local)
+	}
+	if err != nil {
+		os.Remove(part)
+		return nil, err
+	}
+	info, err := os.Stat(local)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Fetched %s from %s", local, f.with.Pretty())
+	return &pb.FileVersion{
+		Name:   r.GetName(),
+		Sha256: r.GetSha256(),
+		Size:   info.Size(),
+		Mtime:  info.ModTime().UnixNano(),
+		Mode:   uint32(info.Mode().Perm()),
+	}, nil
+}
+
+func verify(path string, sum []byte) error {
+	got, err := hashFile(path)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, sum) {
+		return fmt.Errorf("%s arrived corrupted", path)
+	}
+	return nil
+}
@@ -0,0 +1,319 @@
+package folder
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+
+	"github.com/Azanul/peer-pressure/pkg/peer"
+	"github.com/Azanul/peer-pressure/pkg/pressure/pb"
+)
+
+func vv(counters ...interface{}) []*pb.Counter {
+	var version []*pb.Counter
+	for i := 0; i < len(counters); i += 2 {
+		version = append(version, &pb.Counter{Id: counters[i].(string), Value: uint64(counters[i+1].(int))})
+	}
+	return version
+}
+
+func TestCompare(t *testing.T) {
+	var tests = []struct {
+		name string
+		a, b []*pb.Counter
+		want Order
+	}{
+		{"Empty", nil, nil, Equal},
+		{"Equal", vv("a", 1, "b", 2), vv("b", 2, "a", 1), Equal},
+		{"Newer", vv("a", 2), vv("a", 1), Newer},
+		{"NewerThanNothing", vv("a", 1), nil, Newer},
+		{"NewerOtherNode", vv("a", 1, "b", 1), vv("a", 1), Newer},
+		{"Older", vv("a", 1), vv("a", 1, "b", 1), Older},
+		{"Concurrent", vv("a", 2, "b", 1), vv("a", 1, "b", 2), Concurrent},
+		{"ConcurrentDisjoint", vv("a", 1), vv("b", 1), Concurrent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Compare(tt.a, tt.b); got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+			if merged := Merge(tt.a, tt.b); Compare(merged, tt.a) == Older || Compare(merged, tt.b) == Older {
+				t.Errorf("merged %v is older than one of its parts", merged)
+			}
+		})
+	}
+}
+
+// pair shares a folder called "shared" between two connected nodes.
+func pair(t *testing.T) (*Folder, *Folder) {
+	ctx, cancel := context.WithCancel(context.Background())
+	mn := mocknet.New()
+	t.Cleanup(func() {
+		cancel()
+		mn.Close()
+	})
+	var peers []*peer.Peer
+	for _, name := range []string{"alice", "bob"} {
+		h, err := mn.GenPeer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := peer.New(name, "test", peer.WithRoot(t.TempDir()), peer.WithHost(h))
+		if err != nil {
+			t.Fatal(err)
+		}
+		peers = append(peers, p)
+	}
+	if err := mn.LinkAll(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mn.ConnectAllButSelf(); err != nil {
+		t.Fatal(err)
+	}
+
+	var folders []*Folder
+	for i, p := range peers {
+		root := filepath.Join(t.TempDir(), "shared")
+		if err := os.Mkdir(root, 0777); err != nil {
+			t.Fatal(err)
+		}
+		eventCh := make(chan peer.Event)
+		go func() {
+			for {
+				select {
+				case <-eventCh:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		f, err := New(p, root, peers[1-i].Node.ID(), Options{EventCh: eventCh})
+		if err != nil {
+			t.Fatal(err)
+		}
+		folders = append(folders, f)
+	}
+	return folders[0], folders[1]
+}
+
+func round(t *testing.T, folders ...*Folder) {
+	t.Helper()
+	for _, f := range folders {
+		if err := f.Sync(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// write puts content into the file name of f, with an mtime age ago.
+func write(t *testing.T, f *Folder, name, content string, age time.Duration) {
+	t.Helper()
+	path := filepath.Join(f.root, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0666); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(-age)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// contents returns the files of f by name, leaving out the StateDir and
+// shortening conflict copies to "name.sync-conflict".
+func contents(t *testing.T, f *Folder) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	err := filepath.Walk(f.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == StateDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		name, _ := filepath.Rel(f.root, path)
+		if i := strings.Index(name, ".sync-conflict"); i >= 0 {
+			name = name[:i+len(".sync-conflict")]
+		}
+		files[filepath.ToSlash(name)] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func same(t *testing.T, alice, bob *Folder, want map[string]string) {
+	t.Helper()
+	for _, f := range []*Folder{alice, bob} {
+		got := contents(t, f)
+		if len(got) != len(want) {
+			t.Errorf("%s has %v, want %v", f.p.Name, got, want)
+			continue
+		}
+		for name, content := range want {
+			if got[name] != content {
+				t.Errorf("%s has %v, want %v", f.p.Name, got, want)
+				break
+			}
+		}
+	}
+}
+
+func TestSync(t *testing.T) {
+	alice, bob := pair(t)
+
+	write(t, alice, "notes.txt", "first", time.Hour)
+	write(t, alice, "sub/data.bin", strings.Repeat("x", 10000), time.Hour)
+	round(t, alice, bob)
+	same(t, alice, bob, map[string]string{"notes.txt": "first", "sub/data.bin": strings.Repeat("x", 10000)})
+
+	// An edit on the other side comes back
+	write(t, bob, "notes.txt", "second", 30*time.Minute)
+	round(t, bob, alice)
+	same(t, alice, bob, map[string]string{"notes.txt": "second", "sub/data.bin": strings.Repeat("x", 10000)})
+
+	// So does a removal
+	if err := os.Remove(filepath.Join(alice.root, "sub", "data.bin")); err != nil {
+		t.Fatal(err)
+	}
+	round(t, alice, bob)
+	same(t, alice, bob, map[string]string{"notes.txt": "second"})
+
+	// Nothing happens without changes
+	round(t, alice, bob, alice, bob)
+	same(t, alice, bob, map[string]string{"notes.txt": "second"})
+}
+
+func TestConflict(t *testing.T) {
+	alice, bob := pair(t)
+	write(t, alice, "notes.txt", "first", time.Hour)
+	round(t, alice, bob)
+
+	// Both edit, bob later, so alice's edit becomes the conflict copy
+	write(t, alice, "notes.txt", "alice's", 20*time.Minute)
+	write(t, bob, "notes.txt", "bob's", 10*time.Minute)
+	round(t, alice, bob, alice, bob, alice, bob)
+	same(t, alice, bob, map[string]string{"notes.txt": "bob's", "notes.sync-conflict": "alice's"})
+
+	// Edits win over removals
+	if err := os.Remove(filepath.Join(bob.root, "notes.txt")); err != nil {
+		t.Fatal(err)
+	}
+	write(t, alice, "notes.txt", "kept", 0)
+	round(t, alice, bob, alice, bob)
+	same(t, alice, bob, map[string]string{"notes.txt": "kept", "notes.sync-conflict": "alice's"})
+}
+
+func TestUntrusted(t *testing.T) {
+	var tests = []struct {
+		name  string
+		setup func(bob *Folder)
+	}{
+		{"OtherPeer", func(bob *Folder) { bob.with = bob.p.Node.ID() }},
+		{"OtherLabel", func(bob *Folder) { bob.opts.Label = "private" }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alice, bob := pair(t)
+			write(t, bob, "secret.txt", "secret", time.Hour)
+			tt.setup(bob)
+			if err := alice.Sync(context.Background()); err == nil {
+				t.Error("sync with a peer not trusting us went through")
+			}
+			if _, err := os.Stat(filepath.Join(alice.root, "secret.txt")); !os.IsNotExist(err) {
+				t.Error("file fetched without trust")
+			}
+		})
+	}
+}
+
+// TestServed has alice ask bob for files directly, which bob only serves if
+// they're in his index and not reached through a symlink.
+func TestServed(t *testing.T) {
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "data.txt"), []byte("secret"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	scan := func(f *Folder) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if _, err := f.scan(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tests = []struct {
+		name   string
+		file   string                          // Written and indexed by bob
+		ask    string                          // What alice asks for
+		setup  func(t *testing.T, bob *Folder) // Run after the file was indexed
+		served bool
+	}{
+		{"indexed", "notes.txt", "notes.txt", func(t *testing.T, bob *Folder) {}, true},
+		{"not indexed", "notes.txt", "later.txt", func(t *testing.T, bob *Folder) {
+			write(t, bob, "later.txt", "later", 0)
+		}, false},
+		{"deleted", "gone.txt", "gone.txt", func(t *testing.T, bob *Folder) {
+			os.Remove(filepath.Join(bob.root, "gone.txt"))
+			scan(bob)
+			write(t, bob, "gone.txt", "back", 0)
+		}, false},
+		{"symlink", "swapped.txt", "swapped.txt", func(t *testing.T, bob *Folder) {
+			path := filepath.Join(bob.root, "swapped.txt")
+			os.Remove(path)
+			if err := os.Symlink(filepath.Join(outside, "data.txt"), path); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+		{"linked directory", "sub/data.txt", "sub/data.txt", func(t *testing.T, bob *Folder) {
+			sub := filepath.Join(bob.root, "sub")
+			os.RemoveAll(sub)
+			if err := os.Symlink(outside, sub); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alice, bob := pair(t)
+			write(t, bob, tt.file, "shared", time.Hour)
+			scan(bob)
+			tt.setup(t, bob)
+
+			ctx := context.Background()
+			stream, err := alice.p.Node.NewStream(ctx, bob.p.Node.ID(), FileProtocolID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer stream.Reset()
+			if _, err := stream.Write(pb.Marshal(&pb.FileRequest{Folder: bob.opts.Label, Name: tt.ask})); err != nil {
+				t.Fatal(err)
+			}
+			index := pb.Index{}
+			if err := pb.Read(stream, &index); err != nil {
+				t.Fatal(err)
+			}
+			if served := len(index.GetSha256()) > 0; served != tt.served {
+				t.Errorf("served: %v, want %v", served, tt.served)
+			}
+		})
+	}
+}
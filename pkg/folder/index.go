@@ -0,0 +1,167 @@
+package folder
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/Azanul/peer-pressure/pkg/dirwalk"
+	"github.com/Azanul/peer-pressure/pkg/pressure/pb"
+)
+
+// StateDir is kept in the root of a synchronized folder. It holds the index
+// and the files being fetched, and is never synchronized itself.
+const StateDir = ".ppsync"
+
+const indexFile = "index"
+
+func (f *Folder) indexPath() string {
+	return filepath.Join(f.root, StateDir, indexFile)
+}
+
+func (f *Folder) loadIndex() error {
+	data, err := os.ReadFile(f.indexPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	index := pb.FolderIndex{}
+	err = proto.Unmarshal(data, &index)
+	if err != nil {
+		return err
+	}
+	for _, v := range index.GetFiles() {
+		f.files[v.GetName()] = v
+	}
+	return nil
+}
+
+// saveIndex writes the index, replacing the old one only once the new one
+// is complete.
+func (f *Folder) saveIndex() error {
+	data, err := proto.Marshal(f.snapshot())
+	if err != nil {
+		return err
+	}
+	path := f.indexPath()
+	err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(path+".new", data, 0666)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".new", path)
+}
+
+// snapshot returns the index sorted by name, f.mu has to be held.
+func (f *Folder) snapshot() *pb.FolderIndex {
+	index := &pb.FolderIndex{}
+	for _, v := range f.files {
+		index.Files = append(index.Files, v)
+	}
+	sort.Slice(index.Files, func(i, j int) bool {
+		return index.Files[i].GetName() < index.Files[j].GetName()
+	})
+	return index
+}
+
+// scan brings the index up to date with the folder, giving every file
+// changed or removed since the last scan a new version. Files whose size,
+// mtime and mode are as indexed aren't read again. It reports whether
+// anything changed, f.mu has to be held.
+func (f *Folder) scan() (bool, error) {
+	entries, err := dirwalk.Walk(f.root, dirwalk.Options{
+		Symlinks:  dirwalk.Skip,
+		Hardlinks: dirwalk.Follow,
+		Exclude:   []string{"/" + StateDir + "/"},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	changed := false
+	seen := map[string]bool{}
+	for _, e := range entries {
+		_, name, _ := strings.Cut(e.Name, "/")
+		info, err := os.Stat(e.Path)
+		if err != nil {
+			continue // Gone since the walk, the next scan records it
+		}
+		seen[name] = true
+		mode := uint32(info.Mode().Perm())
+		old := f.files[name]
+		if old != nil && !old.GetDeleted() && old.GetSize() == info.Size() &&
+			old.GetMtime() == info.ModTime().UnixNano() && old.GetMode() == mode {
+			continue
+		}
+
+		sum, err := hashFile(e.Path)
+		if err != nil {
+			log.Warnf("Not synchronizing %s: %v", e.Path, err)
+			continue
+		}
+		v := &pb.FileVersion{
+			Name:   name,
+			Sha256: sum,
+			Size:   info.Size(),
+			Mtime:  info.ModTime().UnixNano(),
+			Mode:   mode,
+		}
+		if old != nil && !old.GetDeleted() && bytes.Equal(old.GetSha256(), sum) && old.GetMode() == mode {
+			v.Version = old.GetVersion() // Only touched
+		} else {
+			v.Version = bump(old.GetVersion(), f.id)
+			changed = true
+		}
+		f.files[name] = v
+	}
+
+	for name, v := range f.files {
+		if !v.GetDeleted() && !seen[name] {
+			f.files[name] = &pb.FileVersion{
+				Name:    name,
+				Mtime:   time.Now().UnixNano(),
+				Deleted: true,
+				Version: bump(v.GetVersion(), f.id),
+			}
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+// unchanged reports whether the file at path is still the one indexed as v,
+// so it can be replaced without losing changes.
+func unchanged(path string, v *pb.FileVersion) bool {
+	info, err := os.Lstat(path)
+	if v == nil || v.GetDeleted() {
+		return os.IsNotExist(err)
+	}
+	return err == nil && info.Mode().IsRegular() && info.Size() == v.GetSize() &&
+		info.ModTime().UnixNano() == v.GetMtime()
+}
+
+func hashFile(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	digest := sha256.New()
+	_, err = io.Copy(digest, file)
+	if err != nil {
+		return nil, err
+	}
+	return digest.Sum(nil), nil
+}
@@ -0,0 +1,82 @@
+package folder
+
+import "github.com/Azanul/peer-pressure/pkg/pressure/pb"
+
+// Order is how two versions of a file relate.
+type Order int8
+
+const (
+	Equal      Order = iota
+	Newer            // Has seen every change of the other and more
+	Older            // The other has seen every change of this one and more
+	Concurrent       // Both have changes the other hasn't seen, a conflict
+)
+
+// Compare orders the version vector a against b.
+func Compare(a, b []*pb.Counter) Order {
+	newer, older := false, false
+	for _, c := range a {
+		if v := value(b, c.GetId()); c.GetValue() > v {
+			newer = true
+		} else if c.GetValue() < v {
+			older = true
+		}
+	}
+	for _, c := range b {
+		if c.GetValue() > value(a, c.GetId()) {
+			older = true
+		}
+	}
+	switch {
+	case newer && older:
+		return Concurrent
+	case newer:
+		return Newer
+	case older:
+		return Older
+	}
+	return Equal
+}
+
+// Merge returns the version that has seen the changes of both a and b.
+func Merge(a, b []*pb.Counter) []*pb.Counter {
+	merged := clone(a)
+	for _, c := range b {
+		if c.GetValue() > value(merged, c.GetId()) {
+			merged = set(merged, c.GetId(), c.GetValue())
+		}
+	}
+	return merged
+}
+
+// bump returns version with one more change made by the node id.
+func bump(version []*pb.Counter, id string) []*pb.Counter {
+	return set(clone(version), id, value(version, id)+1)
+}
+
+func value(version []*pb.Counter, id string) uint64 {
+	for _, c := range version {
+		if c.GetId() == id {
+			return c.GetValue()
+		}
+	}
+	return 0
+}
+
+func set(version []*pb.Counter, id string, v uint64) []*pb.Counter {
+	for _, c := range version {
+		if c.GetId() == id {
+			c.Value = v
+			return version
+		}
+	}
+	return append(version, &pb.Counter{Id: id, Value: v})
+}
+
+func clone(version []*pb.Counter) []*pb.Counter {
+	cloned := make([]*pb.Counter, len(version))
+	for i, c := range version {
+		cloned[i] = &pb.Counter{Id: c.GetId(), Value: c.GetValue()}
+	}
+	return cloned
+}
@@ -0,0 +1,187 @@
+package gateway
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Azanul/peer-pressure/pkg/streamio"
+)
+
+// Scheduler is content fetched as it's read, like a streamio.RemoteFile,
+// whose fetch order the gateway steers.
+type Scheduler interface {
+	Prioritize(off, length int64)
+	SetSchedule(schedule streamio.Schedule)
+	SetReadAhead(chunks int32)
+}
+
+// Server exposes a file that is still being received over HTTP. Range
+// requests from media players are answered by reading through to the
+// attached content, so playback can start and seek before the whole file
+// has arrived. Content that is a Scheduler fetches the requested range
+// ahead of the rest, in the schedule set on the server.
+type Server struct {
+	mu        sync.RWMutex
+	name      string
+	content   io.ReaderAt
+	size      int64
+	schedule  streamio.Schedule
+	readAhead int32 // Chunks, streamio.DefaultReadAhead if 0
+	ln        net.Listener
+	srv       *http.Server
+}
+
+// Listen starts serving on addr. Requests are answered with 503 until
+// content is attached.
+func Listen(addr string) (*Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{ln: ln, schedule: streamio.Stream}
+	s.srv = &http.Server{
+		Handler:           s,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		err := s.srv.Serve(ln)
+		if err != nil && err != http.ErrServerClosed {
+			log.Errorln("Gateway stopped:", err)
+		}
+	}()
+	return s, nil
+}
+
+func (s *Server) URL() string {
+	return "http://" + s.ln.Addr().String() + "/"
+}
+
+// Attach sets the file served by the gateway.
+func (s *Server) Attach(name string, content io.ReaderAt, size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.name = name
+	s.content = content
+	s.size = size
+	if sched, ok := content.(Scheduler); ok {
+		sched.SetSchedule(s.schedule)
+		if s.readAhead > 0 {
+			sched.SetReadAhead(s.readAhead)
+		}
+	}
+}
+
+// Schedule returns the order the content is fetched in.
+func (s *Server) Schedule() streamio.Schedule {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.schedule
+}
+
+// SetSchedule switches the order the content is fetched in, streamio.Stream
+// by default, for this file and the ones attached later.
+func (s *Server) SetSchedule(schedule streamio.Schedule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.schedule = schedule
+	if sched, ok := s.content.(Scheduler); ok {
+		sched.SetSchedule(schedule)
+	}
+}
+
+// ReadAhead returns how many chunks past the playhead are kept fetched in
+// the streamio.Stream schedule.
+func (s *Server) ReadAhead() int32 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.readAhead == 0 {
+		return streamio.DefaultReadAhead
+	}
+	return s.readAhead
+}
+
+// SetReadAhead sets how many chunks past the playhead are kept fetched in
+// the streamio.Stream schedule.
+func (s *Server) SetReadAhead(chunks int32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readAhead = chunks
+	if sched, ok := s.content.(Scheduler); ok {
+		sched.SetReadAhead(chunks)
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	name, content, size := s.name, s.content, s.size
+	s.mu.RUnlock()
+
+	if content == nil {
+		http.Error(w, "waiting for sender", http.StatusServiceUnavailable)
+		return
+	}
+	log.Debugf("Gateway %s %s range=%q", r.Method, r.URL.Path, r.Header.Get("Range"))
+	if sched, ok := content.(Scheduler); ok {
+		if off, length, ok := seekRange(r.Header.Get("Range"), size); ok {
+			// A seek, fetched before what the player had buffered so far
+			sched.Prioritize(off, length)
+		}
+	}
+
+	// ServeContent takes care of Range and If-Range handling, every read it
+	// makes ends up as a chunk request for the missing parts of the file.
+	http.ServeContent(w, r, name, time.Time{}, io.NewSectionReader(content, 0, size))
+}
+
+// seekRange returns the bytes to fetch first for a Range header, the first
+// range of it, for content of size bytes. A range open to the end only moves
+// the playhead, the read-ahead takes care of the rest. Malformed headers are
+// left for http.ServeContent to reject.
+func seekRange(header string, size int64) (int64, int64, bool) {
+	if !strings.HasPrefix(header, "bytes=") {
+		return 0, 0, false
+	}
+	spec, _, _ := strings.Cut(strings.TrimPrefix(header, "bytes="), ",")
+	from, to, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, 0, false
+	}
+	if from == "" {
+		// The last to bytes
+		n, err := strconv.ParseInt(to, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, true
+	}
+	off, err := strconv.ParseInt(from, 10, 64)
+	if err != nil || off < 0 || off >= size {
+		return 0, 0, false
+	}
+	if to == "" {
+		return off, 1, true
+	}
+	end, err := strconv.ParseInt(to, 10, 64)
+	if err != nil || end < off {
+		return 0, 0, false
+	}
+	if end >= size {
+		end = size - 1
+	}
+	return off, end - off + 1, true
+}
+
+func (s *Server) Close() error {
+	return s.srv.Close()
+}
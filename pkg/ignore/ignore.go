@@ -0,0 +1,155 @@
+// Package ignore matches paths against gitignore-style patterns.
+package ignore
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// pattern is one parsed line, relative to the directory base.
+type pattern struct {
+	base     string   // Slash separated, "" for the top
+	segments []string // The glob split at slashes
+	negate   bool     // "!" in front, re-includes what matched before
+	dirOnly  bool     // "/" at the end, only matches directories
+	anchored bool     // A slash other than at the end, matches from base only
+}
+
+// Matcher holds patterns and tells which paths they leave out. The zero
+// value ignores nothing.
+//
+// The syntax is that of .gitignore: "#" starts a comment, "!" negates, a
+// trailing "/" only matches directories, a pattern with a slash elsewhere is
+// relative to its base and one without matches at any depth. Globs are those
+// of path.Match, plus "**" for any number of directories. Later patterns
+// win over earlier ones.
+type Matcher struct {
+	patterns []pattern
+}
+
+// Add adds a pattern written in the directory base, slash separated and
+// relative to the paths later passed to Match. Blank lines and comments are
+// skipped.
+func (m *Matcher) Add(line, base string) error {
+	line = strings.TrimSuffix(line, "\r")
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil
+	}
+
+	orig := line
+	p := pattern{base: strings.Trim(base, "/")}
+	if strings.HasPrefix(line, "!") {
+		p.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	p.anchored = strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if line == "" {
+		return fmt.Errorf("invalid pattern %q", orig)
+	}
+	for _, seg := range strings.Split(line, "/") {
+		if _, err := path.Match(seg, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", orig, err)
+		}
+		// Runs of "**" match no more than one, and would only slow matching down
+		if seg == "**" && len(p.segments) > 0 && p.segments[len(p.segments)-1] == "**" {
+			continue
+		}
+		p.segments = append(p.segments, seg)
+	}
+	m.patterns = append(m.patterns, p)
+	return nil
+}
+
+// Read adds the patterns of an ignore file, see Add.
+func (m *Matcher) Read(r io.Reader, base string) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		err := m.Add(scanner.Text(), base)
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// ReadFile adds the patterns of the ignore file at file if there is one.
+func (m *Matcher) ReadFile(file, base string) error {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = m.Read(f, base)
+	if err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	return nil
+}
+
+// Match reports whether name, slash separated, is ignored by the last
+// pattern matching it, and whether any pattern matched at all. A directory
+// being ignored doesn't ignore what's inside, callers are expected to not
+// look into it in the first place.
+func (m *Matcher) Match(name string, isDir bool) (ignored, matched bool) {
+	for i := len(m.patterns) - 1; i >= 0; i-- {
+		if m.patterns[i].match(name, isDir) {
+			return !m.patterns[i].negate, true
+		}
+	}
+	return false, false
+}
+
+func (p pattern) match(name string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	if p.base != "" {
+		if !strings.HasPrefix(name, p.base+"/") {
+			return false
+		}
+		name = name[len(p.base)+1:]
+	}
+	names := strings.Split(name, "/")
+	if !p.anchored {
+		names = names[len(names)-1:]
+	}
+	return matchSegments(p.segments, names)
+}
+
+// matchSegments matches names segment by segment, "**" standing for any
+// number of them, at least one at the end.
+func matchSegments(segments, names []string) bool {
+	if len(segments) == 0 {
+		return len(names) == 0
+	}
+	if segments[0] == "**" {
+		if len(segments) == 1 {
+			return len(names) > 0
+		}
+		for i := 0; i <= len(names); i++ {
+			if matchSegments(segments[1:], names[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(names) == 0 {
+		return false
+	}
+	ok, _ := path.Match(segments[0], names[0])
+	return ok && matchSegments(segments[1:], names[1:])
+}
@@ -0,0 +1,76 @@
+package ignore
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	var tests = []struct {
+		name     string
+		patterns string
+		base     string
+		path     string
+		isDir    bool
+		want     bool
+	}{
+		{"Basename", "node_modules", "", "web/node_modules", true, true},
+		{"BasenameFile", "*.o", "", "a/b/c.o", false, true},
+		{"NoMatch", "*.o", "", "a/b/c.go", false, false},
+		{"Comment", "# *.go", "", "main.go", false, false},
+		{"EscapedHash", `\#notes`, "", "#notes", false, true},
+		{"TrailingSpace", "*.log  ", "", "x.log", false, true},
+		{"DirOnly", "build/", "", "build", true, true},
+		{"DirOnlyFile", "build/", "", "build", false, false},
+		{"Anchored", "/build", "", "build", true, true},
+		{"AnchoredDeep", "/build", "", "src/build", true, false},
+		{"Slash", "doc/*.txt", "", "doc/a.txt", false, true},
+		{"SlashDeep", "doc/*.txt", "", "doc/sub/a.txt", false, false},
+		{"LeadingStars", "**/cache", "", "a/b/cache", true, true},
+		{"LeadingStarsTop", "**/cache", "", "cache", true, true},
+		{"MiddleStars", "a/**/z", "", "a/b/c/z", false, true},
+		{"MiddleStarsNone", "a/**/z", "", "a/z", false, true},
+		{"TrailingStars", "a/**", "", "a/b", false, true},
+		{"TrailingStarsSelf", "a/**", "", "a", true, false},
+		{"Negate", "*.log\n!keep.log", "", "keep.log", false, false},
+		{"NegateThenIgnore", "!keep.log\n*.log", "", "keep.log", false, true},
+		{"Base", "*.tmp", "sub", "sub/x.tmp", false, true},
+		{"OutsideBase", "*.tmp", "sub", "other/x.tmp", false, false},
+		{"AnchoredBase", "/out", "sub", "sub/out", true, true},
+		{"Class", "[ab].txt", "", "b.txt", false, true},
+		{"CRLF", "*.bak\r", "", "x.bak", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := Matcher{}
+			if err := m.Read(strings.NewReader(tt.patterns), tt.base); err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := m.Match(tt.path, tt.isDir); got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddInvalid(t *testing.T) {
+	for _, line := range []string{"[", "/", "!"} {
+		m := Matcher{}
+		if err := m.Add(line, ""); err == nil {
+			t.Errorf("%q accepted", line)
+		}
+	}
+}
+
+func FuzzMatch(f *testing.F) {
+	f.Add("a/**/b", "a/x/y/b")
+	f.Add("!*.go", "main.go")
+	f.Fuzz(func(t *testing.T, pattern, name string) {
+		m := Matcher{}
+		if m.Add(pattern, "") != nil {
+			return
+		}
+		m.Match(name, false)
+	})
+}
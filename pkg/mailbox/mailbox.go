@@ -0,0 +1,336 @@
+// Package mailbox keeps letters, blobs sealed for nodes that may be offline,
+// until the nodes collect them or the letters expire. A mailbox can't read
+// the letters it holds, see package seal.
+package mailbox
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Defaults of a mailbox node
+const (
+	DefaultTTL   = 7 * 24 * time.Hour // How long letters are held when no TTL is set
+	DefaultQuota = 1 << 30            // Most bytes held for one recipient
+	DefaultTotal = 10 << 30           // Most bytes held for all recipients together
+)
+
+// Files kept for a recipient, in a directory named after its peer ID
+const (
+	letterExt = ".json"
+	blobExt   = ".blob"
+	keyFile   = "key"
+)
+
+var (
+	ErrQuota    = errors.New("mailbox full")
+	ErrNoLetter = errors.New("no such letter")
+	ErrNoKey    = errors.New("public key of the recipient unknown to the mailbox")
+)
+
+// Letter describes a blob held for a recipient.
+type Letter struct {
+	ID      string
+	To      peer.ID
+	From    peer.ID
+	Key     []byte // Key the blob is sealed under, wrapped for the recipient
+	Size    int64
+	Expires time.Time
+}
+
+// Mailbox holds letters in Dir.
+type Mailbox struct {
+	Dir   string
+	TTL   time.Duration // DefaultTTL if 0
+	Quota int64         // Most bytes held for one recipient, 0 for no limit
+	Total int64         // Most bytes held for all recipients together, 0 for no limit
+
+	mu      sync.Mutex
+	pending map[peer.ID]int64 // Bytes of the letters being put, by recipient
+}
+
+// New returns the mailbox kept in dir.
+func New(dir string, ttl time.Duration, quota, total int64) *Mailbox {
+	return &Mailbox{Dir: dir, TTL: ttl, Quota: quota, Total: total}
+}
+
+func (m *Mailbox) ttl() time.Duration {
+	if m.TTL == 0 {
+		return DefaultTTL
+	}
+	return m.TTL
+}
+
+func (m *Mailbox) dir(to peer.ID) string {
+	return filepath.Join(m.Dir, to.String())
+}
+
+// Put stores the size bytes of r as a letter from one node to another,
+// sealed under key. The letter expires after the TTL of the mailbox.
+func (m *Mailbox) Put(to, from peer.ID, key []byte, size int64, r io.Reader, now time.Time) (Letter, error) {
+	err := m.reserve(to, size, now)
+	if err != nil {
+		return Letter{}, err
+	}
+	defer m.release(to, size)
+
+	l := Letter{ID: newID(now), To: to, From: from, Key: key, Size: size, Expires: now.Add(m.ttl())}
+	dir := m.dir(to)
+	err = os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return Letter{}, err
+	}
+	blob := filepath.Join(dir, l.ID+blobExt)
+	f, err := os.Create(blob)
+	if err != nil {
+		return Letter{}, err
+	}
+	_, err = io.CopyN(f, r, size)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		// The letter is only there once described
+		err = writeJSON(filepath.Join(dir, l.ID+letterExt), l)
+	}
+	if err != nil {
+		os.Remove(blob)
+		return Letter{}, err
+	}
+	return l, nil
+}
+
+// Fits returns ErrQuota if a letter of size bytes for to would go over the
+// quota of to or the total, for refusing it before it's sent.
+func (m *Mailbox) Fits(to peer.ID, size int64, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.fits(to, size, now)
+}
+
+func (m *Mailbox) fits(to peer.ID, size int64, now time.Time) error {
+	if m.Quota > 0 {
+		letters, err := m.List(to, now)
+		if err != nil {
+			return err
+		}
+		held := m.pending[to]
+		for _, l := range letters {
+			held += l.Size
+		}
+		if held+size > m.Quota {
+			return fmt.Errorf("%w for the recipient: %d of %d bytes held", ErrQuota, held, m.Quota)
+		}
+	}
+	if m.Total > 0 {
+		held, err := m.held(now)
+		if err != nil {
+			return err
+		}
+		for _, n := range m.pending {
+			held += n
+		}
+		if held+size > m.Total {
+			return fmt.Errorf("%w: %d of %d bytes held", ErrQuota, held, m.Total)
+		}
+	}
+	return nil
+}
+
+// held returns the bytes of the letters held for all recipients that haven't
+// expired by now.
+func (m *Mailbox) held(now time.Time) (int64, error) {
+	names, err := filepath.Glob(filepath.Join(m.Dir, "*", "*"+letterExt))
+	if err != nil {
+		return 0, err
+	}
+	var held int64
+	for _, name := range names {
+		var l Letter
+		if readJSON(name, &l) == nil && now.Before(l.Expires) {
+			held += l.Size
+		}
+	}
+	return held, nil
+}
+
+// reserve counts size bytes against the quota of to and the total until
+// released.
+func (m *Mailbox) reserve(to peer.ID, size int64, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Quota == 0 && m.Total == 0 {
+		return nil
+	}
+	err := m.fits(to, size, now)
+	if err != nil {
+		return err
+	}
+	if m.pending == nil {
+		m.pending = map[peer.ID]int64{}
+	}
+	m.pending[to] += size
+	return nil
+}
+
+func (m *Mailbox) release(to peer.ID, size int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Quota == 0 && m.Total == 0 {
+		return
+	}
+	m.pending[to] -= size
+	if m.pending[to] == 0 {
+		delete(m.pending, to)
+	}
+}
+
+// newID returns a letter ID, IDs sort in the order letters were put.
+func newID(now time.Time) string {
+	var r [4]byte
+	rand.Read(r[:])
+	return fmt.Sprintf("%016x%08x", now.UnixNano(), binary.BigEndian.Uint32(r[:]))
+}
+
+// List returns the letters held for to that haven't expired by now, oldest
+// first.
+func (m *Mailbox) List(to peer.ID, now time.Time) ([]Letter, error) {
+	names, err := filepath.Glob(filepath.Join(m.dir(to), "*"+letterExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	var letters []Letter
+	for _, name := range names {
+		var l Letter
+		err := readJSON(name, &l)
+		if err != nil {
+			log.Warnf("Skipping letter %s: %v", name, err)
+			continue
+		}
+		if now.Before(l.Expires) {
+			letters = append(letters, l)
+		}
+	}
+	return letters, nil
+}
+
+// Open opens the blob of a letter for reading.
+func (m *Mailbox) Open(l Letter) (*os.File, error) {
+	f, err := os.Open(filepath.Join(m.dir(l.To), l.ID+blobExt))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrNoLetter, l.ID)
+	}
+	return f, err
+}
+
+// Remove drops a letter, once collected.
+func (m *Mailbox) Remove(l Letter) error {
+	dir := m.dir(l.To)
+	err := os.Remove(filepath.Join(dir, l.ID+letterExt))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%w: %s", ErrNoLetter, l.ID)
+	} else if err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(dir, l.ID+blobExt))
+}
+
+// Expire drops the letters that expired by now and returns how many.
+func (m *Mailbox) Expire(now time.Time) (int, error) {
+	names, err := filepath.Glob(filepath.Join(m.Dir, "*", "*"+letterExt))
+	if err != nil {
+		return 0, err
+	}
+	expired := 0
+	for _, name := range names {
+		var l Letter
+		err := readJSON(name, &l)
+		if err != nil || now.Before(l.Expires) {
+			continue
+		}
+		err = m.Remove(l)
+		if err != nil {
+			return expired, err
+		}
+		expired++
+	}
+
+	// Leftovers of puts cut short by a crash
+	blobs, err := filepath.Glob(filepath.Join(m.Dir, "*", "*"+blobExt))
+	if err != nil {
+		return expired, err
+	}
+	for _, blob := range blobs {
+		letter := strings.TrimSuffix(blob, blobExt) + letterExt
+		info, err := os.Stat(blob)
+		if _, letterErr := os.Stat(letter); os.IsNotExist(letterErr) && err == nil && now.Sub(info.ModTime()) > m.ttl() {
+			os.Remove(blob)
+		}
+	}
+	return expired, nil
+}
+
+// SaveKey remembers the public key of the node id, for senders to seal
+// letters to it.
+func (m *Mailbox) SaveKey(id peer.ID, pub crypto.PubKey) error {
+	data, err := crypto.MarshalPublicKey(pub)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(m.dir(id), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(m.dir(id), keyFile), data, 0666)
+}
+
+// Key returns the public key saved for the node id, see SaveKey.
+func (m *Mailbox) Key(id peer.ID) (crypto.PubKey, error) {
+	data, err := os.ReadFile(filepath.Join(m.dir(id), keyFile))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrNoKey, id)
+	} else if err != nil {
+		return nil, err
+	}
+	return crypto.UnmarshalPublicKey(data)
+}
+
+func writeJSON(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, data, 0666)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func readJSON(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
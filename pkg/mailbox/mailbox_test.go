@@ -0,0 +1,107 @@
+package mailbox
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func newPeer(t *testing.T) (peer.ID, crypto.PubKey) {
+	t.Helper()
+	_, pub, err := crypto.GenerateKeyPair(crypto.Ed25519, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id, pub
+}
+
+func TestMailbox(t *testing.T) {
+	alice, _ := newPeer(t)
+	bob, bobKey := newPeer(t)
+	carol, _ := newPeer(t)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	m := New(t.TempDir(), time.Hour, 10, 17)
+
+	var tests = []struct {
+		name string
+		to   peer.ID
+		blob string
+		at   time.Duration // After now
+		err  error
+	}{
+		{"first", bob, "hello", 0, nil},
+		{"second", bob, "world", time.Minute, nil},
+		{"over quota", bob, "!", 2 * time.Minute, ErrQuota},
+		{"other recipient", carol, "hi", 3 * time.Minute, nil},
+		{"over the total", carol, "abcdef", 4 * time.Minute, ErrQuota},
+		{"cut short", carol, "", 4 * time.Minute, io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			size := int64(len(tt.blob))
+			if tt.err == io.EOF {
+				size = 5
+			}
+			l, err := m.Put(tt.to, alice, []byte("key"), size, strings.NewReader(tt.blob), now.Add(tt.at))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if err == nil && (l.To != tt.to || l.From != alice || l.Expires != now.Add(tt.at+time.Hour)) {
+				t.Errorf("put %+v", l)
+			}
+		})
+	}
+
+	letters, err := m.List(bob, now.Add(30*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 2 {
+		t.Fatalf("got %d letters for bob, want 2", len(letters))
+	}
+	f, err := m.Open(letters[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(f)
+	f.Close()
+	if string(data) != "hello" || string(letters[0].Key) != "key" {
+		t.Errorf("got %q sealed under %q first", data, letters[0].Key)
+	}
+
+	if err := m.Remove(letters[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Remove(letters[0]); !errors.Is(err, ErrNoLetter) {
+		t.Errorf("removed a letter twice: %v", err)
+	}
+	if letters, _ := m.List(carol, now.Add(time.Hour+3*time.Minute)); len(letters) != 0 {
+		t.Errorf("expired letters listed: %+v", letters)
+	}
+	expired, err := m.Expire(now.Add(time.Hour + 2*time.Minute))
+	if err != nil || expired != 1 {
+		t.Errorf("got %d expired, %v, want 1", expired, err)
+	}
+	if letters, _ := m.List(carol, now); len(letters) != 1 {
+		t.Errorf("letter for carol expired early: %+v", letters)
+	}
+
+	if _, err := m.Key(bob); !errors.Is(err, ErrNoKey) {
+		t.Errorf("got %v for an unknown key", err)
+	}
+	if err := m.SaveKey(bob, bobKey); err != nil {
+		t.Fatal(err)
+	}
+	if key, err := m.Key(bob); err != nil || !key.Equals(bobKey) {
+		t.Errorf("got %v, %v, want the saved key", key, err)
+	}
+}
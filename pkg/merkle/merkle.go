@@ -0,0 +1,93 @@
+// Package merkle builds binary hash trees over the chunk digests of a file,
+// so that a chunk can be checked against the root on its own, with a proof
+// of a few hashes rather than the digests of every other chunk.
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+)
+
+// Tree is a hash tree whose leaves are the SHA-256 digests of the chunks.
+// An inner node is the SHA-256 of a 0x01 byte and its two children, a node
+// left without a sibling moves up a level as it is.
+type Tree struct {
+	levels [][][]byte // levels[0] holds the leaves, the last level the root
+}
+
+// New builds the tree over leaves.
+func New(leaves [][]byte) *Tree {
+	t := &Tree{levels: [][][]byte{leaves}}
+	for level := leaves; len(level) > 1; {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+			} else {
+				next = append(next, node(level[i], level[i+1]))
+			}
+		}
+		t.levels = append(t.levels, next)
+		level = next
+	}
+	return t
+}
+
+func node(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// Root returns the root of the tree over leaves.
+func Root(leaves [][]byte) []byte {
+	return New(leaves).Root()
+}
+
+// Root returns the root of the tree, nil if it has no leaves.
+func (t *Tree) Root() []byte {
+	top := t.levels[len(t.levels)-1]
+	if len(top) == 0 {
+		return nil
+	}
+	return top[0]
+}
+
+// Proof returns the siblings on the way from leaf i up to the root, bottom
+// first.
+func (t *Tree) Proof(i int) [][]byte {
+	var proof [][]byte
+	for _, level := range t.levels[:len(t.levels)-1] {
+		if sibling := i ^ 1; sibling < len(level) {
+			proof = append(proof, level[sibling])
+		}
+		i /= 2
+	}
+	return proof
+}
+
+// Verify reports whether leaf is leaf i of the n leaves of the tree with the
+// given root, proof being what Tree.Proof returned for it.
+func Verify(root, leaf []byte, i, n int, proof [][]byte) bool {
+	if i < 0 || i >= n || len(leaf) != sha256.Size {
+		return false
+	}
+	sum := leaf
+	for width := n; width > 1; width = (width + 1) / 2 {
+		if sibling := i ^ 1; sibling < width {
+			if len(proof) == 0 || len(proof[0]) != sha256.Size {
+				return false
+			}
+			if i%2 == 0 {
+				sum = node(sum, proof[0])
+			} else {
+				sum = node(proof[0], sum)
+			}
+			proof = proof[1:]
+		}
+		i /= 2
+	}
+	return len(proof) == 0 && bytes.Equal(sum, root)
+}
@@ -0,0 +1,65 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"testing"
+)
+
+func leaves(n int) [][]byte {
+	var l [][]byte
+	for i := 0; i < n; i++ {
+		sum := sha256.Sum256([]byte(fmt.Sprint(i)))
+		l = append(l, sum[:])
+	}
+	return l
+}
+
+func TestVerify(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 5, 8, 13, 64} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			l := leaves(n)
+			tree := New(l)
+			root := tree.Root()
+			for i := range l {
+				proof := tree.Proof(i)
+				if !Verify(root, l[i], i, n, proof) {
+					t.Fatalf("leaf %d doesn't verify", i)
+				}
+				if Verify(root, l[(i+1)%n], i, n, proof) && n > 1 {
+					t.Errorf("leaf %d verifies in place of leaf %d", (i+1)%n, i)
+				}
+				if i^1 < n && Verify(root, l[i], i^1, n, proof) {
+					t.Errorf("leaf %d verifies at %d", i, i^1)
+				}
+				if len(proof) > 0 && Verify(root, l[i], i, n, proof[1:]) {
+					t.Errorf("leaf %d verifies with a short proof", i)
+				}
+			}
+			if Verify(root, l[0], n, n, nil) {
+				t.Error("leaf out of range verifies")
+			}
+		})
+	}
+}
+
+func TestRoot(t *testing.T) {
+	if root := Root(nil); root != nil {
+		t.Errorf("got %x for no leaves, want nil", root)
+	}
+	l := leaves(3)
+	if root := Root(l[:1]); !bytes.Equal(root, l[0]) {
+		t.Errorf("got %x for a single leaf, want the leaf", root)
+	}
+	if want := node(node(l[0], l[1]), l[2]); !bytes.Equal(Root(l), want) {
+		t.Errorf("got %x for 3 leaves, want %x", Root(l), want)
+	}
+}
+
+func BenchmarkNew(b *testing.B) {
+	l := leaves(1 << 16)
+	for i := 0; i < b.N; i++ {
+		New(l)
+	}
+}
@@ -0,0 +1,96 @@
+// Package meta carries file metadata from the sender to the received file.
+package meta
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Azanul/peer-pressure/pkg/pressure/pb"
+)
+
+// ModePolicy decides how the sender's permission bits are applied.
+type ModePolicy string
+
+const (
+	ModeKeep   ModePolicy = ""       // Take the sender's permission bits, the default
+	ModeExec   ModePolicy = "exec"   // Keep our own permissions, executable wherever readable if the sender's owner could execute
+	ModeIgnore ModePolicy = "ignore" // Keep our own permissions
+)
+
+// Policy picks which of the sender's metadata is applied to received files.
+// The zero value applies all of it.
+type Policy struct {
+	Mode       ModePolicy `json:"mode,omitempty"`
+	SkipMtime  bool       `json:"skip_mtime,omitempty"`
+	SkipXattrs bool       `json:"skip_xattrs,omitempty"`
+}
+
+// xattrPrefix limits the extended attributes that are sent and applied to
+// the user namespace. The others hold security labels and the like that only
+// make sense on the host they were set on.
+const xattrPrefix = "user."
+
+// maxXattrs bounds the total size of the extended attributes sent with a
+// file, larger ones are left out.
+const maxXattrs = 64 << 10
+
+// Fill records the metadata of the file at path in index.
+func Fill(index *pb.Index, path string, info os.FileInfo) error {
+	index.Mtime = info.ModTime().UnixNano()
+	index.Mode = uint32(info.Mode().Perm())
+	xattrs, err := listXattrs(path)
+	if err != nil {
+		return err
+	}
+	total := 0
+	for _, x := range xattrs {
+		total += len(x.Name) + len(x.Value)
+		if total > maxXattrs {
+			break
+		}
+		index.Xattrs = append(index.Xattrs, x)
+	}
+	return nil
+}
+
+// Apply gives the file at path the metadata recorded in index, as far as the
+// policy allows.
+func Apply(path string, index *pb.Index, policy Policy) error {
+	if mode := os.FileMode(index.GetMode()).Perm(); mode != 0 && policy.Mode != ModeIgnore {
+		if policy.Mode == ModeExec {
+			info, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			own := info.Mode().Perm()
+			if mode&0100 != 0 {
+				own |= own & 0444 >> 2
+			}
+			mode = own
+		}
+		err := os.Chmod(path, mode)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !policy.SkipXattrs {
+		for _, x := range index.GetXattrs() {
+			if !strings.HasPrefix(x.GetName(), xattrPrefix) {
+				continue
+			}
+			err := setXattr(path, x.GetName(), x.GetValue())
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Last, setting the rest may count as a modification
+	if mtime := index.GetMtime(); mtime != 0 && !policy.SkipMtime {
+		t := time.Unix(0, mtime)
+		return os.Chtimes(path, t, t)
+	}
+	return nil
+}
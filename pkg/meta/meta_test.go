@@ -0,0 +1,56 @@
+package meta
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/Azanul/peer-pressure/pkg/pressure/pb"
+)
+
+func TestApply(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no permission bits on Windows")
+	}
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	index := &pb.Index{Mode: 0750, Mtime: mtime.UnixNano()}
+
+	var tests = []struct {
+		name      string
+		policy    Policy
+		wantMode  os.FileMode
+		wantMtime bool
+	}{
+		{"All", Policy{}, 0750, true},
+		{"Exec", Policy{Mode: ModeExec}, 0755, true},
+		{"IgnoreMode", Policy{Mode: ModeIgnore}, 0644, true},
+		{"SkipMtime", Policy{SkipMtime: true}, 0750, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "file")
+			if err := os.WriteFile(path, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chmod(path, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := Apply(path, index, tt.policy); err != nil {
+				t.Fatal(err)
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != tt.wantMode {
+				t.Errorf("got mode %v, want %v", info.Mode().Perm(), tt.wantMode)
+			}
+			if info.ModTime().Equal(mtime) != tt.wantMtime {
+				t.Errorf("got mtime %v, applied want %t", info.ModTime(), tt.wantMtime)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+//go:build linux
+
+package meta
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/Azanul/peer-pressure/pkg/pressure/pb"
+)
+
+func listXattrs(path string) ([]*pb.Xattr, error) {
+	size, err := unix.Listxattr(path, nil)
+	if errors.Is(err, unix.ENOTSUP) {
+		return nil, nil
+	} else if err != nil || size == 0 {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = unix.Listxattr(path, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	var xattrs []*pb.Xattr
+	for _, name := range strings.Split(string(buf[:size]), "\x00") {
+		if !strings.HasPrefix(name, xattrPrefix) {
+			continue
+		}
+		size, err := unix.Getxattr(path, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, size)
+		size, err = unix.Getxattr(path, name, value)
+		if err != nil {
+			return nil, err
+		}
+		xattrs = append(xattrs, &pb.Xattr{Name: name, Value: value[:size]})
+	}
+	return xattrs, nil
+}
+
+// setXattr sets an extended attribute, filesystems without them are skipped
+// silently.
+func setXattr(path, name string, value []byte) error {
+	err := unix.Setxattr(path, name, value, 0)
+	if errors.Is(err, unix.ENOTSUP) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,53 @@
+//go:build linux
+
+package meta
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/Azanul/peer-pressure/pkg/pressure/pb"
+)
+
+func TestXattrs(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	for _, path := range []string{src, dst} {
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := unix.Setxattr(src, "user.origin", []byte("build 42"), 0); err != nil {
+		t.Skip("no user xattrs on this filesystem:", err)
+	}
+
+	info, err := os.Stat(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := &pb.Index{}
+	if err := Fill(index, src, info); err != nil {
+		t.Fatal(err)
+	}
+	// Only the user namespace is applied, whatever the sender claims
+	index.Xattrs = append(index.Xattrs, &pb.Xattr{Name: "trusted.evil", Value: []byte("x")})
+
+	if err := Apply(dst, index, Policy{SkipXattrs: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unix.Getxattr(dst, "user.origin", nil); err == nil {
+		t.Errorf("xattr applied despite the policy")
+	}
+
+	if err := Apply(dst, index, Policy{}); err != nil {
+		t.Fatal(err)
+	}
+	value := make([]byte, 64)
+	n, err := unix.Getxattr(dst, "user.origin", value)
+	if err != nil || string(value[:n]) != "build 42" {
+		t.Errorf("got %q, %v, want the sender's xattr", value[:n], err)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package meta
+
+import "github.com/Azanul/peer-pressure/pkg/pressure/pb"
+
+// Extended attributes are only carried over on Linux.
+
+func listXattrs(path string) ([]*pb.Xattr, error) {
+	return nil, nil
+}
+
+func setXattr(path, name string, value []byte) error {
+	return nil
+}
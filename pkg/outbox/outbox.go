@@ -0,0 +1,171 @@
+// Package outbox sends the files dropped into a directory, once they're no
+// longer being written.
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Azanul/peer-pressure/pkg/watch"
+)
+
+// SentDir is the subdirectory files are moved to once sent.
+const SentDir = "sent"
+
+const (
+	// DefaultStable is how long a file has to stay the same before it's sent.
+	DefaultStable = 5 * time.Second
+
+	// RetryAfter is how long a file whose send failed is left alone.
+	RetryAfter = time.Minute
+
+	tick = time.Second // Checks for stability while files are pending
+)
+
+// SendFunc sends the file at path.
+type SendFunc func(ctx context.Context, path string) error
+
+// Outbox watches Dir and hands every regular file in it to Send once its
+// size and modification time haven't changed for Stable. Sent files are
+// moved into SentDir, failed ones are retried after RetryAfter. Hidden files
+// and directories are left alone.
+type Outbox struct {
+	Dir     string
+	Stable  time.Duration // DefaultStable if 0
+	Send    SendFunc
+	OnError func(path string, err error) // Told about failed sends, may be nil
+
+	pending map[string]*candidate
+}
+
+// candidate is a file seen in the outbox.
+type candidate struct {
+	size   int64
+	mtime  time.Time
+	since  time.Time // When it was first seen as it is now
+	failed time.Time // When its last send failed
+}
+
+// Run sends files as they become stable until ctx is done.
+func (o *Outbox) Run(ctx context.Context) error {
+	err := os.MkdirAll(filepath.Join(o.Dir, SentDir), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	changes, err := watch.Changes(ctx, o.Dir, func(dir string) bool {
+		return dir != o.Dir // Only the outbox itself
+	})
+	if err != nil {
+		log.Warnf("Not watching %s, checking every %s: %v", o.Dir, tick, err)
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	for {
+		err := o.Poll(ctx, time.Now())
+		if err != nil {
+			return err
+		}
+		tickCh := ticker.C
+		if len(o.pending) == 0 && changes != nil {
+			tickCh = nil // Nothing to wait for but new files
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-changes:
+		case <-tickCh:
+		}
+	}
+}
+
+// Poll looks at the outbox once, as of now, and sends the files that have
+// become stable.
+func (o *Outbox) Poll(ctx context.Context, now time.Time) error {
+	if o.pending == nil {
+		o.pending = map[string]*candidate{}
+	}
+	stable := o.Stable
+	if stable == 0 {
+		stable = DefaultStable
+	}
+
+	dirents, err := os.ReadDir(o.Dir)
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for _, de := range dirents {
+		if !de.Type().IsRegular() || strings.HasPrefix(de.Name(), ".") {
+			continue
+		}
+		info, err := de.Info()
+		if err != nil {
+			continue // Gone already
+		}
+		path := filepath.Join(o.Dir, de.Name())
+		seen[path] = true
+
+		c := o.pending[path]
+		if c == nil || c.size != info.Size() || !c.mtime.Equal(info.ModTime()) {
+			o.pending[path] = &candidate{size: info.Size(), mtime: info.ModTime(), since: now}
+			continue
+		}
+		if now.Sub(c.since) < stable || now.Sub(c.failed) < RetryAfter {
+			continue
+		}
+
+		log.Printf("Sending %s from the outbox", path)
+		err = o.Send(ctx, path)
+		if err == nil {
+			err = moveToSent(path)
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			log.Errorf("Sending %s: %v, retrying in %s", path, err, RetryAfter)
+			c.failed = now
+			if o.OnError != nil {
+				o.OnError(path, err)
+			}
+			continue
+		}
+		delete(o.pending, path)
+	}
+
+	for path := range o.pending {
+		if !seen[path] {
+			delete(o.pending, path)
+		}
+	}
+	return nil
+}
+
+// moveToSent moves a sent file into SentDir, under a name that isn't taken
+// there yet.
+func moveToSent(path string) error {
+	dir := filepath.Join(filepath.Dir(path), SentDir)
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	name := filepath.Base(path)
+	ext := filepath.Ext(name)
+	for i := 0; i < 1000; i++ {
+		target := filepath.Join(dir, name)
+		if i > 0 {
+			target = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), i, ext))
+		}
+		if _, err := os.Lstat(target); os.IsNotExist(err) {
+			return os.Rename(path, target)
+		}
+	}
+	return fmt.Errorf("no free name for %s in %s", name, dir)
+}
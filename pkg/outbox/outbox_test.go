@@ -0,0 +1,75 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPoll(t *testing.T) {
+	dir := t.TempDir()
+	var sent []string
+	fail := false
+	o := &Outbox{
+		Dir:    dir,
+		Stable: 5 * time.Second,
+		Send: func(ctx context.Context, path string) error {
+			if fail {
+				return errors.New("receiver away")
+			}
+			sent = append(sent, filepath.Base(path))
+			return nil
+		},
+	}
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	poll := func(now time.Time, want ...string) {
+		t.Helper()
+		sent = nil
+		if err := o.Poll(context.Background(), now); err != nil {
+			t.Fatal(err)
+		}
+		if len(sent) != len(want) || (len(want) > 0 && !reflect.DeepEqual(sent, want)) {
+			t.Errorf("sent %q, want %q", sent, want)
+		}
+	}
+	start := time.Now()
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+
+	write("scan.pdf", "page 1")
+	write(".scan.tmp", "hidden")
+	poll(at(0))
+	poll(at(3 * time.Second))
+
+	// Still being written, the wait starts over
+	write("scan.pdf", "page 1, page 2")
+	poll(at(4 * time.Second))
+	poll(at(8 * time.Second))
+	poll(at(9*time.Second), "scan.pdf")
+	if _, err := os.Stat(filepath.Join(dir, SentDir, "scan.pdf")); err != nil {
+		t.Errorf("sent file not moved: %v", err)
+	}
+
+	// Failed sends wait before they're retried, a name taken in sent/ gets a new one
+	write("scan.pdf", "another")
+	fail = true
+	poll(at(10 * time.Second))
+	poll(at(20 * time.Second))
+	fail = false
+	poll(at(30 * time.Second))
+	poll(at(20*time.Second+RetryAfter), "scan.pdf")
+	if _, err := os.Stat(filepath.Join(dir, SentDir, "scan (1).pdf")); err != nil {
+		t.Errorf("second file not moved next to the first: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".scan.tmp")); err != nil {
+		t.Errorf("hidden file touched: %v", err)
+	}
+}
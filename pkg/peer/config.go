@@ -0,0 +1,100 @@
+package peer
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Azanul/peer-pressure/pkg/chunkstore"
+	"github.com/Azanul/peer-pressure/pkg/dest"
+	"github.com/Azanul/peer-pressure/pkg/meta"
+	"github.com/Azanul/peer-pressure/pkg/ratelimit"
+)
+
+// Config holds the per node settings, stored as config.json in the node
+// directory.
+type Config struct {
+	ratelimit.Config
+	DownloadDir string              `json:"download_dir,omitempty"` // Where received files go, DefaultDownloads next to the nodes root by default
+	OnCollision dest.Policy         `json:"on_collision,omitempty"` // What to do when a received file already exists
+	NodeQuota   int64               `json:"node_quota,omitempty"`   // Bytes accepted from all peers together, 0 for no limit
+	PeerQuota   int64               `json:"peer_quota,omitempty"`   // Bytes accepted from any one peer, 0 for no limit
+	Metadata    meta.Policy         `json:"metadata,omitempty"`     // Which of the sender's file metadata to apply
+	Trusted     map[string]string   `json:"trusted,omitempty"`      // Peer IDs of the nodes folders may be synchronized with, by name
+	Groups      map[string][]string `json:"groups,omitempty"`       // Names of trusted nodes sent to together, by group name
+	ChunkStore  int64               `json:"chunk_store,omitempty"`  // Bytes of received chunks kept for reuse, chunkstore.DefaultLimit if 0, none if negative
+	Listen      []string            `json:"listen,omitempty"`       // Multiaddrs the node listens on, random ports if empty
+	Bootstrap   []string            `json:"bootstrap,omitempty"`    // Multiaddrs with peer IDs of the nodes the DHT is joined through, the public ones if empty
+}
+
+func loadConfig(peerDir string) (Config, error) {
+	cfg := Config{}
+	data, err := os.ReadFile(filepath.Join(peerDir, configFile))
+	if os.IsNotExist(err) {
+		return cfg, nil
+	} else if err != nil {
+		return cfg, err
+	}
+	err = json.Unmarshal(data, &cfg)
+	return cfg, err
+}
+
+// SaveConfig writes the node config and applies its limits.
+func (p *Peer) SaveConfig() error {
+	data, err := json.MarshalIndent(p.Config, "", "  ")
+	if err != nil {
+		return err
+	}
+	p.Upload.SetRate(p.Config.UploadLimit)
+	p.Download.SetRate(p.Config.DownloadLimit)
+	return os.WriteFile(filepath.Join(p.peerDir, configFile), data, 0666)
+}
+
+// ChunkStore returns the store of chunks received by the node.
+func (p *Peer) ChunkStore() *chunkstore.Store {
+	return chunkstore.New(filepath.Join(p.peerDir, chunkDir), p.Config.ChunkStore)
+}
+
+// DownloadDir returns where the files received by the node go, a directory
+// next to the node directories unless configured.
+func (p *Peer) DownloadDir() string {
+	if p.Config.DownloadDir != "" {
+		return p.Config.DownloadDir
+	}
+	return filepath.Join(filepath.Dir(p.root), DefaultDownloads)
+}
+
+// Resolver returns where the files received by the node go. Should that be
+// the directory the node directories are kept in, names leading into a node
+// directory are reserved; inside a node directory everything is.
+func (p *Peer) Resolver() dest.Resolver {
+	r := dest.Resolver{Root: p.DownloadDir(), Policy: p.Config.OnCollision}
+	root, rootErr := filepath.Abs(r.Root)
+	nodes, nodesErr := filepath.Abs(p.root)
+	if rootErr != nil || nodesErr != nil {
+		r.Reserved = func(string) bool { return true }
+		return r
+	}
+	rel, err := filepath.Rel(nodes, root)
+	switch {
+	case err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)):
+		// Outside the node directories
+	case rel == ".":
+		r.Reserved = func(first string) bool {
+			return first == p.Name || isNodeDir(filepath.Join(nodes, first))
+		}
+	default:
+		first := strings.SplitN(rel, string(filepath.Separator), 2)[0]
+		if first == p.Name || isNodeDir(filepath.Join(nodes, first)) {
+			r.Reserved = func(string) bool { return true }
+		}
+	}
+	return r
+}
+
+// isNodeDir reports whether dir holds a node, going by its key.
+func isNodeDir(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, pubKeyFile))
+	return err == nil
+}
@@ -4,6 +4,8 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
+	"math"
 	"os"
 	"path/filepath"
 	"strings"
@@ -12,46 +14,158 @@ import (
 	"github.com/charmbracelet/bubbles/progress"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/Azanul/peer-pressure/pkg/ratelimit"
+	"github.com/Azanul/peer-pressure/pkg/seal"
 	"github.com/Azanul/peer-pressure/pkg/util"
 	"github.com/multiformats/go-multiaddr"
 
 	"github.com/libp2p/go-libp2p"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/discovery"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
 	drouting "github.com/libp2p/go-libp2p/p2p/discovery/routing"
 	dutil "github.com/libp2p/go-libp2p/p2p/discovery/util"
 	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
 )
 
+// Files kept in a node directory next to the rendezvous file
+const (
+	privKeyFile  = "rsa.priv"
+	pubKeyFile   = "rsa.pub"
+	configFile   = "config.json"
+	ScheduleFile = "schedule.json"
+	usageFile    = "usage.json"
+	chunkDir     = "chunks"
+	MailboxDir   = "mailbox"
+	SwarmKeyFile = "swarm.key"
+)
+
+// DefaultRoot is the directory the node directories are kept in, relative to
+// the working directory.
+const DefaultRoot = "nodes"
+
+// DefaultDownloads is the directory received files go in unless configured,
+// next to the directory the node directories are kept in.
+const DefaultDownloads = "downloads"
+
+var nodeFiles = map[string]bool{
+	privKeyFile:  true,
+	pubKeyFile:   true,
+	configFile:   true,
+	ScheduleFile: true,
+	usageFile:    true,
+	SwarmKeyFile: true,
+}
+
 type Peer struct {
 	Node       host.Host
 	Name       string
+	dht        *dht.IpfsDHT
+	dhtMu      sync.Mutex
+	discovery  discovery.Discovery
+	routing    routing.ContentRouting
+	Config     Config
+	Upload     *ratelimit.Limiter // Node wide upload limit
+	Download   *ratelimit.Limiter // Node wide download limit
 	rendezvous string
+	root       string
 	peerDir    string
 	privKey    crypto.PrivKey
+	swarmKey   []byte // Swarm key of the private network the node is on, nil if none
+	usageMu    sync.Mutex
+	reserved   map[string]int64 // Bytes set aside per sender for files being received, see Reserve
 	crypto.PubKey
 }
 
-func New(name, rendezvous string) (*Peer, error) {
+// Option customises a peer created by New or Load.
+type Option func(*options)
+
+type options struct {
+	root      string
+	host      host.Host
+	discovery discovery.Discovery
+	routing   routing.ContentRouting
+	swarmKey  []byte
+}
+
+// WithRoot keeps the node directory under root instead of DefaultRoot.
+func WithRoot(root string) Option {
+	return func(o *options) { o.root = root }
+}
+
+// WithHost runs the peer on h instead of a new libp2p host. The identity of
+// h takes the place of the node keys.
+func WithHost(h host.Host) Option {
+	return func(o *options) { o.host = h }
+}
+
+// WithDiscovery finds other peers through d instead of the public DHT.
+func WithDiscovery(d discovery.Discovery) Option {
+	return func(o *options) { o.discovery = d }
+}
+
+// WithContentRouting announces and finds files through r instead of the
+// public DHT.
+func WithContentRouting(r routing.ContentRouting) Option {
+	return func(o *options) { o.routing = r }
+}
+
+// WithSwarmKey puts the peer on the private network of key, see
+// NewSwarmKey, instead of the one of its swarm key file. A host passed in
+// with WithHost has to be on that network already.
+func WithSwarmKey(key []byte) Option {
+	return func(o *options) { o.swarmKey = key }
+}
+
+func newOptions(opts []Option) options {
+	o := options{root: DefaultRoot}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// hostKeys returns the key pair of a host passed in with WithHost.
+func hostKeys(h host.Host) (crypto.PrivKey, crypto.PubKey, error) {
+	prvKey := h.Peerstore().PrivKey(h.ID())
+	if prvKey == nil {
+		return nil, nil, errors.New("no private key for host " + h.ID().Pretty())
+	}
+	return prvKey, prvKey.GetPublic(), nil
+}
+
+func New(name, rendezvous string, opts ...Option) (*Peer, error) {
+	o := newOptions(opts)
 	if rendezvous == "" {
 		rendezvous = "applesauce"
 	}
 
-	// Creates a new RSA key pair for this host.
-	prvKey, pubKey, err := crypto.GenerateKeyPair(crypto.RSA, 2048)
-	if err != nil {
-		return nil, err
-	}
+	h := o.host
+	var prvKey crypto.PrivKey
+	var pubKey crypto.PubKey
+	var err error
+	if h != nil {
+		prvKey, pubKey, err = hostKeys(h)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// Creates a new RSA key pair for this host.
+		prvKey, pubKey, err = crypto.GenerateKeyPair(crypto.RSA, 2048)
+		if err != nil {
+			return nil, err
+		}
 
-	// start a libp2p host with default settings
-	h, err := libp2p.New(libp2p.Identity(prvKey), libp2p.ResourceManager(loadResourceManager()))
-	if err != nil {
-		return nil, err
+		// start a libp2p host with default settings
+		h, err = newHost(prvKey, o.swarmKey, nil)
+		if err != nil {
+			return nil, err
+		}
 	}
-	defer h.Close()
 
 	log.Println(h.ID())
 	log.Println(h.Addrs())
@@ -59,29 +173,42 @@ func New(name, rendezvous string) (*Peer, error) {
 	return &Peer{
 		Node:       h,
 		Name:       name,
+		discovery:  o.discovery,
+		routing:    o.routing,
+		Upload:     ratelimit.New(0),
+		Download:   ratelimit.New(0),
 		rendezvous: rendezvous,
 		privKey:    prvKey,
+		swarmKey:   o.swarmKey,
 		PubKey:     pubKey,
-		peerDir:    filepath.Join("nodes", name),
+		root:       o.root,
+		peerDir:    filepath.Join(o.root, name),
 	}, nil
 }
 
-func Load(name string) (*Peer, error) {
-	nodeDir := filepath.Join("nodes", name)
-	prvBytes, _ := os.ReadFile(filepath.Join(nodeDir, "rsa.priv"))
-	prvKey, _ := crypto.UnmarshalPrivateKey(prvBytes)
-	pubBytes, _ := os.ReadFile(filepath.Join(nodeDir, "rsa.pub"))
-	pubKey, _ := crypto.UnmarshalPublicKey(pubBytes)
-
-	h, err := libp2p.New(libp2p.Identity(prvKey), libp2p.ResourceManager(loadResourceManager()))
+// newHost starts a libp2p host, see hostOptions.
+func newHost(prvKey crypto.PrivKey, swarmKey []byte, listen []string) (host.Host, error) {
+	opts, err := hostOptions(prvKey, swarmKey, listen)
 	if err != nil {
 		return nil, err
 	}
+	return libp2p.New(append(opts, libp2p.ResourceManager(loadResourceManager()))...)
+}
+
+// NodeDir returns the directory holding the files of the named node.
+func NodeDir(name string) string {
+	return filepath.Join(DefaultRoot, name)
+}
+
+func Load(name string, opts ...Option) (*Peer, error) {
+	o := newOptions(opts)
+	nodeDir := filepath.Join(o.root, name)
 
 	f, err := os.Open(nodeDir)
 	if err != nil {
 		return nil, err
 	}
+	defer f.Close()
 	files, err := f.Readdir(0)
 	if err != nil {
 		return nil, err
@@ -89,18 +216,57 @@ func Load(name string) (*Peer, error) {
 
 	rendezvous := "applesauce"
 	for _, v := range files {
-		if !v.IsDir() && v.Name() != "rsa.priv" && v.Name() != "rsa.pub" {
+		if !v.IsDir() && !nodeFiles[v.Name()] {
 			rendezvous = v.Name()
 		}
 	}
 
+	cfg, err := loadConfig(nodeDir)
+	if err != nil {
+		return nil, err
+	}
+	swarmKey := o.swarmKey
+	if swarmKey == nil {
+		swarmKey, err = loadSwarmKey(nodeDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	h := o.host
+	var prvKey crypto.PrivKey
+	var pubKey crypto.PubKey
+	if h != nil {
+		prvKey, pubKey, err = hostKeys(h)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		prvBytes, _ := os.ReadFile(filepath.Join(nodeDir, privKeyFile))
+		prvKey, _ = crypto.UnmarshalPrivateKey(prvBytes)
+		pubBytes, _ := os.ReadFile(filepath.Join(nodeDir, pubKeyFile))
+		pubKey, _ = crypto.UnmarshalPublicKey(pubBytes)
+
+		h, err = newHost(prvKey, swarmKey, cfg.Listen)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return &Peer{
 		Node:       h,
 		Name:       name,
+		discovery:  o.discovery,
+		routing:    o.routing,
+		Config:     cfg,
+		Upload:     ratelimit.New(cfg.UploadLimit),
+		Download:   ratelimit.New(cfg.DownloadLimit),
 		rendezvous: rendezvous,
 		privKey:    prvKey,
+		swarmKey:   swarmKey,
 		PubKey:     pubKey,
-		peerDir:    filepath.Join("nodes", name),
+		root:       o.root,
+		peerDir:    nodeDir,
 	}, nil
 }
 
@@ -116,7 +282,7 @@ func (p *Peer) Save() (err error) {
 	if err != nil {
 		return
 	}
-	err = util.AppendStringToFile(filepath.Join(p.peerDir, "rsa.priv"), string(privBytes))
+	err = util.AppendStringToFile(filepath.Join(p.peerDir, privKeyFile), string(privBytes))
 	if err != nil {
 		return
 	}
@@ -126,18 +292,72 @@ func (p *Peer) Save() (err error) {
 	if err != nil {
 		return
 	}
-	return util.AppendStringToFile(filepath.Join(p.peerDir, "rsa.pub"), string(pubBytes))
+	err = util.AppendStringToFile(filepath.Join(p.peerDir, pubKeyFile), string(pubBytes))
+	if err != nil || p.swarmKey == nil {
+		return
+	}
+	return p.SetSwarmKey(p.swarmKey)
 }
 
+// UnwrapKey decrypts a key wrapped for the node, see seal.WrapKey.
+func (p *Peer) UnwrapKey(wrapped []byte) ([]byte, error) {
+	return seal.UnwrapKey(p.privKey, wrapped)
+}
+
+// DiscoverPeers advertises the node on its rendezvous and returns the peers
+// found there. Unless a discovery was passed in with WithDiscovery, the
+// public DHT is joined on first use.
 func (p *Peer) DiscoverPeers(ctx context.Context) (<-chan peer.AddrInfo, error) {
+	p.dhtMu.Lock()
+	if p.discovery == nil {
+		err := p.joinDHT(ctx)
+		if err != nil {
+			p.dhtMu.Unlock()
+			return nil, err
+		}
+		p.discovery = drouting.NewRoutingDiscovery(p.dht)
+	}
+	p.dhtMu.Unlock()
+	dutil.Advertise(ctx, p.discovery, p.rendezvous)
+
+	return p.discovery.FindPeers(ctx, p.rendezvous)
+}
+
+// ContentRouting returns where the node announces the files it provides and
+// looks for providers of others. Unless one was passed in with
+// WithContentRouting, the public DHT is joined on first use.
+func (p *Peer) ContentRouting(ctx context.Context) (routing.ContentRouting, error) {
+	p.dhtMu.Lock()
+	defer p.dhtMu.Unlock()
+	if p.routing == nil {
+		err := p.joinDHT(ctx)
+		if err != nil {
+			return nil, err
+		}
+		p.routing = p.dht
+	}
+	return p.routing, nil
+}
+
+// joinDHT starts the DHT unless that happened already, p.dhtMu is held.
+func (p *Peer) joinDHT(ctx context.Context) error {
+	if p.dht != nil {
+		return nil
+	}
 	kademliaDHT, err := p.initDHT(ctx, p.peerDir)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	routingDiscovery := drouting.NewRoutingDiscovery(kademliaDHT)
-	dutil.Advertise(ctx, routingDiscovery, p.rendezvous)
+	p.dht = kademliaDHT
+	return nil
+}
 
-	return routingDiscovery.FindPeers(ctx, p.rendezvous)
+// Close shuts down the DHT, if one was joined, and the host.
+func (p *Peer) Close() error {
+	if p.dht != nil {
+		p.dht.Close()
+	}
+	return p.Node.Close()
 }
 
 func (p *Peer) initDHT(ctx context.Context, peerDir string) (*dht.IpfsDHT, error) {
@@ -145,6 +365,10 @@ func (p *Peer) initDHT(ctx context.Context, peerDir string) (*dht.IpfsDHT, error
 	// client because we want each peer to maintain its own local copy of the
 	// DHT, so that the bootstrapping node of the DHT can go down without
 	// inhibiting future peer discovery.
+	bootstrap, err := p.bootstrapPeers()
+	if err != nil {
+		return nil, err
+	}
 	kademliaDHT, err := dht.New(ctx, p.Node)
 	if err != nil {
 		return nil, err
@@ -161,12 +385,12 @@ func (p *Peer) initDHT(ctx context.Context, peerDir string) (*dht.IpfsDHT, error
 	writer := bufio.NewWriter(file)
 
 	var wg sync.WaitGroup
-	for _, peerAddr := range dht.DefaultBootstrapPeers {
+	for _, peerAddr := range bootstrap {
 		peerinfo, _ := peer.AddrInfoFromP2pAddr(peerAddr)
 		wg.Add(1)
 		go func(addr multiaddr.Multiaddr, pInfo *peer.AddrInfo) {
 			defer wg.Done()
-			if err := p.Node.Connect(ctx, *pInfo); err != nil {
+			if err := p.Connect(ctx, *pInfo); err != nil {
 				log.Printf("Bootstraping %v warning: %v\n", *pInfo, err)
 			} else {
 				log.Println("Connection established with bootstrap node:", *pInfo)
@@ -183,6 +407,11 @@ func (p *Peer) GetPeerDir() string {
 	return p.peerDir
 }
 
+// Root returns the directory the node directory lives in.
+func (p *Peer) Root() string {
+	return p.root
+}
+
 func (p *Peer) GetRendezvous() string {
 	return p.rendezvous
 }
@@ -192,6 +421,7 @@ type SignalType int8
 const (
 	Progress SignalType = iota
 	Error
+	Retry
 
 	Pause Command = iota
 	Continue
@@ -203,6 +433,13 @@ type Event struct {
 	Data interface{}
 }
 
+// Stats is the data of a Progress event. A negative Fraction marks the end of
+// the transfer.
+type Stats struct {
+	Fraction float64 // Share of the file transferred, 0 to 1
+	Rate     float64 // Current throughput in bytes per second
+}
+
 type Command SignalType
 
 type transferState int8
@@ -218,7 +455,28 @@ type Transfer struct {
 	Progress  progress.Model
 	EventCh   chan Event
 	CommandCh chan Command
+	Limit     *ratelimit.Limiter // Limit for this transfer alone, adjustable while it runs
 	TempPerc  float64
+	TempRate  float64
+	LastRetry RetryInfo // Latest reconnection attempt, zero if there was none
+}
+
+// Track updates the transfer from its events until it's done.
+func (t *Transfer) Track() {
+	for e := range t.EventCh {
+		switch data := e.Data.(type) {
+		case Stats:
+			if data.Fraction < 0 {
+				return
+			}
+			t.TempPerc = math.Min(data.Fraction, 1)
+			t.TempRate = data.Rate
+		case RetryInfo:
+			t.LastRetry = data
+		case string:
+			log.Errorln("Transfer error:", data)
+		}
+	}
 }
 
 func (t *Transfer) Paused() bool {
@@ -243,7 +501,7 @@ func (t *Transfer) Toggle() {
 }
 
 func (t *Transfer) Stop() {
-	t.CommandCh <- Continue
+	t.CommandCh <- Stop
 	t.state = inactive
 }
 
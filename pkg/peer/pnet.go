@@ -0,0 +1,156 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/libp2p/go-libp2p"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/pnet"
+	"github.com/multiformats/go-multiaddr"
+)
+
+var (
+	ErrPrivateNetwork = errors.New("not on the same private network")
+	ErrNoBootstrap    = errors.New("no bootstrap nodes for the private network")
+)
+
+// privateListenAddrs are where nodes on a private network listen unless
+// configured otherwise. Private networks only run over TCP, QUIC can't
+// carry them.
+var privateListenAddrs = []string{"/ip4/0.0.0.0/tcp/0", "/ip6/::/tcp/0"}
+
+// NewSwarmKey returns a new swarm key, in the format of the swarm.key files
+// of IPFS and other libp2p programs. Nodes holding the same swarm key only
+// ever connect to each other.
+func NewSwarmKey() ([]byte, error) {
+	psk := make([]byte, 32)
+	_, err := rand.Read(psk)
+	if err != nil {
+		return nil, err
+	}
+	return []byte("/key/swarm/psk/1.0.0/\n/base16/\n" + hex.EncodeToString(psk) + "\n"), nil
+}
+
+// decodeSwarmKey returns the pre-shared key of a swarm key, see NewSwarmKey.
+func decodeSwarmKey(key []byte) (pnet.PSK, error) {
+	psk, err := pnet.DecodeV1PSK(bytes.NewReader(key))
+	if err != nil {
+		return nil, fmt.Errorf("invalid swarm key: %w", err)
+	}
+	return psk, nil
+}
+
+// loadSwarmKey returns the swarm key of the node kept in nodeDir, nil if it
+// isn't on a private network.
+func loadSwarmKey(nodeDir string) ([]byte, error) {
+	key, err := os.ReadFile(filepath.Join(nodeDir, SwarmKeyFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return key, err
+}
+
+// hostOptions returns the options for a libp2p host with the identity
+// prvKey, listening on listen or the libp2p defaults if empty, on the
+// private network of swarmKey unless that's nil.
+func hostOptions(prvKey crypto.PrivKey, swarmKey []byte, listen []string) ([]libp2p.Option, error) {
+	opts := []libp2p.Option{libp2p.Identity(prvKey)}
+	if swarmKey != nil {
+		psk, err := decodeSwarmKey(swarmKey)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, libp2p.PrivateNetwork(psk))
+		if len(listen) == 0 {
+			listen = privateListenAddrs
+		}
+	}
+	if len(listen) > 0 {
+		opts = append(opts, libp2p.ListenAddrStrings(listen...))
+	}
+	return opts, nil
+}
+
+// Private reports whether the node is on a private network, only connecting
+// to nodes holding its swarm key.
+func (p *Peer) Private() bool {
+	return p.swarmKey != nil
+}
+
+// SetSwarmKey puts the node on the private network of key, see NewSwarmKey,
+// or back on the public one if key is nil. It takes effect the next time
+// the node is loaded.
+func (p *Peer) SetSwarmKey(key []byte) error {
+	path := filepath.Join(p.peerDir, SwarmKeyFile)
+	if key == nil {
+		err := os.Remove(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	_, err := decodeSwarmKey(key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(p.peerDir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	// The key is all that keeps other nodes out, only the owner may read it
+	return os.WriteFile(path, key, 0600)
+}
+
+// Connect connects to a peer like host.Host.Connect does, telling failures
+// because the nodes aren't on the same private network apart from others.
+// Such a handshake may hang until the node dialed gives up on it, 15s with
+// the libp2p defaults, so ctx should leave it that long.
+func (p *Peer) Connect(ctx context.Context, info peer.AddrInfo) error {
+	err := p.Node.Connect(ctx, info)
+	// Without the same key the handshake reads garbage, which is all there
+	// is to go by
+	if err == nil || !strings.Contains(err.Error(), "failed to negotiate security protocol") {
+		return err
+	}
+	log.Debugf("Connecting to %s: %v", info.ID.Pretty(), err)
+	if p.Private() {
+		return fmt.Errorf("%w: %s doesn't hold the swarm key of this node", ErrPrivateNetwork, info.ID.Pretty())
+	}
+	return fmt.Errorf("%w: %s may be on a private network, this node needs its swarm key, see the swarm-key command", ErrPrivateNetwork, info.ID.Pretty())
+}
+
+// bootstrapPeers returns the nodes the DHT is joined through: the configured
+// ones, or the public bootstrap nodes unless the node is on a private
+// network, which they aren't on.
+func (p *Peer) bootstrapPeers() ([]multiaddr.Multiaddr, error) {
+	if len(p.Config.Bootstrap) == 0 {
+		if p.Private() {
+			return nil, fmt.Errorf("%w, add some with swarm-key -bootstrap", ErrNoBootstrap)
+		}
+		return dht.DefaultBootstrapPeers, nil
+	}
+	addrs := make([]multiaddr.Multiaddr, 0, len(p.Config.Bootstrap))
+	for _, s := range p.Config.Bootstrap {
+		addr, err := multiaddr.NewMultiaddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("bootstrap node %q: %w", s, err)
+		}
+		if _, err := peer.AddrInfoFromP2pAddr(addr); err != nil {
+			return nil, fmt.Errorf("bootstrap node %q: %w", s, err)
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
@@ -0,0 +1,115 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// newPrivatePeer starts a node on the private network of swarmKey, on the
+// public one if it's nil, listening on the loopback interface.
+func newPrivatePeer(t *testing.T, name string, swarmKey []byte) *Peer {
+	t.Helper()
+	prvKey, _, err := crypto.GenerateKeyPair(crypto.Ed25519, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts, err := hostOptions(prvKey, swarmKey, []string{"/ip4/127.0.0.1/tcp/0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := libp2p.New(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := New(name, "test", WithRoot(t.TempDir()), WithHost(h), WithSwarmKey(swarmKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func TestPrivateNetwork(t *testing.T) {
+	key, err := NewSwarmKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewSwarmKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name      string
+		key, peer []byte // Swarm keys of the dialing node and the one dialed
+		err       error
+	}{
+		{"same key", key, key, nil},
+		{"other key", key, other, ErrPrivateNetwork},
+		{"peer without key", key, nil, ErrPrivateNetwork},
+		{"dialing without key", nil, key, ErrPrivateNetwork},
+		{"no keys", nil, nil, nil},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			alice, bob := newPrivatePeer(t, "alice", tt.key), newPrivatePeer(t, "bob", tt.peer)
+			// A handshake stuck on garbage only fails once the node dialed
+			// gives up on it, after 15s
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			err := alice.Connect(ctx, peer.AddrInfo{ID: bob.Node.ID(), Addrs: bob.Node.Addrs()})
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestSwarmKey(t *testing.T) {
+	key, err := NewSwarmKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newPrivatePeer(t, "alice", nil)
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name    string
+		key     []byte
+		private bool
+		err     bool
+	}{
+		{"set", key, true, false},
+		{"invalid", []byte("/key/swarm/psk/1.0.0/\n/base16/\nabc\n"), true, true},
+		{"removed", nil, false, false},
+		{"removed again", nil, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := p.SetSwarmKey(tt.key)
+			if (err != nil) != tt.err {
+				t.Fatalf("got %v, want an error: %v", err, tt.err)
+			}
+			loaded, err := Load(p.Name, WithRoot(p.Root()), WithHost(p.Node))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if loaded.Private() != tt.private {
+				t.Errorf("loaded node private: %v, want %v", loaded.Private(), tt.private)
+			}
+			if _, err := loaded.bootstrapPeers(); tt.private && !errors.Is(err, ErrNoBootstrap) {
+				t.Errorf("got %v, want %v without bootstrap nodes", err, ErrNoBootstrap)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package peer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/Azanul/peer-pressure/pkg/util"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// ErrQuota is returned by Reserve when a file doesn't fit the quotas.
+var ErrQuota = errors.New("quota exceeded")
+
+// usage counts the bytes of the files received per sender, stored as
+// usage.json in the node directory. Deleting received files doesn't lower
+// the counts.
+type usage map[string]int64
+
+func (p *Peer) loadUsage() (usage, error) {
+	u := usage{}
+	data, err := os.ReadFile(filepath.Join(p.peerDir, usageFile))
+	if os.IsNotExist(err) {
+		return u, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &u)
+	return u, err
+}
+
+func (p *Peer) saveUsage(u usage) error {
+	data, err := json.MarshalIndent(u, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(p.peerDir, usageFile), data, 0666)
+}
+
+// Usage returns the bytes received per sender, by peer ID, as counted
+// against the quotas.
+func (p *Peer) Usage() (map[string]int64, error) {
+	p.usageMu.Lock()
+	defer p.usageMu.Unlock()
+	return p.loadUsage()
+}
+
+// Reserve sets size bytes aside for a file offered by from, failing with
+// ErrQuota if that would take the sender or the node over its quota along
+// with what was received and is being received. The bytes are counted once
+// the file is complete, see Charge, and Release gives them back otherwise.
+func (p *Peer) Reserve(from peer.ID, size int64) error {
+	p.usageMu.Lock()
+	defer p.usageMu.Unlock()
+
+	u, err := p.loadUsage()
+	if err != nil {
+		return err
+	}
+	key := from.String()
+	used, total := u[key]+p.reserved[key], int64(0)
+	for _, n := range u {
+		total += n
+	}
+	for _, n := range p.reserved {
+		total += n
+	}
+
+	if q := p.Config.PeerQuota; q > 0 && used+size > q {
+		return fmt.Errorf("%w: %s would exceed the %s left of the sender's quota", ErrQuota,
+			util.HumanBytes(float64(size)), util.HumanBytes(float64(q-used)))
+	}
+	if q := p.Config.NodeQuota; q > 0 && total+size > q {
+		return fmt.Errorf("%w: %s would exceed the %s left of the node's quota", ErrQuota,
+			util.HumanBytes(float64(size)), util.HumanBytes(float64(q-total)))
+	}
+	if p.reserved == nil {
+		p.reserved = map[string]int64{}
+	}
+	p.reserved[key] += size
+	return nil
+}
+
+// Release gives back the size bytes reserved for a file from that wasn't
+// received.
+func (p *Peer) Release(from peer.ID, size int64) {
+	p.usageMu.Lock()
+	defer p.usageMu.Unlock()
+	p.release(from.String(), size)
+}
+
+func (p *Peer) release(key string, size int64) {
+	p.reserved[key] -= size
+	if p.reserved[key] <= 0 {
+		delete(p.reserved, key)
+	}
+}
+
+// Charge counts the size bytes reserved for a file from against its quotas
+// for good, once the file is complete.
+func (p *Peer) Charge(from peer.ID, size int64) error {
+	p.usageMu.Lock()
+	defer p.usageMu.Unlock()
+
+	key := from.String()
+	p.release(key, size)
+	u, err := p.loadUsage()
+	if err != nil {
+		return err
+	}
+	u[key] += size
+	return p.saveUsage(u)
+}
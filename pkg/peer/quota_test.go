@@ -0,0 +1,50 @@
+package peer
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestQuota(t *testing.T) {
+	p := newPrivatePeer(t, "bob", nil)
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+	p.Config.PeerQuota, p.Config.NodeQuota = 100, 150
+	alice, carol := peer.ID("alice"), peer.ID("carol")
+
+	var tests = []struct {
+		name  string
+		step  func() error
+		err   error
+		usage map[string]int64 // Bytes counted once the step is done
+	}{
+		{"reserved", func() error { return p.Reserve(alice, 60) }, nil, map[string]int64{}},
+		{"over the peer quota", func() error { return p.Reserve(alice, 50) }, ErrQuota, map[string]int64{}},
+		{"released", func() error { p.Release(alice, 60); return p.Reserve(alice, 100) }, nil, map[string]int64{}},
+		{"charged", func() error { return p.Charge(alice, 100) }, nil, map[string]int64{alice.String(): 100}},
+		{"over the node quota", func() error { return p.Reserve(carol, 60) }, ErrQuota, map[string]int64{alice.String(): 100}},
+		{"other sender", func() error { return p.Reserve(carol, 50) }, nil, map[string]int64{alice.String(): 100}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.step(); !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			u, err := p.Usage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(u) != len(tt.usage) {
+				t.Fatalf("got usage %v, want %v", u, tt.usage)
+			}
+			for k, n := range tt.usage {
+				if u[k] != n {
+					t.Errorf("got usage %v, want %v", u, tt.usage)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// RetryPolicy describes how often and how quickly a failed operation is
+// retried, backing off exponentially between attempts.
+type RetryPolicy struct {
+	MaxAttempts int           // Retries after the first attempt, 0 to never retry
+	Initial     time.Duration // Delay before the first retry
+	Max         time.Duration // Upper bound of the delay
+	Multiplier  float64       // Growth of the delay per retry
+}
+
+var (
+	// DefaultRetryPolicy is used for transfers interrupted by a dropped stream.
+	DefaultRetryPolicy = RetryPolicy{
+		MaxAttempts: 8,
+		Initial:     time.Second,
+		Max:         time.Minute,
+		Multiplier:  2,
+	}
+
+	// WaitPolicy is used by receivers waiting for a sender to show up.
+	WaitPolicy = RetryPolicy{
+		MaxAttempts: 30,
+		Initial:     2 * time.Second,
+		Max:         30 * time.Second,
+		Multiplier:  1.5,
+	}
+)
+
+// RetryInfo is the data of a Retry event.
+type RetryInfo struct {
+	Attempt     int           // Number of this retry, starting at 1
+	MaxAttempts int           // 0 when unknown, e.g. on a receiver waiting for its sender
+	Delay       time.Duration // Time until the retry
+	Err         string        // What failed
+}
+
+// errPermanent marks errors that retrying won't fix.
+type errPermanent struct{ err error }
+
+func (e errPermanent) Error() string { return e.err.Error() }
+func (e errPermanent) Unwrap() error { return e.err }
+
+// Permanent wraps err so that Do gives up on it right away.
+func Permanent(err error) error {
+	return errPermanent{err}
+}
+
+// Delay returns the backoff before the given retry, with 20% jitter so that
+// peers that failed together don't retry in lockstep.
+func (r RetryPolicy) Delay(attempt int) time.Duration {
+	d := float64(r.Initial) * math.Pow(r.Multiplier, float64(attempt-1))
+	if d > float64(r.Max) {
+		d = float64(r.Max)
+	}
+	d *= 0.8 + 0.4*rand.Float64()
+	return time.Duration(d)
+}
+
+// Do calls fn until it succeeds, the retries are used up, fn returns a
+// Permanent error or ctx is done. fn gets the number of the attempt, 0 for
+// the first one. Every retry is announced on eventCh when it's not nil.
+func (r RetryPolicy) Do(ctx context.Context, eventCh chan Event, fn func(attempt int) error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn(attempt)
+		var permanent errPermanent
+		if err == nil {
+			return nil
+		} else if errors.As(err, &permanent) {
+			return permanent.err
+		} else if attempt >= r.MaxAttempts {
+			return err
+		}
+
+		delay := r.Delay(attempt + 1)
+		log.Printf("Attempt %d failed: %v, retrying in %s", attempt, err, delay)
+		if eventCh != nil {
+			eventCh <- Event{
+				Type: Retry,
+				Data: RetryInfo{
+					Attempt:     attempt + 1,
+					MaxAttempts: r.MaxAttempts,
+					Delay:       delay,
+					Err:         err.Error(),
+				},
+			}
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// Redial reconnects to a peer we lost the connection to. Its known addresses
+// are tried first, if that fails the peer is looked up again on the
+// rendezvous.
+func (p *Peer) Redial(ctx context.Context, id peer.ID) error {
+	err := p.Connect(ctx, p.Node.Peerstore().PeerInfo(id))
+	if err == nil {
+		return nil
+	}
+	log.Printf("Redialing %s failed: %v, rediscovering", id.Pretty(), err)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	peerChan, err := p.DiscoverPeers(ctx)
+	if err != nil {
+		return err
+	}
+	for info := range peerChan {
+		if info.ID == id {
+			return p.Connect(ctx, info)
+		}
+	}
+	return errors.New("peer " + id.Pretty() + " not found on the rendezvous")
+}
@@ -0,0 +1,104 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDelay(t *testing.T) {
+	r := RetryPolicy{Initial: time.Second, Max: 10 * time.Second, Multiplier: 2}
+
+	var tests = []struct {
+		attempt int
+		want    time.Duration // Before the jitter
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{50, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 20; i++ {
+			d := r.Delay(tt.attempt)
+			if d < tt.want*8/10 || d > tt.want*12/10 {
+				t.Errorf("retry %d: got %v, want %v give or take 20%%", tt.attempt, d, tt.want)
+			}
+		}
+	}
+}
+
+func TestDo(t *testing.T) {
+	errFailed := errors.New("failed")
+	instant := RetryPolicy{MaxAttempts: 3, Multiplier: 2}
+
+	var tests = []struct {
+		name   string
+		policy RetryPolicy
+		fails  int   // Attempts failing before one succeeds, -1 for all of them
+		fail   error // What they fail with
+		cancel bool  // Cancel the context in the first attempt
+		err    error
+		calls  int
+	}{
+		{"first attempt", instant, 0, errFailed, false, nil, 1},
+		{"after retries", instant, 2, errFailed, false, nil, 3},
+		{"on the last retry", instant, 3, errFailed, false, nil, 4},
+		{"retries used up", instant, -1, errFailed, false, errFailed, 4},
+		{"never retrying", RetryPolicy{}, -1, errFailed, false, errFailed, 1},
+		{"permanent", instant, -1, Permanent(errFailed), false, errFailed, 1},
+		{"permanent wrapped", instant, -1, Permanent(ErrQuota), false, ErrQuota, 1},
+		{"canceled", RetryPolicy{MaxAttempts: 3, Initial: time.Hour, Max: time.Hour, Multiplier: 2}, -1, errFailed, true, context.Canceled, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			eventCh := make(chan Event, tt.policy.MaxAttempts+1)
+			calls := 0
+			err := tt.policy.Do(ctx, eventCh, func(attempt int) error {
+				if attempt != calls {
+					t.Errorf("got attempt %d, want %d", attempt, calls)
+				}
+				calls++
+				if tt.cancel {
+					cancel()
+				}
+				if tt.fails >= 0 && attempt >= tt.fails {
+					return nil
+				}
+				return tt.fail
+			})
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+			var permanent errPermanent
+			if errors.As(err, &permanent) {
+				t.Errorf("got %v still marked permanent", err)
+			}
+			if calls != tt.calls {
+				t.Errorf("got %d calls, want %d", calls, tt.calls)
+			}
+
+			// Every retry is announced
+			close(eventCh)
+			retry := 0
+			for e := range eventCh {
+				retry++
+				info, ok := e.Data.(RetryInfo)
+				if e.Type != Retry || !ok || info.Attempt != retry || info.MaxAttempts != tt.policy.MaxAttempts {
+					t.Errorf("got event %+v, want retry %d of %d", e, retry, tt.policy.MaxAttempts)
+				}
+			}
+			want := tt.calls - 1
+			if tt.cancel {
+				want = 1 // Announced before waiting for it was canceled
+			}
+			if retry != want {
+				t.Errorf("got %d retries announced, want %d", retry, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package peer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// ReadID returns the peer ID of the named node from its public key, without
+// starting it.
+func ReadID(name string) (peer.ID, error) {
+	data, err := os.ReadFile(filepath.Join(NodeDir(name), pubKeyFile))
+	if err != nil {
+		return "", err
+	}
+	pubKey, err := crypto.UnmarshalPublicKey(data)
+	if err != nil {
+		return "", err
+	}
+	return peer.IDFromPublicKey(pubKey)
+}
+
+// Trust adds the node with the given peer ID to the trusted ones under name
+// and saves the config.
+func (p *Peer) Trust(name string, id peer.ID) error {
+	if p.Config.Trusted == nil {
+		p.Config.Trusted = map[string]string{}
+	}
+	p.Config.Trusted[name] = id.String()
+	return p.SaveConfig()
+}
+
+// TrustedID looks up a trusted node by the name it was trusted under.
+func (p *Peer) TrustedID(name string) (peer.ID, error) {
+	s, ok := p.Config.Trusted[name]
+	if !ok {
+		return "", fmt.Errorf("%q is not a trusted node, see the trust command", name)
+	}
+	return peer.Decode(s)
+}
+
+// SetGroup saves members, names of trusted nodes, as the group name and
+// saves the config. A group without members is removed.
+func (p *Peer) SetGroup(name string, members []string) error {
+	for _, member := range members {
+		if _, err := p.TrustedID(member); err != nil {
+			return err
+		}
+	}
+	if len(members) == 0 {
+		delete(p.Config.Groups, name)
+	} else {
+		if p.Config.Groups == nil {
+			p.Config.Groups = map[string][]string{}
+		}
+		p.Config.Groups[name] = members
+	}
+	return p.SaveConfig()
+}
+
+// Group returns the names of the members of a group.
+func (p *Peer) Group(name string) ([]string, error) {
+	members, ok := p.Config.Groups[name]
+	if !ok {
+		return nil, fmt.Errorf("%q is not a group, see the group command", name)
+	}
+	return members, nil
+}
@@ -2,6 +2,7 @@ package pb
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -13,15 +14,23 @@ import (
 )
 
 type pressure interface {
-	*Chunk | *ChunkRequest | *Index
+	*Chunk | *ChunkRequest | *Index | *SyncRequest | *FolderIndex | *FileRequest | *Delta | *ContentRequest | *CatalogRequest | *Catalog | *BrowseRequest | *Listing | *Letter | *KeyRequest
 	ProtoReflect() protoreflect.Message
 }
 
-func (x *Index) Save() {
-	indexFile, err := os.OpenFile("nodes/"+x.Filename+".ppindex", os.O_CREATE|os.O_WRONLY, 0777)
+// IndexPath returns where the index of the file being received at dest is
+// kept.
+func IndexPath(dest string) string {
+	return dest + ".ppindex"
+}
+
+// Save writes the index to path, see IndexPath.
+func (x *Index) Save(path string) {
+	indexFile, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0777)
 	if err != nil {
 		log.Panicln("Error creating index file:", err)
 	}
+	defer indexFile.Close()
 
 	data, err := proto.Marshal(x)
 	if err != nil {
@@ -34,40 +43,138 @@ func (x *Index) Save() {
 	}
 }
 
-func Read[T pressure](r io.Reader, x T) (err error) {
+// HasChunk reports whether chunk i has already been received.
+func (x *Index) HasChunk(i int32) bool {
+	if i < 0 || i >= x.NChunks {
+		return false
+	}
+	if len(x.Received) == 0 {
+		// Indexes saved by sequential transfers only track progress
+		return i < x.Progress
+	}
+	return int(i/8) < len(x.Received) && x.Received[i/8]&(1<<(i%8)) != 0
+}
+
+// MarkChunk records chunk i as received and bumps the progress. It reports
+// false if the chunk had already been received or is out of range.
+func (x *Index) MarkChunk(i int32) bool {
+	if i < 0 || i >= x.NChunks || x.HasChunk(i) {
+		return false
+	}
+	size := int((x.NChunks + 7) / 8)
+	if len(x.Received) == 0 {
+		x.Received = make([]byte, size)
+		for j := int32(0); j < x.Progress; j++ {
+			x.Received[j/8] |= 1 << (j % 8)
+		}
+	} else if len(x.Received) < size {
+		x.Received = append(x.Received, make([]byte, size-len(x.Received))...)
+	}
+	x.Received[i/8] |= 1 << (i % 8)
+	x.Progress++
+	return true
+}
+
+// ResetProgress forgets which chunks were received. The progress in an
+// index offered by a sender says nothing about what the receiver has, it's
+// dropped before the index is saved.
+func (x *Index) ResetProgress() {
+	x.Progress = 0
+	x.Received = nil
+}
+
+// FirstMissing returns the index of the first chunk that hasn't been
+// received yet, or NChunks if the file is complete.
+func (x *Index) FirstMissing() int32 {
+	for i := int32(0); i < x.NChunks; i++ {
+		if !x.HasChunk(i) {
+			return i
+		}
+	}
+	return x.NChunks
+}
+
+// MaxMessageSize bounds the length of a message on the wire. The largest
+// legitimate messages are the Index of a big file with its chunk bitmap, the
+// Signatures of a big file and the FolderIndex of a big synchronized folder.
+const MaxMessageSize = 16 << 20
+
+// Causes of a FramingError
+var (
+	ErrMessageTooLarge = errors.New("message exceeds the maximum size")
+	ErrTruncated       = errors.New("stream ended inside a message")
+	ErrMalformed       = errors.New("malformed message")
+)
+
+// FramingError is returned by Read when a message can't be read off the
+// stream. Err is ErrMessageTooLarge, ErrTruncated, ErrMalformed or the error
+// of the underlying reader.
+type FramingError struct {
+	Message protoreflect.FullName
+	Size    uint32 // Length announced by the prefix, 0 if it wasn't read
+	Err     error
+}
+
+func (e *FramingError) Error() string {
+	if e.Size > 0 {
+		return fmt.Sprintf("error reading %s of %d bytes: %v", e.Message, e.Size, e.Err)
+	}
+	return fmt.Sprintf("error reading %s: %v", e.Message, e.Err)
+}
+
+func (e *FramingError) Unwrap() error { return e.Err }
+
+// Read reads one length prefixed message into x. It returns io.EOF if the
+// stream ended cleanly before the message, and a *FramingError otherwise.
+func Read[T pressure](r io.Reader, x T) error {
+	name := x.ProtoReflect().Descriptor().FullName()
 	messageSize, err := readMessageLen(r)
-	if err != nil {
+	if err == io.EOF {
 		return err
+	} else if err != nil {
+		return &FramingError{Message: name, Err: err}
 	}
+	if messageSize > MaxMessageSize {
+		return &FramingError{Message: name, Size: messageSize, Err: ErrMessageTooLarge}
+	}
+
 	str := make([]byte, messageSize)
 	_, err = io.ReadFull(r, str)
-	if err != nil {
-		return fmt.Errorf("error reading %s from buffer: %s", x.ProtoReflect().Type().Descriptor().FullName(), err)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return &FramingError{Message: name, Size: messageSize, Err: ErrTruncated}
+	} else if err != nil {
+		return &FramingError{Message: name, Size: messageSize, Err: err}
 	}
 
 	err = proto.Unmarshal(str, x)
 	if err != nil {
-		return fmt.Errorf("error unmarshaling proto %s: %s", x.ProtoReflect().Type().Descriptor().FullName(), err)
+		return &FramingError{Message: name, Size: messageSize, Err: fmt.Errorf("%w: %v", ErrMalformed, err)}
 	}
-	return
+	return nil
 }
 
+// Marshal encodes x with its length prefix.
 func Marshal[T pressure](x T) []byte {
 	data, err := proto.Marshal(x)
 	if err != nil {
 		log.Panicf("Error marshaling proto %s message: %v\n", x.ProtoReflect().Type(), err)
 	}
+	if len(data) > MaxMessageSize {
+		log.Panicf("Proto %s message of %d bytes exceeds the maximum size", x.ProtoReflect().Descriptor().FullName(), len(data))
+	}
 
 	return append(bigEndianMessageSize(len(data)), data...)
 }
 
+// readMessageLen reads the 4 byte length prefix, returning io.EOF only if the
+// stream ended before its first byte.
 func readMessageLen(r io.Reader) (uint32, error) {
 	lenBytes := make([]byte, 4)
-	n, err := r.Read(lenBytes)
-	if err != nil {
+	_, err := io.ReadFull(r, lenBytes)
+	if err == io.ErrUnexpectedEOF {
+		return 0, ErrTruncated
+	} else if err != nil {
 		return 0, err
-	} else if n == 0 {
-		return 0, io.EOF
 	}
 	return binary.BigEndian.Uint32(lenBytes), nil
 }
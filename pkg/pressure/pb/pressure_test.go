@@ -0,0 +1,163 @@
+package pb
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+	"unicode/utf8"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func TestRead(t *testing.T) {
+	chunk := Marshal(&Chunk{Index: 3, Data: []byte("some data")})
+	var tests = []struct {
+		name  string
+		input []byte
+		want  error
+	}{
+		{"Empty", nil, io.EOF},
+		{"Valid", chunk, nil},
+		{"ShortPrefix", []byte{0, 0}, ErrTruncated},
+		{"ShortBody", chunk[:len(chunk)-2], ErrTruncated},
+		{"TooLarge", []byte{0xff, 0xff, 0xff, 0xff, 1, 2, 3}, ErrMessageTooLarge},
+		{"Malformed", []byte{0, 0, 0, 2, 0xff, 0xff}, ErrMalformed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Read(bytes.NewReader(tt.input), &Chunk{})
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+			var framing *FramingError
+			if err != nil && err != io.EOF && !errors.As(err, &framing) {
+				t.Errorf("got %T, want *FramingError", err)
+			}
+		})
+	}
+}
+
+// FuzzRead feeds arbitrary bytes to Read for every message type, fed one
+// byte at a time to exercise short reads. Whatever Read accepts has to
+// survive a round trip.
+func FuzzRead(f *testing.F) {
+	f.Add(Marshal(&Chunk{Index: 1, Data: []byte("data")}))
+	f.Add(Marshal(&ChunkRequest{Index: 2, Count: 16}))
+	f.Add(Marshal(&Index{NChunks: 9, Filename: "file.bin", Size: 33000, Received: []byte{0xff, 1}}))
+	f.Add([]byte{0, 0, 0})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkRead(t, data, &Chunk{})
+		checkRead(t, data, &ChunkRequest{})
+		checkRead(t, data, &Index{})
+	})
+}
+
+func checkRead[T pressure](t *testing.T, data []byte, x T) {
+	err := Read(iotest.OneByteReader(bytes.NewReader(data)), x)
+	if err == io.EOF {
+		if len(data) != 0 {
+			t.Fatalf("io.EOF after %d bytes", len(data))
+		}
+		return
+	}
+	var framing *FramingError
+	if err != nil {
+		if !errors.As(err, &framing) {
+			t.Fatalf("got %T, want *FramingError", err)
+		}
+		return
+	}
+
+	// Unknown fields are kept, so the message fits in what was read
+	got := Marshal(x)
+	if len(got) > len(data) {
+		t.Fatalf("re-marshaled %d bytes out of %d read", len(got), len(data))
+	}
+}
+
+func FuzzChunk(f *testing.F) {
+	f.Add(int32(0), []byte("data"))
+	f.Fuzz(func(t *testing.T, index int32, data []byte) {
+		roundTrip(t, &Chunk{Index: index, Data: data}, &Chunk{})
+	})
+}
+
+func FuzzChunkRequest(f *testing.F) {
+	f.Add(int32(0), int32(0))
+	f.Fuzz(func(t *testing.T, index, count int32) {
+		roundTrip(t, &ChunkRequest{Index: index, Count: count}, &ChunkRequest{})
+	})
+}
+
+func FuzzIndex(f *testing.F) {
+	f.Add(int32(3), "file.bin", int32(1), int64(9000), []byte{1})
+	f.Fuzz(func(t *testing.T, nChunks int32, filename string, progress int32, size int64, received []byte) {
+		if !utf8.ValidString(filename) {
+			t.Skip("proto3 strings have to be valid UTF-8")
+		}
+		roundTrip(t, &Index{
+			NChunks:  nChunks,
+			Filename: filename,
+			Progress: progress,
+			Size:     size,
+			Received: received,
+		}, &Index{})
+	})
+}
+
+// roundTrip checks that Read returns what Marshal wrote, with the message
+// followed by another one on the stream.
+func roundTrip[T pressure](t *testing.T, sent, got T) {
+	data := append(Marshal(sent), Marshal(sent)...)
+	r := iotest.OneByteReader(bytes.NewReader(data))
+	for i := 0; i < 2; i++ {
+		err := Read(r, got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !proto.Equal(sent, got) {
+			t.Fatalf("got %v, want %v", got, sent)
+		}
+	}
+	if err := Read(r, got); err != io.EOF {
+		t.Fatalf("got %v after the last message, want io.EOF", err)
+	}
+}
+
+func TestBitmap(t *testing.T) {
+	var tests = []struct {
+		name  string
+		index *Index
+		first int32 // FirstMissing before marking
+	}{
+		{"sequential", &Index{NChunks: 20, Progress: 3}, 3},
+		{"short bitmap", &Index{NChunks: 100, Progress: 8, Received: []byte{0xff}}, 8},
+		{"empty", &Index{NChunks: 20}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.index.FirstMissing(); got != tt.first {
+				t.Errorf("first missing %d, want %d", got, tt.first)
+			}
+			if tt.index.HasChunk(-1) || tt.index.HasChunk(tt.index.NChunks+8) {
+				t.Error("chunks out of range received")
+			}
+			progress := tt.index.Progress
+			if !tt.index.MarkChunk(tt.index.NChunks-1) || tt.index.MarkChunk(tt.index.NChunks-1) {
+				t.Error("last chunk not marked exactly once")
+			}
+			if !tt.index.HasChunk(tt.index.NChunks-1) || tt.index.Progress != progress+1 {
+				t.Errorf("got progress %d after marking, want %d", tt.index.Progress, progress+1)
+			}
+			tt.index.ResetProgress()
+			if tt.index.FirstMissing() != 0 || tt.index.Progress != 0 {
+				t.Error("progress left after a reset")
+			}
+		})
+	}
+}
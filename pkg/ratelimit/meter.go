@@ -0,0 +1,47 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+const meterInterval = 500 * time.Millisecond
+
+// Meter measures throughput, smoothing it over roughly a second.
+type Meter struct {
+	mu    sync.Mutex
+	start time.Time
+	bytes int64
+	rate  float64
+}
+
+func NewMeter() *Meter {
+	return &Meter{start: time.Now()}
+}
+
+// Add records n bytes as transferred now.
+func (m *Meter) Add(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bytes += int64(n)
+
+	elapsed := time.Since(m.start)
+	if elapsed < meterInterval {
+		return
+	}
+	current := float64(m.bytes) / elapsed.Seconds()
+	if m.rate == 0 {
+		m.rate = current
+	} else {
+		m.rate = (m.rate + current) / 2
+	}
+	m.start = time.Now()
+	m.bytes = 0
+}
+
+// Rate returns the throughput in bytes per second.
+func (m *Meter) Rate() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.rate
+}
@@ -0,0 +1,147 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket measured in bytes per second, allowing bursts of
+// up to one second worth of traffic. A rate of 0 means unlimited. A nil
+// *Limiter is valid and never limits.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+// Global limits shared by every transfer of every node in this process.
+var (
+	GlobalUpload   = New(0)
+	GlobalDownload = New(0)
+)
+
+func New(bytesPerSec int64) *Limiter {
+	return &Limiter{
+		rate: bytesPerSec,
+		last: time.Now(),
+	}
+}
+
+// SetRate changes the limit, taking effect for the next read or write.
+func (l *Limiter) SetRate(bytesPerSec int64) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = bytesPerSec
+	l.tokens = 0
+	l.last = time.Now()
+}
+
+func (l *Limiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// reserve takes n bytes from the bucket, going into debt if needed, and
+// returns how long the caller has to wait for the debt to be paid off.
+func (l *Limiter) reserve(n int) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+	l.last = now
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
+
+// Wait blocks until n bytes may pass every one of the limiters.
+func Wait(n int, limiters ...*Limiter) {
+	var wait time.Duration
+	for _, l := range limiters {
+		if d := l.reserve(n); d > wait {
+			wait = d
+		}
+	}
+	time.Sleep(wait)
+}
+
+type reader struct {
+	r        io.Reader
+	limiters []*Limiter
+}
+
+// NewReader returns a reader that is throttled by all of the limiters.
+func NewReader(r io.Reader, limiters ...*Limiter) io.Reader {
+	return &reader{r: r, limiters: limiters}
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	Wait(n, r.limiters...)
+	return n, err
+}
+
+type writer struct {
+	w        io.Writer
+	limiters []*Limiter
+}
+
+// NewWriter returns a writer that is throttled by all of the limiters.
+func NewWriter(w io.Writer, limiters ...*Limiter) io.Writer {
+	return &writer{w: w, limiters: limiters}
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	Wait(len(p), w.limiters...)
+	return w.w.Write(p)
+}
+
+// Config is the on disk form of a pair of upload and download limits.
+type Config struct {
+	UploadLimit   int64 `json:"upload_limit"`   // Bytes per second, 0 for unlimited
+	DownloadLimit int64 `json:"download_limit"` // Bytes per second, 0 for unlimited
+}
+
+// LoadGlobal sets the global limits from the config file at path, a missing
+// file leaves them unlimited.
+func LoadGlobal(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	cfg := Config{}
+	err = json.Unmarshal(data, &cfg)
+	if err != nil {
+		return err
+	}
+	GlobalUpload.SetRate(cfg.UploadLimit)
+	GlobalDownload.SetRate(cfg.DownloadLimit)
+	return nil
+}
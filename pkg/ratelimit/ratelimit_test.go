@@ -0,0 +1,165 @@
+package ratelimit
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// near reports whether got is within 50ms of want, what goes by between
+// taking tokens and checking the time.
+func near(got, want time.Duration) bool {
+	d := got - want
+	return d > -50*time.Millisecond && d < 50*time.Millisecond
+}
+
+func TestLimiter(t *testing.T) {
+	var tests = []struct {
+		name  string
+		rate  int64
+		idle  time.Duration // Since the bucket was last filled
+		takes []int
+		wait  time.Duration // For the last of takes
+	}{
+		{"empty bucket", 1000, 0, []int{500}, 500 * time.Millisecond},
+		{"in debt", 1000, 0, []int{500, 500}, time.Second},
+		{"refilled", 1000, 300 * time.Millisecond, []int{300}, 0},
+		{"burst", 1000, 10 * time.Second, []int{1000}, 0},
+		{"burst of a second at most", 1000, 10 * time.Second, []int{1000, 250}, 250 * time.Millisecond},
+		{"unlimited", 0, 0, []int{1 << 30}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := New(tt.rate)
+			l.last = time.Now().Add(-tt.idle)
+			var wait time.Duration
+			for _, n := range tt.takes {
+				wait = l.reserve(n)
+			}
+			if !near(wait, tt.wait) {
+				t.Errorf("got a wait of %v, want %v", wait, tt.wait)
+			}
+		})
+	}
+}
+
+func TestSetRate(t *testing.T) {
+	l := New(1000)
+	l.reserve(5000)
+	l.SetRate(2000)
+	if l.Rate() != 2000 {
+		t.Errorf("got rate %d, want 2000", l.Rate())
+	}
+	// The debt run up under the old rate is forgotten
+	if wait := l.reserve(1000); !near(wait, 500*time.Millisecond) {
+		t.Errorf("got a wait of %v, want 500ms", wait)
+	}
+	l.SetRate(0)
+	if wait := l.reserve(1 << 30); wait != 0 {
+		t.Errorf("got a wait of %v once unlimited, want none", wait)
+	}
+}
+
+func TestNilLimiter(t *testing.T) {
+	var l *Limiter
+	l.SetRate(1000)
+	if l.Rate() != 0 {
+		t.Errorf("got rate %d, want 0", l.Rate())
+	}
+	if wait := l.reserve(1 << 30); wait != 0 {
+		t.Errorf("got a wait of %v, want none", wait)
+	}
+
+	data := bytes.Repeat([]byte("x"), 1<<20)
+	got, err := io.ReadAll(NewReader(bytes.NewReader(data), nil, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("read something else than what went in")
+	}
+}
+
+func TestWait(t *testing.T) {
+	// The slowest of the limiters sets the pace
+	slow, fast := New(10000), New(1000000)
+	var out bytes.Buffer
+	w := NewWriter(&out, nil, fast, slow)
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		if _, err := w.Write(make([]byte, 500)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 190*time.Millisecond {
+		t.Errorf("2000 bytes at 10000 bytes/s took %v, want 200ms", elapsed)
+	}
+	if out.Len() != 2000 {
+		t.Errorf("got %d bytes written, want 2000", out.Len())
+	}
+}
+
+func TestMeter(t *testing.T) {
+	m := NewMeter()
+	m.Add(1000)
+	if m.Rate() != 0 {
+		t.Errorf("got rate %v before an interval went by, want 0", m.Rate())
+	}
+
+	var tests = []struct {
+		bytes int
+		rate  float64 // Averaged with the previous one
+	}{
+		{1000, 2000}, // Includes the 1000 bytes added before
+		{4000, 3000},
+		{0, 1500},
+	}
+	for _, tt := range tests {
+		m.start = m.start.Add(-time.Second)
+		m.Add(tt.bytes)
+		// The second above is stretched by however long the test took
+		if r := m.Rate(); r > tt.rate || r < tt.rate*0.9 {
+			t.Errorf("got rate %v, want %v", r, tt.rate)
+		}
+	}
+}
+
+func TestLoadGlobal(t *testing.T) {
+	t.Cleanup(func() {
+		GlobalUpload.SetRate(0)
+		GlobalDownload.SetRate(0)
+	})
+	dir := t.TempDir()
+	path := filepath.Join(dir, "bandwidthCfg.json")
+
+	var tests = []struct {
+		name     string
+		config   string // Nothing written if empty
+		err      bool
+		up, down int64
+	}{
+		{"missing", "", false, 0, 0},
+		{"set", `{"upload_limit": 1000, "download_limit": 2000}`, false, 1000, 2000},
+		{"malformed", `{"upload_limit": "fast"}`, true, 1000, 2000},
+		{"removed", `{}`, false, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.config != "" {
+				if err := os.WriteFile(path, []byte(tt.config), 0666); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := LoadGlobal(path)
+			if (err != nil) != tt.err {
+				t.Fatalf("got %v, want an error: %v", err, tt.err)
+			}
+			if GlobalUpload.Rate() != tt.up || GlobalDownload.Rate() != tt.down {
+				t.Errorf("got limits %d up and %d down, want %d and %d", GlobalUpload.Rate(), GlobalDownload.Rate(), tt.up, tt.down)
+			}
+		})
+	}
+}
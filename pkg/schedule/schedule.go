@@ -0,0 +1,367 @@
+package schedule
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Azanul/peer-pressure/pkg/peer"
+	"github.com/Azanul/peer-pressure/pkg/util"
+)
+
+// Job is a send waiting for its time.
+type Job struct {
+	ID        string    `json:"id"`
+	Path      string    `json:"path"`
+	StartAt   time.Time `json:"start_at,omitempty"` // Not before this time, zero for right away
+	Window    *Window   `json:"window,omitempty"`   // Only inside this daily window
+	LastError string    `json:"last_error,omitempty"`
+}
+
+func (j Job) String() string {
+	s := j.ID + "  " + j.Path
+	if !j.StartAt.IsZero() {
+		s += "  at " + j.StartAt.Format(time.RFC3339)
+	}
+	if j.Window != nil {
+		s += "  within " + j.Window.String()
+	}
+	if j.LastError != "" {
+		s += "  (last attempt failed: " + j.LastError + ")"
+	}
+	return s
+}
+
+// due returns when the job may start, given the current time.
+func (j Job) due(now time.Time) time.Time {
+	t := now
+	if j.StartAt.After(t) {
+		t = j.StartAt
+	}
+	if j.Window != nil {
+		t = j.Window.NextOpen(t)
+	}
+	return t
+}
+
+// SendFunc performs the send of a job. It has to honour the commands on
+// cmdCh, the queue uses them to pause the send outside of the job's window.
+type SendFunc func(ctx context.Context, job Job, cmdCh chan peer.Command) error
+
+// Queue holds the pending jobs of a node. Every change is saved to disk so
+// the jobs survive restarts. Several processes may share a queue, a running
+// queue and the schedule commands for one: changes are made to the jobs as
+// saved, under a lock file, so that none are lost.
+type Queue struct {
+	mu    sync.Mutex
+	path  string
+	poll  time.Duration    // How often Run looks for jobs added or removed elsewhere
+	retry peer.RetryPolicy // How Run retries failed jobs
+	Jobs  []Job            `json:"jobs"`
+}
+
+// pollInterval is how often a running queue picks up changes made by other
+// processes.
+const pollInterval = 5 * time.Second
+
+// Lock file handling, the lock is only held while the queue is read and
+// written again
+const (
+	lockRetry = 10 * time.Millisecond
+	lockWait  = 5 * time.Second  // Longest wait for the lock
+	lockStale = 10 * time.Second // Age of a lock left behind by a crash
+)
+
+var (
+	ErrLocked = errors.New("schedule locked by another process")
+	ErrNoJob  = errors.New("no scheduled job")
+)
+
+// Load reads the queue saved at path, a missing file is an empty queue.
+func Load(path string) (*Queue, error) {
+	q := &Queue{path: path, poll: pollInterval, retry: peer.DefaultRetryPolicy}
+	err := q.reload()
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *Queue) reload() error {
+	data, err := os.ReadFile(q.path)
+	if os.IsNotExist(err) {
+		q.Jobs = nil
+		return nil
+	} else if err != nil {
+		return err
+	}
+	q.Jobs = nil
+	err = json.Unmarshal(data, q)
+	if err != nil {
+		return fmt.Errorf("error parsing %s: %w", q.path, err)
+	}
+	return nil
+}
+
+// update applies change to the jobs as saved and saves them again, holding
+// the lock file.
+func (q *Queue) update(change func() error) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	unlock, err := lock(q.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	err = q.reload()
+	if err != nil {
+		return err
+	}
+	err = change()
+	if err != nil {
+		return err
+	}
+	return q.save()
+}
+
+// lock creates the lock file at path, waiting for another process holding
+// it, and returns the function removing it.
+func lock(path string) (func(), error) {
+	deadline := time.Now().Add(lockWait)
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > lockStale {
+			log.Warnf("Removing the stale lock %s", path)
+			os.Remove(path)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%w: %s", ErrLocked, path)
+		}
+		time.Sleep(lockRetry)
+	}
+}
+
+// Add queues a new job and returns it with its ID filled in.
+func (q *Queue) Add(job Job) (Job, error) {
+	job.ID = util.RandString(8)
+	return job, q.update(func() error {
+		q.Jobs = append(q.Jobs, job)
+		return nil
+	})
+}
+
+// Remove drops the job with the given ID.
+func (q *Queue) Remove(id string) error {
+	return q.update(func() error {
+		for i, job := range q.Jobs {
+			if job.ID == id {
+				q.Jobs = append(q.Jobs[:i], q.Jobs[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("%w with ID %s", ErrNoJob, id)
+	})
+}
+
+func (q *Queue) setError(id string, jobErr error) {
+	err := q.update(func() error {
+		for i := range q.Jobs {
+			if q.Jobs[i].ID == id {
+				q.Jobs[i].LastError = jobErr.Error()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorln("Error saving schedule:", err)
+	}
+}
+
+// save writes the queue to a temporary file first, so that readers not
+// holding the lock never see it half written.
+func (q *Queue) save() error {
+	data, err := json.MarshalIndent(q, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := q.path + ".tmp"
+	err = os.WriteFile(tmp, data, 0666)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path)
+}
+
+// jobs returns the jobs as saved, picking up changes made elsewhere.
+func (q *Queue) jobs() ([]Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	err := q.reload()
+	if err != nil {
+		return nil, err
+	}
+	return append([]Job(nil), q.Jobs...), nil
+}
+
+// Run starts the queued jobs once they're due and keeps running while jobs
+// remain or until ctx is cancelled. Jobs queued in the meantime are picked
+// up, removed ones are stopped. Finished jobs are removed from the queue.
+// Failed ones keep their error and are tried again, inside their window,
+// backing off between attempts; once the retries are used up they stay
+// queued for the next run.
+func (q *Queue) Run(ctx context.Context, send SendFunc) {
+	type result struct {
+		id  string
+		err error
+	}
+	results := make(chan result)
+	running := map[string]context.CancelFunc{}
+	failures := map[string]int{}
+	retryAt := map[string]time.Time{}
+	poll := time.NewTicker(q.poll)
+	defer poll.Stop()
+
+	for {
+		if ctx.Err() != nil {
+			for range running {
+				<-results
+			}
+			return
+		}
+		jobs, err := q.jobs()
+		if err != nil {
+			log.Errorln("Error loading schedule:", err)
+		}
+		queued := map[string]bool{}
+		waiting := 0
+		for _, job := range jobs {
+			queued[job.ID] = true
+			if running[job.ID] != nil || failures[job.ID] > q.retry.MaxAttempts {
+				continue
+			}
+			waiting++
+			jobCtx, cancel := context.WithCancel(ctx)
+			running[job.ID] = cancel
+			go func(job Job, notBefore time.Time) {
+				results <- result{job.ID, runJob(jobCtx, job, notBefore, send)}
+			}(job, retryAt[job.ID])
+		}
+		for id, cancel := range running {
+			if err == nil && !queued[id] {
+				log.Printf("Scheduled send %s was cancelled, stopping it", id)
+				cancel()
+			}
+		}
+		if len(running) == 0 && waiting == 0 {
+			return
+		}
+
+		select {
+		case r := <-results:
+			running[r.id]()
+			delete(running, r.id)
+			switch {
+			case r.err == nil:
+				log.Printf("Scheduled send %s done", r.id)
+				if err := q.Remove(r.id); err != nil && !errors.Is(err, ErrNoJob) {
+					log.Errorln(err)
+				}
+			case ctx.Err() != nil || !queued[r.id]:
+				// Stopped, not failed
+			default:
+				failures[r.id]++
+				q.setError(r.id, r.err)
+				if failures[r.id] > q.retry.MaxAttempts {
+					log.Errorf("Scheduled send %s failed: %v, giving up", r.id, r.err)
+					break
+				}
+				delay := q.retry.Delay(failures[r.id])
+				log.Errorf("Scheduled send %s failed: %v, retrying in %s", r.id, r.err, delay)
+				retryAt[r.id] = time.Now().Add(delay)
+			}
+		case <-poll.C:
+		case <-ctx.Done():
+		}
+	}
+}
+
+// runJob waits for job to be due, not before notBefore, and sends it, only
+// inside its window.
+func runJob(ctx context.Context, job Job, notBefore time.Time, send SendFunc) error {
+	now := time.Now()
+	if notBefore.After(now) {
+		now = notBefore
+	}
+	due := job.due(now)
+	log.Printf("Scheduled send %s waiting until %s", job.ID, due.Format(time.RFC3339))
+	if !sleepUntil(ctx, due) {
+		return ctx.Err()
+	}
+
+	cmdCh := make(chan peer.Command)
+	done := make(chan error, 1)
+	go func() {
+		done <- send(ctx, job, cmdCh)
+	}()
+	if job.Window == nil {
+		return <-done
+	}
+
+	// Pause the send whenever the window closes and continue once it opens
+	for {
+		closes := time.NewTimer(time.Until(job.Window.NextClose(time.Now())))
+		select {
+		case err := <-done:
+			closes.Stop()
+			return err
+		case <-closes.C:
+		}
+
+		log.Printf("Window of scheduled send %s closed, pausing", job.ID)
+		select {
+		case err := <-done:
+			return err
+		case cmdCh <- peer.Pause:
+		}
+		if !sleepUntil(ctx, job.Window.NextOpen(time.Now())) {
+			select {
+			case <-done:
+			case cmdCh <- peer.Stop:
+			}
+			return ctx.Err()
+		}
+
+		log.Printf("Window of scheduled send %s opened, continuing", job.ID)
+		select {
+		case err := <-done:
+			return err
+		case cmdCh <- peer.Continue:
+		}
+	}
+}
+
+// sleepUntil waits for t, it reports false if ctx was cancelled first.
+func sleepUntil(ctx context.Context, t time.Time) bool {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
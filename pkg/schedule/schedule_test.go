@@ -0,0 +1,249 @@
+package schedule
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azanul/peer-pressure/pkg/peer"
+)
+
+// paths returns the paths of the jobs saved at path, sorted.
+func paths(t *testing.T, path string) []string {
+	t.Helper()
+	q, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, job := range q.Jobs {
+		got = append(got, job.Path)
+	}
+	sort.Strings(got)
+	return got
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// TestQueueShared has two queues loaded from the same file, like a running
+// queue and the schedule commands, change it in turns.
+func TestQueueShared(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schedule.json")
+	runner, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := runner.Add(Job{Path: "first"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name   string
+		change func() error
+		err    error
+		want   []string
+	}{
+		{"added elsewhere", func() error { _, err := cli.Add(Job{Path: "second"}); return err }, nil, []string{"first", "second"}},
+		{"error saved", func() error { runner.setError(first.ID, errors.New("failed")); return nil }, nil, []string{"first", "second"}},
+		{"removed elsewhere", func() error { return cli.Remove(first.ID) }, nil, []string{"second"}},
+		{"removed again", func() error { return runner.Remove(first.ID) }, ErrNoJob, []string{"second"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.change(); !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if got := paths(t, path); !equal(got, tt.want) {
+				t.Errorf("saved %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueueConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schedule.json")
+	var want []string
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		q, err := Load(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := string(rune('a' + i))
+		want = append(want, name)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := q.Add(Job{Path: name}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := paths(t, path); !equal(got, want) {
+		t.Errorf("saved %v, want %v", got, want)
+	}
+	if _, err := os.Stat(path + ".lock"); !os.IsNotExist(err) {
+		t.Errorf("lock left behind: %v", err)
+	}
+}
+
+func TestStaleLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schedule.json")
+	if err := os.WriteFile(path+".lock", nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * lockStale)
+	if err := os.Chtimes(path+".lock", old, old); err != nil {
+		t.Fatal(err)
+	}
+	q, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Add(Job{Path: "file"}); err != nil {
+		t.Errorf("got %v with a stale lock", err)
+	}
+}
+
+// fastQueue loads the queue at path, polling and retrying without delay.
+func fastQueue(t *testing.T, path string) *Queue {
+	t.Helper()
+	q, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.poll = 10 * time.Millisecond
+	q.retry = peer.RetryPolicy{MaxAttempts: 2, Initial: time.Millisecond, Max: time.Millisecond, Multiplier: 1}
+	return q
+}
+
+func TestRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schedule.json")
+	q := fastQueue(t, path)
+	for _, p := range []string{"ok", "flaky", "failing"} {
+		if _, err := q.Add(Job{Path: p}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var mu sync.Mutex
+	calls := map[string]int{}
+	q.Run(context.Background(), func(ctx context.Context, job Job, cmdCh chan peer.Command) error {
+		mu.Lock()
+		defer mu.Unlock()
+		calls[job.Path]++
+		if job.Path == "failing" || (job.Path == "flaky" && calls[job.Path] == 1) {
+			return errors.New("peer gone")
+		}
+		return nil
+	})
+
+	want := map[string]int{"ok": 1, "flaky": 2, "failing": 3}
+	for p, n := range want {
+		if calls[p] != n {
+			t.Errorf("%s sent %d times, want %d", p, calls[p], n)
+		}
+	}
+	saved, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.Jobs) != 1 || saved.Jobs[0].Path != "failing" || saved.Jobs[0].LastError != "peer gone" {
+		t.Errorf("saved %+v, want the failed job with its error", saved.Jobs)
+	}
+}
+
+// TestRunChanges changes the queue from elsewhere while it runs.
+func TestRunChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schedule.json")
+	q := fastQueue(t, path)
+	cli, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"blocking", "removed"} {
+		if _, err := q.Add(Job{Path: p}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	started, stopped := make(chan string, 3), make(chan string, 3)
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		q.Run(context.Background(), func(ctx context.Context, job Job, cmdCh chan peer.Command) error {
+			started <- job.Path
+			if job.Path == "added" {
+				return nil
+			}
+			select {
+			case <-release:
+				return nil
+			case <-ctx.Done():
+				stopped <- job.Path
+				return ctx.Err()
+			}
+		})
+	}()
+
+	expect := func(ch chan string, want string) {
+		t.Helper()
+		select {
+		case got := <-ch:
+			if got != want {
+				t.Fatalf("got %s, want %s", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s never came", want)
+		}
+	}
+	got := []string{<-started, <-started}
+	sort.Strings(got)
+	if !equal(got, []string{"blocking", "removed"}) {
+		t.Fatalf("started %v", got)
+	}
+
+	if _, err := cli.Add(Job{Path: "added"}); err != nil {
+		t.Fatal(err)
+	}
+	expect(started, "added")
+	for _, job := range cli.Jobs {
+		if job.Path == "removed" {
+			if err := cli.Remove(job.ID); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	expect(stopped, "removed")
+
+	close(release)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("still running with the queue empty")
+	}
+	if got := paths(t, path); len(got) != 0 {
+		t.Errorf("saved %v, want an empty queue", got)
+	}
+}
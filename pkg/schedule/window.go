@@ -0,0 +1,78 @@
+package schedule
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Window is a daily time range in local time, e.g. 01:00-06:00. It may wrap
+// past midnight, e.g. 22:00-04:00.
+type Window struct {
+	Start int `json:"start"` // Minutes since midnight
+	End   int `json:"end"`   // Minutes since midnight
+}
+
+// ParseWindow parses a window in the HH:MM-HH:MM form.
+func ParseWindow(s string) (Window, error) {
+	start, end, found := strings.Cut(s, "-")
+	if !found {
+		return Window{}, fmt.Errorf("window %q is not in the HH:MM-HH:MM form", s)
+	}
+	startMin, err := parseClock(start)
+	if err != nil {
+		return Window{}, err
+	}
+	endMin, err := parseClock(end)
+	if err != nil {
+		return Window{}, err
+	}
+	if startMin == endMin {
+		return Window{}, fmt.Errorf("window %q is empty", s)
+	}
+	return Window{Start: startMin, End: endMin}, nil
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q: %w", s, err)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (w Window) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", w.Start/60, w.Start%60, w.End/60, w.End%60)
+}
+
+// Contains reports whether t falls inside the window.
+func (w Window) Contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if w.Start < w.End {
+		return m >= w.Start && m < w.End
+	}
+	return m >= w.Start || m < w.End
+}
+
+// NextOpen returns the next time the window opens after t, or t itself if
+// the window is already open.
+func (w Window) NextOpen(t time.Time) time.Time {
+	if w.Contains(t) {
+		return t
+	}
+	return nextClock(t, w.Start)
+}
+
+// NextClose returns the next time the window closes after t.
+func (w Window) NextClose(t time.Time) time.Time {
+	return nextClock(t, w.End)
+}
+
+// nextClock returns the first time after t at the given minute of the day.
+func nextClock(t time.Time, minutes int) time.Time {
+	next := time.Date(t.Year(), t.Month(), t.Day(), minutes/60, minutes%60, 0, 0, t.Location())
+	if !next.After(t) {
+		next = time.Date(t.Year(), t.Month(), t.Day()+1, minutes/60, minutes%60, 0, 0, t.Location())
+	}
+	return next
+}
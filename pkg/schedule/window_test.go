@@ -0,0 +1,68 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseWindow(t *testing.T) {
+	var tests = []struct {
+		in      string
+		want    Window
+		wantErr bool
+	}{
+		{"01:00-06:00", Window{60, 360}, false},
+		{"22:30-04:15", Window{1350, 255}, false},
+		{" 1:00 - 6:00 ", Window{60, 360}, false},
+		{"01:00", Window{}, true},
+		{"01:00-01:00", Window{}, true},
+		{"25:00-06:00", Window{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseWindow(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWindowNextOpenClose(t *testing.T) {
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2023, 3, day, hour, min, 0, 0, time.UTC)
+	}
+	night := Window{Start: 60, End: 360}  // 01:00-06:00
+	wrap := Window{Start: 1320, End: 240} // 22:00-04:00
+
+	var tests = []struct {
+		name      string
+		w         Window
+		now       time.Time
+		wantOpen  time.Time
+		wantClose time.Time
+	}{
+		{"BeforeWindow", night, at(1, 0, 30), at(1, 1, 0), at(1, 6, 0)},
+		{"InsideWindow", night, at(1, 2, 0), at(1, 2, 0), at(1, 6, 0)},
+		{"AfterWindow", night, at(1, 7, 0), at(2, 1, 0), at(2, 6, 0)},
+		{"AtClose", night, at(1, 6, 0), at(2, 1, 0), at(2, 6, 0)},
+		{"WrapEvening", wrap, at(1, 23, 0), at(1, 23, 0), at(2, 4, 0)},
+		{"WrapMorning", wrap, at(2, 3, 0), at(2, 3, 0), at(2, 4, 0)},
+		{"WrapOutside", wrap, at(2, 12, 0), at(2, 22, 0), at(3, 4, 0)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.w.NextOpen(tt.now); !got.Equal(tt.wantOpen) {
+				t.Errorf("NextOpen got %v, want %v", got, tt.wantOpen)
+			}
+			if got := tt.w.NextClose(tt.w.NextOpen(tt.now)); !got.Equal(tt.wantClose) {
+				t.Errorf("NextClose got %v, want %v", got, tt.wantClose)
+			}
+		})
+	}
+}
@@ -0,0 +1,307 @@
+// Package seal encrypts data for a node, so that only the node holding the
+// private key can read it. Data is encrypted under a random key with
+// AES-256-GCM, the key itself is wrapped for the public key of the node: with
+// RSA-OAEP for RSA keys, the keys nodes are created with, and with an
+// ephemeral ECDH exchange for ECDSA keys.
+package seal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"golang.org/x/crypto/hkdf"
+)
+
+// KeySize is the length of the keys data is sealed under.
+const KeySize = 32
+
+// SegmentSize is how much plaintext a Writer seals at a time.
+const SegmentSize = 64 << 10
+
+// label binds wrapped keys to their use here.
+var label = []byte("peer-pressure seal")
+
+var (
+	ErrUnsupportedKey = errors.New("key type can't be sealed for")
+	ErrOpen           = errors.New("sealed data doesn't open, wrong key or tampered with")
+)
+
+// NewKey returns a random key to seal data under.
+func NewKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	_, err := io.ReadFull(rand.Reader, key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// WrapKey encrypts key for the holder of the private key of pub.
+func WrapKey(pub crypto.PubKey, key []byte) ([]byte, error) {
+	std, err := crypto.PubKeyToStdKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedKey, err)
+	}
+	switch pub := std.(type) {
+	case *rsa.PublicKey:
+		return rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, key, label)
+	case *ecdsa.PublicKey:
+		ephemeral, err := ecdsa.GenerateKey(pub.Curve, rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		point := elliptic.Marshal(pub.Curve, ephemeral.X, ephemeral.Y)
+		aead, err := sharedAEAD(pub.Curve, pub.X, pub.Y, ephemeral.D.Bytes(), point)
+		if err != nil {
+			return nil, err
+		}
+		nonce := make([]byte, aead.NonceSize())
+		_, err = io.ReadFull(rand.Reader, nonce)
+		if err != nil {
+			return nil, err
+		}
+		wrapped := append(point, nonce...)
+		return aead.Seal(wrapped, nonce, key, label), nil
+	}
+	return nil, fmt.Errorf("%w: %T", ErrUnsupportedKey, std)
+}
+
+// UnwrapKey decrypts a key wrapped by WrapKey for the public key of priv.
+func UnwrapKey(priv crypto.PrivKey, wrapped []byte) ([]byte, error) {
+	std, err := crypto.PrivKeyToStdKey(priv)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedKey, err)
+	}
+	var key []byte
+	switch priv := std.(type) {
+	case *rsa.PrivateKey:
+		key, err = rsa.DecryptOAEP(sha256.New(), nil, priv, wrapped, label)
+	case *ecdsa.PrivateKey:
+		n := 1 + 2*((priv.Curve.Params().BitSize+7)/8)
+		if len(wrapped) < n {
+			return nil, ErrOpen
+		}
+		point := wrapped[:n]
+		x, y := elliptic.Unmarshal(priv.Curve, point)
+		if x == nil {
+			return nil, ErrOpen
+		}
+		aead, err := sharedAEAD(priv.Curve, x, y, priv.D.Bytes(), point)
+		if err != nil {
+			return nil, err
+		}
+		rest := wrapped[n:]
+		if len(rest) < aead.NonceSize() {
+			return nil, ErrOpen
+		}
+		key, err = aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], label)
+	default:
+		return nil, fmt.Errorf("%w: %T", ErrUnsupportedKey, std)
+	}
+	if err != nil || len(key) != KeySize {
+		return nil, ErrOpen
+	}
+	return key, nil
+}
+
+// sharedAEAD derives the cipher a key is wrapped with from the ECDH secret of
+// the point (x, y) and the scalar d. The ephemeral point is mixed in as well.
+func sharedAEAD(curve elliptic.Curve, x, y *big.Int, d []byte, point []byte) (cipher.AEAD, error) {
+	sx, _ := curve.ScalarMult(x, y, d)
+	kek := make([]byte, KeySize)
+	_, err := io.ReadFull(hkdf.New(sha256.New, sx.Bytes(), point, label), kek)
+	if err != nil {
+		return nil, err
+	}
+	return newAEAD(kek)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Chunks seals the chunks of a file one by one under a key, so that they can
+// be sent and opened in any order. The nonce of a chunk is made from its
+// index, which is why a key must only ever seal the chunks of one version of
+// one file.
+type Chunks struct {
+	aead cipher.AEAD
+}
+
+// NewChunks returns the chunk cipher under key.
+func NewChunks(key []byte) (*Chunks, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Chunks{aead: aead}, nil
+}
+
+// Seal returns chunk i sealed.
+func (c *Chunks) Seal(i int32, data []byte) []byte {
+	return c.aead.Seal(nil, chunkNonce(i), data, nil)
+}
+
+// Open returns the data of chunk i, sealed by Seal, or ErrOpen.
+func (c *Chunks) Open(i int32, sealed []byte) ([]byte, error) {
+	data, err := c.aead.Open(nil, chunkNonce(i), sealed, nil)
+	if err != nil {
+		return nil, ErrOpen
+	}
+	return data, nil
+}
+
+func chunkNonce(i int32) []byte {
+	n := make([]byte, 12)
+	binary.BigEndian.PutUint32(n[8:], uint32(i))
+	return n
+}
+
+// Size returns how long n bytes of plaintext are once sealed by a Writer.
+func Size(n int64) int64 {
+	segments := (n + SegmentSize - 1) / SegmentSize
+	if segments == 0 {
+		segments = 1
+	}
+	return n + segments*16
+}
+
+// nonce returns the nonce of segment i. The last segment of a stream is
+// sealed with a different additional data, so that a stream cut short at a
+// segment boundary doesn't open.
+func nonce(i uint64) []byte {
+	n := make([]byte, 12)
+	binary.BigEndian.PutUint64(n[4:], i)
+	return n
+}
+
+func additionalData(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// Writer seals what is written to it segment by segment. It has to be
+// closed to seal the last one.
+type Writer struct {
+	w    io.Writer
+	aead cipher.AEAD
+	buf  []byte
+	i    uint64
+}
+
+// NewWriter returns a Writer sealing to w under key, which must never seal
+// another stream.
+func NewWriter(w io.Writer, key []byte) (*Writer, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{w: w, aead: aead, buf: make([]byte, 0, SegmentSize)}, nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full segment is only sealed once more follows, the last one may be full too
+		if len(w.buf) == SegmentSize {
+			err := w.seal(false)
+			if err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buf[len(w.buf):SegmentSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close seals the last segment, it doesn't close the underlying writer.
+func (w *Writer) Close() error {
+	return w.seal(true)
+}
+
+func (w *Writer) seal(last bool) error {
+	sealed := w.aead.Seal(nil, nonce(w.i), w.buf, additionalData(last))
+	w.i++
+	w.buf = w.buf[:0]
+	_, err := w.w.Write(sealed)
+	return err
+}
+
+// Reader opens what a Writer sealed. It returns io.EOF after the last
+// segment, io.ErrUnexpectedEOF if the stream ends between segments before it
+// and ErrOpen if a segment doesn't open, cut short ones included.
+type Reader struct {
+	r    io.Reader
+	aead cipher.AEAD
+	buf  []byte // Opened but not yet read
+	seg  []byte
+	i    uint64
+	done bool
+}
+
+// NewReader returns a Reader opening r under key.
+func NewReader(r io.Reader, key []byte) (*Reader, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{r: r, aead: aead, seg: make([]byte, SegmentSize+aead.Overhead())}, nil
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		err := r.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// open reads and opens the next segment. Only the last one can be short.
+func (r *Reader) open() error {
+	n, err := io.ReadFull(r.r, r.seg)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	} else if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	short := err == io.ErrUnexpectedEOF
+	sealed := r.seg[:n]
+	opened, err := r.aead.Open(nil, nonce(r.i), sealed, additionalData(false))
+	if err != nil || short {
+		opened, err = r.aead.Open(nil, nonce(r.i), sealed, additionalData(true))
+		if err != nil {
+			return ErrOpen
+		}
+		r.done = true
+	}
+	r.i++
+	r.buf = opened
+	return nil
+}
@@ -0,0 +1,181 @@
+package seal
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+func TestWrapKey(t *testing.T) {
+	var tests = []struct {
+		name    string
+		typ     int
+		bits    int
+		wrapErr error
+	}{
+		{"RSA", crypto.RSA, 2048, nil},
+		{"ECDSA", crypto.ECDSA, 0, nil},
+		{"Ed25519", crypto.Ed25519, 0, ErrUnsupportedKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			priv, pub, err := crypto.GenerateKeyPair(tt.typ, tt.bits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			other, _, err := crypto.GenerateKeyPair(tt.typ, tt.bits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			key, err := NewKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+			wrapped, err := WrapKey(pub, key)
+			if !errors.Is(err, tt.wrapErr) {
+				t.Fatalf("got %v, want %v", err, tt.wrapErr)
+			}
+			if err != nil {
+				return
+			}
+			if bytes.Contains(wrapped, key) {
+				t.Error("key readable in the wrapped key")
+			}
+			got, err := UnwrapKey(priv, wrapped)
+			if err != nil || !bytes.Equal(got, key) {
+				t.Errorf("got %x, %v, want %x", got, err, key)
+			}
+			if _, err := UnwrapKey(other, wrapped); !errors.Is(err, ErrOpen) {
+				t.Errorf("unwrapped with another key: %v", err)
+			}
+			wrapped[len(wrapped)-1] ^= 1
+			if _, err := UnwrapKey(priv, wrapped); !errors.Is(err, ErrOpen) {
+				t.Errorf("unwrapped a damaged key: %v", err)
+			}
+		})
+	}
+}
+
+func TestWriter(t *testing.T) {
+	key, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{0, 1, SegmentSize - 1, SegmentSize, SegmentSize + 1, 3*SegmentSize + 7} {
+		data := make([]byte, n)
+		rand.New(rand.NewSource(int64(n))).Read(data)
+		var sealed bytes.Buffer
+		w, err := NewWriter(&sealed, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Odd sized writes, to cross segment boundaries
+		for rest := data; len(rest) > 0; {
+			k := 1000
+			if k > len(rest) {
+				k = len(rest)
+			}
+			if _, err := w.Write(rest[:k]); err != nil {
+				t.Fatal(err)
+			}
+			rest = rest[k:]
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if int64(sealed.Len()) != Size(int64(n)) {
+			t.Errorf("%d bytes sealed to %d, Size says %d", n, sealed.Len(), Size(int64(n)))
+		}
+
+		var tests = []struct {
+			name   string
+			sealed []byte
+			err    error
+		}{
+			{"whole", sealed.Bytes(), nil},
+			{"truncated", sealed.Bytes()[:sealed.Len()-1], ErrOpen},
+			{"damaged", damage(sealed.Bytes(), sealed.Len()/2), ErrOpen},
+		}
+		if n > SegmentSize {
+			// Cut at the end of the first segment, which opens on its own
+			tests = append(tests, struct {
+				name   string
+				sealed []byte
+				err    error
+			}{"cut", sealed.Bytes()[:SegmentSize+16], io.ErrUnexpectedEOF})
+		}
+		for _, tt := range tests {
+			r, err := NewReader(bytes.NewReader(tt.sealed), key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(r)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("%d bytes %s: got %v, want %v", n, tt.name, err, tt.err)
+			}
+			if err == nil && !bytes.Equal(got, data) {
+				t.Errorf("%d bytes %s: opened to different data", n, tt.name)
+			}
+		}
+	}
+}
+
+func TestChunks(t *testing.T) {
+	key, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewChunks(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("chunk data")
+	sealed := c.Seal(3, data)
+	var tests = []struct {
+		name   string
+		i      int32
+		sealed []byte
+		err    error
+	}{
+		{"same index", 3, sealed, nil},
+		{"other index", 4, sealed, ErrOpen},
+		{"damaged", 3, damage(sealed, 0), ErrOpen},
+		{"short", 3, sealed[:10], ErrOpen},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := c.Open(tt.i, tt.sealed)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if err == nil && !bytes.Equal(got, data) {
+				t.Errorf("got %q, want %q", got, data)
+			}
+		})
+	}
+	if !bytes.Equal(c.Seal(3, data), sealed) {
+		t.Error("a chunk sealed again differs, resent chunks wouldn't match")
+	}
+}
+
+// damage returns a copy of b with the byte at i flipped.
+func damage(b []byte, i int) []byte {
+	d := append([]byte(nil), b...)
+	d[i] ^= 0xff
+	return d
+}
+
+func BenchmarkWriter(b *testing.B) {
+	key, _ := NewKey()
+	data := make([]byte, 1<<20)
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		w, _ := NewWriter(io.Discard, key)
+		w.Write(data)
+		w.Close()
+	}
+}
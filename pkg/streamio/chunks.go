@@ -0,0 +1,275 @@
+package streamio
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/Azanul/peer-pressure/pkg/cdc"
+	"github.com/Azanul/peer-pressure/pkg/chunkstore"
+	"github.com/Azanul/peer-pressure/pkg/merkle"
+	"github.com/Azanul/peer-pressure/pkg/pressure/pb"
+	"github.com/Azanul/peer-pressure/pkg/seal"
+)
+
+// Chunking is how a sender splits a file into chunks.
+type Chunking int8
+
+const (
+	// Fixed cuts the file into slices of the same size, addressed by index.
+	Fixed Chunking = iota
+	// ContentDefined cuts where the content says, see package cdc, and lists
+	// the digests of the chunks in the index. Receivers fetch only the
+	// chunks their chunk store lacks.
+	ContentDefined
+)
+
+// maxChunkRefs keeps the index of a file with content defined chunks well
+// below pb.MaxMessageSize, bigger files are sent in fixed chunks.
+const maxChunkRefs = 1 << 18
+
+// maxBadChunks is how many chunks failing their check a receiver drops and
+// fetches again before it gives up on the sender.
+const maxBadChunks = 64
+
+// ErrBadChunk is returned for a chunk that doesn't match its digest or
+// Merkle proof.
+var ErrBadChunk = errors.New("chunk doesn't match the manifest")
+
+// span returns where chunk i of the file described by index starts and how
+// long it is at most.
+func span(index *pb.Index, i int32) (int64, int) {
+	if refs := index.GetChunks(); len(refs) > 0 {
+		return refs[i].GetOffset(), int(refs[i].GetSize())
+	}
+	return int64(i) * chunkSize, chunkSize
+}
+
+// chunkAt returns the chunk holding byte off of the file described by index.
+func chunkAt(index *pb.Index, off int64) int32 {
+	refs := index.GetChunks()
+	if len(refs) == 0 {
+		return int32(off / chunkSize)
+	}
+	return int32(sort.Search(len(refs), func(i int) bool {
+		return refs[i].GetOffset()+int64(refs[i].GetSize()) > off
+	}))
+}
+
+// maxChunk returns the size of the largest chunk a file can have.
+func maxChunk(index *pb.Index) int {
+	if len(index.GetChunks()) > 0 {
+		return cdc.MaxSize
+	}
+	return chunkSize
+}
+
+// inBitmap reports whether bit i of bitmap is set.
+func inBitmap(bitmap []byte, i int32) bool {
+	return int(i/8) < len(bitmap) && bitmap[i/8]&(1<<(i%8)) != 0
+}
+
+// CheckChunks makes sure the content defined chunks listed in index, if
+// any, cover the file without gaps, keep to the size bounds and match the
+// Merkle root. Fixed chunks have to add up to the size of the file, when
+// the sender gives it.
+func CheckChunks(index *pb.Index) error {
+	refs := index.GetChunks()
+	if index.GetNChunks() < 0 || index.GetSize() < 0 {
+		return fmt.Errorf("%d chunks for a file of %d bytes", index.GetNChunks(), index.GetSize())
+	}
+	if len(refs) == 0 {
+		if size := index.GetSize(); size > 0 && int64(index.GetNChunks()) != (size+chunkSize-1)/chunkSize {
+			return fmt.Errorf("%d chunks for a file of %d bytes", index.GetNChunks(), size)
+		}
+		return nil
+	}
+	if len(refs) != int(index.GetNChunks()) {
+		return fmt.Errorf("%d chunks listed for %d", len(refs), index.GetNChunks())
+	}
+	var offset int64
+	for i, ref := range refs {
+		if ref.GetOffset() != offset || ref.GetSize() <= 0 || ref.GetSize() > cdc.MaxSize || len(ref.GetSha256()) != sha256.Size {
+			return fmt.Errorf("chunk %d of %d bytes at %d is malformed", i, ref.GetSize(), ref.GetOffset())
+		}
+		offset += int64(ref.GetSize())
+	}
+	if offset != index.GetSize() {
+		return fmt.Errorf("chunks add up to %d bytes for a file of %d", offset, index.GetSize())
+	}
+	if root := index.GetMerkleRoot(); root != nil {
+		leaves := make([][]byte, len(refs))
+		for i, ref := range refs {
+			leaves[i] = ref.GetSha256()
+		}
+		if !bytes.Equal(merkle.Root(leaves), root) {
+			return errors.New("chunk digests don't add up to the Merkle root")
+		}
+	}
+	return nil
+}
+
+// checkChunk makes sure a received chunk is the one described by the index,
+// fitting its span, against the listed digest for content defined chunks
+// and against the Merkle root with the chunk's proof otherwise. Chunks of senders not giving
+// a root are only checked with the whole file. A chunk of a sealed transfer
+// is opened with chunks first, its data replaced by what it holds.
+func checkChunk(index *pb.Index, chunk *pb.Chunk, chunks *seal.Chunks) error {
+	if chunk.Index < 0 || chunk.Index >= index.NChunks {
+		return fmt.Errorf("chunk index %d out of range", chunk.Index)
+	}
+	if chunks != nil {
+		data, err := chunks.Open(chunk.Index, chunk.Data)
+		if err != nil {
+			return fmt.Errorf("%w: chunk %d: %v", ErrBadChunk, chunk.Index, err)
+		}
+		chunk.Data = data
+	}
+	offset, length := span(index, chunk.Index)
+	if size := index.GetSize(); len(chunk.Data) > length || size > 0 && offset+int64(len(chunk.Data)) > size {
+		return fmt.Errorf("%w: chunk %d of %d bytes", ErrBadChunk, chunk.Index, len(chunk.Data))
+	}
+	sum := sha256.Sum256(chunk.Data)
+	if refs := index.GetChunks(); len(refs) > 0 {
+		if !bytes.Equal(sum[:], refs[chunk.Index].GetSha256()) {
+			return fmt.Errorf("%w: chunk %d", ErrBadChunk, chunk.Index)
+		}
+	} else if root := index.GetMerkleRoot(); root != nil {
+		if !merkle.Verify(root, sum[:], int(chunk.Index), int(index.NChunks), chunk.GetProof()) {
+			return fmt.Errorf("%w: chunk %d", ErrBadChunk, chunk.Index)
+		}
+	}
+	return nil
+}
+
+// fixedLeaves returns the digests of the fixed chunks of the data read from
+// r, the leaves of its Merkle tree.
+func fixedLeaves(r io.Reader) ([][]byte, error) {
+	var leaves [][]byte
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			sum := sha256.Sum256(buf[:n])
+			leaves = append(leaves, sum[:])
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return leaves, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// proofTree rebuilds the tree that proves the fixed chunks of the file
+// described by index, nil if the index lists its chunks or has no root.
+func proofTree(file *os.File, index *pb.Index) (*merkle.Tree, error) {
+	if len(index.GetChunks()) > 0 || index.GetMerkleRoot() == nil {
+		return nil, nil
+	}
+	leaves, err := fixedLeaves(io.NewSectionReader(file, 0, index.GetSize()))
+	if err != nil {
+		return nil, err
+	}
+	tree := merkle.New(leaves)
+	if !bytes.Equal(tree.Root(), index.GetMerkleRoot()) {
+		return nil, fmt.Errorf("%s changed since it was indexed", file.Name())
+	}
+	return tree, nil
+}
+
+// RequestChunks asks the sender for count chunks from start and writes them
+// to file as they arrive, checked first, see checkChunk, and opened with
+// chunks in a sealed transfer. got is called for every chunk written. Chunks
+// failing their check are dropped and reported as ErrBadChunk once the rest
+// have arrived, so the stream can be used for more requests.
+func RequestChunks(rw *bufio.ReadWriter, file *os.File, index *pb.Index, chunks *seal.Chunks, start, count int32, got func(chunk *pb.Chunk)) error {
+	_, err := rw.Write(pb.Marshal(&pb.ChunkRequest{Index: start, Count: count}))
+	if err != nil {
+		return err
+	}
+	err = rw.Flush()
+	if err != nil {
+		return err
+	}
+
+	var bad error
+	for k := int32(0); k < count; k++ {
+		chunk := &pb.Chunk{}
+		err = pb.Read(rw.Reader, chunk)
+		if err != nil {
+			return err
+		}
+		err = checkChunk(index, chunk, chunks)
+		if errors.Is(err, ErrBadChunk) {
+			bad = err
+			continue
+		} else if err != nil {
+			return err
+		}
+		offset, _ := span(index, chunk.Index)
+		_, err = file.WriteAt(chunk.Data, offset)
+		if err != nil {
+			return err
+		}
+		got(chunk)
+	}
+	return bad
+}
+
+// FillFromStore copies the chunks of the file described by index that store
+// holds into file and marks them received. It returns how many bytes it
+// copied.
+func FillFromStore(file *os.File, index *pb.Index, store *chunkstore.Store) (int64, error) {
+	var filled int64
+	for i, ref := range index.GetChunks() {
+		if index.HasChunk(int32(i)) {
+			continue
+		}
+		data, err := store.Get(ref.GetSha256())
+		if errors.Is(err, chunkstore.ErrNotFound) || errors.Is(err, chunkstore.ErrCorrupt) {
+			continue
+		} else if err != nil {
+			return filled, err
+		}
+		_, err = file.WriteAt(data, ref.GetOffset())
+		if err != nil {
+			return filled, err
+		}
+		index.MarkChunk(int32(i))
+		filled += int64(len(data))
+	}
+	return filled, nil
+}
+
+// StoreChunks adds the content defined chunks of the complete file at path,
+// described by index, to store and trims it.
+func StoreChunks(path string, index *pb.Index, store *chunkstore.Store) error {
+	if len(index.GetChunks()) == 0 {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buf := make([]byte, cdc.MaxSize)
+	for _, ref := range index.GetChunks() {
+		data := buf[:ref.GetSize()]
+		_, err := f.ReadAt(data, ref.GetOffset())
+		if err != nil {
+			return err
+		}
+		err = store.Put(ref.GetSha256(), data)
+		if err != nil {
+			return err
+		}
+	}
+	return store.Trim()
+}
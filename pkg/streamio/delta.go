@@ -0,0 +1,166 @@
+package streamio
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/Azanul/peer-pressure/pkg/delta"
+	"github.com/Azanul/peer-pressure/pkg/peer"
+	"github.com/Azanul/peer-pressure/pkg/pressure/pb"
+	"github.com/Azanul/peer-pressure/pkg/ratelimit"
+	"github.com/Azanul/peer-pressure/pkg/util"
+)
+
+var errStopped = errors.New("stopped by command")
+
+// sendDelta answers the signatures of the receiver's copy with the
+// instructions turning it into file. It reports whether the transfer was
+// stopped by a command.
+func sendDelta(rw *bufio.ReadWriter, file *os.File, sig *pb.Signatures, size int64, meter *ratelimit.Meter, eventCh chan peer.Event, cmdCh chan peer.Command) (bool, error) {
+	var covered int64
+	err := delta.Diff(bufio.NewReader(io.NewSectionReader(file, 0, size)), sig, func(op *pb.Delta) error {
+		_, err := rw.Write(pb.Marshal(op))
+		if err != nil {
+			return err
+		}
+		meter.Add(len(op.GetLiteral()))
+		covered += int64(len(op.GetLiteral())) + int64(op.GetCount())*int64(sig.GetBlockSize())
+		if covered > size {
+			covered = size
+		}
+		pushEvent(eventCh, peer.Progress, peer.Stats{
+			Fraction: float64(covered) / float64(size),
+			Rate:     meter.Rate(),
+		})
+		select {
+		case cmd := <-cmdCh:
+			if cmd == peer.Pause {
+				cmd = <-cmdCh
+			}
+			if cmd == peer.Stop {
+				return errStopped
+			}
+		default:
+		}
+		return nil
+	})
+	if err == errStopped {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	_, err = rw.Write(pb.Marshal(&pb.Delta{Done: true}))
+	if err != nil {
+		return false, err
+	}
+	return false, rw.Flush()
+}
+
+// DeltaToFile receives the file described by the index saved at indexPath
+// as a delta against basis, an older copy of it, rather than chunk by chunk.
+// The sender has to have announced deltas in its index. Once the file is
+// complete, the index is marked so and the caller finalizes it as usual,
+// which makes sure the result matches the sender's digest. An interrupted
+// delta leaves nothing marked, so resuming fetches every chunk. Like
+// StreamToFile it closes file and leaves reporting the end of the transfer
+// to the caller.
+func DeltaToFile(rw *bufio.ReadWriter, file *os.File, basis string, indexPath string, eventCh chan peer.Event, cmdCh chan peer.Command) error {
+	defer file.Close()
+	index := pb.Index{}
+	data, err := os.ReadFile(indexPath)
+	if err == nil {
+		err = proto.Unmarshal(data, &index)
+	}
+	if err != nil {
+		handleError(eventCh, err)
+		return err
+	}
+
+	b, err := os.Open(basis)
+	if err != nil {
+		handleError(eventCh, err)
+		return err
+	}
+	defer b.Close()
+	info, err := b.Stat()
+	if err != nil {
+		handleError(eventCh, err)
+		return err
+	}
+	sig, err := delta.Sign(bufio.NewReader(b), delta.BlockSize(info.Size()))
+	if err != nil {
+		handleError(eventCh, err)
+		return err
+	}
+	log.Printf("Asking for a delta against %s, %d blocks of %d bytes", basis, len(sig.GetBlocks()), sig.GetBlockSize())
+	_, err = rw.Write(pb.Marshal(&pb.ChunkRequest{Signatures: sig}))
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		handleError(eventCh, err)
+		return err
+	}
+	patcher := delta.NewPatcher(file, b, sig, index.GetSize())
+	meter := ratelimit.NewMeter()
+	var literal int64
+	for {
+		op := &pb.Delta{}
+		err = pb.Read(rw.Reader, op)
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		} else if err != nil {
+			handleError(eventCh, err)
+			return err
+		}
+		if op.GetDone() {
+			break
+		}
+		err = patcher.Apply(op)
+		if err != nil {
+			handleError(eventCh, err)
+			return err
+		}
+
+		literal += int64(len(op.GetLiteral()))
+		meter.Add(len(op.GetLiteral()))
+		pushEvent(eventCh, peer.Progress, peer.Stats{
+			Fraction: float64(patcher.Written) / float64(index.GetSize()),
+			Rate:     meter.Rate(),
+		})
+		select {
+		case cmd := <-cmdCh:
+			if cmd == peer.Pause {
+				cmd = <-cmdCh
+			}
+			if cmd == peer.Stop {
+				return nil
+			}
+		default:
+		}
+	}
+	if patcher.Written != index.GetSize() {
+		err = fmt.Errorf("%w: %d bytes for a file of %d", delta.ErrInvalid, patcher.Written, index.GetSize())
+		handleError(eventCh, err)
+		return err
+	}
+
+	for i := int32(0); i < index.NChunks; i++ {
+		index.MarkChunk(i)
+	}
+	index.Save(indexPath)
+	log.Printf("%s done writing, %s of %s sent", file.Name(), util.HumanBytes(float64(literal)), util.HumanBytes(float64(index.GetSize())))
+	return nil
+}
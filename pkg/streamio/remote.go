@@ -0,0 +1,285 @@
+package streamio
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Azanul/peer-pressure/pkg/peer"
+	"github.com/Azanul/peer-pressure/pkg/pressure/pb"
+	"github.com/Azanul/peer-pressure/pkg/ratelimit"
+	"github.com/Azanul/peer-pressure/pkg/seal"
+)
+
+// Schedule decides in which order the missing chunks of a RemoteFile are
+// requested from the sender.
+type Schedule int8
+
+const (
+	// Bulk fetches whatever is missing in large requests, for throughput.
+	Bulk Schedule = iota
+	// Stream fetches in playback order, only keeping a read-ahead window past
+	// the playhead filled.
+	Stream
+)
+
+const (
+	// DefaultReadAhead is the read-ahead window of the Stream schedule, in chunks.
+	DefaultReadAhead = 256
+
+	bulkBatch   = 1024 // Chunks per request in Bulk, small enough to still honour reprioritization
+	streamBatch = 16   // Chunks per request in Stream, keeps seeks responsive
+)
+
+var ErrClosed = errors.New("remote file closed")
+
+// RemoteFile is a file that is still being received. Chunks are fetched in
+// the background according to its Schedule, and reads of ranges that haven't
+// arrived yet are moved to the front of the queue, so the file can be
+// consumed out of order before the transfer completes.
+type RemoteFile struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	rw        *bufio.ReadWriter
+	file      *os.File
+	index     *pb.Index
+	chunks    *seal.Chunks // Opens the chunks of a sealed transfer, nil otherwise
+	indexPath string
+	schedule  Schedule
+	readAhead int32
+	playhead  int32
+	urgent    [2]int32 // First and last chunk of the latest prioritized range
+	err       error
+	bad       int // Requests with chunks that failed their check
+	closed    bool
+	meter     *ratelimit.Meter
+	eventCh   chan peer.Event
+}
+
+// NewRemoteFile starts fetching the file described by index into file,
+// opening the chunks with chunks if the transfer is sealed. The index is
+// kept up to date at indexPath.
+func NewRemoteFile(rw *bufio.ReadWriter, file *os.File, index *pb.Index, indexPath string, chunks *seal.Chunks, schedule Schedule, eventCh chan peer.Event) *RemoteFile {
+	r := &RemoteFile{
+		rw:        rw,
+		file:      file,
+		index:     index,
+		chunks:    chunks,
+		indexPath: indexPath,
+		schedule:  schedule,
+		readAhead: DefaultReadAhead,
+		urgent:    [2]int32{0, -1},
+		meter:     ratelimit.NewMeter(),
+		eventCh:   eventCh,
+	}
+	r.cond = sync.NewCond(&r.mu)
+	go r.run()
+	return r
+}
+
+func (r *RemoteFile) Size() int64 {
+	return r.index.GetSize()
+}
+
+// SetSchedule switches the fetch order of the remaining chunks.
+func (r *RemoteFile) SetSchedule(schedule Schedule) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.schedule = schedule
+	r.cond.Broadcast()
+}
+
+// SetReadAhead sets how many chunks past the playhead the Stream schedule
+// keeps fetched.
+func (r *RemoteFile) SetReadAhead(chunks int32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.readAhead = chunks
+	r.cond.Broadcast()
+}
+
+// Prioritize moves the playhead to off and fetches the chunks covering
+// [off, off+length) before anything else.
+func (r *RemoteFile) Prioritize(off, length int64) {
+	if length <= 0 || off >= r.Size() {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.prioritize(r.chunkRange(off, length))
+}
+
+func (r *RemoteFile) ReadAt(p []byte, off int64) (int, error) {
+	size := r.Size()
+	if off >= size {
+		return 0, io.EOF
+	}
+	end := off + int64(len(p))
+	if end > size {
+		end = size
+	}
+
+	first, last := r.chunkRange(off, end-off)
+	r.mu.Lock()
+	r.prioritize(first, last)
+	for !r.haveRange(first, last) && r.err == nil && !r.closed {
+		r.cond.Wait()
+	}
+	if !r.haveRange(first, last) {
+		err := r.err
+		if err == nil {
+			err = ErrClosed
+		}
+		r.mu.Unlock()
+		return 0, err
+	}
+	r.mu.Unlock()
+
+	n, err := r.file.ReadAt(p[:end-off], off)
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Wait blocks until every chunk has been received.
+func (r *RemoteFile) Wait() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for r.index.Progress < r.index.NChunks && r.err == nil && !r.closed {
+		r.cond.Wait()
+	}
+	if r.index.Progress < r.index.NChunks && r.err == nil {
+		return ErrClosed
+	}
+	return r.err
+}
+
+func (r *RemoteFile) Close() error {
+	r.mu.Lock()
+	r.closed = true
+	r.cond.Broadcast()
+	r.mu.Unlock()
+	return r.file.Close()
+}
+
+func (r *RemoteFile) chunkRange(off, length int64) (int32, int32) {
+	return chunkAt(r.index, off), chunkAt(r.index, off+length-1)
+}
+
+func (r *RemoteFile) prioritize(first, last int32) {
+	r.urgent = [2]int32{first, last}
+	r.playhead = first
+	r.cond.Broadcast()
+}
+
+func (r *RemoteFile) haveRange(first, last int32) bool {
+	for i := first; i <= last; i++ {
+		if !r.index.HasChunk(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// run is the only goroutine talking to the sender, it keeps requesting the
+// batch picked by next until the file is complete or closed.
+func (r *RemoteFile) run() {
+	for {
+		r.mu.Lock()
+		start, count, ok := r.next()
+		for !ok && !r.closed && r.index.Progress < r.index.NChunks {
+			r.cond.Wait()
+			start, count, ok = r.next()
+		}
+		r.mu.Unlock()
+		if !ok {
+			break
+		}
+
+		err := r.request(start, count)
+		if errors.Is(err, ErrBadChunk) && r.bad < maxBadChunks {
+			r.bad++
+			log.Warnf("%s: %v, fetching it again", r.file.Name(), err)
+			continue
+		} else if err != nil {
+			r.mu.Lock()
+			r.err = err
+			r.cond.Broadcast()
+			r.mu.Unlock()
+			handleError(r.eventCh, err)
+			return
+		}
+	}
+	log.Printf("%s fetched %d/%d chunks", r.file.Name(), r.index.Progress, r.index.NChunks)
+	pushEvent(r.eventCh, peer.Progress, peer.Stats{Fraction: -1})
+}
+
+// next picks the chunks to request next according to the schedule. A range
+// someone is blocked on always goes first.
+func (r *RemoteFile) next() (int32, int32, bool) {
+	n := r.index.NChunks
+	if start, count, ok := r.missingRun(r.urgent[0], r.urgent[1]+1, streamBatch); ok {
+		return start, count, ok
+	}
+
+	switch r.schedule {
+	case Stream:
+		end := n
+		if r.readAhead > 0 && r.playhead+r.readAhead < n {
+			end = r.playhead + r.readAhead
+		}
+		return r.missingRun(r.playhead, end, streamBatch)
+	default:
+		return r.missingRun(0, n, bulkBatch)
+	}
+}
+
+// missingRun finds the first run of missing chunks in [from, to), at most
+// max chunks long.
+func (r *RemoteFile) missingRun(from, to, max int32) (int32, int32, bool) {
+	if from < 0 {
+		from = 0
+	}
+	if to > r.index.NChunks {
+		to = r.index.NChunks
+	}
+	for i := from; i < to; i++ {
+		if r.index.HasChunk(i) {
+			continue
+		}
+		j := i + 1
+		for j < to && j-i < max && !r.index.HasChunk(j) {
+			j++
+		}
+		return i, j - i, true
+	}
+	return 0, 0, false
+}
+
+func (r *RemoteFile) request(start, count int32) error {
+	err := RequestChunks(r.rw, r.file, r.index, r.chunks, start, count, func(chunk *pb.Chunk) {
+		r.meter.Add(len(chunk.Data))
+		r.mu.Lock()
+		r.index.MarkChunk(chunk.Index)
+		r.cond.Broadcast()
+		r.mu.Unlock()
+	})
+	if err != nil && !errors.Is(err, ErrBadChunk) {
+		return err
+	}
+
+	r.mu.Lock()
+	r.index.Save(r.indexPath)
+	stats := peer.Stats{
+		Fraction: float64(r.index.Progress) / float64(r.index.NChunks),
+		Rate:     r.meter.Rate(),
+	}
+	r.mu.Unlock()
+	pushEvent(r.eventCh, peer.Progress, stats)
+	return err
+}
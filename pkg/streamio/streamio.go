@@ -2,131 +2,416 @@ package streamio
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"errors"
+	"fmt"
 	"io"
 	"math"
 	"os"
-	"path/filepath"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/Azanul/peer-pressure/pkg/cdc"
+	"github.com/Azanul/peer-pressure/pkg/merkle"
+	"github.com/Azanul/peer-pressure/pkg/meta"
 	"github.com/Azanul/peer-pressure/pkg/peer"
 	"github.com/Azanul/peer-pressure/pkg/pressure/pb"
+	"github.com/Azanul/peer-pressure/pkg/ratelimit"
+	"github.com/Azanul/peer-pressure/pkg/seal"
+	"github.com/libp2p/go-libp2p/core/crypto"
 	"google.golang.org/protobuf/proto"
 )
 
 const chunkSize = 4096
 
-func FileToStream(rw *bufio.ReadWriter, file *os.File, eventCh chan peer.Event, cmdCh chan peer.Command) {
-	data := make([]byte, chunkSize)
-	filename := filepath.Base(file.Name())
-	fileInfo, _ := file.Stat()
+// saveInterval is how often the index of a download is saved at most,
+// rewriting it for every chunk would take longer than writing the chunk.
+const saveInterval = time.Second
 
-	index := &pb.Index{
-		NChunks:  int32(math.Ceil(float64(fileInfo.Size()) / chunkSize)),
-		Filename: filename,
-		Progress: 0,
+// ErrRefused is returned by FileToStream when the receiver declines the file.
+var ErrRefused = errors.New("receiver refused the file")
+
+// Refuse declines a file offered on the stream, reason is shown to the
+// sender.
+func Refuse(rw *bufio.ReadWriter, reason string) error {
+	_, err := rw.Write(pb.Marshal(&pb.ChunkRequest{Refusal: reason}))
+	if err != nil {
+		return err
 	}
-	str := pb.Marshal(index)
-	_, err := rw.Write(str)
+	return rw.Flush()
+}
+
+// NeededBytes returns the room the file described by index takes up once
+// received.
+func NeededBytes(index *pb.Index) int64 {
+	if index.GetSize() > 0 {
+		return index.GetSize()
+	}
+	return int64(index.GetNChunks()) * chunkSize
+}
+
+// FileToStream offers file under name, a slash separated path, split into
+// chunks as chunking says, and serves the chunks the receiver requests until
+// it closes the stream. A receiver with an older copy may ask for a delta
+// against it instead.
+func FileToStream(rw *bufio.ReadWriter, file *os.File, name string, chunking Chunking, eventCh chan peer.Event, cmdCh chan peer.Command) error {
+	index, tree, err := newIndex(file, name, chunking)
 	if err != nil {
 		handleError(eventCh, err)
-		return
+		return err
+	}
+	if len(index.GetChunks()) > 0 {
+		tree = nil // The receiver checks chunks against the listed digests
 	}
-	err = rw.Flush()
+	return serve(rw, file, index, tree, nil, eventCh, cmdCh)
+}
+
+// SealedFileToStream is FileToStream with the chunks sealed for recipient
+// alone: they're encrypted under a key of their own, which goes along in the
+// index wrapped for recipient, see package seal. The name, size and digests
+// in the index aren't sealed. No delta is offered, it would go out in the
+// clear.
+func SealedFileToStream(rw *bufio.ReadWriter, file *os.File, name string, chunking Chunking, recipient crypto.PubKey, eventCh chan peer.Event, cmdCh chan peer.Command) error {
+	index, tree, err := newIndex(file, name, chunking)
 	if err != nil {
 		handleError(eventCh, err)
-		return
+		return err
+	}
+	if len(index.GetChunks()) > 0 {
+		tree = nil
+	}
+	key, err := seal.NewKey()
+	if err == nil {
+		index.SealedKey, err = seal.WrapKey(recipient, key)
 	}
+	var chunks *seal.Chunks
+	if err == nil {
+		chunks, err = seal.NewChunks(key)
+	}
+	if err != nil {
+		handleError(eventCh, err)
+		return err
+	}
+	index.Delta = false
+	return serve(rw, file, index, tree, chunks, eventCh, cmdCh)
+}
 
-	cr := &pb.ChunkRequest{}
-	pb.Read(rw.Reader, cr)
+// NewIndex describes file, offered under name, with its digest, chunks and
+// metadata.
+func NewIndex(file *os.File, name string, chunking Chunking) (*pb.Index, error) {
+	index, _, err := newIndex(file, name, chunking)
+	return index, err
+}
 
-	partNum := cr.GetIndex()
-	newOff, err := file.Seek(int64(partNum/chunkSize), 0)
-	log.Debugln("New offset:", newOff)
+// newIndex is NewIndex, also returning the hash tree over the chunks.
+func newIndex(file *os.File, name string, chunking Chunking) (*pb.Index, *merkle.Tree, error) {
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	digest := sha256.New()
+	data := io.NewSectionReader(file, 0, fileInfo.Size())
+	var refs []*pb.ChunkRef
+	var leaves [][]byte
+	if chunking == ContentDefined {
+		var offset int64
+		err = cdc.Split(io.TeeReader(data, digest), func(chunk []byte) error {
+			sum := sha256.Sum256(chunk)
+			refs = append(refs, &pb.ChunkRef{Sha256: sum[:], Offset: offset, Size: int32(len(chunk))})
+			leaves = append(leaves, sum[:])
+			offset += int64(len(chunk))
+			return nil
+		})
+	} else {
+		leaves, err = fixedLeaves(io.TeeReader(data, digest))
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	nChunks := int32(math.Ceil(float64(fileInfo.Size()) / chunkSize))
+	if len(refs) > maxChunkRefs {
+		log.Warnf("%s has too many chunks to list, sending it in fixed chunks", name)
+		refs = nil
+		leaves, err = fixedLeaves(io.NewSectionReader(file, 0, fileInfo.Size()))
+		if err != nil {
+			return nil, nil, err
+		}
+	} else if len(refs) > 0 {
+		nChunks = int32(len(refs))
+	}
+
+	tree := merkle.New(leaves)
+	index := &pb.Index{
+		NChunks:    nChunks,
+		Filename:   name,
+		Progress:   0,
+		Size:       fileInfo.Size(),
+		Sha256:     digest.Sum(nil),
+		Delta:      true,
+		Chunks:     refs,
+		MerkleRoot: tree.Root(),
+	}
+	err = meta.Fill(index, file.Name(), fileInfo)
+	if err != nil {
+		log.Warnf("Metadata of %s left out: %v", file.Name(), err)
+	}
+	return index, tree, nil
+}
+
+// ServeFile offers the file described by index and serves the chunks the
+// receiver requests until it closes the stream.
+func ServeFile(rw *bufio.ReadWriter, file *os.File, index *pb.Index, eventCh chan peer.Event, cmdCh chan peer.Command) error {
+	tree, err := proofTree(file, index)
 	if err != nil {
 		handleError(eventCh, err)
-		return
+		return err
 	}
+	return serve(rw, file, index, tree, nil, eventCh, cmdCh)
+}
 
-STREAM_LOOP:
+// serve is ServeFile, sending proofs from tree along with the chunks unless
+// it's nil and sealing the chunks with chunks unless that's nil.
+func serve(rw *bufio.ReadWriter, file *os.File, index *pb.Index, tree *merkle.Tree, chunks *seal.Chunks, eventCh chan peer.Event, cmdCh chan peer.Command) error {
+	err := offer(rw, index)
+	if err != nil {
+		handleError(eventCh, err)
+		return err
+	}
+
+	// Serve chunk requests until the receiver closes the stream
+	meter := ratelimit.NewMeter()
 	for {
-		_, err := file.Read(data)
+		cr := &pb.ChunkRequest{}
+		err = pb.Read(rw.Reader, cr)
 		if err == io.EOF {
 			break
 		} else if err != nil {
 			handleError(eventCh, err)
-			return
+			return err
+		}
+		err = refusal(cr)
+		if err != nil {
+			handleError(eventCh, err)
+			return err
+		}
+
+		if sig := cr.GetSignatures(); sig != nil && chunks != nil {
+			err = errors.New("delta asked for in a sealed transfer")
+			handleError(eventCh, err)
+			return err
+		} else if sig != nil {
+			log.Debugf("Serving a delta against %d blocks of %d bytes", len(sig.GetBlocks()), sig.GetBlockSize())
+			stopped, err := sendDelta(rw, file, sig, index.Size, meter, eventCh, cmdCh)
+			if err != nil {
+				handleError(eventCh, err)
+				return err
+			}
+			if stopped {
+				break
+			}
+			continue
+		}
+
+		if cr.GetIndex() < 0 {
+			err = fmt.Errorf("chunk index %d out of range", cr.GetIndex())
+			handleError(eventCh, err)
+			return err
+		}
+		end := index.NChunks
+		if cr.GetCount() > 0 && cr.GetIndex()+cr.GetCount() < end {
+			end = cr.GetIndex() + cr.GetCount()
+		}
+		log.Debugf("Serving chunks [%d, %d)", cr.GetIndex(), end)
+
+		stopped, err := sendChunks(rw, file, index, tree, chunks, cr.GetIndex(), end, cr.GetSkip(), meter, eventCh, cmdCh)
+		if err != nil {
+			handleError(eventCh, err)
+			return err
+		}
+		if stopped {
+			break
+		}
+	}
+	pushEvent(eventCh, peer.Progress, peer.Stats{Fraction: -1})
+	return nil
+}
+
+// LinkToStream offers a link, index having no chunks but a link target or
+// hard link. The receiver just creates it and closes the stream.
+func LinkToStream(rw *bufio.ReadWriter, index *pb.Index, eventCh chan peer.Event) error {
+	err := offer(rw, index)
+	if err != nil {
+		handleError(eventCh, err)
+		return err
+	}
+	cr := &pb.ChunkRequest{}
+	err = pb.Read(rw.Reader, cr)
+	if err == nil {
+		err = refusal(cr)
+	}
+	if err != nil && err != io.EOF {
+		handleError(eventCh, err)
+		return err
+	}
+	pushEvent(eventCh, peer.Progress, peer.Stats{Fraction: -1})
+	return nil
+}
+
+func offer(rw *bufio.ReadWriter, index *pb.Index) error {
+	_, err := rw.Write(pb.Marshal(index))
+	if err != nil {
+		return err
+	}
+	return rw.Flush()
+}
+
+// refusal returns the reason the receiver gave for declining, if it did.
+func refusal(cr *pb.ChunkRequest) error {
+	if cr.GetRefusal() != "" {
+		return fmt.Errorf("%w: %s", ErrRefused, cr.GetRefusal())
+	}
+	return nil
+}
+
+// sendChunks writes the chunks in [start, end) of file to the stream,
+// leaving out those set in the skip bitmap, with their proofs if tree is set
+// and sealed if chunks is. It reports whether the transfer was stopped by a
+// command.
+func sendChunks(rw *bufio.ReadWriter, file *os.File, index *pb.Index, tree *merkle.Tree, chunks *seal.Chunks, start, end int32, skip []byte, meter *ratelimit.Meter, eventCh chan peer.Event, cmdCh chan peer.Command) (bool, error) {
+	data := make([]byte, maxChunk(index))
+	for partNum := start; partNum < end; partNum++ {
+		if inBitmap(skip, partNum) {
+			continue
+		}
+		offset, length := span(index, partNum)
+		n, err := file.ReadAt(data[:length], offset)
+		if err != nil && err != io.EOF {
+			return false, err
 		}
 
-		partNum++
 		chunk := &pb.Chunk{
 			Index: partNum,
-			Data:  data,
+			Data:  data[:n],
 		}
-		str := pb.Marshal(chunk)
-		_, err = rw.Write(str)
+		if tree != nil {
+			chunk.Proof = tree.Proof(int(partNum))
+		}
+		if chunks != nil {
+			chunk.Data = chunks.Seal(partNum, chunk.Data)
+		}
+		_, err = rw.Write(pb.Marshal(chunk))
 		if err != nil {
-			handleError(eventCh, err)
-			return
+			return false, err
 		}
 
 		err = rw.Flush()
 		if err != nil {
-			handleError(eventCh, err)
-			return
+			return false, err
 		}
-		pushEvent(eventCh, 1, float64(partNum)*chunkSize/float64(fileInfo.Size()))
+		meter.Add(n)
+		pushEvent(eventCh, peer.Progress, peer.Stats{
+			Fraction: float64(offset+int64(n)) / float64(index.Size),
+			Rate:     meter.Rate(),
+		})
 		select {
 		case cmd := <-cmdCh:
 			if cmd == peer.Pause {
 				cmd = <-cmdCh
 			}
 			if cmd == peer.Stop {
-				break STREAM_LOOP
+				return true, nil
 			}
 		default:
 		}
 	}
-	pushEvent(eventCh, 1, float64(-1))
+	return false, nil
 }
 
-func StreamToFile(rw *bufio.ReadWriter, file *os.File, eventCh chan peer.Event, cmdCh chan peer.Command) {
-	indexPath := file.Name() + ".ppindex"
+// StreamToFile writes the requested chunks to file until every chunk has
+// arrived or the transfer is stopped, keeping the index saved at indexPath
+// up to date. Chunks failing their check are dropped and requested again
+// once the sender is through with the others, up to maxBadChunks of them. A
+// stream ending early is reported as io.ErrUnexpectedEOF so the caller can
+// wait for the sender to resume. Chunks of a sealed transfer are opened
+// with chunks. Unlike FileToStream it leaves reporting the end of the
+// transfer to the caller, which may still have to finish the file.
+func StreamToFile(rw *bufio.ReadWriter, file *os.File, indexPath string, chunks *seal.Chunks, eventCh chan peer.Event, cmdCh chan peer.Command) error {
 	index := pb.Index{}
 	IndexFile, err := os.ReadFile(indexPath)
 	if err != nil {
 		handleError(eventCh, err)
-		return
+		return err
 	}
 	defer file.Close()
-	proto.Unmarshal(IndexFile, &index)
+	err = proto.Unmarshal(IndexFile, &index)
 	if err != nil {
 		handleError(eventCh, err)
-		return
+		return err
 	}
 
-	writer := bufio.NewWriter(file)
+	// Chunks written but not saved yet are fetched again after a crash
+	saved, unsaved := time.Now(), false
+	defer func() {
+		if unsaved {
+			index.Save(indexPath)
+		}
+	}()
+
+	meter := ratelimit.NewMeter()
+	pending := index.NChunks - index.Progress // Chunks the sender has yet to send
+	bad := 0
 STREAM_LOOP:
-	for {
+	for index.Progress < index.NChunks {
+		if pending == 0 {
+			// Only dropped chunks are missing
+			_, err = rw.Write(pb.Marshal(&pb.ChunkRequest{Index: index.FirstMissing(), Skip: index.GetReceived()}))
+			if err == nil {
+				err = rw.Flush()
+			}
+			if err != nil {
+				handleError(eventCh, err)
+				return err
+			}
+			pending = index.NChunks - index.Progress
+		}
 		chunk := &pb.Chunk{}
 		err = pb.Read(rw.Reader, chunk)
 		if err == io.EOF {
-			log.Printf("%s done writing", file.Name())
-			break
+			return io.ErrUnexpectedEOF
 		} else if err != nil {
 			handleError(eventCh, err)
-			return
+			return err
 		}
-		_, err = writer.Write(chunk.Data)
+		pending--
+		err = checkChunk(&index, chunk, chunks)
+		if errors.Is(err, ErrBadChunk) && bad < maxBadChunks {
+			bad++
+			log.Warnf("%s: %v, fetching it again", file.Name(), err)
+			continue
+		} else if err != nil {
+			handleError(eventCh, err)
+			return err
+		}
+		offset, _ := span(&index, chunk.Index)
+		_, err = file.WriteAt(chunk.Data, offset)
 		if err != nil {
 			handleError(eventCh, err)
-			return
+			return err
+		}
+		if index.MarkChunk(chunk.Index) {
+			unsaved = true
+			if index.Progress == index.NChunks || time.Since(saved) >= saveInterval {
+				index.Save(indexPath)
+				saved, unsaved = time.Now(), false
+			}
 		}
-		index.Progress += 1
-		index.Save()
 
-		pushEvent(eventCh, 1, index.Progress)
+		meter.Add(len(chunk.Data))
+		pushEvent(eventCh, peer.Progress, peer.Stats{
+			Fraction: float64(index.Progress) / float64(index.NChunks),
+			Rate:     meter.Rate(),
+		})
 
 		select {
 		case cmd := <-cmdCh:
@@ -139,12 +424,11 @@ STREAM_LOOP:
 		default:
 		}
 	}
-	pushEvent(eventCh, 1, int32(-1))
-
-	log.Debugln(writer.Flush())
+	log.Printf("%s done writing", file.Name())
+	return nil
 }
 
-func pushEvent[T int32 | float64 | string](ch chan peer.Event, msgType peer.SignalType, data T) {
+func pushEvent[T peer.Stats | string](ch chan peer.Event, msgType peer.SignalType, data T) {
 	ch <- peer.Event{
 		Type: msgType,
 		Data: data,
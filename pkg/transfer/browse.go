@@ -0,0 +1,187 @@
+package transfer
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Azanul/peer-pressure/pkg/peer"
+	"github.com/Azanul/peer-pressure/pkg/pressure/pb"
+	"github.com/libp2p/go-libp2p/core/network"
+	libp2ppeer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Sizes of a page of a Listing, when none is asked for and at most.
+const (
+	DefaultPage = 100
+	MaxPage     = 1000
+)
+
+// fileSum is the digest of a file as it was when hashed.
+type fileSum struct {
+	size, mtime int64
+	sha256      []byte
+}
+
+// List returns a page of the entries of the directory dir of the share,
+// offset entries in, or of the shared paths themselves if dir is empty. A
+// directory that isn't shared is listed as empty. The files of the page are
+// hashed, each only once for as long as it doesn't change.
+func (s *Share) List(dir string, offset, limit int) (*pb.Listing, error) {
+	files, err := s.files()
+	if err != nil {
+		return nil, err
+	}
+	dir = strings.Trim(dir, "/")
+	entries := map[string]*pb.SharedFile{}
+	paths := map[string]string{} // Where the files among the entries are on this host
+	for _, e := range files {
+		rest := e.Name
+		if dir != "" {
+			if !strings.HasPrefix(e.Name, dir+"/") {
+				continue
+			}
+			rest = e.Name[len(dir)+1:]
+		}
+		info, err := os.Stat(e.Path)
+		if err != nil {
+			log.Warnf("Leaving %s out of the listing: %v", e.Path, err)
+			continue
+		}
+		base, _, isDir := strings.Cut(rest, "/")
+		name := path.Join(dir, base)
+		entry, ok := entries[name]
+		if !ok {
+			entry = &pb.SharedFile{Name: name, Dir: isDir}
+			entries[name] = entry
+		}
+		if !isDir {
+			paths[name] = e.Path
+		}
+		entry.Size += info.Size()
+		if mtime := info.ModTime().UnixNano(); mtime > entry.Mtime {
+			entry.Mtime = mtime
+		}
+	}
+
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > len(names) {
+		offset = len(names)
+	}
+	if limit <= 0 {
+		limit = DefaultPage
+	}
+	if limit > MaxPage {
+		limit = MaxPage
+	}
+	end := offset + limit
+	if end > len(names) {
+		end = len(names)
+	}
+
+	listing := &pb.Listing{Total: int32(len(names))}
+	for _, name := range names[offset:end] {
+		entry := entries[name]
+		if !entry.Dir {
+			entry.Sha256, err = s.sum(paths[name], entry.Size, entry.Mtime)
+			if err != nil {
+				log.Warnf("Listing %s without its digest: %v", paths[name], err)
+			}
+		}
+		listing.Entries = append(listing.Entries, entry)
+	}
+	return listing, nil
+}
+
+// sum returns the digest of the file at path, of size and mtime, hashing it
+// only if it wasn't already at that size and mtime.
+func (s *Share) sum(path string, size, mtime int64) ([]byte, error) {
+	s.mu.Lock()
+	cached, ok := s.sums[path]
+	s.mu.Unlock()
+	if ok && cached.size == size && cached.mtime == mtime {
+		return cached.sha256, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	digest := sha256.New()
+	_, err = io.Copy(digest, file)
+	if err != nil {
+		return nil, err
+	}
+	sum := digest.Sum(nil)
+	s.mu.Lock()
+	s.sums[path] = fileSum{size: size, mtime: mtime, sha256: sum}
+	s.mu.Unlock()
+	return sum, nil
+}
+
+func (s *Share) handleBrowse(stream network.Stream) {
+	defer stream.Close()
+	rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+	remote := stream.Conn().RemotePeer().Pretty()
+	req := pb.BrowseRequest{}
+	err := pb.Read(rw.Reader, &req)
+	if err != nil {
+		return
+	}
+	listing, err := s.List(req.GetDir(), int(req.GetOffset()), int(req.GetLimit()))
+	if err != nil {
+		log.Errorf("Listing %q of the share for %s: %v", req.GetDir(), remote, err)
+		stream.Reset()
+		return
+	}
+	_, err = rw.Write(pb.Marshal(listing))
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		log.Warnf("Sending the listing of %q to %s: %v", req.GetDir(), remote, err)
+	}
+}
+
+// BrowseDir returns a page of the entries of the directory dir of the share
+// of the node id, see Share.List.
+func BrowseDir(ctx context.Context, p *peer.Peer, id libp2ppeer.ID, dir string, offset, limit int) (*pb.Listing, error) {
+	err := p.Redial(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := p.Node.NewStream(ctx, id, BrowseProtocolID)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+	_, err = rw.Write(pb.Marshal(&pb.BrowseRequest{Dir: dir, Offset: int32(offset), Limit: int32(limit)}))
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		return nil, err
+	}
+	listing := &pb.Listing{}
+	err = pb.Read(rw.Reader, listing)
+	if err != nil {
+		return nil, err
+	}
+	return listing, nil
+}
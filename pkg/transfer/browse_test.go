@@ -0,0 +1,110 @@
+package transfer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBrowseDir(t *testing.T) {
+	h := newHarness(t)
+	alice, bob := h.node("alice"), h.node("bob")
+	dir := filepath.Join(t.TempDir(), "shared")
+	files := map[string]string{
+		"a.txt":       "first",
+		"b/c.txt":     "second",
+		"b/d/e.txt":   "third",
+		"b/f.txt":     "fourth",
+		"b/g/h/i.txt": "fifth",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h.share(alice, dir)
+
+	var tests = []struct {
+		dir           string
+		offset, limit int
+		want          string // Entries listed, directories with a trailing slash
+		total         int
+	}{
+		{"", 0, 0, "shared/", 1},
+		{"shared", 0, 0, "shared/a.txt shared/b/", 2},
+		{"shared/b/", 0, 0, "shared/b/c.txt shared/b/d/ shared/b/f.txt shared/b/g/", 4},
+		{"shared/b", 1, 2, "shared/b/d/ shared/b/f.txt", 4},
+		{"shared/b", 3, 2, "shared/b/g/", 4},
+		{"shared/b", 4, 2, "", 4},
+		{"shared/b", -1, 1, "shared/b/c.txt", 4},
+		{"shared/a", 0, 0, "", 0},
+		{"../outside", 0, 0, "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s@%d+%d", tt.dir, tt.offset, tt.limit), func(t *testing.T) {
+			listing, err := BrowseDir(h.ctx, bob, alice.Node.ID(), tt.dir, tt.offset, tt.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, e := range listing.GetEntries() {
+				name := e.GetName()
+				if e.GetDir() {
+					name += "/"
+					if e.GetSha256() != nil {
+						t.Errorf("directory %s listed with a digest", e.GetName())
+					}
+				} else {
+					want := sha256.Sum256([]byte(files[strings.TrimPrefix(name, "shared/")]))
+					if !bytes.Equal(e.GetSha256(), want[:]) {
+						t.Errorf("%s listed with digest %x, want %x", name, e.GetSha256(), want)
+					}
+				}
+				var size int
+				for f, content := range files {
+					if strings.HasPrefix("shared/"+f, name) {
+						size += len(content)
+					}
+				}
+				if int(e.GetSize()) != size {
+					t.Errorf("%s listed with %d bytes, want %d", name, e.GetSize(), size)
+				}
+				names = append(names, name)
+			}
+			if got := strings.Join(names, " "); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if int(listing.GetTotal()) != tt.total {
+				t.Errorf("got %d entries in total, want %d", listing.GetTotal(), tt.total)
+			}
+		})
+	}
+
+	t.Run("changed", func(t *testing.T) {
+		path := filepath.Join(dir, "a.txt")
+		if err := os.WriteFile(path, []byte("changed"), 0666); err != nil {
+			t.Fatal(err)
+		}
+		later := time.Now().Add(time.Minute)
+		if err := os.Chtimes(path, later, later); err != nil {
+			t.Fatal(err)
+		}
+		listing, err := BrowseDir(h.ctx, bob, alice.Node.ID(), "shared", 0, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := sha256.Sum256([]byte("changed"))
+		if got := listing.GetEntries()[0].GetSha256(); !bytes.Equal(got, want[:]) {
+			t.Errorf("got digest %x after the change, want %x", got, want)
+		}
+	})
+}
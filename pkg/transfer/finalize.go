@@ -0,0 +1,105 @@
+package transfer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/Azanul/peer-pressure/pkg/dest"
+	"github.com/Azanul/peer-pressure/pkg/meta"
+	"github.com/Azanul/peer-pressure/pkg/pressure/pb"
+)
+
+// ErrCorrupt is returned when a complete download doesn't match the digest
+// the sender announced.
+var ErrCorrupt = errors.New("download doesn't match the sender's digest")
+
+// errIncomplete is returned by finalize for a download still missing chunks,
+// one that was stopped early.
+var errIncomplete = errors.New("download incomplete")
+
+// finalize moves a complete download into place. The part file is synced,
+// checked against the sender's digest and given the sender's metadata, as
+// far as policy allows, before it's renamed, so the file never shows up half
+// written. The index goes last, a crash before that leaves the download to
+// be resumed and finalized again. A transfer that was stopped early is left
+// as it is, with errIncomplete. On ErrCorrupt the index is reset, so that every chunk is
+// requested again.
+func finalize(d dest.Dest, policy meta.Policy) error {
+	data, err := os.ReadFile(d.Index)
+	if err != nil {
+		return err
+	}
+	index := pb.Index{}
+	err = proto.Unmarshal(data, &index)
+	if err != nil {
+		return err
+	}
+	if index.GetProgress() < index.GetNChunks() {
+		return errIncomplete
+	}
+
+	f, err := os.OpenFile(d.Part, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if err == nil && len(index.GetSha256()) > 0 {
+		err = verify(f, index.GetSha256())
+	}
+	f.Close()
+	if errors.Is(err, ErrCorrupt) {
+		// Nothing tells which chunks are bad, all of them have to come again
+		index.Progress = 0
+		index.Received = nil
+		index.Save(d.Index)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = meta.Apply(d.Part, &index, policy)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(d.Part, d.Path)
+	if err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(d.Path))
+	log.Printf("%s complete", d.Path)
+	return os.Remove(d.Index)
+}
+
+func verify(f *os.File, want []byte) error {
+	digest := sha256.New()
+	_, err := io.Copy(digest, io.NewSectionReader(f, 0, 1<<62))
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(digest.Sum(nil), want) {
+		return fmt.Errorf("%w: %s", ErrCorrupt, f.Name())
+	}
+	return nil
+}
+
+// syncDir makes a rename in dir durable. Not every OS can sync a directory,
+// so failures are only logged.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		log.Debugf("Syncing %s: %v", dir, err)
+	}
+}
@@ -0,0 +1,125 @@
+package transfer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Azanul/peer-pressure/pkg/gateway"
+	"github.com/Azanul/peer-pressure/pkg/peer"
+	"github.com/Azanul/peer-pressure/pkg/streamio"
+)
+
+// getRange reads rng of the file served at url, waiting for the gateway to
+// have one attached.
+func getRange(url, rng string) ([]byte, error) {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Range", rng)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case resp.StatusCode == http.StatusPartialContent:
+			return body, nil
+		case resp.StatusCode != http.StatusServiceUnavailable:
+			return nil, fmt.Errorf("got status %s", resp.Status)
+		case time.Now().After(deadline):
+			return nil, fmt.Errorf("nothing attached to the gateway")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGatewaySeek(t *testing.T) {
+	h := newHarness(t)
+	alice, bob := h.node("alice"), h.node("bob")
+	path, data := testFile(t, "video.bin", testSize)
+
+	gw, err := gateway.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gw.Close()
+	// A short read-ahead, so that nothing but the tail is fetched after the seek
+	gw.SetReadAhead(16)
+
+	opts := newOptions()
+	go Receive(h.ctx, bob, gw, opts)
+	h.advertised(bob, "receiver")
+	sent := h.send(alice, path)
+
+	type result struct {
+		body []byte
+		err  error
+	}
+	tail := make(chan result, 1)
+	go func() {
+		body, err := getRange(gw.URL(), "bytes=-100")
+		tail <- result{body, err}
+	}()
+
+	// The end of the file is served long before the transfer is through
+	fetched := 0.0
+	timeout := time.After(20 * time.Second)
+	for waiting := true; waiting; {
+		select {
+		case e := <-opts.EventCh:
+			if f, ok := fraction(e); ok {
+				fetched = f
+			} else if msg, ok := e.Data.(string); ok {
+				t.Fatalf("receiver error: %s", msg)
+			}
+		case r := <-tail:
+			if r.err != nil {
+				t.Fatal(r.err)
+			}
+			if !bytes.Equal(r.body, data[len(data)-100:]) {
+				t.Fatal("the tail served differs from the one sent")
+			}
+			waiting = false
+		case <-timeout:
+			t.Fatal("the tail was never served")
+		}
+	}
+	for quiet := false; !quiet; {
+		select {
+		case e := <-opts.EventCh:
+			if f, ok := fraction(e); ok {
+				fetched = f
+			}
+		case <-time.After(200 * time.Millisecond):
+			quiet = true
+		}
+	}
+	if fetched > 0.5 {
+		t.Errorf("%.0f%% fetched after the seek, want the stream to wait for the playhead", fetched*100)
+	}
+
+	// Bulk fetches everything left regardless of the playhead
+	gw.SetSchedule(streamio.Bulk)
+	untilDone(t, opts.EventCh, func(e peer.Event) bool {
+		if msg, ok := e.Data.(string); ok {
+			t.Errorf("receiver error: %s", msg)
+		}
+		return true
+	})
+	command(h, opts.CommandCh, peer.Stop)
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+	checkReceived(t, bob, "video.bin", data)
+}
@@ -0,0 +1,181 @@
+package transfer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Azanul/peer-pressure/pkg/dirwalk"
+	"github.com/Azanul/peer-pressure/pkg/peer"
+	libp2ppeer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Delivery is how a send to one member of a group went.
+type Delivery struct {
+	Name string // Name the member is trusted under
+	ID   libp2ppeer.ID
+	Err  error // Why the member didn't get everything, nil if it did
+}
+
+// RecipientEvent is the Data of an event of the send to one member of a
+// group, wrapping the Data of the member's own event.
+type RecipientEvent struct {
+	Name string
+	Data interface{}
+}
+
+// SendToGroup sends the file or directory at path to the members of a group
+// of p, see peer.Peer.Group, all at once. Members are found on the
+// rendezvous of p like receivers of Send. The events of every member's
+// transfer come on opts.EventCh with their Data wrapped in a RecipientEvent,
+// the commands on opts.CommandCh go to all of them.
+// It returns how the send to each member went, in the order of the group,
+// an error only if it couldn't be started.
+func SendToGroup(ctx context.Context, p *peer.Peer, group, path string, opts Options) ([]Delivery, error) {
+	members, err := p.Group(group)
+	if err != nil {
+		return nil, err
+	}
+	deliveries := make([]Delivery, len(members))
+	byID := map[libp2ppeer.ID]int{}
+	for i, name := range members {
+		id, err := p.TrustedID(name)
+		if err != nil {
+			return nil, err
+		}
+		deliveries[i] = Delivery{Name: name, ID: id, Err: ErrNoReceiver}
+		byID[id] = i
+	}
+	entries, err := dirwalk.Walk(path, opts.Walk)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("nothing to send in %s", path)
+	}
+
+	peerChan, err := p.DiscoverPeers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	commands := newFanout(opts.CommandCh)
+	defer commands.close()
+	var wg sync.WaitGroup
+	started := map[int]bool{}
+	for info := range peerChan {
+		i, ok := byID[info.ID]
+		if !ok || started[i] || info.ID == p.Node.ID() {
+			continue
+		}
+		err := p.Connect(ctx, info)
+		if err != nil {
+			log.Println("S Failed connecting to ", info.ID.Pretty(), ", error:", err)
+			deliveries[i].Err = err
+			continue
+		}
+		started[i] = true
+		wg.Add(1)
+		go func(i int, m member) {
+			defer wg.Done()
+			defer close(m.done)
+			opts := opts
+			opts.CommandCh = m.cmdCh
+			deliveries[i].Err = sendToMember(ctx, p, deliveries[i], entries, opts)
+		}(i, commands.join())
+	}
+	wg.Wait()
+	return deliveries, nil
+}
+
+// sendToMember sends the entries to a member of a group, passing the events
+// of its transfer on wrapped in RecipientEvents.
+func sendToMember(ctx context.Context, p *peer.Peer, d Delivery, entries []dirwalk.Entry, opts Options) error {
+	events := opts.EventCh
+	opts.EventCh = make(chan peer.Event)
+	forwarded := make(chan struct{})
+	go func() {
+		defer close(forwarded)
+		for e := range opts.EventCh {
+			events <- peer.Event{Type: e.Type, Data: RecipientEvent{Name: d.Name, Data: e.Data}}
+		}
+	}()
+
+	err := sendToPeer(ctx, p, d.ID, entries, opts)
+	close(opts.EventCh)
+	<-forwarded
+	if err != nil {
+		log.Warnf("Sending to %s of the group: %v", d.Name, err)
+	}
+	return err
+}
+
+// fanout copies every command of a group send to the sends to each member,
+// so that a pause or a stop reaches all of them rather than whichever reads
+// it first. Members joining late get the latest command as well, to start
+// paused or stopped.
+type fanout struct {
+	joinCh chan member
+	quit   chan struct{}
+}
+
+// member is where the commands for the send to one member go, until done is
+// closed.
+type member struct {
+	cmdCh chan peer.Command
+	done  chan struct{}
+}
+
+func newFanout(in chan peer.Command) *fanout {
+	f := &fanout{joinCh: make(chan member), quit: make(chan struct{})}
+	go f.run(in)
+	return f
+}
+
+func (f *fanout) join() member {
+	m := member{cmdCh: make(chan peer.Command), done: make(chan struct{})}
+	select {
+	case f.joinCh <- m:
+	case <-f.quit:
+	}
+	return m
+}
+
+func (f *fanout) close() {
+	close(f.quit)
+}
+
+func (f *fanout) run(in chan peer.Command) {
+	var members []member
+	latest := peer.Continue
+	// deliver reports false for a member that's done
+	deliver := func(m member, cmd peer.Command) bool {
+		select {
+		case m.cmdCh <- cmd:
+			return true
+		case <-m.done:
+		case <-f.quit:
+		}
+		return false
+	}
+	for {
+		select {
+		case m := <-f.joinCh:
+			if latest == peer.Continue || deliver(m, latest) {
+				members = append(members, m)
+			}
+		case cmd := <-in:
+			latest = cmd
+			kept := members[:0]
+			for _, m := range members {
+				if deliver(m, cmd) {
+					kept = append(kept, m)
+				}
+			}
+			members = kept
+		case <-f.quit:
+			return
+		}
+	}
+}
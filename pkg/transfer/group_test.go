@@ -0,0 +1,174 @@
+package transfer
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Azanul/peer-pressure/pkg/peer"
+	"github.com/Azanul/peer-pressure/pkg/ratelimit"
+)
+
+func TestSendToGroup(t *testing.T) {
+	h := newHarness(t)
+	alice, bob, carol, dave := h.node("alice"), h.node("bob"), h.node("carol"), h.node("dave")
+	path, data := testFile(t, "file.bin", testSize)
+	for _, p := range []*peer.Peer{bob, carol, dave} {
+		if err := alice.Trust(p.Name, p.Node.ID()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := alice.SetGroup("team", []string{"bob", "carol", "dave"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.SetGroup("strangers", []string{"mallory"}); err == nil {
+		t.Error("group of an untrusted node saved")
+	}
+
+	// dave isn't receiving
+	for _, p := range []*peer.Peer{bob, carol} {
+		opts := newOptions()
+		go drain(h.ctx, opts.EventCh)
+		h.receive(p, opts)
+	}
+
+	opts := newOptions()
+	done := map[string]bool{}
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		for e := range opts.EventCh {
+			r, ok := e.Data.(RecipientEvent)
+			if !ok {
+				t.Errorf("got %+v, want a RecipientEvent", e)
+				continue
+			}
+			if stats, ok := r.Data.(peer.Stats); ok && stats.Fraction < 0 {
+				done[r.Name] = true
+			}
+		}
+	}()
+	deliveries, err := SendToGroup(h.ctx, alice, "team", path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(opts.EventCh)
+	<-finished
+
+	var tests = []struct {
+		name string
+		err  error
+	}{
+		{"bob", nil},
+		{"carol", nil},
+		{"dave", ErrNoReceiver},
+	}
+	if len(deliveries) != len(tests) {
+		t.Fatalf("got %d deliveries, want %d", len(deliveries), len(tests))
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := deliveries[i]
+			if d.Name != tt.name || !errors.Is(d.Err, tt.err) {
+				t.Errorf("got %s: %v, want %s: %v", d.Name, d.Err, tt.name, tt.err)
+			}
+			if done[tt.name] != (tt.err == nil) {
+				t.Errorf("end of the transfer reported: %v", done[tt.name])
+			}
+		})
+	}
+	checkReceived(t, bob, "file.bin", data)
+	checkReceived(t, carol, "file.bin", data)
+}
+
+func TestGroupCommands(t *testing.T) {
+	h := newHarness(t)
+	alice, bob, carol := h.node("alice"), h.node("bob"), h.node("carol")
+	path, data := testFile(t, "file.bin", testSize)
+	for _, p := range []*peer.Peer{bob, carol} {
+		if err := alice.Trust(p.Name, p.Node.ID()); err != nil {
+			t.Fatal(err)
+		}
+		opts := newOptions()
+		go drain(h.ctx, opts.EventCh)
+		h.receive(p, opts)
+	}
+	if err := alice.SetGroup("team", []string{"bob", "carol"}); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := newOptions()
+	// Both sends take a second at least, shared
+	opts.Limit = ratelimit.New(testSize)
+	type result struct {
+		deliveries []Delivery
+		err        error
+	}
+	sent := make(chan result, 1)
+	go func() {
+		deliveries, err := SendToGroup(h.ctx, alice, "team", path, opts)
+		sent <- result{deliveries, err}
+	}()
+
+	progress := map[string]float64{}
+	// watch records the progress of each member until fn returns false, or
+	// for d if it's not 0
+	watch := func(fn func() bool, d time.Duration) {
+		t.Helper()
+		timeout, failing := time.After(20*time.Second), true
+		if d > 0 {
+			timeout, failing = time.After(d), false
+		}
+		for fn() {
+			select {
+			case e := <-opts.EventCh:
+				if r, ok := e.Data.(RecipientEvent); ok {
+					if stats, ok := r.Data.(peer.Stats); ok {
+						progress[r.Name] = stats.Fraction
+					}
+				}
+			case <-timeout:
+				if failing {
+					t.Fatalf("got progress %v, still waiting", progress)
+				}
+				return
+			}
+		}
+	}
+	always := func() bool { return true }
+	send := func(cmd peer.Command) {
+		t.Helper()
+		select {
+		case opts.CommandCh <- cmd:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("command %v never taken", cmd)
+		}
+	}
+
+	watch(func() bool { return progress["bob"] <= 0 || progress["carol"] <= 0 }, 0)
+	// A single pause holds up every member, once the chunks on their way are in
+	send(peer.Pause)
+	watch(always, 200*time.Millisecond)
+	paused := map[string]float64{"bob": progress["bob"], "carol": progress["carol"]}
+	watch(always, 500*time.Millisecond)
+	for name, f := range paused {
+		if progress[name] != f {
+			t.Errorf("%s went on from %.2f to %.2f while paused", name, f, progress[name])
+		}
+	}
+
+	send(peer.Continue)
+	watch(func() bool { return progress["bob"] >= 0 || progress["carol"] >= 0 }, 0)
+	go drain(h.ctx, opts.EventCh)
+	r := <-sent
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	for _, d := range r.deliveries {
+		if d.Err != nil {
+			t.Errorf("%s: %v", d.Name, d.Err)
+		}
+	}
+	checkReceived(t, bob, "file.bin", data)
+	checkReceived(t, carol, "file.bin", data)
+}
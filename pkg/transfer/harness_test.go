@@ -0,0 +1,295 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azanul/peer-pressure/pkg/peer"
+	"github.com/Azanul/peer-pressure/pkg/pressure/pb"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/discovery"
+	"github.com/libp2p/go-libp2p/core/host"
+	libp2ppeer "github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+// fastRetry keeps reconnects and waits for a sender short in tests.
+var fastRetry = peer.RetryPolicy{
+	MaxAttempts: 50,
+	Initial:     10 * time.Millisecond,
+	Max:         100 * time.Millisecond,
+	Multiplier:  1.5,
+}
+
+// noRetry makes senders give up on the first interruption, leaving it to
+// the test to resume.
+var noRetry = peer.RetryPolicy{Initial: time.Millisecond}
+
+// rendezvous is an in-memory stand-in for the DHT, shared by the peers of a
+// harness.
+type rendezvous struct {
+	mu    sync.Mutex
+	peers map[string]map[libp2ppeer.ID]libp2ppeer.AddrInfo
+}
+
+func (r *rendezvous) leave(id libp2ppeer.ID) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, peers := range r.peers {
+		delete(peers, id)
+	}
+}
+
+func (r *rendezvous) has(ns string, id libp2ppeer.ID) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.peers[ns][id]
+	return ok
+}
+
+// rendezvousClient is the discovery of a single host on a rendezvous.
+type rendezvousClient struct {
+	r *rendezvous
+	h host.Host
+}
+
+func (c rendezvousClient) Advertise(ctx context.Context, ns string, opts ...discovery.Option) (time.Duration, error) {
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+	if c.r.peers[ns] == nil {
+		c.r.peers[ns] = map[libp2ppeer.ID]libp2ppeer.AddrInfo{}
+	}
+	c.r.peers[ns][c.h.ID()] = *host.InfoFromHost(c.h)
+	return time.Hour, nil
+}
+
+func (c rendezvousClient) FindPeers(ctx context.Context, ns string, opts ...discovery.Option) (<-chan libp2ppeer.AddrInfo, error) {
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+	ch := make(chan libp2ppeer.AddrInfo, len(c.r.peers[ns]))
+	for _, info := range c.r.peers[ns] {
+		ch <- info
+	}
+	close(ch)
+	return ch, nil
+}
+
+// providerRecords is an in-memory stand-in for the provider records on the
+// DHT, shared by the peers of a harness. Providers are found in the order
+// they announced themselves.
+type providerRecords struct {
+	mu        sync.Mutex
+	providers map[cid.Cid][]libp2ppeer.AddrInfo
+}
+
+// contentRouter is the content routing of a single host.
+type contentRouter struct {
+	r *providerRecords
+	h host.Host
+}
+
+func (c contentRouter) Provide(ctx context.Context, id cid.Cid, announce bool) error {
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+	for _, info := range c.r.providers[id] {
+		if info.ID == c.h.ID() {
+			return nil
+		}
+	}
+	c.r.providers[id] = append(c.r.providers[id], *host.InfoFromHost(c.h))
+	return nil
+}
+
+func (c contentRouter) FindProvidersAsync(ctx context.Context, id cid.Cid, limit int) <-chan libp2ppeer.AddrInfo {
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+	ch := make(chan libp2ppeer.AddrInfo, len(c.r.providers[id]))
+	for _, info := range c.r.providers[id] {
+		if limit > 0 && len(ch) == limit {
+			break
+		}
+		ch <- info
+	}
+	close(ch)
+	return ch
+}
+
+// harness runs peers in one process, connected through mocknet and finding
+// each other on an in-memory rendezvous and provider records.
+type harness struct {
+	t    *testing.T
+	ctx  context.Context
+	mn   mocknet.Mocknet
+	rv   *rendezvous
+	pr   *providerRecords
+	root string
+}
+
+func newHarness(t *testing.T) *harness {
+	ctx, cancel := context.WithCancel(context.Background())
+	mn := mocknet.New()
+	t.Cleanup(func() {
+		cancel()
+		mn.Close()
+	})
+	return &harness{
+		t:    t,
+		ctx:  ctx,
+		mn:   mn,
+		rv:   &rendezvous{peers: map[string]map[libp2ppeer.ID]libp2ppeer.AddrInfo{}},
+		pr:   &providerRecords{providers: map[cid.Cid][]libp2ppeer.AddrInfo{}},
+		root: t.TempDir(),
+	}
+}
+
+// node starts a node with the given name. Every node has a root directory of
+// its own, starting a node under a name used before reuses the directory like
+// a restarted node would.
+func (h *harness) node(name string) *peer.Peer {
+	h.t.Helper()
+	host, err := h.mn.GenPeer()
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	if err := h.mn.LinkAll(); err != nil {
+		h.t.Fatal(err)
+	}
+
+	p, err := peer.New(name, "test",
+		peer.WithRoot(filepath.Join(h.root, name, peer.DefaultRoot)),
+		peer.WithHost(host),
+		peer.WithDiscovery(rendezvousClient{h.rv, host}),
+		peer.WithContentRouting(contentRouter{h.pr, host}),
+	)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	if err := os.MkdirAll(p.GetPeerDir(), os.ModePerm); err != nil {
+		h.t.Fatal(err)
+	}
+	h.t.Cleanup(func() { h.stop(p) })
+	return p
+}
+
+// stop shuts a node down and takes it off the rendezvous.
+func (h *harness) stop(p *peer.Peer) {
+	h.rv.leave(p.Node.ID())
+	p.Close()
+}
+
+// receive starts receiving on p and waits until p is on the rendezvous, so
+// that a sender started afterwards finds it.
+func (h *harness) receive(p *peer.Peer, opts Options) <-chan error {
+	h.t.Helper()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- Receive(h.ctx, p, nil, opts)
+	}()
+	h.advertised(p, "receiver")
+	return errCh
+}
+
+// advertised waits until p, started as role, is on the rendezvous.
+func (h *harness) advertised(p *peer.Peer, role string) {
+	h.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !h.rv.has(p.GetRendezvous(), p.Node.ID()) {
+		if time.Now().After(deadline) {
+			h.t.Fatalf("%s never showed up on the rendezvous", role)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// send sends path from p in the background, the events of the sender are
+// drained.
+func (h *harness) send(p *peer.Peer, path string) <-chan error {
+	return h.sendWith(p, path, newOptions())
+}
+
+// sendWith is send with options of the caller's.
+func (h *harness) sendWith(p *peer.Peer, path string, opts Options) <-chan error {
+	go drain(h.ctx, opts.EventCh)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- Send(h.ctx, p, path, opts)
+	}()
+	return errCh
+}
+
+func newOptions() Options {
+	return Options{
+		EventCh:   make(chan peer.Event),
+		CommandCh: make(chan peer.Command),
+		Retry:     fastRetry,
+	}
+}
+
+func drain(ctx context.Context, ch chan peer.Event) {
+	for {
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// untilDone hands the events on ch to fn until the transfer reports its end
+// or fn returns false.
+func untilDone(t *testing.T, ch chan peer.Event, fn func(peer.Event) bool) {
+	t.Helper()
+	timeout := time.After(20 * time.Second)
+	for {
+		select {
+		case e := <-ch:
+			if !fn(e) {
+				return
+			}
+			if stats, ok := e.Data.(peer.Stats); ok && stats.Fraction < 0 {
+				return
+			}
+		case <-timeout:
+			t.Fatal("transfer timed out")
+		}
+	}
+}
+
+// testFile writes size random bytes to a file in a fresh directory.
+func testFile(t *testing.T, name string, size int) (string, []byte) {
+	t.Helper()
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	return path, data
+}
+
+// checkReceived compares the file received by p with want and makes sure
+// the download left nothing behind.
+func checkReceived(t *testing.T, p *peer.Peer, name string, want []byte) {
+	t.Helper()
+	path := filepath.Join(p.DownloadDir(), name)
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("received %d bytes differing from the %d sent", len(got), len(want))
+	}
+	for _, leftover := range []string{path + ".part", pb.IndexPath(path)} {
+		if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+			t.Errorf("%s left behind", leftover)
+		}
+	}
+}
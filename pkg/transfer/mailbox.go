@@ -0,0 +1,541 @@
+package transfer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/Azanul/peer-pressure/pkg/mailbox"
+	"github.com/Azanul/peer-pressure/pkg/peer"
+	"github.com/Azanul/peer-pressure/pkg/pressure/pb"
+	"github.com/Azanul/peer-pressure/pkg/ratelimit"
+	"github.com/Azanul/peer-pressure/pkg/seal"
+	"github.com/Azanul/peer-pressure/pkg/streamio"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	libp2ppeer "github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// Protocols of a mailbox, letters are left over DepositProtocolID and picked
+// up over CollectProtocolID. Senders ask for the keys of recipients over
+// KeyProtocolID.
+const (
+	DepositProtocolID = protocol.ID("/peer-pressure/mailbox/deposit/1.0.0")
+	CollectProtocolID = protocol.ID("/peer-pressure/mailbox/collect/1.0.0")
+	KeyProtocolID     = protocol.ID("/peer-pressure/mailbox/key/1.0.0")
+)
+
+// expireInterval is how often a mailbox drops the letters that expired.
+const expireInterval = time.Minute
+
+var ErrNoKey = errors.New("public key of the recipient unknown, it has to collect from the mailbox once first")
+
+// Mailbox holds files for nodes that are offline, so that sender and
+// receiver don't have to be online at the same time. Senders Post files to
+// it sealed for the recipient, see package seal, so that the mailbox can't
+// read them, and recipients Collect them whenever they come online, before
+// they expire.
+type Mailbox struct {
+	p    *peer.Peer
+	box  *mailbox.Mailbox
+	opts Options
+}
+
+// NewMailbox starts holding letters in box for whoever posts them. Reads and
+// writes are throttled by the transfer limit as well as the node and global
+// limits.
+func NewMailbox(p *peer.Peer, box *mailbox.Mailbox, opts Options) *Mailbox {
+	m := &Mailbox{p: p, box: box, opts: opts}
+	p.Node.SetStreamHandler(DepositProtocolID, m.handleDeposit)
+	p.Node.SetStreamHandler(CollectProtocolID, m.handleCollect)
+	p.Node.SetStreamHandler(KeyProtocolID, m.handleKey)
+	return m
+}
+
+// Close stops holding letters, those held are kept for the next start.
+func (m *Mailbox) Close() {
+	m.p.Node.RemoveStreamHandler(DepositProtocolID)
+	m.p.Node.RemoveStreamHandler(CollectProtocolID)
+	m.p.Node.RemoveStreamHandler(KeyProtocolID)
+}
+
+// Run keeps the node on its rendezvous and drops expired letters until ctx
+// is done.
+func (m *Mailbox) Run(ctx context.Context) error {
+	peerChan, err := m.p.DiscoverPeers(ctx)
+	if err != nil {
+		return err
+	}
+	for range peerChan {
+	}
+
+	ticker := time.NewTicker(expireInterval)
+	defer ticker.Stop()
+	for {
+		n, err := m.box.Expire(time.Now())
+		if err != nil {
+			log.Errorf("Dropping expired letters: %v", err)
+		} else if n > 0 {
+			log.Printf("Dropped %d expired letter(s)", n)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *Mailbox) handleDeposit(stream network.Stream) {
+	defer stream.Close()
+	in := ratelimit.NewReader(stream, m.opts.Limit, m.p.Download, ratelimit.GlobalDownload)
+	rw := bufio.NewReadWriter(bufio.NewReader(in), bufio.NewWriter(stream))
+	remote := stream.Conn().RemotePeer()
+	letter := pb.Letter{}
+	err := pb.Read(rw.Reader, &letter)
+	if err != nil {
+		return
+	}
+
+	to, err := libp2ppeer.IDFromBytes(letter.GetTo())
+	if err == nil && letter.GetSize() < 0 {
+		err = fmt.Errorf("letter of %d bytes", letter.GetSize())
+	}
+	if err == nil {
+		err = m.box.Fits(to, letter.GetSize(), time.Now())
+	}
+	if err != nil {
+		log.Warnf("Refusing a letter from %s: %v", remote.Pretty(), err)
+		rw.Write(pb.Marshal(&pb.Letter{Refusal: err.Error()}))
+		rw.Flush()
+		return
+	}
+	_, err = rw.Write(pb.Marshal(&pb.Letter{}))
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		return
+	}
+
+	l, err := m.box.Put(to, remote, letter.GetKey(), letter.GetSize(), rw.Reader, time.Now())
+	if errors.Is(err, mailbox.ErrQuota) {
+		rw.Write(pb.Marshal(&pb.Letter{Refusal: err.Error()}))
+		rw.Flush()
+		return
+	} else if err != nil {
+		log.Errorf("Keeping a letter from %s: %v", remote.Pretty(), err)
+		stream.Reset()
+		return
+	}
+	log.Printf("Holding %s from %s for %s until %s", l.ID, remote.Pretty(), to.Pretty(), l.Expires.Format(time.RFC3339))
+	_, err = rw.Write(pb.Marshal(letterMessage(l)))
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		log.Warnf("Confirming %s to %s: %v", l.ID, remote.Pretty(), err)
+	}
+}
+
+// letterMessage describes a letter held on the wire.
+func letterMessage(l mailbox.Letter) *pb.Letter {
+	return &pb.Letter{
+		To:      []byte(l.To),
+		From:    []byte(l.From),
+		Key:     l.Key,
+		Size:    l.Size,
+		Id:      l.ID,
+		Expires: l.Expires.UnixNano(),
+	}
+}
+
+// handleCollect hands the letters held for the remote node over, dropping
+// each once the node acknowledges it and keeping those it refuses. The key of the node, known from the
+// connection, is kept for senders to seal letters to it.
+func (m *Mailbox) handleCollect(stream network.Stream) {
+	defer stream.Close()
+	out := ratelimit.NewWriter(stream, m.opts.Limit, m.p.Upload, ratelimit.GlobalUpload)
+	rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(out))
+	remote := stream.Conn().RemotePeer()
+	if pub := stream.Conn().RemotePublicKey(); pub != nil {
+		err := m.box.SaveKey(remote, pub)
+		if err != nil {
+			log.Warnf("Keeping the key of %s: %v", remote.Pretty(), err)
+		}
+	}
+
+	letters, err := m.box.List(remote, time.Now())
+	if err != nil {
+		log.Errorf("Listing the letters for %s: %v", remote.Pretty(), err)
+		stream.Reset()
+		return
+	}
+	for _, l := range letters {
+		err := m.deliver(rw, l)
+		if errors.Is(err, errLetterKept) {
+			log.Warnf("Delivering %s to %s: %v", l.ID, remote.Pretty(), err)
+			continue
+		} else if err != nil {
+			log.Warnf("Delivering %s to %s: %v", l.ID, remote.Pretty(), err)
+			stream.Reset()
+			return
+		}
+		log.Printf("Delivered %s to %s", l.ID, remote.Pretty())
+	}
+	_, err = rw.Write(pb.Marshal(&pb.Letter{}))
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		log.Warnf("Ending the collection of %s: %v", remote.Pretty(), err)
+	}
+}
+
+// errLetterKept is returned by deliver for a letter the recipient couldn't
+// take for now.
+var errLetterKept = errors.New("recipient left the letter with the mailbox")
+
+// deliver sends a letter and drops it once acknowledged, keeping it if the
+// recipient refuses it.
+func (m *Mailbox) deliver(rw *bufio.ReadWriter, l mailbox.Letter) error {
+	f, err := m.box.Open(l)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = rw.Write(pb.Marshal(letterMessage(l)))
+	if err == nil {
+		_, err = io.CopyN(rw, f, l.Size)
+	}
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		return err
+	}
+	ack := pb.Letter{}
+	err = pb.Read(rw.Reader, &ack)
+	if err != nil {
+		return err
+	}
+	if ack.GetId() != l.ID {
+		return fmt.Errorf("acknowledged %q instead", ack.GetId())
+	}
+	if ack.GetRefusal() != "" {
+		return fmt.Errorf("%w: %s", errLetterKept, ack.GetRefusal())
+	}
+	return m.box.Remove(l)
+}
+
+func (m *Mailbox) handleKey(stream network.Stream) {
+	defer stream.Close()
+	rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+	req := pb.KeyRequest{}
+	err := pb.Read(rw.Reader, &req)
+	if err != nil {
+		return
+	}
+	reply := &pb.KeyRequest{Id: req.GetId()}
+	id, err := libp2ppeer.IDFromBytes(req.GetId())
+	var pub crypto.PubKey
+	if err == nil {
+		pub, err = m.box.Key(id)
+	}
+	if err == nil {
+		reply.Key, err = crypto.MarshalPublicKey(pub)
+	}
+	if err != nil && !errors.Is(err, mailbox.ErrNoKey) {
+		log.Warnf("Looking up a key for %s: %v", stream.Conn().RemotePeer().Pretty(), err)
+	}
+	_, err = rw.Write(pb.Marshal(reply))
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		log.Warnf("Sending a key to %s: %v", stream.Conn().RemotePeer().Pretty(), err)
+	}
+}
+
+// recipientKey returns the public key of the node to, from the peerstore of
+// p if it's there or else from the mailbox. A key from the mailbox is only
+// taken if it's the one the peer ID was made from.
+func recipientKey(ctx context.Context, p *peer.Peer, box, to libp2ppeer.ID) (crypto.PubKey, error) {
+	if pub := p.Node.Peerstore().PubKey(to); pub != nil {
+		return pub, nil
+	}
+	stream, err := p.Node.NewStream(ctx, box, KeyProtocolID)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+	_, err = rw.Write(pb.Marshal(&pb.KeyRequest{Id: []byte(to)}))
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		return nil, err
+	}
+	reply := pb.KeyRequest{}
+	err = pb.Read(rw.Reader, &reply)
+	if err != nil {
+		return nil, err
+	}
+	if len(reply.GetKey()) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNoKey, to.Pretty())
+	}
+	pub, err := crypto.UnmarshalPublicKey(reply.GetKey())
+	if err != nil {
+		return nil, err
+	}
+	if !to.MatchesPublicKey(pub) {
+		return nil, fmt.Errorf("mailbox sent a key that isn't the one of %s", to.Pretty())
+	}
+	return pub, nil
+}
+
+// Post leaves the file at path with the mailbox node box for the node to,
+// sealed so that only to can read it, and returns the letter as the mailbox
+// keeps it. The name, metadata and digest of the file are sealed with it. A
+// post whose stream drops is started over after redialing, following
+// opts.Retry.
+func Post(ctx context.Context, p *peer.Peer, box, to libp2ppeer.ID, path string, opts Options) (*pb.Letter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	index, err := streamio.NewIndex(f, filepath.Base(path), streamio.Fixed)
+	if err != nil {
+		return nil, err
+	}
+	header := pb.Marshal(index)
+
+	err = p.Redial(ctx, box)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := recipientKey(ctx, p, box, to)
+	if err != nil {
+		return nil, err
+	}
+	key, err := seal.NewKey()
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := seal.WrapKey(pub, key)
+	if err != nil {
+		return nil, err
+	}
+	letter := &pb.Letter{
+		To:   []byte(to),
+		Key:  wrapped,
+		Size: seal.Size(int64(len(header)) + index.GetSize()),
+	}
+
+	var receipt *pb.Letter
+	err = opts.retry(peer.DefaultRetryPolicy).Do(ctx, opts.EventCh, func(attempt int) error {
+		if attempt > 0 {
+			err := p.Redial(ctx, box)
+			if err != nil {
+				return err
+			}
+		}
+		stream, err := p.Node.NewStream(ctx, box, DepositProtocolID)
+		if err != nil {
+			return err
+		}
+		defer stream.Close()
+		out := ratelimit.NewWriter(stream, opts.Limit, p.Upload, ratelimit.GlobalUpload)
+		rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(out))
+		receipt, err = deposit(rw, letter, key, header, f, index.GetSize())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("%s left for %s, held until %s", path, to.Pretty(), time.Unix(0, receipt.GetExpires()).Format(time.RFC3339))
+	opts.EventCh <- peer.Event{Type: peer.Progress, Data: peer.Stats{Fraction: -1}}
+	return receipt, nil
+}
+
+// deposit offers the letter to the mailbox and, unless it's refused, seals
+// the header and size bytes of f into it.
+func deposit(rw *bufio.ReadWriter, letter *pb.Letter, key, header []byte, f *os.File, size int64) (*pb.Letter, error) {
+	_, err := rw.Write(pb.Marshal(letter))
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		return nil, err
+	}
+	reply := &pb.Letter{}
+	err = pb.Read(rw.Reader, reply)
+	if err != nil {
+		return nil, err
+	}
+	if reply.GetRefusal() != "" {
+		return nil, peer.Permanent(fmt.Errorf("%w: %s", ErrDeclined, reply.GetRefusal()))
+	}
+
+	w, err := seal.NewWriter(rw, key)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(header)
+	if err == nil {
+		_, err = io.Copy(w, io.NewSectionReader(f, 0, size))
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = pb.Read(rw.Reader, reply)
+	if err != nil {
+		return nil, err
+	}
+	if reply.GetRefusal() != "" {
+		return nil, peer.Permanent(fmt.Errorf("%w: %s", ErrDeclined, reply.GetRefusal()))
+	}
+	return reply, nil
+}
+
+// Collect picks up the letters held for p by the mailbox node box and writes
+// the files in them to the download directory of p, like Receive would. It
+// returns where the files went, those collected before an error as well.
+// A letter that can't be opened doesn't hold up the others: it's dropped,
+// unless it didn't fit the quotas or the disk of p, in which case it stays
+// with the mailbox for a later collection. The last such failure is
+// returned once the rest are collected.
+func Collect(ctx context.Context, p *peer.Peer, box libp2ppeer.ID, opts Options) ([]string, error) {
+	err := p.Redial(ctx, box)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := p.Node.NewStream(ctx, box, CollectProtocolID)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	in := ratelimit.NewReader(stream, opts.Limit, p.Download, ratelimit.GlobalDownload)
+	rw := bufio.NewReadWriter(bufio.NewReader(in), bufio.NewWriter(stream))
+
+	var paths []string
+	var failed error // Why the last letter that couldn't be opened wasn't
+	for {
+		letter := pb.Letter{}
+		err := pb.Read(rw.Reader, &letter)
+		if err != nil {
+			return paths, err
+		}
+		if letter.GetId() == "" {
+			return paths, failed
+		}
+		body := &io.LimitedReader{R: rw.Reader, N: letter.GetSize()}
+		path, err := openLetter(p, &letter, body)
+		ack := &pb.Letter{Id: letter.GetId()}
+		if err != nil {
+			// What's left of the letter comes before the next one
+			_, drainErr := io.Copy(io.Discard, body)
+			if drainErr == nil && body.N > 0 {
+				drainErr = io.ErrUnexpectedEOF
+			}
+			if drainErr != nil {
+				return paths, drainErr
+			}
+			failed = fmt.Errorf("opening letter %s: %w", letter.GetId(), err)
+			if errors.Is(err, peer.ErrQuota) || errors.Is(err, ErrNoSpace) {
+				log.Warnf("%v, leaving it with the mailbox", failed)
+				ack.Refusal = err.Error()
+			} else {
+				log.Errorf("%v, dropping it", failed)
+			}
+			opts.EventCh <- peer.Event{Type: peer.Error, Data: failed.Error()}
+		}
+		_, err = rw.Write(pb.Marshal(ack))
+		if err == nil {
+			err = rw.Flush()
+		}
+		if err != nil {
+			return paths, err
+		}
+		if path != "" {
+			paths = append(paths, path)
+			opts.EventCh <- peer.Event{Type: peer.Progress, Data: peer.Stats{Fraction: -1}}
+		}
+	}
+}
+
+// openLetter unseals the blob of a letter from r and moves the file in it
+// into place.
+func openLetter(p *peer.Peer, letter *pb.Letter, r io.Reader) (string, error) {
+	from, err := libp2ppeer.IDFromBytes(letter.GetFrom())
+	if err != nil {
+		return "", err
+	}
+	key, err := p.UnwrapKey(letter.GetKey())
+	if err != nil {
+		return "", err
+	}
+	sealed, err := seal.NewReader(r, key)
+	if err != nil {
+		return "", err
+	}
+	index := pb.Index{}
+	err = pb.Read(sealed, &index)
+	if err != nil {
+		return "", err
+	}
+	d, err := p.Resolver().Resolve(&index)
+	if err != nil {
+		return "", err
+	}
+	f, err := createPreallocated(d.Part, index.GetSize(), from, p)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.CopyN(f, sealed, index.GetSize())
+	if err == nil {
+		// Only the end of the blob proves nothing was cut off
+		_, err = sealed.Read(make([]byte, 1))
+		if err == io.EOF {
+			err = nil
+		} else if err == nil {
+			err = errors.New("letter longer than its file")
+		}
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(d.Part)
+		p.Release(from, index.GetSize())
+		return "", err
+	}
+	index.ResetProgress()
+	index.Progress = index.GetNChunks()
+	index.Save(d.Index)
+	err = finalize(d, p.Config.Metadata)
+	if err != nil {
+		p.Release(from, index.GetSize())
+		return "", err
+	}
+	err = p.Charge(from, index.GetSize())
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Collected %s from %s", d.Path, from.Pretty())
+	return d.Path, nil
+}
@@ -0,0 +1,131 @@
+package transfer
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azanul/peer-pressure/pkg/mailbox"
+	"github.com/Azanul/peer-pressure/pkg/peer"
+)
+
+// mailbox runs a mailbox on p holding up to quota bytes per recipient, with
+// no limit on the total, and waits until p is on the rendezvous.
+func (h *harness) mailbox(p *peer.Peer, quota int64) *mailbox.Mailbox {
+	h.t.Helper()
+	opts := newOptions()
+	go drain(h.ctx, opts.EventCh)
+	box := mailbox.New(filepath.Join(p.GetPeerDir(), peer.MailboxDir), time.Hour, quota, 0)
+	m := NewMailbox(p, box, opts)
+	h.t.Cleanup(m.Close)
+	go m.Run(h.ctx)
+	h.advertised(p, "mailbox")
+	return box
+}
+
+func TestMailbox(t *testing.T) {
+	h := newHarness(t)
+	alice, bob, carol := h.node("alice"), h.node("bob"), h.node("carol")
+	box := h.mailbox(carol, testSize+1024)
+	path, data := testFile(t, "letter.bin", testSize)
+	large, _ := testFile(t, "large.bin", testSize+1)
+
+	opts := newOptions()
+	go drain(h.ctx, opts.EventCh)
+	collect := func(want int) {
+		t.Helper()
+		paths, err := Collect(h.ctx, bob, carol.Node.ID(), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(paths) != want {
+			t.Fatalf("collected %v, want %d file(s)", paths, want)
+		}
+	}
+
+	var tests = []struct {
+		name    string
+		path    string
+		collect bool // bob collects ahead of the post
+		err     error
+	}{
+		{"key unknown", path, false, ErrNoKey},
+		{"posted", path, true, nil},
+		{"over quota", large, false, ErrDeclined},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.collect {
+				collect(0)
+			}
+			// bob is gone by the time the letter is posted
+			bob.Node.Network().ClosePeer(carol.Node.ID())
+			receipt, err := Post(h.ctx, alice, carol.Node.ID(), bob.Node.ID(), tt.path, opts)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if err == nil && receipt.GetId() == "" {
+				t.Errorf("got receipt %+v", receipt)
+			}
+		})
+	}
+
+	letters, err := box.List(bob.Node.ID(), time.Now())
+	if err != nil || len(letters) != 1 {
+		t.Fatalf("mailbox holds %+v, %v, want a letter", letters, err)
+	}
+	f, err := box.Open(letters[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := os.ReadFile(f.Name())
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(blob, []byte("letter.bin")) || bytes.Contains(blob, data[:64]) {
+		t.Error("mailbox can read the letter")
+	}
+
+	collect(1)
+	checkReceived(t, bob, "letter.bin", data)
+	collect(0)
+
+	// A letter that can't be opened is dropped without holding up the next
+	if _, err := box.Put(bob.Node.ID(), alice.Node.ID(), []byte("bad key"), 5, strings.NewReader("hello"), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	second, secondData := testFile(t, "second.bin", 1024)
+	if _, err := Post(h.ctx, alice, carol.Node.ID(), bob.Node.ID(), second, opts); err != nil {
+		t.Fatal(err)
+	}
+	paths, err := Collect(h.ctx, bob, carol.Node.ID(), opts)
+	if err == nil || len(paths) != 1 {
+		t.Fatalf("collected %v, %v, want the second letter and an error", paths, err)
+	}
+	checkReceived(t, bob, "second.bin", secondData)
+	if letters, _ := box.List(bob.Node.ID(), time.Now()); len(letters) != 0 {
+		t.Errorf("mailbox kept %+v", letters)
+	}
+
+	// One that doesn't fit the quota of bob stays until there's room
+	third, thirdData := testFile(t, "third.bin", 1024)
+	if _, err := Post(h.ctx, alice, carol.Node.ID(), bob.Node.ID(), third, opts); err != nil {
+		t.Fatal(err)
+	}
+	bob.Config.PeerQuota = 1
+	paths, err = Collect(h.ctx, bob, carol.Node.ID(), opts)
+	if !errors.Is(err, peer.ErrQuota) || len(paths) != 0 {
+		t.Fatalf("collected %v, %v, want %v", paths, err, peer.ErrQuota)
+	}
+	if letters, _ := box.List(bob.Node.ID(), time.Now()); len(letters) != 1 {
+		t.Errorf("mailbox holds %+v, want the refused letter", letters)
+	}
+	bob.Config.PeerQuota = 0
+	collect(1)
+	checkReceived(t, bob, "third.bin", thirdData)
+}
@@ -0,0 +1,257 @@
+package transfer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/Azanul/peer-pressure/pkg/dirwalk"
+	"github.com/Azanul/peer-pressure/pkg/peer"
+	"github.com/Azanul/peer-pressure/pkg/pressure/pb"
+	"github.com/Azanul/peer-pressure/pkg/ratelimit"
+	"github.com/libp2p/go-libp2p/core/network"
+	libp2ppeer "github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// Protocols of a share, the catalog is asked for over CatalogProtocolID,
+// directories are listed page by page over BrowseProtocolID and files are
+// pulled over PullProtocolID.
+const (
+	CatalogProtocolID = protocol.ID("/peer-pressure/share/catalog/1.0.0")
+	BrowseProtocolID  = protocol.ID("/peer-pressure/share/browse/1.0.0")
+	PullProtocolID    = protocol.ID("/peer-pressure/share/pull/1.0.0")
+)
+
+var ErrNotShared = errors.New("file not in the share")
+
+// Share serves files to the peers asking for them, for as long as the node
+// runs, rather than pushing them to receivers that have to be waiting. Peers
+// browse its Catalog and pull files from it by name. A pull starts with a
+// ChunkRequest naming the file and goes on like a transfer, the sharing node
+// offering the file and the puller requesting its chunks.
+type Share struct {
+	p     *peer.Peer
+	paths []string
+	opts  Options
+
+	mu   sync.Mutex
+	sums map[string]fileSum // Digests of the files listed so far, by path
+}
+
+// NewShare starts sharing the files and directories at paths, see
+// dirwalk.Walk for what of a directory is shared. Serving is throttled by the
+// transfer limit as well as the node and global upload limits.
+func NewShare(p *peer.Peer, paths []string, opts Options) *Share {
+	s := &Share{p: p, paths: paths, opts: opts, sums: map[string]fileSum{}}
+	p.Node.SetStreamHandler(CatalogProtocolID, s.handleCatalog)
+	p.Node.SetStreamHandler(BrowseProtocolID, s.handleBrowse)
+	p.Node.SetStreamHandler(PullProtocolID, s.handlePull)
+	return s
+}
+
+// Close stops sharing.
+func (s *Share) Close() {
+	s.p.Node.RemoveStreamHandler(CatalogProtocolID)
+	s.p.Node.RemoveStreamHandler(BrowseProtocolID)
+	s.p.Node.RemoveStreamHandler(PullProtocolID)
+}
+
+// Run keeps the node on its rendezvous, where pullers look for it, until ctx
+// is done.
+func (s *Share) Run(ctx context.Context) error {
+	peerChan, err := s.p.DiscoverPeers(ctx)
+	if err != nil {
+		return err
+	}
+	for range peerChan {
+	}
+	<-ctx.Done()
+	return nil
+}
+
+// files lists the regular files shared, as they are now.
+func (s *Share) files() ([]dirwalk.Entry, error) {
+	var files []dirwalk.Entry
+	for _, path := range s.paths {
+		entries, err := dirwalk.Walk(path, s.opts.Walk)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if e.Kind == dirwalk.File {
+				files = append(files, e)
+			}
+		}
+	}
+	return files, nil
+}
+
+// Catalog lists the files shared.
+func (s *Share) Catalog() (*pb.Catalog, error) {
+	files, err := s.files()
+	if err != nil {
+		return nil, err
+	}
+	catalog := &pb.Catalog{}
+	for _, e := range files {
+		info, err := os.Stat(e.Path)
+		if err != nil {
+			log.Warnf("Leaving %s out of the catalog: %v", e.Path, err)
+			continue
+		}
+		catalog.Files = append(catalog.Files, &pb.SharedFile{
+			Name:  e.Name,
+			Size:  info.Size(),
+			Mtime: info.ModTime().UnixNano(),
+		})
+	}
+	return catalog, nil
+}
+
+func (s *Share) handleCatalog(stream network.Stream) {
+	defer stream.Close()
+	rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+	err := pb.Read(rw.Reader, &pb.CatalogRequest{})
+	if err != nil {
+		return
+	}
+	catalog, err := s.Catalog()
+	if err == nil && proto.Size(catalog) > pb.MaxMessageSize {
+		err = fmt.Errorf("catalog of %d files too large to send", len(catalog.GetFiles()))
+	}
+	if err != nil {
+		log.Errorf("Listing the share for %s: %v", stream.Conn().RemotePeer().Pretty(), err)
+		stream.Reset()
+		return
+	}
+	_, err = rw.Write(pb.Marshal(catalog))
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		log.Warnf("Sending the catalog to %s: %v", stream.Conn().RemotePeer().Pretty(), err)
+	}
+}
+
+// handlePull serves the file named by the first request like a sender
+// would.
+func (s *Share) handlePull(stream network.Stream) {
+	defer stream.Close()
+	out := ratelimit.NewWriter(stream, s.opts.Limit, s.p.Upload, ratelimit.GlobalUpload)
+	rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(out))
+	req := pb.ChunkRequest{}
+	err := pb.Read(rw.Reader, &req)
+	if err != nil {
+		return
+	}
+	remote := stream.Conn().RemotePeer().Pretty()
+
+	var f *os.File
+	var entry dirwalk.Entry
+	files, err := s.files()
+	if err == nil {
+		err = fmt.Errorf("%w: %s", ErrNotShared, req.GetName())
+		for _, e := range files {
+			if e.Name == req.GetName() {
+				entry = e
+				f, err = os.Open(e.Path)
+				break
+			}
+		}
+	}
+	if err != nil {
+		log.Warnf("Refusing %q to %s: %v", req.GetName(), remote, err)
+		stream.Reset()
+		return
+	}
+	defer f.Close()
+
+	log.Printf("Serving %s to %s", entry.Path, remote)
+	err = fileToStream(s.p, stream, rw, f, entry.Name, s.opts)
+	if err != nil {
+		log.Errorf("Serving %s to %s: %v", entry.Path, remote, err)
+	}
+}
+
+// Browse returns the catalog of the share of the node id.
+func Browse(ctx context.Context, p *peer.Peer, id libp2ppeer.ID) (*pb.Catalog, error) {
+	err := p.Redial(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := p.Node.NewStream(ctx, id, CatalogProtocolID)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+	_, err = rw.Write(pb.Marshal(&pb.CatalogRequest{}))
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		return nil, err
+	}
+	catalog := &pb.Catalog{}
+	err = pb.Read(rw.Reader, catalog)
+	if err != nil {
+		return nil, err
+	}
+	return catalog, nil
+}
+
+// Pull fetches the file called name from the share of the node id into the
+// download directory of p, like Receive would, and returns where it went. A
+// pull whose stream drops is resumed after redialing, following opts.Retry.
+func Pull(ctx context.Context, p *peer.Peer, id libp2ppeer.ID, name string, opts Options) (string, error) {
+	catalog, err := Browse(ctx, p, id)
+	if err != nil {
+		return "", err
+	}
+	shared := false
+	for _, f := range catalog.GetFiles() {
+		shared = shared || f.GetName() == name
+	}
+	if !shared {
+		return "", fmt.Errorf("%w: %s", ErrNotShared, name)
+	}
+
+	received := &receivedFiles{paths: map[string]string{}}
+	err = opts.retry(peer.DefaultRetryPolicy).Do(ctx, opts.EventCh, func(attempt int) error {
+		if attempt > 0 {
+			err := p.Redial(ctx, id)
+			if err != nil {
+				return err
+			}
+		}
+		stream, err := p.Node.NewStream(ctx, id, PullProtocolID)
+		if err != nil {
+			return err
+		}
+		defer stream.Close()
+		_, err = stream.Write(pb.Marshal(&pb.ChunkRequest{Name: name}))
+		if err != nil {
+			return err
+		}
+		err = receiveStream(stream, p, nil, received, opts)
+		if errors.Is(err, ErrDeclined) {
+			return peer.Permanent(err)
+		}
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	path, _ := received.get(name)
+	if _, err := os.Stat(pb.IndexPath(path)); err == nil {
+		return "", fmt.Errorf("pull of %s stopped before it was complete", name)
+	}
+	return path, nil
+}
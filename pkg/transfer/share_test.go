@@ -0,0 +1,85 @@
+package transfer
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Azanul/peer-pressure/pkg/peer"
+)
+
+// share shares paths from p and waits until p is on the rendezvous.
+func (h *harness) share(p *peer.Peer, paths ...string) *Share {
+	h.t.Helper()
+	opts := newOptions()
+	go drain(h.ctx, opts.EventCh)
+	s := NewShare(p, paths, opts)
+	h.t.Cleanup(s.Close)
+	go s.Run(h.ctx)
+	h.advertised(p, "sharing node")
+	return s
+}
+
+func TestShare(t *testing.T) {
+	h := newHarness(t)
+	alice, bob := h.node("alice"), h.node("bob")
+	dir := filepath.Join(t.TempDir(), "shared")
+	files := map[string]string{
+		".ppignore": "*.tmp\n",
+		"a.txt":     "first",
+		"sub/b.txt": "second",
+		"skip.tmp":  "ignored",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h.share(alice, dir)
+
+	catalog, err := Browse(h.ctx, bob, alice.Node.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range catalog.GetFiles() {
+		names = append(names, f.GetName())
+		if int(f.GetSize()) != len(files[strings.TrimPrefix(f.GetName(), "shared/")]) {
+			t.Errorf("%s listed with %d bytes", f.GetName(), f.GetSize())
+		}
+	}
+	if len(names) != 3 || names[0] != "shared/.ppignore" || names[1] != "shared/a.txt" || names[2] != "shared/sub/b.txt" {
+		t.Errorf("catalog lists %v", names)
+	}
+
+	var tests = []struct {
+		name string
+		err  error
+	}{
+		{"shared/sub/b.txt", nil},
+		{"shared/skip.tmp", ErrNotShared},
+		{"../outside", ErrNotShared},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := newOptions()
+			go drain(h.ctx, opts.EventCh)
+			path, err := Pull(h.ctx, bob, alice.Node.ID(), tt.name, opts)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if err == nil {
+				if path != filepath.Join(bob.DownloadDir(), filepath.FromSlash(tt.name)) {
+					t.Errorf("pulled to %s", path)
+				}
+				checkReceived(t, bob, tt.name, []byte(files["sub/b.txt"]))
+			}
+		})
+	}
+}
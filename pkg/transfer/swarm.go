@@ -0,0 +1,554 @@
+package transfer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/Azanul/peer-pressure/pkg/dest"
+	"github.com/Azanul/peer-pressure/pkg/peer"
+	"github.com/Azanul/peer-pressure/pkg/pressure/pb"
+	"github.com/Azanul/peer-pressure/pkg/ratelimit"
+	"github.com/Azanul/peer-pressure/pkg/streamio"
+	"github.com/Azanul/peer-pressure/pkg/util"
+	"github.com/libp2p/go-libp2p/core/network"
+	libp2ppeer "github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/core/routing"
+)
+
+// SwarmProtocolID is the protocol providers serve files by digest over.
+const SwarmProtocolID = protocol.ID("/peer-pressure/swarm/1.0.0")
+
+const (
+	// ReprovideInterval is how often provided files are announced again, well
+	// within the time the DHT keeps provider records.
+	ReprovideInterval = 12 * time.Hour
+
+	maxProviders = 16          // Providers fetched from at once
+	maxManifests = 4           // Manifests tried by a fetch at most
+	swarmBatch   = 8           // Chunks per request to a provider
+	saveInterval = time.Second // How often the index is saved at most
+)
+
+var ErrNoProvider = errors.New("no provider found for the file")
+
+// ContentID returns the key a file is announced under on the DHT, made from
+// its SHA-256.
+func ContentID(digest []byte) (cid.Cid, error) {
+	mh, err := multihash.Encode(digest, multihash.SHA2_256)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return cid.NewCidV1(cid.Raw, mh), nil
+}
+
+// Provider serves files by their digest to downloaders, see Fetch, and
+// announces them on the DHT.
+type Provider struct {
+	p     *peer.Peer
+	opts  Options
+	mu    sync.Mutex
+	files map[string]provided // By hex digest
+}
+
+// provided is a file as it was when it was indexed.
+type provided struct {
+	path  string
+	index *pb.Index
+	info  os.FileInfo
+}
+
+// NewProvider starts serving the files added to it. Serving is throttled by
+// the transfer limit as well as the node and global upload limits.
+func NewProvider(p *peer.Peer, opts Options) *Provider {
+	pr := &Provider{p: p, opts: opts, files: map[string]provided{}}
+	p.Node.SetStreamHandler(SwarmProtocolID, pr.handle)
+	return pr
+}
+
+// Close stops serving.
+func (pr *Provider) Close() {
+	pr.p.Node.RemoveStreamHandler(SwarmProtocolID)
+}
+
+// Add indexes the file at path in content defined chunks, announces it and
+// returns its SHA-256, which downloaders fetch it by. A file that changes
+// afterwards is no longer served.
+func (pr *Provider) Add(ctx context.Context, path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", path)
+	}
+	index, err := streamio.NewIndex(f, filepath.Base(path), streamio.ContentDefined)
+	if err != nil {
+		return nil, err
+	}
+	if index.GetSize() > 0 && len(index.GetChunks()) == 0 {
+		return nil, fmt.Errorf("%s has too many chunks to provide", path)
+	}
+
+	pr.mu.Lock()
+	pr.files[hex.EncodeToString(index.GetSha256())] = provided{path, index, info}
+	pr.mu.Unlock()
+	return index.GetSha256(), pr.announce(ctx, index.GetSha256())
+}
+
+func (pr *Provider) announce(ctx context.Context, digest []byte) error {
+	router, err := pr.p.ContentRouting(ctx)
+	if err != nil {
+		return err
+	}
+	id, err := ContentID(digest)
+	if err != nil {
+		return err
+	}
+	return router.Provide(ctx, id, true)
+}
+
+// Run announces the files again every ReprovideInterval until ctx is done.
+func (pr *Provider) Run(ctx context.Context) {
+	ticker := time.NewTicker(ReprovideInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		pr.mu.Lock()
+		var digests [][]byte
+		for _, f := range pr.files {
+			digests = append(digests, f.index.GetSha256())
+		}
+		pr.mu.Unlock()
+		for _, digest := range digests {
+			if err := pr.announce(ctx, digest); err != nil {
+				log.Warnf("Announcing %x: %v", digest, err)
+			}
+		}
+	}
+}
+
+// handle serves the requested file like a sender would, downloaders only
+// asking for the chunks they fetch from us.
+func (pr *Provider) handle(stream network.Stream) {
+	defer stream.Close()
+	out := ratelimit.NewWriter(stream, pr.opts.Limit, pr.p.Upload, ratelimit.GlobalUpload)
+	rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(out))
+	req := pb.ContentRequest{}
+	err := pb.Read(rw.Reader, &req)
+	if err != nil {
+		return
+	}
+	remote := stream.Conn().RemotePeer().Pretty()
+
+	pr.mu.Lock()
+	entry, ok := pr.files[hex.EncodeToString(req.GetSha256())]
+	pr.mu.Unlock()
+	if !ok {
+		log.Warnf("Refusing %x to %s: not provided here", req.GetSha256(), remote)
+		stream.Reset()
+		return
+	}
+	f, err := os.Open(entry.path)
+	if err == nil {
+		defer f.Close()
+		var info os.FileInfo
+		info, err = f.Stat()
+		if err == nil && (info.Size() != entry.info.Size() || !info.ModTime().Equal(entry.info.ModTime())) {
+			err = fmt.Errorf("%s changed since it was provided", entry.path)
+		}
+	}
+	if err != nil {
+		log.Warnf("Refusing %x to %s: %v", req.GetSha256(), remote, err)
+		stream.Reset()
+		return
+	}
+
+	log.Printf("Serving %s to %s", entry.path, remote)
+	index := proto.Clone(entry.index).(*pb.Index)
+	err = streamio.ServeFile(rw, f, index, pr.opts.EventCh, pr.opts.CommandCh)
+	if err != nil {
+		log.Errorf("Serving %s to %s: %v", entry.path, remote, err)
+	}
+}
+
+// Fetch downloads the file with the given SHA-256 from the providers found
+// for it on the DHT into the download directory of p and returns its path.
+// The first provider to answer hands out the manifest, the list of chunk
+// digests adding up to the file's digest. Disjoint runs of chunks are then
+// fetched from up to maxProviders providers at once, every chunk being
+// checked against the manifest before it's written. A provider sending a bad
+// chunk or dropping out is left behind and the others take over its chunks.
+// Nothing but the whole file proves the manifest though: when the file
+// doesn't add up to the digest, or the providers agreeing on the manifest
+// drop out while others offered another one, the fetch starts over without
+// them, up to maxManifests times. Reads are throttled by the transfer limit
+// as well as the node and global download limits.
+func Fetch(ctx context.Context, p *peer.Peer, digest []byte, opts Options) (string, error) {
+	router, err := p.ContentRouting(ctx)
+	if err != nil {
+		return "", err
+	}
+	id, err := ContentID(digest)
+	if err != nil {
+		return "", err
+	}
+	excluded := map[libp2ppeer.ID]bool{}
+	for round := 1; ; round++ {
+		path, s, err := fetch(ctx, p, router, id, digest, excluded, opts)
+		if err == nil || ctx.Err() != nil || s.file == nil || round == maxManifests {
+			return path, err
+		}
+		if !errors.Is(err, ErrCorrupt) && !s.disagreed {
+			return "", err
+		}
+		log.Warnf("%v, dropping the manifest of %s", err, s.provider.Pretty())
+		for id := range s.joined {
+			excluded[id] = true
+		}
+		// What was received was checked against the dropped manifest
+		os.Remove(s.d.Part)
+		os.Remove(s.d.Index)
+	}
+}
+
+// fetch runs one round of Fetch, with the providers found for id that
+// aren't excluded. It returns the swarm for Fetch to tell what went wrong.
+func fetch(ctx context.Context, p *peer.Peer, router routing.ContentRouting, id cid.Cid, digest []byte, excluded map[libp2ppeer.ID]bool, opts Options) (string, *swarm, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	searchCtx, stopSearch := context.WithCancel(ctx)
+	defer stopSearch()
+
+	s := newSwarm(opts.EventCh)
+	go func() {
+		// Wakes up the workers waiting for chunks to be released
+		<-ctx.Done()
+		s.mu.Lock()
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	}()
+
+	var wg sync.WaitGroup
+	found := 0
+	for info := range router.FindProvidersAsync(searchCtx, id, maxProviders) {
+		if info.ID == p.Node.ID() || excluded[info.ID] {
+			continue
+		}
+		found++
+		stream, rw, err := s.join(ctx, p, info, digest, opts)
+		if err != nil {
+			log.Warnf("Provider %s left out: %v", info.ID.Pretty(), err)
+			continue
+		}
+		if s.complete() {
+			stopSearch()
+		}
+		log.Printf("Fetching %x from %s", digest, info.ID.Pretty())
+		wg.Add(1)
+		go func(info libp2ppeer.AddrInfo) {
+			defer wg.Done()
+			defer stream.Close()
+			go func() {
+				<-ctx.Done()
+				stream.Reset()
+			}()
+			err := s.work(ctx, rw)
+			if err != nil {
+				log.Warnf("Provider %s dropped: %v", info.ID.Pretty(), err)
+			} else if s.complete() {
+				stopSearch()
+			}
+		}(info)
+	}
+	wg.Wait()
+
+	if s.file == nil {
+		if found == 0 {
+			return "", s, fmt.Errorf("%w: %x", ErrNoProvider, digest)
+		}
+		return "", s, fmt.Errorf("%w: none of %d providers served %x", ErrNoProvider, found, digest)
+	}
+	s.index.Save(s.d.Index)
+	s.file.Close()
+	if err := ctx.Err(); err != nil {
+		p.Release(s.provider, s.size)
+		return "", s, err
+	}
+	if !s.complete() {
+		p.Release(s.provider, s.size)
+		return "", s, fmt.Errorf("%w: providers left with %d of %d chunks missing", ErrNoProvider, s.index.GetNChunks()-s.index.GetProgress(), s.index.GetNChunks())
+	}
+	err := finalize(s.d, p.Config.Metadata)
+	if err != nil {
+		p.Release(s.provider, s.size)
+		return "", s, err
+	}
+	err = p.Charge(s.provider, s.size)
+	if err != nil {
+		return "", s, err
+	}
+	err = streamio.StoreChunks(s.d.Path, s.index, p.ChunkStore())
+	if err != nil {
+		log.Warnf("Keeping the chunks of %s: %v", s.d.Path, err)
+	}
+	opts.EventCh <- peer.Event{Type: peer.Progress, Data: peer.Stats{Fraction: -1}}
+	return s.d.Path, s, nil
+}
+
+// swarm is a download shared by several providers, each fetching the runs
+// of chunks it claims.
+type swarm struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	d         dest.Dest
+	file      *os.File
+	index     *pb.Index     // The manifest, only Progress and Received change
+	provider  libp2ppeer.ID // Who handed out the manifest, charged for the file, see peer.Reserve
+	size      int64
+	joined    map[libp2ppeer.ID]bool // Providers that agreed on the manifest
+	disagreed bool                   // Whether any offered another manifest
+	inflight  map[int32]bool
+	saved     time.Time
+	meter     *ratelimit.Meter
+	eventCh   chan peer.Event
+}
+
+func newSwarm(eventCh chan peer.Event) *swarm {
+	s := &swarm{inflight: map[int32]bool{}, joined: map[libp2ppeer.ID]bool{}, meter: ratelimit.NewMeter(), eventCh: eventCh}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// join asks a provider for the file and checks its index against the
+// manifest. The first provider to join sets up the download.
+func (s *swarm) join(ctx context.Context, p *peer.Peer, info libp2ppeer.AddrInfo, digest []byte, opts Options) (network.Stream, *bufio.ReadWriter, error) {
+	err := p.Connect(ctx, info)
+	if err != nil {
+		return nil, nil, err
+	}
+	stream, err := p.Node.NewStream(ctx, info.ID, SwarmProtocolID)
+	if err != nil {
+		return nil, nil, err
+	}
+	in := ratelimit.NewReader(stream, opts.Limit, p.Download, ratelimit.GlobalDownload)
+	rw := bufio.NewReadWriter(bufio.NewReader(in), bufio.NewWriter(stream))
+	_, err = rw.Write(pb.Marshal(&pb.ContentRequest{Sha256: digest}))
+	if err == nil {
+		err = rw.Flush()
+	}
+	index := &pb.Index{}
+	if err == nil {
+		err = pb.Read(rw.Reader, index)
+	}
+	if err == nil {
+		err = s.check(index, digest)
+	}
+	if errors.Is(err, errOtherManifest) {
+		s.disagreed = true
+	}
+	if err == nil && s.file == nil {
+		err = s.start(p, index, info.ID)
+	}
+	if err != nil {
+		stream.Reset()
+		return nil, nil, err
+	}
+	s.joined[info.ID] = true
+	return stream, rw, nil
+}
+
+// errOtherManifest is returned by check for an index that doesn't match the
+// manifest.
+var errOtherManifest = errors.New("differs from the manifest")
+
+// check makes sure index describes the file with the given digest in
+// content defined chunks, the same ones as the manifest if there is one.
+func (s *swarm) check(index *pb.Index, digest []byte) error {
+	if !bytes.Equal(index.GetSha256(), digest) {
+		return fmt.Errorf("offered %x instead", index.GetSha256())
+	}
+	if index.GetSize() > 0 && len(index.GetChunks()) == 0 {
+		return errors.New("no chunk digests to check the file against")
+	}
+	err := streamio.CheckChunks(index)
+	if err != nil {
+		return err
+	}
+	if s.index == nil {
+		return nil
+	}
+	refs, want := index.GetChunks(), s.index.GetChunks()
+	if len(refs) != len(want) {
+		return fmt.Errorf("%w: %d chunks where it has %d", errOtherManifest, len(refs), len(want))
+	}
+	for i := range refs {
+		if !bytes.Equal(refs[i].GetSha256(), want[i].GetSha256()) || refs[i].GetSize() != want[i].GetSize() {
+			return fmt.Errorf("%w: chunk %d", errOtherManifest, i)
+		}
+	}
+	return nil
+}
+
+// start sets up the download of the file described by index, resuming an
+// earlier one of the same file and reusing stored chunks.
+func (s *swarm) start(p *peer.Peer, index *pb.Index, provider libp2ppeer.ID) error {
+	d, err := p.Resolver().Resolve(index)
+	if err != nil {
+		return err
+	}
+	index.ResetProgress()
+	var f *os.File
+	if d.Resume {
+		existing := pb.Index{}
+		data, err := os.ReadFile(d.Index)
+		if err == nil {
+			err = proto.Unmarshal(data, &existing)
+		}
+		if err == nil && bytes.Equal(existing.GetSha256(), index.GetSha256()) {
+			index.Progress = existing.GetProgress()
+			index.Received = existing.GetReceived()
+			f, err = os.OpenFile(d.Part, os.O_RDWR, 0666)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	size := streamio.NeededBytes(index)
+	if f != nil {
+		err = p.Reserve(provider, size)
+		if err != nil {
+			f.Close()
+			return err
+		}
+	} else {
+		f, err = createPreallocated(d.Part, size, provider, p)
+		if err != nil {
+			return err
+		}
+	}
+	reused, err := streamio.FillFromStore(f, index, p.ChunkStore())
+	if err != nil {
+		log.Warnf("Reusing stored chunks for %s: %v", d.Path, err)
+	}
+	if reused > 0 {
+		log.Printf("%s of %s found in the chunk store", util.HumanBytes(float64(reused)), d.Path)
+	}
+	index.Save(d.Index)
+
+	s.mu.Lock()
+	s.d, s.file, s.index, s.saved = d, f, index, time.Now()
+	s.provider, s.size = provider, size
+	s.mu.Unlock()
+	return nil
+}
+
+// work fetches the runs of chunks it claims from one provider until none are
+// left.
+func (s *swarm) work(ctx context.Context, rw *bufio.ReadWriter) error {
+	for {
+		start, count, ok := s.claim(ctx, swarmBatch)
+		if !ok {
+			return nil
+		}
+		claimed := int32(0)
+		err := streamio.RequestChunks(rw, s.file, s.index, nil, start, count, func(chunk *pb.Chunk) {
+			if chunk.Index >= start && chunk.Index < start+count {
+				claimed++
+			}
+			s.got(chunk)
+		})
+		s.release(start, count)
+		if err == nil && claimed < count {
+			err = fmt.Errorf("sent %d of the %d chunks asked for", claimed, count)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// claim picks the first run of at most max chunks that are neither received
+// nor being fetched by someone else. When all that's missing is in flight,
+// it waits in case it's released again.
+func (s *swarm) claim(ctx context.Context, max int32) (int32, int32, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ctx.Err() == nil {
+		available := func(i int32) bool { return !s.index.HasChunk(i) && !s.inflight[i] }
+		for i := int32(0); i < s.index.NChunks; i++ {
+			if !available(i) {
+				continue
+			}
+			j := i + 1
+			for j < s.index.NChunks && j-i < max && available(j) {
+				j++
+			}
+			for k := i; k < j; k++ {
+				s.inflight[k] = true
+			}
+			return i, j - i, true
+		}
+		if len(s.inflight) == 0 {
+			break
+		}
+		s.cond.Wait()
+	}
+	return 0, 0, false
+}
+
+// release hands back the chunks of a request that didn't arrive.
+func (s *swarm) release(start, count int32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := start; i < start+count; i++ {
+		delete(s.inflight, i)
+	}
+	s.cond.Broadcast()
+}
+
+// got marks a checked chunk received, saving the index every saveInterval.
+func (s *swarm) got(chunk *pb.Chunk) {
+	s.meter.Add(len(chunk.Data))
+	s.mu.Lock()
+	delete(s.inflight, chunk.Index)
+	if s.index.MarkChunk(chunk.Index) && time.Since(s.saved) >= saveInterval {
+		s.index.Save(s.d.Index)
+		s.saved = time.Now()
+	}
+	s.cond.Broadcast()
+	stats := peer.Stats{
+		Fraction: float64(s.index.Progress) / float64(s.index.NChunks),
+		Rate:     s.meter.Rate(),
+	}
+	s.mu.Unlock()
+	s.eventCh <- peer.Event{Type: peer.Progress, Data: stats}
+}
+
+func (s *swarm) complete() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.index != nil && s.index.Progress == s.index.NChunks
+}
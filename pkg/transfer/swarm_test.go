@@ -0,0 +1,164 @@
+package transfer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azanul/peer-pressure/pkg/pressure/pb"
+	"github.com/Azanul/peer-pressure/pkg/streamio"
+)
+
+func TestSwarm(t *testing.T) {
+	h := newHarness(t)
+	bob := h.node("bob")
+	_, data := testFile(t, "file.bin", 3<<20)
+
+	var digest []byte
+	for _, name := range []string{"carol", "dave", "eve"} {
+		p := h.node(name)
+		path := filepath.Join(t.TempDir(), "file.bin")
+		if err := os.WriteFile(path, data, 0666); err != nil {
+			t.Fatal(err)
+		}
+		opts := newOptions()
+		go drain(h.ctx, opts.EventCh)
+		pr := NewProvider(p, opts)
+		t.Cleanup(pr.Close)
+		sum, err := pr.Add(h.ctx, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		digest = sum
+
+		if name == "eve" {
+			// Serves garbage under the same size and mtime, which only the
+			// chunk digests give away
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bad, _ := testFile(t, "bad.bin", len(data))
+			garbage, err := os.ReadFile(bad)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, garbage, 0666); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(path, info.ModTime(), info.ModTime()); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	opts := newOptions()
+	go drain(h.ctx, opts.EventCh)
+	path, err := Fetch(h.ctx, bob, digest, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != filepath.Join(bob.DownloadDir(), "file.bin") {
+		t.Errorf("fetched to %s", path)
+	}
+	checkReceived(t, bob, "file.bin", data)
+
+	unknown := make([]byte, len(digest))
+	if _, err := Fetch(h.ctx, bob, unknown, opts); !errors.Is(err, ErrNoProvider) {
+		t.Errorf("got %v fetching %x, want ErrNoProvider", err, unknown)
+	}
+}
+
+// TestFakeManifest has the first provider hand out a manifest of other
+// chunks under the digest of the file, which only shows once they're all
+// fetched. The fetch has to start over with the provider offering another
+// manifest.
+func TestFakeManifest(t *testing.T) {
+	h := newHarness(t)
+	mallory, carol, bob := h.node("mallory"), h.node("carol"), h.node("bob")
+	path, data := testFile(t, "file.bin", 1<<20)
+	fake, _ := testFile(t, "fake.bin", 1<<20)
+
+	opts := newOptions()
+	go drain(h.ctx, opts.EventCh)
+	pr := NewProvider(mallory, opts)
+	t.Cleanup(pr.Close)
+	f, err := os.Open(fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	index, err := streamio.NewIndex(f, "file.bin", streamio.ContentDefined)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(data)
+	index.Sha256 = digest[:]
+	pr.files[hex.EncodeToString(digest[:])] = provided{fake, index, info}
+	if err := pr.announce(h.ctx, digest[:]); err != nil {
+		t.Fatal(err)
+	}
+
+	honest := NewProvider(carol, opts)
+	t.Cleanup(honest.Close)
+	if _, err := honest.Add(h.ctx, path); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Fetch(h.ctx, bob, digest[:], opts); err != nil {
+		t.Fatal(err)
+	}
+	checkReceived(t, bob, "file.bin", data)
+}
+
+func TestClaim(t *testing.T) {
+	s := newSwarm(nil)
+	s.index = &pb.Index{NChunks: 20}
+	s.index.MarkChunk(3)
+	ctx := context.Background()
+
+	var tests = []struct {
+		name         string
+		start, count int32
+	}{
+		{"UpToReceived", 0, 3},
+		{"FullBatch", 4, 8},
+		{"Rest", 12, 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, count, ok := s.claim(ctx, 8)
+			if !ok || start != tt.start || count != tt.count {
+				t.Errorf("claimed %d chunks from %d, %v, want %d from %d", count, start, ok, tt.count, tt.start)
+			}
+		})
+	}
+
+	// Everything missing is in flight, waiting for it ends with the context
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if start, count, ok := s.claim(cancelled, 8); ok {
+		t.Errorf("claimed %d chunks from %d while all were in flight", count, start)
+	}
+
+	s.release(4, 8)
+	if start, count, ok := s.claim(ctx, 8); !ok || start != 4 || count != 8 {
+		t.Errorf("claimed %d chunks from %d, %v after a release, want 8 from 4", count, start, ok)
+	}
+
+	for i := int32(0); i < 20; i++ {
+		s.index.MarkChunk(i)
+	}
+	s.release(0, 20)
+	if start, count, ok := s.claim(ctx, 8); ok {
+		t.Errorf("claimed %d chunks from %d of a complete file", count, start)
+	}
+}
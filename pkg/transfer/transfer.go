@@ -0,0 +1,590 @@
+package transfer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/Azanul/peer-pressure/pkg/dest"
+	"github.com/Azanul/peer-pressure/pkg/dirwalk"
+	"github.com/Azanul/peer-pressure/pkg/disk"
+	"github.com/Azanul/peer-pressure/pkg/gateway"
+	"github.com/Azanul/peer-pressure/pkg/peer"
+	"github.com/Azanul/peer-pressure/pkg/pressure/pb"
+	"github.com/Azanul/peer-pressure/pkg/ratelimit"
+	"github.com/Azanul/peer-pressure/pkg/seal"
+	"github.com/Azanul/peer-pressure/pkg/streamio"
+	"github.com/Azanul/peer-pressure/pkg/util"
+	"github.com/libp2p/go-libp2p/core/network"
+	libp2ppeer "github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// ProtocolID is the protocol files are sent over.
+const ProtocolID = protocol.ID("tcp")
+
+var (
+	ErrNoReceiver = errors.New("no receiver found on the rendezvous")
+	ErrNoSender   = errors.New("no sender found on the rendezvous yet")
+	ErrNoSpace    = errors.New("not enough disk space")
+	ErrDeclined   = errors.New("offer declined")
+)
+
+// Options are shared by senders and receivers.
+type Options struct {
+	Limit     *ratelimit.Limiter // Limit for this transfer alone, nil for none
+	EventCh   chan peer.Event
+	CommandCh chan peer.Command
+	Walk      dirwalk.Options   // What a sender sends of a directory
+	To        []libp2ppeer.ID   // The only peers a sender sends to, all on the rendezvous if empty
+	Chunking  streamio.Chunking // How a sender splits files
+	Seal      bool              // Whether a sender seals the chunks for the receiver, see streamio.SealedFileToStream
+
+	// Retry is how senders reconnect to dropped receivers and how receivers
+	// wait for a sender. The zero value means peer.DefaultRetryPolicy and
+	// peer.WaitPolicy respectively.
+	Retry peer.RetryPolicy
+}
+
+func (o Options) retry(def peer.RetryPolicy) peer.RetryPolicy {
+	if o.Retry == (peer.RetryPolicy{}) {
+		return def
+	}
+	return o.Retry
+}
+
+// Receive waits for a sender and writes the incoming files to the download
+// directory of p, see peer.Peer.Resolver. Links are created as long as they
+// stay inside it. When a file of the same name is already there, only the
+// differences to it are fetched, see streamio.DeltaToFile. When gw is set the
+// file is served through the gateway instead, fetching chunks in the order
+// the HTTP client reads them. Reads are throttled by the transfer limit as well as the node
+// and global download limits.
+//
+// Receive returns once a sender was found, the transfer itself goes on in the
+// background and reports on opts.EventCh.
+func Receive(ctx context.Context, p *peer.Peer, gw *gateway.Server, opts Options) error {
+	var mu sync.Mutex
+	foundSender := false // flag for closing receiver
+	interruptions := 0   // streams that ended before the file was complete
+	received := &receivedFiles{paths: map[string]string{}}
+
+	h := p.Node
+	h.SetStreamHandler(ProtocolID, func(stream network.Stream) {
+		defer stream.Close()
+		mu.Lock()
+		foundSender = true
+		mu.Unlock()
+
+		err := receiveStream(stream, p, gw, received, opts)
+		if err != nil && !errors.Is(err, ErrDeclined) {
+			mu.Lock()
+			interruptions++
+			attempt := interruptions
+			mu.Unlock()
+
+			// The sender reconnects on its own, the new stream resumes from the saved index
+			log.Printf("Stream from %s interrupted: %v, waiting for the sender to resume", stream.Conn().RemotePeer().Pretty(), err)
+			opts.EventCh <- peer.Event{
+				Type: peer.Retry,
+				Data: peer.RetryInfo{Attempt: attempt, Err: err.Error()},
+			}
+		}
+	})
+
+	log.Printf("R Peer ID: %s\n\n", h.ID())
+	return opts.retry(peer.WaitPolicy).Do(ctx, nil, func(attempt int) error {
+		mu.Lock()
+		found := foundSender
+		mu.Unlock()
+		if found {
+			return nil
+		}
+
+		peerChan, err := p.DiscoverPeers(ctx)
+		if err != nil {
+			return err
+		}
+		var connErr error
+		for info := range peerChan {
+			if info.ID == h.ID() {
+				continue // No self connection
+			}
+			err := p.Connect(ctx, info)
+			if err != nil {
+				log.Println("R Failed connecting to ", info.ID.Pretty(), ", error:", err)
+				if errors.Is(err, peer.ErrPrivateNetwork) {
+					connErr = err
+				}
+			} else {
+				log.Println("R Connected to peer:", info.ID.Pretty())
+				return nil
+			}
+		}
+		log.Printf("Receiver wait round: %d", attempt)
+		if connErr != nil {
+			return fmt.Errorf("%w, %v", ErrNoSender, connErr)
+		}
+		return ErrNoSender
+	})
+}
+
+// receivedFiles maps the names senders gave files to where they went, so
+// that hard links can be made to them.
+type receivedFiles struct {
+	mu    sync.Mutex
+	paths map[string]string
+}
+
+func (r *receivedFiles) add(name, path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.paths[name] = path
+}
+
+func (r *receivedFiles) get(name string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	path, ok := r.paths[name]
+	return path, ok
+}
+
+// receiveStream handles one stream from a sender, resuming from the saved
+// index if the file was partially received before.
+func receiveStream(stream network.Stream, p *peer.Peer, gw *gateway.Server, received *receivedFiles, opts Options) error {
+	// Create a buffer stream for non blocking read and write.
+	in := ratelimit.NewReader(stream, opts.Limit, p.Download, ratelimit.GlobalDownload)
+	rw := bufio.NewReadWriter(bufio.NewReader(in), bufio.NewWriter(stream))
+
+	index := pb.Index{}
+	err := pb.Read(rw.Reader, &index)
+	if err != nil {
+		return err
+	}
+	index.ResetProgress()
+	err = streamio.CheckChunks(&index)
+	if err != nil {
+		return refuse(rw, stream, &index, err, opts)
+	}
+	resolver := p.Resolver()
+	d, err := resolver.Resolve(&index)
+	if err != nil {
+		return refuse(rw, stream, &index, err, opts)
+	}
+	if index.GetLinkTarget() != "" || index.GetHardlink() != "" {
+		err = receiveLink(resolver, d, &index, received)
+		if err != nil {
+			return refuse(rw, stream, &index, err, opts)
+		}
+		opts.EventCh <- peer.Event{Type: peer.Progress, Data: peer.Stats{Fraction: -1}}
+		return nil
+	}
+	// The key only opens the chunks of this stream, it isn't kept for a
+	// resume, where the sender offers another one
+	var chunks *seal.Chunks
+	if wrapped := index.GetSealedKey(); wrapped != nil {
+		key, err := p.UnwrapKey(wrapped)
+		if err == nil {
+			chunks, err = seal.NewChunks(key)
+		}
+		if err != nil {
+			return refuse(rw, stream, &index, fmt.Errorf("sealed key: %w", err), opts)
+		}
+		index.SealedKey = nil
+	}
+	size := streamio.NeededBytes(&index)
+	sender := stream.Conn().RemotePeer()
+	var f *os.File
+	if d.Resume {
+		log.Debugln("index file found, using existing index")
+		existingIndex, err := os.ReadFile(d.Index)
+		if err != nil {
+			return err
+		}
+		err = proto.Unmarshal(existingIndex, &index)
+		if err != nil {
+			return err
+		}
+
+		// Files are preallocated, only those of older versions still grow
+		need := size
+		if info, err := os.Stat(d.Part); err == nil {
+			need -= info.Size()
+		}
+		err = checkSpace(d.Part, need)
+		if err == nil {
+			err = p.Reserve(sender, size)
+		}
+		if err != nil {
+			return refuse(rw, stream, &index, err, opts)
+		}
+		f, err = os.OpenFile(d.Part, os.O_RDWR, 0666)
+		if err != nil {
+			p.Release(sender, size)
+			return fmt.Errorf("error opening file %s: %w", d.Part, err)
+		}
+	} else {
+		f, err = createPreallocated(d.Part, size, sender, p)
+		if err != nil {
+			return refuse(rw, stream, &index, err, opts)
+		}
+		log.Debugln("new download, saving incoming index")
+		index.Save(d.Index)
+	}
+	// The file only counts against the quotas once it's in place, a
+	// transfer stopped early leaves errIncomplete and nothing charged
+	charged := false
+	defer func() {
+		if !charged {
+			p.Release(sender, size)
+		}
+	}()
+	complete := func() error {
+		err := finalize(d, p.Config.Metadata)
+		if err != nil {
+			return err
+		}
+		charged = true
+		return p.Charge(sender, size)
+	}
+	store := p.ChunkStore()
+	reused, err := streamio.FillFromStore(f, &index, store)
+	if err != nil {
+		log.Warnf("Reusing stored chunks for %s: %v", d.Path, err)
+	}
+	if reused > 0 {
+		log.Printf("%s of %s found in the chunk store", util.HumanBytes(float64(reused)), d.Path)
+		index.Save(d.Index)
+	}
+
+	if gw != nil {
+		rf := streamio.NewRemoteFile(rw, f, &index, d.Index, chunks, streamio.Stream, opts.EventCh)
+		gw.Attach(filepath.Base(d.Path), rf, rf.Size())
+
+		// Keep the stream open for the gateway until the user stops
+		waitErr := make(chan error, 1)
+		go func() {
+			waitErr <- rf.Wait()
+		}()
+		for {
+			select {
+			case cmd := <-opts.CommandCh:
+				if cmd == peer.Stop {
+					rf.Close()
+					gw.Close()
+					// Closing ends the wait, without an error if the last
+					// chunks arrived in the meantime
+					if waitErr == nil || <-waitErr == nil {
+						err := complete()
+						if errors.Is(err, errIncomplete) {
+							return nil
+						}
+						return err
+					}
+					return nil
+				}
+			case err := <-waitErr:
+				if err != nil {
+					return err
+				}
+				waitErr = nil // Complete, moved into place once the gateway is done with it
+			}
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		if attempt == 0 && !d.Resume && index.GetProgress() == 0 && d.Basis != "" && index.GetDelta() && index.GetSize() > 0 {
+			err = streamio.DeltaToFile(rw, f, d.Basis, d.Index, opts.EventCh, opts.CommandCh)
+		} else {
+			err = requestChunks(rw, f, &index, d, chunks, opts)
+		}
+		if err != nil {
+			return err
+		}
+		err = complete()
+		if errors.Is(err, errIncomplete) {
+			log.Printf("%s stopped, left to be resumed", d.Path)
+			return nil
+		} else if errors.Is(err, ErrCorrupt) && attempt == 0 {
+			log.Warnf("%v, fetching it again", err)
+			index.Progress = 0
+			index.Received = nil
+			f, err = os.OpenFile(d.Part, os.O_RDWR, 0666)
+			if err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		err = streamio.StoreChunks(d.Path, &index, store)
+		if err != nil {
+			log.Warnf("Keeping the chunks of %s: %v", d.Path, err)
+		}
+		received.add(index.GetFilename(), d.Path)
+		opts.EventCh <- peer.Event{Type: peer.Progress, Data: peer.Stats{Fraction: -1}}
+		return nil
+	}
+}
+
+// requestChunks asks for the chunks still missing and writes them to f,
+// opening them with chunks in a sealed transfer.
+func requestChunks(rw *bufio.ReadWriter, f *os.File, index *pb.Index, d dest.Dest, chunks *seal.Chunks, opts Options) error {
+	cr := pb.ChunkRequest{
+		Index: index.FirstMissing(),
+		Skip:  index.GetReceived(),
+	}
+	_, err := rw.Write(pb.Marshal(&cr))
+	if err != nil {
+		return err
+	}
+	err = rw.Flush()
+	if err != nil {
+		return err
+	}
+	return streamio.StreamToFile(rw, f, d.Index, chunks, opts.EventCh, opts.CommandCh)
+}
+
+// fileToStream serves f over stream, sealed for the node at the other end
+// if opts say so.
+func fileToStream(p *peer.Peer, stream network.Stream, rw *bufio.ReadWriter, f *os.File, name string, opts Options) error {
+	if !opts.Seal {
+		return streamio.FileToStream(rw, f, name, opts.Chunking, opts.EventCh, opts.CommandCh)
+	}
+	pub := stream.Conn().RemotePublicKey()
+	if pub == nil {
+		pub = p.Node.Peerstore().PubKey(stream.Conn().RemotePeer())
+	}
+	if pub == nil {
+		return fmt.Errorf("%w: public key of %s unknown", seal.ErrUnsupportedKey, stream.Conn().RemotePeer().Pretty())
+	}
+	return streamio.SealedFileToStream(rw, f, name, opts.Chunking, pub, opts.EventCh, opts.CommandCh)
+}
+
+// receiveLink creates the link described by index at d. Hard links can only
+// be made to files received from the same sender before.
+func receiveLink(resolver dest.Resolver, d dest.Dest, index *pb.Index, received *receivedFiles) error {
+	if index.GetHardlink() == "" {
+		log.Printf("Linking %s to %s", d.Path, index.GetLinkTarget())
+		return resolver.Symlink(d, index.GetLinkTarget())
+	}
+	existing, ok := received.get(index.GetHardlink())
+	if !ok {
+		return fmt.Errorf("hard link to %q, which wasn't received", index.GetHardlink())
+	}
+	log.Printf("Linking %s to %s", d.Path, existing)
+	return resolver.Hardlink(d, existing)
+}
+
+// refuse declines the offer, telling the sender as well as our own user why.
+// It returns reason as an ErrDeclined once the sender was told.
+func refuse(rw *bufio.ReadWriter, stream network.Stream, index *pb.Index, reason error, opts Options) error {
+	log.Errorf("Refusing %q from %s: %v", index.GetFilename(), stream.Conn().RemotePeer().Pretty(), reason)
+	err := streamio.Refuse(rw, reason.Error())
+	opts.EventCh <- peer.Event{Type: peer.Error, Data: reason.Error()}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: %v", ErrDeclined, reason)
+}
+
+// checkSpace fails with ErrNoSpace if need more bytes don't fit on the
+// filesystem holding path. Systems we can't ask are given the benefit of
+// the doubt.
+func checkSpace(path string, need int64) error {
+	if need <= 0 {
+		return nil
+	}
+	free, err := disk.Free(filepath.Dir(path))
+	if errors.Is(err, disk.ErrUnsupported) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if uint64(need) > free {
+		return fmt.Errorf("%w: %s needed, %s free", ErrNoSpace, util.HumanBytes(float64(need)), util.HumanBytes(float64(free)))
+	}
+	return nil
+}
+
+// createPreallocated creates the file for a new download of size bytes from
+// sender, after checking it fits on disk and reserving it in the quotas of
+// p. The caller charges or releases the reservation.
+func createPreallocated(path string, size int64, sender libp2ppeer.ID, p *peer.Peer) (*os.File, error) {
+	err := checkSpace(path, size)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("error creating file %s: %w", path, err)
+	}
+	err = disk.Preallocate(f, size)
+	if err == nil {
+		err = p.Reserve(sender, size)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return f, nil
+}
+
+// Send sends the file or directory at path to every peer found on the
+// rendezvous of p, or only to those in opts.To, and waits for the transfers
+// to finish. Peers of opts.To that weren't found fail it with ErrNoReceiver.
+// Directories are sent file by file, see dirwalk.Walk for what is included.
+// A transfer whose stream drops is resumed after redialing the peer,
+// following opts.Retry. Writes are throttled by the transfer limit as well as
+// the node and global upload limits.
+func Send(ctx context.Context, p *peer.Peer, path string, opts Options) error {
+	entries, err := dirwalk.Walk(path, opts.Walk)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("nothing to send in %s", path)
+	}
+
+	peerChan, err := p.DiscoverPeers(ctx)
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var sendErr error
+	sent := 0
+
+	missing := map[libp2ppeer.ID]bool{}
+	for _, id := range opts.To {
+		missing[id] = true
+	}
+
+	// Why receivers found on the rendezvous were out of reach, when it's
+	// worth telling
+	var connErr error
+
+	h := p.Node
+	log.Printf("S Peer ID: %s\n\n", h.ID())
+	for info := range peerChan {
+		if info.ID == h.ID() {
+			continue // No self connection
+		}
+		if len(opts.To) > 0 && !missing[info.ID] {
+			continue
+		}
+		err := p.Connect(ctx, info)
+		if err != nil {
+			log.Println("S Failed connecting to ", info.ID.Pretty(), ", error:", err)
+			if errors.Is(err, peer.ErrPrivateNetwork) {
+				connErr = err
+			}
+			continue
+		}
+		log.Println("S Connected to:", info.ID.Pretty())
+		delete(missing, info.ID)
+
+		sent++
+		wg.Add(1)
+		go func(id libp2ppeer.ID) {
+			defer wg.Done()
+			err := sendToPeer(ctx, p, id, entries, opts)
+			if err != nil {
+				mu.Lock()
+				sendErr = err
+				mu.Unlock()
+			}
+		}(info.ID)
+	}
+	wg.Wait()
+	if sendErr == nil && len(missing) > 0 {
+		ids := []string{}
+		for id := range missing {
+			ids = append(ids, id.Pretty())
+		}
+		if connErr != nil {
+			return fmt.Errorf("%w: %s, %v", ErrNoReceiver, strings.Join(ids, ", "), connErr)
+		}
+		return fmt.Errorf("%w: %s", ErrNoReceiver, strings.Join(ids, ", "))
+	}
+	if sent == 0 && sendErr == nil {
+		if connErr != nil {
+			return fmt.Errorf("%w, %v", ErrNoReceiver, connErr)
+		}
+		return ErrNoReceiver
+	}
+	return sendErr
+}
+
+// sendToPeer sends the entries one after the other. Entries the peer refuses
+// are skipped, the refusals are returned once the others are through.
+func sendToPeer(ctx context.Context, p *peer.Peer, id libp2ppeer.ID, entries []dirwalk.Entry, opts Options) error {
+	var refused error
+	refusals := 0
+	for _, e := range entries {
+		err := sendEntry(ctx, p, id, e, opts)
+		if errors.Is(err, streamio.ErrRefused) {
+			log.Warnf("%s refused %s: %v", id.Pretty(), e.Name, err)
+			refused = err
+			refusals++
+		} else if err != nil {
+			return err
+		}
+	}
+	if refusals > 0 && len(entries) > 1 {
+		return fmt.Errorf("%d of %d files refused, last: %w", refusals, len(entries), refused)
+	}
+	return refused
+}
+
+func sendEntry(ctx context.Context, p *peer.Peer, id libp2ppeer.ID, e dirwalk.Entry, opts Options) error {
+	var f *os.File
+	if e.Kind == dirwalk.File {
+		var err error
+		f, err = os.Open(e.Path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+	}
+
+	return opts.retry(peer.DefaultRetryPolicy).Do(ctx, opts.EventCh, func(attempt int) error {
+		if attempt > 0 {
+			err := p.Redial(ctx, id)
+			if err != nil {
+				return err
+			}
+		}
+
+		stream, err := p.Node.NewStream(ctx, id, ProtocolID)
+		if err != nil {
+			return err
+		}
+		defer stream.Close()
+
+		out := ratelimit.NewWriter(stream, opts.Limit, p.Upload, ratelimit.GlobalUpload)
+		rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(out))
+		switch e.Kind {
+		case dirwalk.Symlink:
+			err = streamio.LinkToStream(rw, &pb.Index{Filename: e.Name, LinkTarget: e.Target}, opts.EventCh)
+		case dirwalk.Hardlink:
+			err = streamio.LinkToStream(rw, &pb.Index{Filename: e.Name, Hardlink: e.Target}, opts.EventCh)
+		default:
+			err = fileToStream(p, stream, rw, f, e.Name, opts)
+		}
+		if errors.Is(err, streamio.ErrRefused) || errors.Is(err, seal.ErrUnsupportedKey) {
+			return peer.Permanent(err)
+		}
+		return err
+	})
+}
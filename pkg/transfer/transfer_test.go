@@ -0,0 +1,759 @@
+package transfer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/Azanul/peer-pressure/pkg/dest"
+	"github.com/Azanul/peer-pressure/pkg/merkle"
+	"github.com/Azanul/peer-pressure/pkg/peer"
+	"github.com/Azanul/peer-pressure/pkg/pressure/pb"
+	"github.com/Azanul/peer-pressure/pkg/ratelimit"
+	"github.com/Azanul/peer-pressure/pkg/seal"
+	"github.com/Azanul/peer-pressure/pkg/streamio"
+	"github.com/libp2p/go-libp2p/core/network"
+	libp2ppeer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+const testSize = 300*4096 + 123
+
+// command hands cmd to the transfer without blocking the event loop, the
+// transfer only picks up commands between chunks.
+func command(h *harness, ch chan peer.Command, cmd peer.Command) {
+	go func() {
+		select {
+		case ch <- cmd:
+		case <-h.ctx.Done():
+		}
+	}()
+}
+
+func fraction(e peer.Event) (float64, bool) {
+	stats, ok := e.Data.(peer.Stats)
+	return stats.Fraction, ok && stats.Fraction >= 0
+}
+
+// stopAt stops the transfer reporting on opts once it's past at, and waits
+// for the sender, one that doesn't retry, to give up.
+func stopAt(t *testing.T, h *harness, opts Options, sent <-chan error, at float64) {
+	t.Helper()
+	stopped := false
+	untilDone(t, opts.EventCh, func(e peer.Event) bool {
+		if f, ok := fraction(e); ok && f > at && !stopped {
+			stopped = true
+			command(h, opts.CommandCh, peer.Stop)
+		}
+		return !stopped
+	})
+	for {
+		select {
+		case e := <-opts.EventCh:
+			if stats, ok := e.Data.(peer.Stats); ok && stats.Fraction < 0 {
+				t.Fatal("stopped transfer reported as done")
+			}
+		case <-sent:
+			return
+		case <-time.After(5 * time.Second):
+			t.Fatal("transfer went on after the stop")
+		}
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	h := newHarness(t)
+	alice, bob := h.node("alice"), h.node("bob")
+	path, data := testFile(t, "file.bin", testSize)
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	if err := os.Chmod(path, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := newOptions()
+	received := h.receive(bob, opts)
+	sent := h.send(alice, path)
+
+	untilDone(t, opts.EventCh, func(e peer.Event) bool {
+		if msg, ok := e.Data.(string); ok {
+			t.Errorf("receiver error: %s", msg)
+		}
+		return true
+	})
+	if err := <-received; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+	checkReceived(t, bob, "file.bin", data)
+
+	info, err := os.Stat(filepath.Join(bob.DownloadDir(), "file.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 || !info.ModTime().Equal(mtime) {
+		t.Errorf("got mode %v and mtime %v, want the sender's %v and %v", info.Mode().Perm(), info.ModTime(), os.FileMode(0640), mtime)
+	}
+}
+
+func TestCorruptDownload(t *testing.T) {
+	h := newHarness(t)
+	alice, bob := h.node("alice"), h.node("bob")
+	path, data := testFile(t, "file.bin", testSize)
+
+	opts := newOptions()
+	h.receive(bob, opts)
+	sent := h.send(alice, path)
+
+	// Damage what was already received, the digest check has to catch it
+	corrupted := false
+	untilDone(t, opts.EventCh, func(e peer.Event) bool {
+		if f, ok := fraction(e); ok && f > 0.5 && !corrupted {
+			corrupted = true
+			part := filepath.Join(bob.DownloadDir(), "file.bin.part")
+			if err := os.WriteFile(part, []byte("garbage"), 0666); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return true
+	})
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+	checkReceived(t, bob, "file.bin", data)
+}
+
+func TestPauseResume(t *testing.T) {
+	h := newHarness(t)
+	alice, bob := h.node("alice"), h.node("bob")
+	path, data := testFile(t, "file.bin", testSize)
+
+	opts := newOptions()
+	h.receive(bob, opts)
+	h.send(alice, path)
+
+	// Pause at a third and expect the events to stop until we continue
+	pausedAt := -1.0
+	untilDone(t, opts.EventCh, func(e peer.Event) bool {
+		if f, ok := fraction(e); ok && f > 0.3 && pausedAt < 0 {
+			pausedAt = f
+			command(h, opts.CommandCh, peer.Pause)
+		}
+		return pausedAt < 0
+	})
+	quiet := false
+	for !quiet {
+		select {
+		case e := <-opts.EventCh:
+			if f, ok := e.Data.(peer.Stats); ok && f.Fraction < 0 {
+				t.Fatal("transfer finished while paused")
+			}
+		case <-time.After(200 * time.Millisecond):
+			quiet = true
+		}
+	}
+
+	command(h, opts.CommandCh, peer.Continue)
+	untilDone(t, opts.EventCh, func(peer.Event) bool { return true })
+	checkReceived(t, bob, "file.bin", data)
+}
+
+func TestInterruption(t *testing.T) {
+	h := newHarness(t)
+	alice, bob := h.node("alice"), h.node("bob")
+	path, data := testFile(t, "file.bin", testSize)
+
+	opts := newOptions()
+	h.receive(bob, opts)
+	sent := h.send(alice, path)
+
+	// Drop the connection at a third, the sender has to redial and the
+	// receiver to pick up where it was
+	droppedAt, resumedAt := -1.0, -1.0
+	retried := false
+	untilDone(t, opts.EventCh, func(e peer.Event) bool {
+		f, ok := fraction(e)
+		switch {
+		case ok && droppedAt < 0 && f > 0.3:
+			droppedAt = f
+			if err := h.mn.DisconnectPeers(alice.Node.ID(), bob.Node.ID()); err != nil {
+				t.Fatal(err)
+			}
+		case ok && retried && resumedAt < 0:
+			resumedAt = f
+		}
+		if _, ok := e.Data.(peer.RetryInfo); ok {
+			retried = true
+		}
+		return true
+	})
+	if !retried {
+		t.Fatal("receiver didn't report the interruption")
+	}
+	if resumedAt < droppedAt {
+		t.Errorf("transfer restarted at %.2f after dropping at %.2f", resumedAt, droppedAt)
+	}
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+	checkReceived(t, bob, "file.bin", data)
+}
+
+func TestResumeAfterRestart(t *testing.T) {
+	h := newHarness(t)
+	alice, bob := h.node("alice"), h.node("bob")
+	path, data := testFile(t, "file.bin", testSize)
+
+	opts := newOptions()
+	h.receive(bob, opts)
+	sendOpts := newOptions()
+	sendOpts.Retry = noRetry
+	stopAt(t, h, opts, h.sendWith(alice, path, sendOpts), 0.3)
+	h.stop(bob)
+	h.stop(alice)
+
+	saved := pb.Index{}
+	raw, err := os.ReadFile(pb.IndexPath(filepath.Join(bob.DownloadDir(), "file.bin")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := proto.Unmarshal(raw, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.Progress >= saved.NChunks {
+		t.Fatalf("transfer completed before it was stopped")
+	}
+
+	// Both sides come back up, the receiver in the same directory
+	alice, bob = h.node("alice"), h.node("bob")
+	opts = newOptions()
+	h.receive(bob, opts)
+	sent := h.send(alice, path)
+
+	first := -1.0
+	untilDone(t, opts.EventCh, func(e peer.Event) bool {
+		if f, ok := fraction(e); ok && first < 0 {
+			first = f
+		}
+		return true
+	})
+	if min := float64(saved.Progress) / float64(saved.NChunks); first < min {
+		t.Errorf("restarted transfer began at %.2f, %.2f was already received", first, min)
+	}
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+	checkReceived(t, bob, "file.bin", data)
+}
+
+func TestHostileManifest(t *testing.T) {
+	var tests = []struct {
+		name     string
+		filename string
+		nChunks  int32
+		inNodes  bool   // Bob downloads into the directory the node directories are in
+		target   string // Where the file mustn't show up, relative to the nodes root
+	}{
+		{"escaping", "../escaped", 1, false, "../escaped"},
+		{"node config", "bob/config.json", 1, true, "bob/config.json"},
+		{"swarm key", "bob/swarm.key", 1, true, "bob/swarm.key"},
+		{"chunk count", "file.bin", 1 << 20, false, "../downloads/file.bin.part"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHarness(t)
+			mallory, bob := h.node("mallory"), h.node("bob")
+			if err := bob.Save(); err != nil {
+				t.Fatal(err)
+			}
+			nodes := filepath.Dir(bob.GetPeerDir())
+			if tt.inNodes {
+				bob.Config.DownloadDir = nodes
+			}
+
+			opts := newOptions()
+			h.receive(bob, opts)
+
+			// Offer a file named to get out of the download directory or
+			// into the node's own files, or with more chunks than it has
+			if err := mallory.Node.Connect(h.ctx, libp2ppeer.AddrInfo{ID: bob.Node.ID(), Addrs: bob.Node.Addrs()}); err != nil {
+				t.Fatal(err)
+			}
+			stream, err := mallory.Node.NewStream(h.ctx, bob.Node.ID(), ProtocolID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer stream.Close()
+			if _, err := stream.Write(pb.Marshal(&pb.Index{Filename: tt.filename, NChunks: tt.nChunks, Size: 5})); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case e := <-opts.EventCh:
+				if e.Type != peer.Error {
+					t.Errorf("got %+v, want an error event", e)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("hostile manifest went unnoticed")
+			}
+			cr := pb.ChunkRequest{}
+			if err := pb.Read(stream, &cr); err != nil || cr.GetRefusal() == "" {
+				t.Errorf("got %v, %v, want a refusal", &cr, err)
+			}
+			if _, err := os.Stat(filepath.Join(nodes, filepath.FromSlash(tt.target))); !os.IsNotExist(err) {
+				t.Errorf("file created at %s", tt.target)
+			}
+		})
+	}
+}
+
+// TestOfferedProgress has a sender claim the receiver already has chunks,
+// with a bitmap too short for them, which the receiver has to ignore.
+func TestOfferedProgress(t *testing.T) {
+	h := newHarness(t)
+	mallory, bob := h.node("mallory"), h.node("bob")
+
+	opts := newOptions()
+	go drain(h.ctx, opts.EventCh)
+	h.receive(bob, opts)
+	if err := mallory.Node.Connect(h.ctx, libp2ppeer.AddrInfo{ID: bob.Node.ID(), Addrs: bob.Node.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := mallory.Node.NewStream(h.ctx, bob.Node.ID(), ProtocolID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	offer := &pb.Index{Filename: "file.bin", NChunks: 100, Size: 100 * 4096, Progress: 8, Received: []byte{0xff}}
+	if _, err := stream.Write(pb.Marshal(offer)); err != nil {
+		t.Fatal(err)
+	}
+	cr := pb.ChunkRequest{}
+	if err := pb.Read(stream, &cr); err != nil {
+		t.Fatal(err)
+	}
+	if cr.GetIndex() != 0 || len(cr.GetSkip()) != 0 {
+		t.Errorf("asked for %+v, want everything", &cr)
+	}
+}
+
+// TestBadChunk has a sender damage a chunk on the wire, which the receiver
+// has to notice with its Merkle proof, or its length without one, and fetch
+// again.
+func TestBadChunk(t *testing.T) {
+	var tests = []struct {
+		name   string
+		noRoot bool // Sent like older senders, without a Merkle root
+		bad    int32
+		damage func(chunk []byte) []byte
+	}{
+		{"damaged", false, 2, func(chunk []byte) []byte { return append([]byte("damaged"), chunk[7:]...) }},
+		{"oversized", true, 5, func(chunk []byte) []byte { return append(chunk, make([]byte, 4096)...) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHarness(t)
+			mallory, bob := h.node("mallory"), h.node("bob")
+			path, data := testFile(t, "file.bin", 5*4096+100)
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			index, err := streamio.NewIndex(f, "file.bin", streamio.Fixed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.noRoot {
+				index.MerkleRoot = nil
+			}
+			var chunks, leaves [][]byte
+			for off := 0; off < len(data); off += 4096 {
+				end := off + 4096
+				if end > len(data) {
+					end = len(data)
+				}
+				sum := sha256.Sum256(data[off:end])
+				chunks, leaves = append(chunks, data[off:end]), append(leaves, sum[:])
+			}
+			tree := merkle.New(leaves)
+
+			opts := newOptions()
+			h.receive(bob, opts)
+			if err := mallory.Node.Connect(h.ctx, libp2ppeer.AddrInfo{ID: bob.Node.ID(), Addrs: bob.Node.Addrs()}); err != nil {
+				t.Fatal(err)
+			}
+			stream, err := mallory.Node.NewStream(h.ctx, bob.Node.ID(), ProtocolID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer stream.Close()
+
+			requests := make(chan *pb.ChunkRequest, 2)
+			go func() {
+				defer close(requests)
+				stream.Write(pb.Marshal(index))
+				for round := 0; round < 2; round++ {
+					cr := &pb.ChunkRequest{}
+					if err := pb.Read(stream, cr); err != nil {
+						return
+					}
+					requests <- cr
+					for i := cr.GetIndex(); i < index.GetNChunks(); i++ {
+						if skip := cr.GetSkip(); int(i/8) < len(skip) && skip[i/8]&(1<<(i%8)) != 0 {
+							continue
+						}
+						chunk := &pb.Chunk{Index: i, Data: chunks[i], Proof: tree.Proof(int(i))}
+						if round == 0 && i == tt.bad {
+							chunk.Data = tt.damage(append([]byte(nil), chunks[i]...))
+						}
+						stream.Write(pb.Marshal(chunk))
+					}
+				}
+			}()
+
+			untilDone(t, opts.EventCh, func(e peer.Event) bool {
+				if e.Type == peer.Error {
+					t.Fatalf("got %+v", e)
+				}
+				return true
+			})
+			checkReceived(t, bob, "file.bin", data)
+			<-requests
+			if cr := <-requests; cr.GetIndex() != tt.bad {
+				t.Errorf("asked again from chunk %d, want only the bad chunk %d", cr.GetIndex(), tt.bad)
+			}
+		})
+	}
+}
+
+func TestRefusedOffer(t *testing.T) {
+	h := newHarness(t)
+	alice, bob := h.node("alice"), h.node("bob")
+	bob.Config.PeerQuota = testSize - 1
+	path, _ := testFile(t, "file.bin", testSize)
+
+	opts := newOptions()
+	h.receive(bob, opts)
+	sent := h.send(alice, path)
+
+	select {
+	case e := <-opts.EventCh:
+		if e.Type != peer.Error {
+			t.Errorf("got %+v, want an error event", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("oversized offer went unnoticed")
+	}
+	err := <-sent
+	if !errors.Is(err, streamio.ErrRefused) {
+		t.Fatalf("got %v, want the refusal", err)
+	}
+	if _, err := os.Stat(filepath.Join(bob.DownloadDir(), "file.bin")); !os.IsNotExist(err) {
+		t.Errorf("refused file was created")
+	}
+	if u, err := bob.Usage(); err != nil || len(u) != 0 {
+		t.Errorf("got usage %v, %v, want nothing counted", u, err)
+	}
+}
+
+func TestStopped(t *testing.T) {
+	h := newHarness(t)
+	alice, bob := h.node("alice"), h.node("bob")
+	path, _ := testFile(t, "file.bin", testSize)
+
+	opts := newOptions()
+	// Slow enough for the stop to arrive long before the last chunk
+	opts.Limit = ratelimit.New(testSize / 2)
+	h.receive(bob, opts)
+	sendOpts := newOptions()
+	sendOpts.Retry = noRetry
+	stopAt(t, h, opts, h.sendWith(alice, path, sendOpts), 0.1)
+
+	download := filepath.Join(bob.DownloadDir(), "file.bin")
+	if _, err := os.Stat(download); !os.IsNotExist(err) {
+		t.Errorf("stopped download moved into place")
+	}
+	if _, err := os.Stat(download + ".part"); err != nil {
+		t.Errorf("stopped download not kept to be resumed: %v", err)
+	}
+	if u, err := bob.Usage(); err != nil || len(u) != 0 {
+		t.Errorf("got usage %v, %v, want nothing counted", u, err)
+	}
+}
+
+func TestDirectory(t *testing.T) {
+	h := newHarness(t)
+	alice, bob := h.node("alice"), h.node("bob")
+	dir := filepath.Join(t.TempDir(), "dir")
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	_, data := testFile(t, "file.bin", testSize)
+	if err := os.WriteFile(filepath.Join(dir, "sub", "file.bin"), data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(dir, "sub", "file.bin"), filepath.Join(dir, "hard.bin")); err != nil {
+		t.Skip("hard links not supported:", err)
+	}
+	for link, target := range map[string]string{"inside": "sub/file.bin", "outside": "../../secret"} {
+		if err := os.Symlink(filepath.FromSlash(target), filepath.Join(dir, link)); err != nil {
+			t.Skip("symlinks not supported:", err)
+		}
+	}
+
+	opts := newOptions()
+	go drain(h.ctx, opts.EventCh)
+	h.receive(bob, opts)
+	err := <-h.send(alice, dir)
+	if !errors.Is(err, streamio.ErrRefused) {
+		t.Fatalf("got %v, want the link leading outside refused", err)
+	}
+
+	checkReceived(t, bob, "dir/sub/file.bin", data)
+	received := filepath.Join(bob.DownloadDir(), "dir")
+	if target, err := os.Readlink(filepath.Join(received, "inside")); err != nil || target != filepath.FromSlash("sub/file.bin") {
+		t.Errorf("got link to %q, %v, want one to sub/file.bin", target, err)
+	}
+	if _, err := os.Lstat(filepath.Join(received, "outside")); !os.IsNotExist(err) {
+		t.Errorf("link leading outside was created")
+	}
+	a, errA := os.Stat(filepath.Join(received, "hard.bin"))
+	b, errB := os.Stat(filepath.Join(received, "sub", "file.bin"))
+	if errA != nil || errB != nil || !os.SameFile(a, b) {
+		t.Errorf("hard link not kept: %v, %v", errA, errB)
+	}
+}
+
+func TestSendTo(t *testing.T) {
+	h := newHarness(t)
+	alice, bob, carol := h.node("alice"), h.node("bob"), h.node("carol")
+	path, data := testFile(t, "file.bin", testSize)
+
+	opts := newOptions()
+	go drain(h.ctx, opts.EventCh)
+	h.receive(bob, opts)
+
+	sendOpts := newOptions()
+	go drain(h.ctx, sendOpts.EventCh)
+	sendOpts.To = []libp2ppeer.ID{carol.Node.ID()}
+	if err := Send(h.ctx, alice, path, sendOpts); !errors.Is(err, ErrNoReceiver) {
+		t.Fatalf("got %v, want carol missing", err)
+	}
+	if _, err := os.Stat(filepath.Join(bob.DownloadDir(), "file.bin")); !os.IsNotExist(err) {
+		t.Errorf("file sent to a peer left out")
+	}
+
+	sendOpts.To = []libp2ppeer.ID{bob.Node.ID()}
+	if err := Send(h.ctx, alice, path, sendOpts); err != nil {
+		t.Fatal(err)
+	}
+	checkReceived(t, bob, "file.bin", data)
+}
+
+func TestDelta(t *testing.T) {
+	var tests = []struct {
+		name   string
+		policy dest.Policy
+		want   string
+	}{
+		{"Overwrite", dest.Overwrite, "file.bin"},
+		{"Rename", dest.Rename, "file (1).bin"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHarness(t)
+			alice, bob := h.node("alice"), h.node("bob")
+			bob.Config.OnCollision = tt.policy
+			path, data := testFile(t, "file.bin", testSize)
+			old := append(append([]byte{}, data[:testSize/2]...), data[testSize/2+100:]...)
+			if err := os.MkdirAll(bob.DownloadDir(), os.ModePerm); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(bob.DownloadDir(), "file.bin"), old, 0666); err != nil {
+				t.Fatal(err)
+			}
+
+			opts := newOptions()
+			go drain(h.ctx, opts.EventCh)
+			h.receive(bob, opts)
+			if err := <-h.send(alice, path); err != nil {
+				t.Fatal(err)
+			}
+			checkReceived(t, bob, tt.want, data)
+		})
+	}
+}
+
+func TestChunkStore(t *testing.T) {
+	h := newHarness(t)
+	alice, bob := h.node("alice"), h.node("bob")
+	first, data := testFile(t, "first.bin", 4<<20)
+	second := filepath.Join(filepath.Dir(first), "second.bin")
+	edited := append(append(append([]byte{}, data[:1<<20]...), "inserted"...), data[1<<20:]...)
+	if err := os.WriteFile(second, edited, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := newOptions()
+	h.receive(bob, opts)
+	var fetched []int
+	for _, path := range []string{first, second} {
+		sendOpts := newOptions()
+		sendOpts.Chunking = streamio.ContentDefined
+		go drain(h.ctx, sendOpts.EventCh)
+		sent := make(chan error, 1)
+		go func(path string) {
+			sent <- Send(h.ctx, alice, path, sendOpts)
+		}(path)
+
+		chunks := 0
+		untilDone(t, opts.EventCh, func(e peer.Event) bool {
+			if _, ok := fraction(e); ok {
+				chunks++
+			}
+			return true
+		})
+		if err := <-sent; err != nil {
+			t.Fatal(err)
+		}
+		fetched = append(fetched, chunks)
+	}
+
+	checkReceived(t, bob, "first.bin", data)
+	checkReceived(t, bob, "second.bin", edited)
+	if fetched[1] == 0 || fetched[1] > 3 {
+		t.Errorf("fetched %d chunks of the edited file after %d of the first, want only those around the edit", fetched[1], fetched[0])
+	}
+}
+
+func TestSealed(t *testing.T) {
+	var tests = []struct {
+		name      string
+		interrupt bool // Drop the connection at a third, resuming under a new key
+	}{
+		{"whole", false},
+		{"interrupted", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHarness(t)
+			alice, bob := h.node("alice"), h.node("bob")
+			path, data := testFile(t, "file.bin", testSize)
+
+			opts := newOptions()
+			h.receive(bob, opts)
+			sendOpts := newOptions()
+			sendOpts.Seal = true
+			go drain(h.ctx, sendOpts.EventCh)
+			sent := make(chan error, 1)
+			go func() {
+				sent <- Send(h.ctx, alice, path, sendOpts)
+			}()
+
+			droppedAt, resumedAt := -1.0, -1.0
+			untilDone(t, opts.EventCh, func(e peer.Event) bool {
+				if msg, ok := e.Data.(string); ok && !tt.interrupt {
+					t.Errorf("receiver error: %s", msg)
+				}
+				f, ok := fraction(e)
+				switch {
+				case ok && tt.interrupt && droppedAt < 0 && f > 0.3:
+					droppedAt = f
+					if err := h.mn.DisconnectPeers(alice.Node.ID(), bob.Node.ID()); err != nil {
+						t.Fatal(err)
+					}
+				case ok && droppedAt >= 0 && resumedAt < 0 && f != droppedAt:
+					resumedAt = f
+				}
+				return true
+			})
+			if err := <-sent; err != nil {
+				t.Fatal(err)
+			}
+			if resumedAt < droppedAt {
+				t.Errorf("transfer restarted at %.2f after dropping at %.2f", resumedAt, droppedAt)
+			}
+			checkReceived(t, bob, "file.bin", data)
+		})
+	}
+}
+
+// TestSealedOnTheWire reads a sealed transfer off the stream, where only the
+// receiver's key opens the chunks.
+func TestSealedOnTheWire(t *testing.T) {
+	h := newHarness(t)
+	alice, bob := h.node("alice"), h.node("bob")
+	path, data := testFile(t, "file.bin", 3*4096+100)
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	opts := newOptions()
+	opts.Seal = true
+	go drain(h.ctx, opts.EventCh)
+	const sealedID = "/test/sealed"
+	alice.Node.SetStreamHandler(sealedID, func(stream network.Stream) {
+		defer stream.Close()
+		rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+		fileToStream(alice, stream, rw, f, "file.bin", opts)
+	})
+	if err := bob.Node.Connect(h.ctx, libp2ppeer.AddrInfo{ID: alice.Node.ID(), Addrs: alice.Node.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := bob.Node.NewStream(h.ctx, alice.Node.ID(), sealedID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	index := pb.Index{}
+	if err := pb.Read(stream, &index); err != nil {
+		t.Fatal(err)
+	}
+	if index.GetDelta() {
+		t.Error("delta offered in a sealed transfer")
+	}
+	key, err := bob.UnwrapKey(index.GetSealedKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks, err := seal.NewChunks(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Write(pb.Marshal(&pb.ChunkRequest{})); err != nil {
+		t.Fatal(err)
+	}
+	var got []byte
+	for i := int32(0); i < index.GetNChunks(); i++ {
+		chunk := pb.Chunk{}
+		if err := pb.Read(stream, &chunk); err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(chunk.Data, data[i*4096:i*4096+64]) {
+			t.Errorf("chunk %d readable on the wire", i)
+		}
+		opened, err := chunks.Open(chunk.Index, chunk.Data)
+		if err != nil {
+			t.Fatalf("chunk %d: %v", i, err)
+		}
+		got = append(got, opened...)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("sealed chunks opened to different data")
+	}
+}
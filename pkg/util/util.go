@@ -2,8 +2,10 @@ package util
 
 import (
 	"bufio"
+	"fmt"
 	"math/rand"
 	"os"
+	"sync"
 	"time"
 	"unsafe"
 )
@@ -31,9 +33,14 @@ const (
 	letterIdxMax  = 63 / letterIdxBits   // # of letter indices fitting in 63 bits
 )
 
-var src = rand.NewSource(time.Now().UnixNano())
+var (
+	srcMu sync.Mutex // Sources aren't safe for concurrent use
+	src   = rand.NewSource(time.Now().UnixNano())
+)
 
 func RandString(n uint) string {
+	srcMu.Lock()
+	defer srcMu.Unlock()
 	b := make([]byte, n)
 	// A src.Int63() generates 63 random bits, enough for letterIdxMax characters!
 	for i, cache, remain := int(n)-1, src.Int63(), letterIdxMax; i >= 0; {
@@ -50,3 +57,17 @@ func RandString(n uint) string {
 
 	return *(*string)(unsafe.Pointer(&b))
 }
+
+// HumanBytes formats a byte count with a binary unit, e.g. 1.5 MiB.
+func HumanBytes(n float64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%.0f B", n)
+	}
+	exp := 0
+	for n >= unit*unit && exp < 4 {
+		n /= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", n/unit, "KMGTP"[exp])
+}
@@ -72,6 +72,28 @@ func TestRandString(t *testing.T) {
 	})
 }
 
+func TestHumanBytes(t *testing.T) {
+	var tests = []struct {
+		n    float64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536 * 1024, "1.5 MiB"},
+		{5 * 1024 * 1024 * 1024, "5.0 GiB"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			got := HumanBytes(tt.n)
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
 func isValidCharacter(char rune) bool {
 	for _, validChar := range letterBytes {
 		if rune(validChar) == char {
@@ -0,0 +1,100 @@
+//go:build linux
+
+// Package watch notices changes in directory trees.
+package watch
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"unsafe"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const watchMask = unix.IN_CREATE | unix.IN_DELETE | unix.IN_MODIFY | unix.IN_CLOSE_WRITE |
+	unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_ATTRIB
+
+// Changes reports changes below root as inotify notices them, directories
+// created later are watched as well. Directories skip returns true for are
+// left out. Changes in quick succession may be reported once.
+func Changes(ctx context.Context, root string, skip func(dir string) bool) (<-chan struct{}, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	err = addWatches(fd, root, skip)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	ch := make(chan struct{}, 1)
+	go func() {
+		defer unix.Close(fd)
+		buf := make([]byte, 64<<10)
+		for ctx.Err() == nil {
+			// Poll with a timeout to notice ctx being done
+			fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+			n, err := unix.Poll(fds, 500)
+			if errors.Is(err, unix.EINTR) || n == 0 {
+				continue
+			} else if err != nil {
+				log.Errorf("Watching %s: %v", root, err)
+				return
+			}
+			n, err = unix.Read(fd, buf)
+			if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+				continue
+			} else if err != nil {
+				log.Errorf("Watching %s: %v", root, err)
+				return
+			}
+
+			if newDirs(buf[:n]) {
+				err = addWatches(fd, root, skip)
+				if err != nil {
+					log.Warnf("Watching new directories in %s: %v", root, err)
+				}
+			}
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// newDirs reports whether any of the events in buf is about a directory
+// showing up.
+func newDirs(buf []byte) bool {
+	for off := 0; off+unix.SizeofInotifyEvent <= len(buf); {
+		event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+		if event.Mask&unix.IN_ISDIR != 0 && event.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+			return true
+		}
+		off += unix.SizeofInotifyEvent + int(event.Len)
+	}
+	return false
+}
+
+// addWatches watches every directory below root, watching one twice does no
+// harm.
+func addWatches(fd int, root string, skip func(string) bool) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if skip != nil && skip(path) {
+			return filepath.SkipDir
+		}
+		_, err = unix.InotifyAddWatch(fd, path, watchMask)
+		return err
+	})
+}
@@ -0,0 +1,36 @@
+package watch
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestChanges(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	root := t.TempDir()
+	changes, err := Changes(ctx, root, nil)
+	if err != nil {
+		t.Skip("inotify not available:", err)
+	}
+
+	expect := func(what string) {
+		t.Helper()
+		select {
+		case <-changes:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s went unnoticed", what)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(root, "new"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	expect("new directory")
+	if err := os.WriteFile(filepath.Join(root, "new", "file"), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	expect("file in the new directory")
+}
@@ -0,0 +1,34 @@
+//go:build !linux
+
+package watch
+
+import (
+	"context"
+	"time"
+)
+
+// pollInterval is how often a change is reported where changes can't be
+// watched, for the caller to look for itself.
+const pollInterval = 10 * time.Second
+
+// Changes falls back to polling.
+func Changes(ctx context.Context, root string, skip func(dir string) bool) (<-chan struct{}, error) {
+	ch := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				select {
+				case ch <- struct{}{}:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
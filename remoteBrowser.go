@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Azanul/peer-pressure/pkg/peer"
+	"github.com/Azanul/peer-pressure/pkg/pressure/pb"
+	"github.com/Azanul/peer-pressure/pkg/transfer"
+	"github.com/Azanul/peer-pressure/pkg/util"
+	"github.com/Azanul/peer-pressure/tui/style"
+	"github.com/charmbracelet/bubbles/filepicker"
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+	libp2ppeer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+// browseTimeout bounds asking the remote node for a page of a listing.
+const browseTimeout = 30 * time.Second
+
+// browserHeight is how many entries the remote browser shows at once.
+const browserHeight = 15
+
+// remoteBrowserModel browses the share of another node like the filepicker
+// browses the local disk, fetching the entries of a directory a page at a
+// time as the cursor gets to them. Selecting a file pulls it.
+type remoteBrowserModel struct {
+	input  textinput.Model // Trusted name or peer ID of the sharing node
+	styles filepicker.Styles
+
+	p       *peer.Peer
+	id      libp2ppeer.ID
+	dir     string
+	entries []*pb.SharedFile
+	total   int
+	loading bool
+	cursor  int
+	min     int // First entry shown
+	err     error
+}
+
+// listingMsg carries a page of the listing of dir, offset entries in.
+type listingMsg struct {
+	dir     string
+	offset  int
+	listing *pb.Listing
+	err     error
+}
+
+// fetch asks for the page of the current directory after the entries
+// already listed.
+func (m *remoteBrowserModel) fetch() tea.Cmd {
+	m.loading = true
+	p, id, dir, offset := m.p, m.id, m.dir, len(m.entries)
+	return func() tea.Msg {
+		ctx, cancel := context.WithTimeout(context.Background(), browseTimeout)
+		defer cancel()
+		listing, err := transfer.BrowseDir(ctx, p, id, dir, offset, transfer.DefaultPage)
+		return listingMsg{dir: dir, offset: offset, listing: listing, err: err}
+	}
+}
+
+// open lists dir from its start.
+func (m *remoteBrowserModel) open(dir string) tea.Cmd {
+	m.dir = dir
+	m.entries = nil
+	m.total = 0
+	m.cursor = 0
+	m.min = 0
+	m.err = nil
+	return m.fetch()
+}
+
+// connect loads the node the menu was opened for, if it isn't already, and
+// starts browsing the node entered.
+func (m *remoteBrowserModel) connect() error {
+	if m.p == nil || m.p.Name != crrNode.name {
+		p, err := peer.Load(crrNode.name)
+		if err != nil {
+			return err
+		}
+		m.p = p
+	}
+	remote := strings.TrimSpace(m.input.Value())
+	id, err := m.p.TrustedID(remote)
+	if err != nil {
+		id, err = libp2ppeer.Decode(remote)
+		if err != nil {
+			return fmt.Errorf("%q is neither a trusted node nor a peer ID", remote)
+		}
+	}
+	m.id = id
+	return nil
+}
+
+func (m *remoteBrowserModel) Update(parent *model, msg tea.Msg) (tea.Model, tea.Cmd) {
+	if parent.state == remotePeerForm {
+		return m.updateForm(parent, msg)
+	}
+
+	switch msg := msg.(type) {
+	case listingMsg:
+		if msg.dir != m.dir || msg.offset != len(m.entries) {
+			return parent, nil // Answer to a page no longer wanted
+		}
+		m.loading = false
+		m.err = msg.err
+		if msg.err == nil {
+			m.entries = append(m.entries, msg.listing.GetEntries()...)
+			m.total = int(msg.listing.GetTotal())
+		}
+
+	case tea.KeyMsg:
+		switch msg.String() {
+		case "ctrl+c", "q", "esc":
+			return parent, tea.Quit
+
+		case "up", "k":
+			if m.cursor > 0 {
+				m.cursor--
+			}
+			if m.cursor < m.min {
+				m.min = m.cursor
+			}
+
+		case "down", "j":
+			if m.cursor < len(m.entries)-1 {
+				m.cursor++
+			}
+			if m.cursor >= m.min+browserHeight {
+				m.min = m.cursor - browserHeight + 1
+			}
+
+		case "left", "h", "backspace":
+			if m.dir == "" {
+				parent.state = oldNodeMenu
+				parent.Tabs = parent.Tabs[:len(parent.Tabs)-1]
+				return parent, nil
+			}
+			dir := path.Dir(m.dir)
+			if dir == "." {
+				dir = ""
+			}
+			return parent, m.open(dir)
+
+		case "right", "l", "enter":
+			if len(m.entries) == 0 {
+				break
+			}
+			entry := m.entries[m.cursor]
+			if entry.GetDir() {
+				return parent, m.open(entry.GetName())
+			}
+			m.pull(entry.GetName())
+			parent.state = receiveLoader
+			return parent, nil
+		}
+	}
+
+	// Fetch the next page once the cursor gets near the end of this one
+	var cmd tea.Cmd
+	if !m.loading && m.err == nil && len(m.entries) < m.total && m.cursor >= len(m.entries)-browserHeight {
+		cmd = m.fetch()
+	}
+	return parent, cmd
+}
+
+func (m *remoteBrowserModel) updateForm(parent *model, msg tea.Msg) (tea.Model, tea.Cmd) {
+	if msg, ok := msg.(tea.KeyMsg); ok {
+		switch msg.Type {
+		case tea.KeyEnter:
+			m.err = m.connect()
+			if m.err != nil {
+				return parent, nil
+			}
+			parent.state = remoteExplorer
+			return parent, m.open("")
+
+		case tea.KeyCtrlC, tea.KeyEsc, tea.KeyCtrlQ:
+			return parent, tea.Quit
+
+		case tea.KeyCtrlLeft:
+			parent.state = oldNodeMenu
+			parent.Tabs = parent.Tabs[:len(parent.Tabs)-1]
+			return parent, nil
+		}
+	}
+
+	var cmd tea.Cmd
+	m.input, cmd = m.input.Update(msg)
+	return parent, cmd
+}
+
+// pull starts pulling the file called name, its progress shown like that of
+// a receive.
+func (m *remoteBrowserModel) pull(name string) {
+	go crrNode.transfer.Track()
+	go func() {
+		_, err := transfer.Pull(context.Background(), m.p, m.id, name, transfer.Options{
+			Limit:     crrNode.transfer.Limit,
+			EventCh:   crrNode.transfer.EventCh,
+			CommandCh: crrNode.transfer.CommandCh,
+		})
+		if err != nil {
+			fmt.Println(style.ErrorTextStyle(err.Error()))
+		}
+	}()
+}
+
+func (m remoteBrowserModel) View(state sessionState) string {
+	if state == remotePeerForm {
+		footer := "\nPress Ctrl+◀  to go back"
+		footer += "\nPress esc / Ctrl+q to quit.\n"
+		s := fmt.Sprintf("\n\n %s\n %s\n\n", style.NNInputStyle("Trusted name or peer ID"), m.input.View())
+		if m.err != nil {
+			s += style.ErrorTextStyle(m.err.Error()) + "\n"
+		}
+		return s + style.FooterStyle(footer)
+	}
+
+	s := "\n\n" + style.HeaderStyle(fmt.Sprintf("%s:/%s", m.input.Value(), m.dir)) + "\n\n"
+	switch {
+	case m.err != nil:
+		s += style.ErrorTextStyle(m.err.Error()) + "\n"
+	case len(m.entries) == 0 && m.loading:
+		s += "  Listing...\n"
+	case len(m.entries) == 0:
+		s += m.styles.EmptyDirectory.String() + "\n"
+	}
+
+	for i := m.min; i < len(m.entries) && i < m.min+browserHeight; i++ {
+		e := m.entries[i]
+		name := path.Base(e.GetName())
+		if e.GetDir() {
+			name += "/"
+		}
+		mtime := time.Unix(0, e.GetMtime()).Format("2006-01-02 15:04")
+		size := util.HumanBytes(float64(e.GetSize()))
+
+		if i == m.cursor {
+			row := fmt.Sprintf(" %s %"+fmt.Sprint(m.styles.FileSize.GetWidth())+"s %s", mtime, size, name)
+			s += m.styles.Cursor.Render(">") + m.styles.Selected.Render(row) + "\n"
+			continue
+		}
+		nameStyle := m.styles.File
+		if e.GetDir() {
+			nameStyle = m.styles.Directory
+		}
+		s += fmt.Sprintf("  %s %s %s\n", m.styles.Permission.Render(mtime), m.styles.FileSize.Render(size), nameStyle.Render(name))
+	}
+
+	footer := fmt.Sprintf("\n%d/%d entries", len(m.entries), m.total)
+	if m.cursor < len(m.entries) && !m.entries[m.cursor].GetDir() {
+		footer += fmt.Sprintf(", sha256 %x", m.entries[m.cursor].GetSha256())
+	}
+	footer += "\nPress enter to open a directory or pull a file, ◀ / Backspace to go up"
+	footer += "\nPress q to quit.\n"
+	return s + style.FooterStyle(footer)
+}